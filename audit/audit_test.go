@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf)
+
+	l.Log(&Event{Type: TokenIssue, Result: Success, Username: "alice", Groups: []string{"admins"}})
+	l.Log(&Event{Type: TokenVerify, Result: Failure, Reason: "token has expired"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+
+	e := &Event{}
+	if err := json.Unmarshal([]byte(lines[0]), e); err != nil {
+		t.Fatalf("Error decoding event: %v", err)
+	}
+	if e.Username != "alice" || e.Result != Success || e.Time.IsZero() {
+		t.Errorf("Unexpected event %+v", e)
+	}
+
+	// a nil logger discards events
+	var nilLogger *Logger
+	nilLogger.Log(&Event{})
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.log")
+	rf := &RotatingFile{Filename: filename, MaxSize: 10, MaxBackups: 2}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		filename:        "fourth\n",
+		filename + ".1": "third\n",
+		filename + ".2": "second\n",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only %d backups", rf.MaxBackups)
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// CertAuthPath is the endpoint of ServeCertAuth.
+const CertAuthPath = "/certAuth"
+
+// Names of client certificates which users are looked up by
+const (
+	// CertNameCN is the common name of the subject.
+	CertNameCN = "cn"
+	// CertNameDNS is the first DNS SAN, e.g. the host name of a machine.
+	CertNameDNS = "dns"
+	// CertNameEmail is the first email SAN.
+	CertNameEmail = "email"
+	// CertNameURI is the first URI SAN, e.g. a SPIFFE ID.
+	CertNameURI = "uri"
+)
+
+// CertNames lists the names of client certificates users can be looked
+// up by.
+var CertNames = []string{CertNameCN, CertNameDNS, CertNameEmail, CertNameURI}
+
+var (
+	errNoCertificate = loginError{
+		Error:   "no_certificate",
+		Message: "A client certificate verified by the server is required.",
+		status:  http.StatusUnauthorized,
+	}
+	errUnknownCertificate = loginError{
+		Error:   "unknown_certificate",
+		Message: "Your client certificate matches no account in the directory.",
+		status:  http.StatusForbidden,
+	}
+	errCertMFARequired = loginError{
+		Error:   "mfa_required",
+		Message: "Your account requires a second factor and can't log in with a client certificate.",
+		status:  http.StatusForbidden,
+	}
+)
+
+// certName returns the name of kind of cert, or "" if it has none.
+func certName(cert *x509.Certificate, kind string) string {
+	first := func(names []string) string {
+		if len(names) == 0 {
+			return ""
+		}
+		return names[0]
+	}
+	switch kind {
+	case CertNameCN:
+		return cert.Subject.CommonName
+	case CertNameDNS:
+		return first(cert.DNSNames)
+	case CertNameEmail:
+		return first(cert.EmailAddresses)
+	case CertNameURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// ServeCertAuth issues a token to the client of a verified TLS client
+// certificate, issued by CertRoots if set. The user is looked up via
+// CertLookup by the name CertName of the certificate, e.g. its DNS SAN, and
+// responds like ServeHTTP. Accounts required to use MFA are rejected.
+// Client versions are not enforced, as clients are automation rather
+// than k8sldapctl.
+func (lti *LDAPTokenIssuer) ServeCertAuth(resp http.ResponseWriter, req *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "LDAPTokenIssuer.ServeCertAuth", tracing.KindServer)
+	defer span.Finish()
+
+	start := time.Now()
+	result := resultInternalError
+	defer func() {
+		span.SetAttribute("result", result)
+		tokenRequests.WithLabelValues(result).Inc()
+		tokenRequestDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	event := &audit.Event{
+		Type:      audit.TokenIssue,
+		Result:    audit.Failure,
+		Method:    audit.MethodClientCert,
+		SourceIP:  lti.sourceIP(req),
+		UserAgent: req.UserAgent(),
+	}
+	defer lti.Audit.Log(event)
+	span.SetAttribute("method", audit.MethodClientCert)
+
+	if lti.CertLookup == nil {
+		result = resultInvalidRequest
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	cert := clientCertVerifiedBy(req, lti.CertRoots)
+	if cert == nil {
+		result = resultNoCertificate
+		event.Reason = "no verified client certificate"
+		errNoCertificate.write(resp)
+		return
+	}
+	name := certName(cert, lti.CertName)
+	event.Username = name
+	if name == "" {
+		result = resultLDAPAuthFailed
+		event.Reason = "client certificate has no " + lti.CertName + " name"
+		glog.Warningf("Rejecting client certificate %q without %s name", cert.Subject.CommonName, lti.CertName)
+		errUnknownCertificate.write(resp)
+		return
+	}
+	span.SetAttribute("certificate.name", name)
+
+	id, err := lti.CertLookup.LookupIdentity(ctx, name)
+	if id != nil && id.Source != nil {
+		event.Directory = id.Source.Name
+		span.SetAttribute("directory", id.Source.Name)
+	}
+	if err != nil {
+		span.RecordError(err)
+		unauthTokenRequests.Inc()
+		event.Reason = err.Error()
+		glog.Errorf("Error looking up the user of client certificate %q: %v", name, err)
+
+		switch ldap.ReasonOf(err) {
+		case ldap.ReasonUserNotFound, ldap.ReasonAmbiguousUser:
+			errUnknownCertificate.write(resp)
+			result = resultLDAPAuthFailed
+			return
+		}
+		newLoginError(err).write(resp)
+		result = resultLDAPError
+		return
+	}
+
+	result = lti.issueToken(ctx, resp, req, "", id, event)
+}
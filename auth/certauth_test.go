@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+)
+
+func TestCertName(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/alice")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice-cn"},
+		DNSNames:       []string{"alice.example.com", "other.example.com"},
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	expected := map[string]string{
+		CertNameCN:    "alice-cn",
+		CertNameDNS:   "alice.example.com",
+		CertNameEmail: "alice@example.com",
+		CertNameURI:   "spiffe://example.com/alice",
+		"serial":      "",
+	}
+	for kind, name := range expected {
+		if actual := certName(cert, kind); actual != name {
+			t.Errorf("%s: expected %q, got %q", kind, name, actual)
+		}
+	}
+	if name := certName(&x509.Certificate{}, CertNameDNS); name != "" {
+		t.Errorf("Expected no DNS name, got %q", name)
+	}
+}
+
+func TestServeCertAuth(t *testing.T) {
+	verified := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	cases := []struct {
+		name          string
+		state         *tls.ConnectionState
+		certName      string
+		expectedCode  int
+		expectedError string
+	}{
+		{"no TLS", nil, CertNameCN, http.StatusUnauthorized, "no_certificate"},
+		{"unverified", &tls.ConnectionState{}, CertNameCN, http.StatusUnauthorized, "no_certificate"},
+		{"known CN", verified(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}), CertNameCN, http.StatusOK, ""},
+		{"unknown CN", verified(&x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}), CertNameCN, http.StatusForbidden, "unknown_certificate"},
+		{"known DNS SAN", verified(&x509.Certificate{DNSNames: []string{"alice"}}), CertNameDNS, http.StatusOK, ""},
+		{"no DNS SAN", verified(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}), CertNameDNS, http.StatusForbidden, "unknown_certificate"},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		lti := &LDAPTokenIssuer{
+			TokenSigner: dummySigner{"signedToken", nil},
+			CertLookup:  dummyLookup{},
+			CertName:    c.certName,
+			Audit:       audit.NewLogger(buf),
+			// certificates are not challenged for a second factor
+			MFA:                &mfa.Authenticator{RequiredGroups: []string{"admins"}},
+			MFASecretAttribute: "totpSecret",
+		}
+		req, _ := http.NewRequest(http.MethodGet, CertAuthPath, nil)
+		req.TLS = c.state
+		rec := httptest.NewRecorder()
+		lti.ServeCertAuth(rec, req)
+
+		if rec.Code != c.expectedCode {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.expectedCode, rec.Code, rec.Body.String())
+		}
+		event := &audit.Event{}
+		if err := json.Unmarshal(buf.Bytes(), event); err != nil || event.Method != audit.MethodClientCert {
+			t.Errorf("%s: unexpected audit event %q (%v)", c.name, buf.String(), err)
+		}
+		if c.expectedError == "" {
+			if rec.Body.String() != "signedToken" || event.Result != audit.Success || event.Username != "alice" {
+				t.Errorf("%s: unexpected response %q, event %+v", c.name, rec.Body.String(), event)
+			}
+			continue
+		}
+		var body loginError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != c.expectedError {
+			t.Errorf("%s: unexpected body %q", c.name, rec.Body.String())
+		}
+	}
+
+	lti := &LDAPTokenIssuer{TokenSigner: dummySigner{"signedToken", nil}}
+	req, _ := http.NewRequest(http.MethodGet, CertAuthPath, nil)
+	rec := httptest.NewRecorder()
+	lti.ServeCertAuth(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected %d without lookup, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// accounts required to use MFA can't log in with certificates
+	lti = &LDAPTokenIssuer{
+		TokenSigner: dummySigner{"signedToken", nil},
+		CertLookup:  dummyLookup{},
+		CertName:    CertNameCN,
+		MFA:         &mfa.Authenticator{RequiredGroups: []string{"developers"}},
+	}
+	req, _ = http.NewRequest(http.MethodGet, CertAuthPath, nil)
+	req.TLS = verified(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	rec = httptest.NewRecorder()
+	lti.ServeCertAuth(rec, req)
+	var body loginError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusForbidden || err != nil || body.Error != "mfa_required" {
+		t.Errorf("Expected MFA to be required, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var clientCertRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kubernetes_ldap_client_cert_rejections_total",
+		Help: "Total number of requests rejected for a missing or disallowed client certificate by endpoint.",
+	},
+	[]string{"endpoint"},
+)
+
+// RegisterClientCertMetrics registers the metrics for client certificate checks
+func RegisterClientCertMetrics() {
+	prometheus.MustRegister(clientCertRejections)
+}
+
+// ClientCertPolicy requires requests to present a client certificate which
+// was verified against the server's client CAs during the TLS handshake.
+type ClientCertPolicy struct {
+	// AllowedNames optionally restricts the accepted certificates to those
+	// with one of these names as subject CN or DNS, email or URI SAN.
+	AllowedNames []string
+	// Roots optionally restricts the accepted certificates to those issued
+	// by these CAs, for servers verifying client certificates of several
+	// CAs during the handshake.
+	Roots *x509.CertPool
+}
+
+// Wrap returns a handler enforcing the policy before calling h.
+func (p *ClientCertPolicy) Wrap(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		cert := clientCertVerifiedBy(req, p.Roots)
+		if cert == nil {
+			clientCertRejections.WithLabelValues(endpoint).Inc()
+			glog.Warningf("Rejecting request to %s from %s without verified client certificate", endpoint, req.RemoteAddr)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !p.allowed(cert) {
+			clientCertRejections.WithLabelValues(endpoint).Inc()
+			glog.Warningf("Rejecting request to %s from %s with client certificate %q", endpoint, req.RemoteAddr, cert.Subject.CommonName)
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(resp, req)
+	})
+}
+
+func (p *ClientCertPolicy) allowed(cert *x509.Certificate) bool {
+	if len(p.AllowedNames) == 0 {
+		return true
+	}
+
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, allowed := range p.AllowedNames {
+		for _, name := range names {
+			if name != "" && name == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifiedClientCert returns the client certificate of the request if it
+// was verified during the TLS handshake, and nil otherwise.
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// clientCertVerifiedBy returns the verified client certificate of the
+// request if it chains up to one of roots, or regardless of its CA if roots
+// is nil.
+func clientCertVerifiedBy(req *http.Request, roots *x509.CertPool) *x509.Certificate {
+	cert := verifiedClientCert(req)
+	if cert == nil || roots == nil {
+		return cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range req.TLS.VerifiedChains[0][1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil
+	}
+	return cert
+}
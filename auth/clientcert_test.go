@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClientCertPolicy(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/kube-system/sa/apiserver")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "kube-apiserver"},
+		DNSNames: []string{"apiserver.example.com"},
+		URIs:     []*url.URL{spiffe},
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	cases := []struct {
+		name         string
+		state        *tls.ConnectionState
+		allowedNames []string
+		expectedCode int
+	}{
+		{
+			name:         "no TLS",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "no client certificate",
+			state:        &tls.ConnectionState{},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "any verified certificate",
+			state:        verified,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "allowed CN",
+			state:        verified,
+			allowedNames: []string{"kube-apiserver"},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "allowed DNS SAN",
+			state:        verified,
+			allowedNames: []string{"other", "apiserver.example.com"},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "allowed URI SAN",
+			state:        verified,
+			allowedNames: []string{spiffe.String()},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "name not allowed",
+			state:        verified,
+			allowedNames: []string{"someone-else"},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy := &ClientCertPolicy{AllowedNames: c.allowedNames}
+			h := policy.Wrap("/authenticate", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req, _ := http.NewRequest("POST", "/authenticate", nil)
+			req.TLS = c.state
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != c.expectedCode {
+				t.Errorf("Expected %d, got %d", c.expectedCode, rec.Code)
+			}
+		})
+	}
+}
+
+// newTestCA returns a self-signed CA and a client certificate it issued.
+func newTestCA(t *testing.T, cn string) (ca, client *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(template, parent *x509.Certificate) *x509.Certificate {
+		if parent == nil {
+			parent = template
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	ca = issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	client = issue(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return ca, client
+}
+
+func TestClientCertPolicyRoots(t *testing.T) {
+	usersCA, user := newTestCA(t, "kube-apiserver")
+	machinesCA, machine := newTestCA(t, "host.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(usersCA)
+
+	policy := &ClientCertPolicy{Roots: roots}
+	h := policy.Wrap("/authenticate", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, chain := range [][]*x509.Certificate{{user, usersCA}, {machine, machinesCA}} {
+		req, _ := http.NewRequest("POST", "/authenticate", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{chain}}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		expectedCode := http.StatusOK
+		if chain[1] != usersCA {
+			expectedCode = http.StatusUnauthorized
+		}
+		if rec.Code != expectedCode {
+			t.Errorf("%s: expected %d, got %d", chain[0].Subject.CommonName, expectedCode, rec.Code)
+		}
+	}
+}
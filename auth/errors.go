@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+)
+
+// loginError is the JSON body of failed logins.
+type loginError struct {
+	// Error is the reason, e.g. "password_expired".
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// ChangePassword is the endpoint for changing expired passwords.
+	ChangePassword string `json:"changePassword,omitempty"`
+
+	status int
+}
+
+// statusClientClosedRequest is the status nginx logs for requests which
+// the client canceled before the response.
+const statusClientClosedRequest = 499
+
+var (
+	errInvalidCredentials = loginError{
+		Error:   string(ldap.ReasonInvalidCredentials),
+		Message: "Invalid username or password.",
+		status:  http.StatusUnauthorized,
+	}
+
+	loginErrors = map[ldap.Reason]loginError{
+		ldap.ReasonAccountDisabled: {
+			Error:   string(ldap.ReasonAccountDisabled),
+			Message: "Your account is disabled, expired or locked out.",
+			status:  http.StatusForbidden,
+		},
+		ldap.ReasonPasswordExpired: {
+			Error:   string(ldap.ReasonPasswordExpired),
+			Message: "Your password has expired and must be changed.",
+			status:  http.StatusForbidden,
+		},
+		ldap.ReasonMustChangePassword: {
+			Error:   string(ldap.ReasonMustChangePassword),
+			Message: "Your password must be changed before logging in.",
+			status:  http.StatusForbidden,
+		},
+		ldap.ReasonPasswordRejected: {
+			Error:   string(ldap.ReasonPasswordRejected),
+			Message: "The new password does not meet the password policy.",
+			status:  http.StatusBadRequest,
+		},
+		ldap.ReasonServerUnavailable: {
+			Error:   string(ldap.ReasonServerUnavailable),
+			Message: "The directory is unavailable, please retry later.",
+			status:  http.StatusServiceUnavailable,
+		},
+		ldap.ReasonTimeout: {
+			Error:   string(ldap.ReasonTimeout),
+			Message: "The directory did not respond in time, please retry later.",
+			status:  http.StatusGatewayTimeout,
+		},
+		ldap.ReasonCanceled: {
+			Error:   string(ldap.ReasonCanceled),
+			Message: "The request was canceled.",
+			status:  statusClientClosedRequest,
+		},
+		ldap.ReasonDirectoryError: {
+			Error:   string(ldap.ReasonDirectoryError),
+			Message: "The directory failed to authenticate you.",
+			status:  http.StatusBadGateway,
+		},
+	}
+)
+
+// newLoginError returns the response to a failed authentication. Unknown
+// and ambiguous users are reported as invalid credentials so that clients
+// can't find out which users exist.
+func newLoginError(err error) loginError {
+	if e, ok := loginErrors[ldap.ReasonOf(err)]; ok {
+		return e
+	}
+	return errInvalidCredentials
+}
+
+// credentialsRejected returns true if the directory rejected the
+// credentials rather than failed, which counts against the rate limits.
+func (e loginError) credentialsRejected() bool {
+	return e.status == http.StatusUnauthorized || e.status == http.StatusForbidden
+}
+
+func (e loginError) write(resp http.ResponseWriter) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Error marshalling json %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Add("Content-Type", "application/json")
+	resp.WriteHeader(e.status)
+	resp.Write(body)
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// negotiateScheme is the authentication scheme of Kerberos tickets
+// (SPNEGO, RFC 4559).
+const negotiateScheme = "Negotiate"
+
+var (
+	errInvalidTicket = loginError{
+		Error:   "invalid_ticket",
+		Message: "Your Kerberos ticket was rejected, please log in with your password.",
+		status:  http.StatusUnauthorized,
+	}
+	errUnknownPrincipal = loginError{
+		Error:   "unknown_principal",
+		Message: "Your Kerberos principal has no account in the directory.",
+		status:  http.StatusForbidden,
+	}
+)
+
+// negotiateToken returns the base64 encoded token of an Authorization:
+// Negotiate header.
+func negotiateToken(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) <= len(negotiateScheme) || !strings.EqualFold(auth[:len(negotiateScheme)], negotiateScheme) || auth[len(negotiateScheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(negotiateScheme):]), true
+}
+
+// serveNegotiate issues a token to the client of a Kerberos ticket. It
+// returns the result for the metrics.
+func (lti *LDAPTokenIssuer) serveNegotiate(ctx context.Context, resp http.ResponseWriter, req *http.Request, encoded string, event *audit.Event) string {
+	span := tracing.SpanFromContext(ctx)
+	event.Method = audit.MethodKerberos
+	span.SetAttribute("method", audit.MethodKerberos)
+
+	if err := lti.checkClientVersions(resp, req); err != nil {
+		event.Reason = err.Error()
+		return resultClientVersion
+	}
+	// the user is only known from a valid ticket, so only the source IP
+	// is throttled before checking it
+	if err := lti.allowLogin(resp, req, ""); err != nil {
+		event.Reason = err.Error()
+		return resultThrottled
+	}
+
+	var id *identity.Identity
+	var response []byte
+	ticket, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", kerberos.ErrInvalidTicket, err)
+	} else {
+		id, response, err = lti.Kerberos.Authenticate(ctx, ticket)
+	}
+	if id != nil && id.Source != nil {
+		event.Directory = id.Source.Name
+		span.SetAttribute("directory", id.Source.Name)
+	}
+	if err != nil {
+		span.RecordError(err)
+		unauthTokenRequests.Inc()
+		event.Reason = err.Error()
+		glog.Errorf("Error authenticating Kerberos ticket: %v", err)
+
+		if errors.Is(err, kerberos.ErrInvalidTicket) {
+			lti.loginFailed(req, "")
+			resp.Header().Add("WWW-Authenticate", negotiateScheme)
+			errInvalidTicket.write(resp)
+			return resultInvalidTicket
+		}
+		// the ticket is valid, so the failures of the lookup don't count
+		// against the source IP
+		switch ldap.ReasonOf(err) {
+		case ldap.ReasonUserNotFound, ldap.ReasonAmbiguousUser:
+			errUnknownPrincipal.write(resp)
+			return resultLDAPAuthFailed
+		}
+		newLoginError(err).write(resp)
+		return resultLDAPError
+	}
+
+	// the account is only known now, and is locked out after too many
+	// wrong second factors
+	if err := lti.checkAccount(id.Account()); err != nil {
+		event.Reason = err.Error()
+		writeThrottled(resp, err)
+		return resultThrottled
+	}
+
+	if response != nil {
+		resp.Header().Set("WWW-Authenticate", negotiateScheme+" "+base64.StdEncoding.EncodeToString(response))
+	}
+	return lti.issueToken(ctx, resp, req, "", id, event)
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+	"github.com/proofpoint/kubernetes-ldap/kerberostest"
+	kldap "github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
+)
+
+const testService = "HTTP/auth.example.com"
+
+type dummyLookup struct{}
+
+func (dummyLookup) LookupIdentity(ctx context.Context, username string) (*identity.Identity, error) {
+	if username != "alice" {
+		return nil, &kldap.Error{Reason: kldap.ReasonUserNotFound}
+	}
+	return &identity.Identity{Username: "alice", Groups: []string{"developers"}, Source: &identity.Source{Name: "corp"}}, nil
+}
+
+func newKerberosIssuer(t *testing.T, kdc *kerberostest.KDC) *LDAPTokenIssuer {
+	keytab, err := kdc.Keytab(testService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{nil, &kldap.Error{Reason: kldap.ReasonInvalidCredentials}},
+		TokenSigner:       dummySigner{"signedToken", nil},
+		Kerberos: &kerberos.Authenticator{
+			Keytab:     func() *kerberos.Keytab { return keytab },
+			Lookup:     dummyLookup{},
+			StripRealm: true,
+		},
+	}
+}
+
+func TestTokenIssuerKerberos(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	other := kerberostest.NewKDC("EXAMPLE.COM")
+
+	cases := []struct {
+		kdc           *kerberostest.KDC
+		client        string
+		expectedCode  int
+		expectedError string
+	}{
+		{kdc, "alice", http.StatusOK, ""},
+		{kdc, "bob", http.StatusForbidden, "unknown_principal"},
+		{other, "alice", http.StatusUnauthorized, "invalid_ticket"},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		lti := newKerberosIssuer(t, kdc)
+		lti.Audit = audit.NewLogger(buf)
+		negotiate, err := c.kdc.Negotiate(c.client, testService)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", "", nil)
+		req.Header.Set("Authorization", negotiate)
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+
+		if rec.Code != c.expectedCode {
+			t.Errorf("%s: expected %d, got %d", c.client, c.expectedCode, rec.Code)
+		}
+		event := &audit.Event{}
+		if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+			t.Fatalf("%s: error decoding audit event %q: %v", c.client, buf.String(), err)
+		}
+		if event.Method != audit.MethodKerberos {
+			t.Errorf("%s: unexpected audit event %+v", c.client, event)
+		}
+		if c.expectedError == "" {
+			if rec.Body.String() != "signedToken" || event.Username != "alice" || event.Directory != "corp" {
+				t.Errorf("%s: unexpected response %q, event %+v", c.client, rec.Body.String(), event)
+			}
+			continue
+		}
+		var body loginError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != c.expectedError {
+			t.Errorf("%s: unexpected body %q", c.client, rec.Body.String())
+		}
+	}
+}
+
+func TestTokenIssuerKerberosMutual(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	lti := newKerberosIssuer(t, kdc)
+	token, sessionKey, err := kdc.Token(kerberostest.Ticket{Client: "alice", Service: testService, MutualRequired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "", nil)
+	req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	rec := httptest.NewRecorder()
+	lti.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	header := rec.Header().Get("WWW-Authenticate")
+	if !strings.HasPrefix(header, "Negotiate ") {
+		t.Fatalf("Expected a Negotiate response, got %q", header)
+	}
+	response, err := base64.StdEncoding.DecodeString(header[len("Negotiate "):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kerberostest.VerifyResponse(response, sessionKey); err != nil {
+		t.Errorf("Expected a valid response, got %v", err)
+	}
+}
+
+func TestTokenIssuerKerberosChallenge(t *testing.T) {
+	lti := newKerberosIssuer(t, kerberostest.NewKDC("EXAMPLE.COM"))
+
+	req, _ := http.NewRequest("GET", "", nil)
+	rec := httptest.NewRecorder()
+	lti.ServeHTTP(rec, req)
+
+	challenges := rec.Header()["Www-Authenticate"]
+	if rec.Code != http.StatusUnauthorized || len(challenges) != 2 || challenges[0] != "Negotiate" || !strings.HasPrefix(challenges[1], "Basic ") {
+		t.Errorf("Expected Negotiate and Basic challenges, got %d %v", rec.Code, challenges)
+	}
+
+	// without Kerberos Negotiate headers are not basic auth credentials
+	lti.Kerberos = nil
+	req.Header.Set("Authorization", "Negotiate YWJj")
+	rec = httptest.NewRecorder()
+	lti.ServeHTTP(rec, req)
+	if challenges := rec.Header()["Www-Authenticate"]; rec.Code != http.StatusUnauthorized || len(challenges) != 1 {
+		t.Errorf("Expected only the Basic challenge, got %d %v", rec.Code, challenges)
+	}
+}
+
+func TestTokenIssuerKerberosThrottling(t *testing.T) {
+	lti := newKerberosIssuer(t, kerberostest.NewKDC("EXAMPLE.COM"))
+	lti.IPLimiter = &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute}
+
+	expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i, code := range expected {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.Header.Set("Authorization", "Negotiate not-base64")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("Attempt %d: expected %d, got %d", i, code, rec.Code)
+		}
+	}
+}
+
+func TestTokenIssuerKerberosSecondFactor(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := "JBSWY3DPEHPK3PXP"
+	validCode, _ := mfa.GenerateCode(secret, now)
+	store := mfa.NewMemoryStore()
+	store.Put("alice", &mfa.Enrollment{Secret: secret, Confirmed: true})
+
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	lti := newKerberosIssuer(t, kdc)
+	lti.MFA = &mfa.Authenticator{Store: store, Now: func() time.Time { return now }}
+	lti.UserLimiter = &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute}
+
+	// wrong codes lock out the account although there are no basic auth
+	// credentials
+	attempts := []struct {
+		code         string
+		expectedCode int
+	}{
+		{"000000", http.StatusUnauthorized},
+		{"111111", http.StatusUnauthorized},
+		{validCode, http.StatusTooManyRequests},
+	}
+	for i, a := range attempts {
+		negotiate, err := kdc.Negotiate("alice", testService)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "", nil)
+		req.Header.Set("Authorization", negotiate)
+		req.Header.Set(OTPHeader, a.code)
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+		if rec.Code != a.expectedCode {
+			t.Errorf("Attempt %d: expected %d, got %d", i, a.expectedCode, rec.Code)
+		}
+	}
+}
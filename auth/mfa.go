@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+const (
+	// OTPHeader carries the TOTP or backup code of the user.
+	OTPHeader = "X-Kubernetes-Ldap-Otp"
+	// MFAChallengeHeader is set on responses asking the client to retry with an OTP.
+	MFAChallengeHeader = "X-Kubernetes-Ldap-Mfa"
+	// EnrollmentCodeHeader carries the one-time code an admin issued to
+	// let the user enroll.
+	EnrollmentCodeHeader = "X-Kubernetes-Ldap-Enrollment-Code"
+)
+
+var errSecondFactorRequired = errors.New("second factor required")
+
+var (
+	mfaEnrollments = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_mfa_enrollments",
+			Help: "Total number of confirmed MFA enrollments.",
+		},
+	)
+)
+
+// RegisterMFAMetrics registers the metrics for the second factor
+func RegisterMFAMetrics() {
+	prometheus.MustRegister(mfaEnrollments)
+}
+
+// verifySecondFactor enforces the MFA policy for an LDAP authenticated user.
+// It writes the response and returns the reason if the token must not be
+// issued.
+func (lti *LDAPTokenIssuer) verifySecondFactor(resp http.ResponseWriter, req *http.Request, id *identity.Identity, tok *token.AuthToken) error {
+	var secret string
+	enrolled := false
+	if lti.MFASecretAttribute != "" {
+		secret = id.Attribute(lti.MFASecretAttribute)
+		enrolled = secret != ""
+	} else {
+		var err error
+		enrolled, err = lti.MFA.Enrolled(tok.Username)
+		if err != nil {
+			glog.Errorf("Error reading MFA enrollment of %s: %v", tok.Username, err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+	}
+
+	if !enrolled {
+		if !lti.MFA.Required(tok.Groups) {
+			return nil
+		}
+		resp.WriteHeader(http.StatusForbidden)
+		resp.Write([]byte("\nError: MFA is required for your account. Please ask an admin for an enrollment code and enroll first."))
+		return mfa.ErrNotEnrolled
+	}
+
+	code := req.Header.Get(OTPHeader)
+	if code == "" {
+		resp.Header().Set(MFAChallengeHeader, "required")
+		resp.WriteHeader(http.StatusUnauthorized)
+		return errSecondFactorRequired
+	}
+
+	var err error
+	if secret != "" {
+		err = lti.MFA.VerifySecret(tok.Username, secret, code)
+	} else {
+		err = lti.MFA.Verify(tok.Username, code)
+	}
+	if err != nil {
+		// wrong codes count against the account whichever way its first
+		// factor was verified, e.g. by a Kerberos ticket
+		lti.loginFailed(req, id.Account())
+		glog.Errorf("Error verifying second factor of %s: %v", tok.Username, err)
+		resp.Header().Set(MFAChallengeHeader, "required")
+		resp.WriteHeader(http.StatusUnauthorized)
+		return err
+	}
+
+	return nil
+}
+
+// secondFactorResult maps an error of verifySecondFactor to a metric label.
+func secondFactorResult(err error) string {
+	switch err {
+	case errSecondFactorRequired:
+		return resultMFARequired
+	case mfa.ErrNotEnrolled:
+		return resultMFANotEnrolled
+	case mfa.ErrInvalidCode:
+		return resultMFAInvalid
+	}
+	return resultInternalError
+}
+
+// ServeMFAEnroll creates a new TOTP secret and backup codes for the LDAP
+// authenticated user, who passes the enrollment code issued by an admin in
+// the enrollment code header. The enrollment must be confirmed via
+// ServeMFAConfirm.
+func (lti *LDAPTokenIssuer) ServeMFAEnroll(resp http.ResponseWriter, req *http.Request) {
+	tok, ok := lti.authenticateForMFA(resp, req)
+	if !ok {
+		return
+	}
+
+	enrollment, err := lti.MFA.Enroll(tok.Username, req.Header.Get(EnrollmentCodeHeader))
+	switch err {
+	case mfa.ErrAlreadyEnrolled, mfa.ErrEnrollmentPending:
+		resp.WriteHeader(http.StatusConflict)
+		resp.Write([]byte("\nError: " + err.Error()))
+		return
+	case mfa.ErrInvalidEnrollmentCode:
+		user, _, _ := req.BasicAuth()
+		lti.loginFailed(req, user)
+		glog.Warningf("Rejecting MFA enrollment of %s: %v", tok.Username, err)
+		resp.WriteHeader(http.StatusForbidden)
+		resp.Write([]byte("\nError: " + err.Error() + ", please ask an admin for an enrollment code"))
+		return
+	}
+	if err != nil {
+		glog.Errorf("Error enrolling %s for MFA: %v", tok.Username, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	jsondata, err := json.Marshal(enrollment)
+	if err != nil {
+		glog.Errorf("Error marshalling json %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Add("Content-Type", "application/json")
+	resp.Write(jsondata)
+}
+
+// ServeMFAConfirm activates a pending enrollment with the code passed in the OTP header.
+func (lti *LDAPTokenIssuer) ServeMFAConfirm(resp http.ResponseWriter, req *http.Request) {
+	tok, ok := lti.authenticateForMFA(resp, req)
+	if !ok {
+		return
+	}
+
+	err := lti.MFA.Confirm(tok.Username, req.Header.Get(OTPHeader))
+	switch err {
+	case nil:
+		mfaEnrollments.Inc()
+		resp.WriteHeader(http.StatusNoContent)
+	case mfa.ErrNotEnrolled:
+		resp.WriteHeader(http.StatusNotFound)
+	case mfa.ErrInvalidCode:
+		user, _, _ := req.BasicAuth()
+		lti.loginFailed(req, user)
+		resp.WriteHeader(http.StatusUnauthorized)
+	default:
+		glog.Errorf("Error confirming MFA enrollment of %s: %v", tok.Username, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// authenticateForMFA authenticates the user of an enrollment request,
+// throttled like logins on ServeHTTP.
+func (lti *LDAPTokenIssuer) authenticateForMFA(resp http.ResponseWriter, req *http.Request) (*token.AuthToken, bool) {
+	if lti.MFA == nil || lti.MFA.Store == nil || lti.MFASecretAttribute != "" {
+		resp.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		resp.Header().Add("WWW-Authenticate", `Basic realm="kubernetes ldap"`)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if err := lti.allowLogin(resp, req, user); err != nil {
+		return nil, false
+	}
+
+	id, err := lti.authenticate(req.Context(), user, password)
+	if err != nil {
+		if writeThrottled(resp, err) {
+			return nil, false
+		}
+		glog.Errorf("Error authenticating user: %v", err)
+		// failures of the directory neither count against the user nor
+		// the source IP
+		if newLoginError(err).credentialsRejected() {
+			lti.loginFailed(req, failedAccount(user, err))
+		}
+		resp.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return lti.createToken(id), true
+}
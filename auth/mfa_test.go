@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
+)
+
+func TestSecondFactor(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := "JBSWY3DPEHPK3PXP"
+	validCode, _ := mfa.GenerateCode(secret, now)
+
+	store := mfa.NewMemoryStore()
+	store.Put("enrolled", &mfa.Enrollment{Secret: secret, Confirmed: true})
+	store.Put("pending", &mfa.Enrollment{Secret: secret})
+
+	newEntry := func(uid string, attributes ...*ldap.EntryAttribute) *ldap.Entry {
+		return &ldap.Entry{
+			DN: "cn=" + uid,
+			Attributes: append(attributes,
+				&ldap.EntryAttribute{Name: "uid", Values: []string{uid}},
+				&ldap.EntryAttribute{Name: "memberOf", Values: []string{"cn=admins,dc=example,dc=com"}},
+			),
+		}
+	}
+
+	cases := []struct {
+		name            string
+		entry           *ldap.Entry
+		requiredGroups  []string
+		secretAttribute string
+		code            string
+		expectedCode    int
+	}{
+		{
+			name:         "not enrolled and not required",
+			entry:        newEntry("pending"),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:           "not enrolled but required",
+			entry:          newEntry("pending"),
+			requiredGroups: []string{"admins"},
+			expectedCode:   http.StatusForbidden,
+		},
+		{
+			name:         "enrolled without code",
+			entry:        newEntry("enrolled"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "enrolled with invalid code",
+			entry:        newEntry("enrolled"),
+			code:         "000000",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "enrolled with valid code",
+			entry:        newEntry("enrolled"),
+			code:         validCode,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "secret from LDAP attribute",
+			entry:           newEntry("other", &ldap.EntryAttribute{Name: "totpSecret", Values: []string{secret}}),
+			secretAttribute: "totpSecret",
+			code:            validCode,
+			expectedCode:    http.StatusOK,
+		},
+		{
+			name:            "required but no secret in LDAP attribute",
+			entry:           newEntry("other"),
+			secretAttribute: "totpSecret",
+			requiredGroups:  []string{"*"},
+			expectedCode:    http.StatusForbidden,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lti := LDAPTokenIssuer{
+				LDAPAuthenticator: dummyLDAP{c.entry, nil},
+				TokenSigner:       dummySigner{"signedToken", nil},
+				UsernameAttribute: "uid",
+				MFA: &mfa.Authenticator{
+					Store:          store,
+					RequiredGroups: c.requiredGroups,
+					Now:            func() time.Time { return now },
+				},
+				MFASecretAttribute: c.secretAttribute,
+			}
+
+			req, _ := http.NewRequest("GET", "", nil)
+			req.SetBasicAuth("user", "password")
+			if c.code != "" {
+				req.Header.Set(OTPHeader, c.code)
+			}
+
+			rec := httptest.NewRecorder()
+			lti.ServeHTTP(rec, req)
+
+			if rec.Code != c.expectedCode {
+				t.Errorf("Expected %d, got %d", c.expectedCode, rec.Code)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get(MFAChallengeHeader) == "" {
+				t.Errorf("Expected MFA challenge header")
+			}
+		})
+	}
+}
+
+func TestMFAEnrollment(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	lti := LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{&ldap.Entry{DN: "cn=alice"}, nil},
+		MFA: &mfa.Authenticator{
+			Store: mfa.NewMemoryStore(),
+			Now:   func() time.Time { return now },
+		},
+	}
+
+	req, _ := http.NewRequest("POST", "", nil)
+	req.SetBasicAuth("alice", "password")
+	rec := httptest.NewRecorder()
+	lti.ServeMFAEnroll(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected %d enrolling without enrollment code, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	enrollmentCode, _ := lti.MFA.IssueEnrollmentCode("cn=alice")
+	req.Header.Set(EnrollmentCodeHeader, enrollmentCode)
+	rec = httptest.NewRecorder()
+	lti.ServeMFAEnroll(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d enrolling, got %d", http.StatusOK, rec.Code)
+	}
+
+	// a leaked password doesn't suffice to replace the pending enrollment
+	rec = httptest.NewRecorder()
+	lti.ServeMFAEnroll(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Expected %d enrolling again, got %d", http.StatusConflict, rec.Code)
+	}
+
+	enrollment, _ := lti.MFA.Store.Get("cn=alice")
+	code, _ := mfa.GenerateCode(enrollment.Secret, now)
+
+	req.Header.Set(OTPHeader, code)
+	rec = httptest.NewRecorder()
+	lti.ServeMFAConfirm(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d confirming, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	lti.ServeMFAEnroll(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected %d enrolling twice, got %d", http.StatusConflict, rec.Code)
+	}
+}
+
+func TestMFAEnrollmentThrottling(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	store := mfa.NewMemoryStore()
+	store.Put("cn=alice", &mfa.Enrollment{Secret: "JBSWY3DPEHPK3PXP"})
+	lti := LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{&ldap.Entry{DN: "cn=alice"}, nil},
+		MFA: &mfa.Authenticator{
+			Store: store,
+			Now:   func() time.Time { return now },
+		},
+		UserLimiter: &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute},
+	}
+
+	// wrong confirmation codes count as failed logins
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "", nil)
+		req.SetBasicAuth("alice", "password")
+		req.Header.Set(OTPHeader, "000000")
+		rec := httptest.NewRecorder()
+		lti.ServeMFAConfirm(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected %d, got %d", i, http.StatusUnauthorized, rec.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "", nil)
+	req.SetBasicAuth("alice", "password")
+	rec := httptest.NewRecorder()
+	lti.ServeMFAEnroll(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d enrolling while locked out, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	// rejected passwords count as well
+	lti.LDAPAuthenticator = dummyLDAP{nil, errors.New("Invalid username/password")}
+	lti.UserLimiter = &ratelimit.Limiter{LockoutThreshold: 1, LockoutDuration: time.Minute}
+	expected := []int{http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i, code := range expected {
+		req, _ := http.NewRequest("POST", "", nil)
+		req.SetBasicAuth("bob", "guess")
+		rec := httptest.NewRecorder()
+		lti.ServeMFAEnroll(rec, req)
+		if rec.Code != code {
+			t.Errorf("Attempt %d: expected %d, got %d", i, code, rec.Code)
+		}
+	}
+}
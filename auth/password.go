@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// ChangePasswordPath is the endpoint of ServeChangePassword, offered to
+// users whose password expired.
+const ChangePasswordPath = "/changePassword"
+
+var (
+	passwordChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_password_changes_total",
+			Help: "Total number of requests to change an LDAP password by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+// RegisterPasswordChangeMetrics registers the metrics for password changes
+func RegisterPasswordChangeMetrics() {
+	prometheus.MustRegister(passwordChanges)
+}
+
+// changePasswordRequest is the body of requests to ServeChangePassword.
+type changePasswordRequest struct {
+	NewPassword string `json:"newPassword"`
+}
+
+// ServeChangePassword changes the password of the user authenticated with
+// its current password via basic auth to the newPassword of the JSON body,
+// and responds with a token like ServeHTTP.
+func (lti *LDAPTokenIssuer) ServeChangePassword(resp http.ResponseWriter, req *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "LDAPTokenIssuer.ServeChangePassword", tracing.KindServer)
+	defer span.Finish()
+
+	result := resultInternalError
+	defer func() {
+		span.SetAttribute("result", result)
+		passwordChanges.WithLabelValues(result).Inc()
+	}()
+
+	event := &audit.Event{
+		Type:           audit.PasswordChange,
+		Result:         audit.Failure,
+		SourceIP:       lti.sourceIP(req),
+		UserAgent:      req.UserAgent(),
+		PluginVersion:  req.Header.Get("x-pfpt-k8sldapctl-version"),
+		KubectlVersion: req.Header.Get("x-pfpt-kubectl-version"),
+	}
+	defer lti.Audit.Log(event)
+
+	if lti.PasswordChanger == nil {
+		result = resultInvalidRequest
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		result = resultInvalidMethod
+		event.Reason = "invalid HTTP method"
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, password, ok := req.BasicAuth()
+	event.Username = user
+	if !ok {
+		result = resultNoAuth
+		event.Reason = "no basic auth credentials"
+		resp.Header().Add("WWW-Authenticate", `Basic realm="kubernetes ldap"`)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body changePasswordRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.NewPassword == "" {
+		result = resultInvalidRequest
+		event.Reason = "invalid password change request"
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte("\nError: expected a JSON body with newPassword"))
+		return
+	}
+
+	if err := lti.allowLogin(resp, req, user); err != nil {
+		result = resultThrottled
+		event.Reason = err.Error()
+		return
+	}
+
+	id, err := lti.PasswordChanger.ChangePassword(identity.WithAccountCheck(ctx, lti.checkAccount), user, password, body.NewPassword)
+	if id != nil && id.Source != nil {
+		event.Directory = id.Source.Name
+		span.SetAttribute("directory", id.Source.Name)
+	}
+	if err != nil {
+		span.RecordError(err)
+		event.Reason = err.Error()
+		if writeThrottled(resp, err) {
+			result = resultThrottled
+			return
+		}
+		glog.Errorf("Error changing password: %v", err)
+
+		loginErr := newLoginError(err)
+		result = resultLDAPError
+		if loginErr.credentialsRejected() {
+			result = resultLDAPAuthFailed
+			lti.loginFailed(req, failedAccount(user, err))
+		}
+		loginErr.write(resp)
+		return
+	}
+	glog.Infof("Changed the password of user %q", user)
+
+	result = lti.issueToken(ctx, resp, req, user, id, event)
+}
+
+// offerPasswordChange points users whose password must be changed to
+// ServeChangePassword.
+func (lti *LDAPTokenIssuer) offerPasswordChange(loginErr *loginError, err error) {
+	if lti.PasswordChanger == nil {
+		return
+	}
+	switch ldap.ReasonOf(err) {
+	case ldap.ReasonPasswordExpired, ldap.ReasonMustChangePassword:
+		loginErr.ChangePassword = ChangePasswordPath
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	kldap "github.com/proofpoint/kubernetes-ldap/ldap"
+)
+
+type dummyPasswordChanger struct {
+	identity *identity.Identity
+	err      error
+}
+
+func (d dummyPasswordChanger) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) (*identity.Identity, error) {
+	return d.identity, d.err
+}
+
+func TestChangePassword(t *testing.T) {
+	cases := []struct {
+		changer       kldap.PasswordChanger
+		method        string
+		basicAuth     bool
+		body          string
+		expectedCode  int
+		expectedError string
+	}{
+		{
+			changer:      dummyPasswordChanger{identity: &identity.Identity{DN: "some-dn", Source: &identity.Source{Name: "example"}}},
+			method:       http.MethodPost,
+			basicAuth:    true,
+			body:         `{"newPassword": "new-secret"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			// password changes are disabled
+			method:       http.MethodPost,
+			basicAuth:    true,
+			body:         `{"newPassword": "new-secret"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			changer:      dummyPasswordChanger{},
+			method:       http.MethodGet,
+			basicAuth:    true,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			changer:      dummyPasswordChanger{},
+			method:       http.MethodPost,
+			body:         `{"newPassword": "new-secret"}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			changer:      dummyPasswordChanger{},
+			method:       http.MethodPost,
+			basicAuth:    true,
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			changer:       dummyPasswordChanger{err: &kldap.Error{Reason: kldap.ReasonInvalidCredentials}},
+			method:        http.MethodPost,
+			basicAuth:     true,
+			body:          `{"newPassword": "new-secret"}`,
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "invalid_credentials",
+		},
+		{
+			changer:       dummyPasswordChanger{err: &kldap.Error{Reason: kldap.ReasonPasswordRejected}},
+			method:        http.MethodPost,
+			basicAuth:     true,
+			body:          `{"newPassword": "short"}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "password_rejected",
+		},
+	}
+
+	for i, c := range cases {
+		lti := LDAPTokenIssuer{
+			TokenSigner:     dummySigner{"signedToken", nil},
+			PasswordChanger: c.changer,
+		}
+		req, _ := http.NewRequest(c.method, ChangePasswordPath, strings.NewReader(c.body))
+		if c.basicAuth {
+			req.SetBasicAuth("user", "password")
+		}
+
+		rec := httptest.NewRecorder()
+		lti.ServeChangePassword(rec, req)
+
+		if rec.Code != c.expectedCode {
+			t.Errorf("Case: %d. Expected %d, got %d", i, c.expectedCode, rec.Code)
+		}
+		if c.expectedCode == http.StatusOK && !strings.Contains(rec.Body.String(), "signedToken") {
+			t.Errorf("Case: %d. body did not contain expected token. body contents: %q", i, rec.Body.String())
+		}
+		if c.expectedError != "" {
+			var body loginError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != c.expectedError {
+				t.Errorf("Case: %d. Expected error %s, got %q", i, c.expectedError, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestLoginOffersPasswordChange(t *testing.T) {
+	for _, changer := range []kldap.PasswordChanger{nil, dummyPasswordChanger{}} {
+		lti := LDAPTokenIssuer{
+			LDAPAuthenticator: dummyLDAP{nil, &kldap.Error{Reason: kldap.ReasonPasswordExpired}},
+			TokenSigner:       dummySigner{"signedToken", nil},
+			PasswordChanger:   changer,
+		}
+		req, _ := http.NewRequest("GET", "", nil)
+		req.SetBasicAuth("user", "password")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+
+		var body loginError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Invalid body %q: %v", rec.Body.String(), err)
+		}
+		expected := ""
+		if changer != nil {
+			expected = ChangePasswordPath
+		}
+		if rec.Code != http.StatusForbidden || body.ChangePassword != expected {
+			t.Errorf("Expected %q to be offered, got %d %q", expected, rec.Code, rec.Body.String())
+		}
+	}
+}
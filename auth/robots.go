@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/robot"
+	"github.com/proofpoint/kubernetes-ldap/token"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// RobotsPath is the endpoint of RobotAdmin.
+const RobotsPath = "/robots"
+
+// Operations of RobotAdmin used as metric labels
+const (
+	robotCreate = "create"
+	robotList   = "list"
+	robotRevoke = "revoke"
+)
+
+var robotRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kubernetes_ldap_robot_requests_total",
+		Help: "Total number of requests to manage robot tokens by operation and result.",
+	},
+	[]string{"operation", "result"},
+)
+
+// RegisterRobotMetrics registers the metrics for managing robot tokens
+func RegisterRobotMetrics() {
+	prometheus.MustRegister(robotRequests)
+}
+
+// RobotRequest is the body of requests creating a robot.
+type RobotRequest struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups"`
+	// TTL is the lifetime of the token as Go duration, e.g. "720h".
+	TTL string `json:"ttl"`
+}
+
+// RobotResponse is the created robot with its token, which is only
+// returned once.
+type RobotResponse struct {
+	robot.Robot
+	Token string `json:"token"`
+}
+
+// RobotAdmin lets admins manage the tokens of robots:
+//
+//	POST /robots with a RobotRequest creates a robot and returns its token,
+//	GET /robots lists the robots without their tokens,
+//	DELETE /robots/<token ID> revokes the token of a robot.
+//
+// Admins are expected to be authenticated by a ClientCertPolicy.
+type RobotAdmin struct {
+	Store       *robot.Store
+	TokenSigner token.Signer
+	// MaxTTL optionally limits the lifetime of robot tokens.
+	MaxTTL time.Duration
+
+	// Audit records the creations and revocations. Optional.
+	Audit *audit.Logger
+}
+
+func (ra *RobotAdmin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "RobotAdmin.ServeHTTP", tracing.KindServer)
+	defer span.Finish()
+
+	operation := ""
+	result := resultInternalError
+	defer func() {
+		span.SetAttribute("result", result)
+		if operation != "" {
+			robotRequests.WithLabelValues(operation, result).Inc()
+		}
+	}()
+
+	tokenID := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, RobotsPath), "/")
+	switch {
+	case req.Method == http.MethodPost && tokenID == "":
+		operation = robotCreate
+	case req.Method == http.MethodGet && tokenID == "":
+		operation = robotList
+	case req.Method == http.MethodDelete && tokenID != "":
+		operation = robotRevoke
+	default:
+		result = resultInvalidMethod
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	span.SetAttribute("operation", operation)
+
+	if operation == robotList {
+		result = ra.writeJSON(resp, http.StatusOK, ra.Store.List())
+		return
+	}
+
+	event := &audit.Event{
+		Result:    audit.Failure,
+		Admin:     adminName(req),
+		SourceIP:  remoteIP(req, false),
+		UserAgent: req.UserAgent(),
+	}
+	defer ra.Audit.Log(event)
+
+	if operation == robotRevoke {
+		event.Type = audit.RobotRevoke
+		event.TokenID = tokenID
+		r, err := ra.Store.Revoke(tokenID, time.Now())
+		if err != nil {
+			span.RecordError(err)
+			event.Reason = err.Error()
+			if errors.Is(err, robot.ErrUnknown) {
+				result = resultInvalidRequest
+				http.Error(resp, err.Error(), http.StatusNotFound)
+				return
+			}
+			glog.Errorf("Error revoking robot token %s: %v", tokenID, err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		glog.Infof("%s revoked the token %s of robot %s", event.Admin, tokenID, r.Name)
+		event.Username = robot.UsernamePrefix + r.Name
+		event.Groups = r.Groups
+		event.Result = audit.Success
+		result = ra.writeJSON(resp, http.StatusOK, r)
+		return
+	}
+
+	event.Type = audit.RobotCreate
+	r, err := ra.newRobot(req, event.Admin)
+	if err != nil {
+		event.Reason = err.Error()
+		result = resultInvalidRequest
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event.Username = robot.UsernamePrefix + r.Name
+	event.Groups = r.Groups
+	event.TokenID = r.TokenID
+	event.Expiration = r.Token().Expiration
+
+	signed, err := token.UpgradeSigner(ra.TokenSigner).SignContext(ctx, r.Token())
+	if err != nil {
+		span.RecordError(err)
+		event.Reason = "signing token failed"
+		glog.Errorf("Error signing robot token: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		result = resultSigningError
+		return
+	}
+	// the token is only handed out once it can be revoked
+	if err := ra.Store.Add(r); err != nil {
+		span.RecordError(err)
+		event.Reason = err.Error()
+		glog.Errorf("Error recording robot %s: %v", r.Name, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	glog.Infof("%s created the token %s of robot %s", event.Admin, r.TokenID, r.Name)
+	event.Result = audit.Success
+	result = ra.writeJSON(resp, http.StatusCreated, &RobotResponse{Robot: *r, Token: signed.Serialized})
+}
+
+// newRobot returns the robot of a RobotRequest.
+func (ra *RobotAdmin) newRobot(req *http.Request, admin string) (*robot.Robot, error) {
+	rr := &RobotRequest{}
+	if err := json.NewDecoder(req.Body).Decode(rr); err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+	defer req.Body.Close()
+
+	ttl, err := time.ParseDuration(rr.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TTL: %v", err)
+	}
+	if ra.MaxTTL > 0 && ttl > ra.MaxTTL {
+		return nil, fmt.Errorf("TTL %s exceeds the maximum of %s", ttl, ra.MaxTTL)
+	}
+	return robot.New(rr.Name, rr.Groups, ttl, admin)
+}
+
+func (ra *RobotAdmin) writeJSON(resp http.ResponseWriter, status int, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("Error marshalling response: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return resultInternalError
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(data)
+	return resultSuccess
+}
+
+// adminName returns the first name of the client certificate of an admin.
+func adminName(req *http.Request) string {
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return ""
+	}
+	for _, kind := range CertNames {
+		if name := certName(cert, kind); name != "" {
+			return name
+		}
+	}
+	return ""
+}
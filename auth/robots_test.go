@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/robot"
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+func newTestRobotStore(t *testing.T) *robot.Store {
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := robot.NewStore(filepath.Join(dir, "robots.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRobotAdmin(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ra := &RobotAdmin{
+		Store:       newTestRobotStore(t),
+		TokenSigner: dummySigner{"signedToken", nil},
+		MaxTTL:      24 * time.Hour,
+		Audit:       audit.NewLogger(buf),
+	}
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		ra.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodPost, RobotsPath, `{"name": "ci-deployer", "groups": ["deployers"], "ttl": "12h"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	created := &RobotResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Token != "signedToken" || created.Name != "ci-deployer" || created.Expiration.Sub(created.Created) != 12*time.Hour {
+		t.Errorf("Unexpected robot %+v", created)
+	}
+	event := &audit.Event{}
+	if err := json.Unmarshal(buf.Bytes(), event); err != nil || event.Type != audit.RobotCreate || event.Result != audit.Success || event.Username != "robot:ci-deployer" {
+		t.Errorf("Unexpected audit event %q (%v)", buf.String(), err)
+	}
+
+	for _, body := range []string{
+		`{"name": "ci-deployer", "ttl": "48h"}`,
+		`{"name": "CI", "ttl": "1h"}`,
+		`{"name": "ci-deployer"}`,
+		`{`,
+	} {
+		if rec := serve(http.MethodPost, RobotsPath, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	rec = serve(http.MethodGet, RobotsPath, "")
+	var robots []robot.Robot
+	if err := json.Unmarshal(rec.Body.Bytes(), &robots); err != nil || len(robots) != 1 || robots[0].TokenID != created.TokenID {
+		t.Errorf("Unexpected list %q (%v)", rec.Body.String(), err)
+	}
+	if strings.Contains(rec.Body.String(), "signedToken") {
+		t.Error("Expected the list to omit tokens")
+	}
+
+	buf.Reset()
+	if rec := serve(http.MethodDelete, RobotsPath+"/"+created.TokenID, ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	if err := ra.Store.Check(created.TokenID); err != robot.ErrRevoked {
+		t.Errorf("Expected the token to be revoked, got %v", err)
+	}
+	event = &audit.Event{}
+	if err := json.Unmarshal(buf.Bytes(), event); err != nil || event.Type != audit.RobotRevoke || event.TokenID != created.TokenID {
+		t.Errorf("Unexpected audit event %q (%v)", buf.String(), err)
+	}
+	if rec := serve(http.MethodDelete, RobotsPath+"/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := serve(http.MethodDelete, RobotsPath, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestWebhookRobots(t *testing.T) {
+	store := newTestRobotStore(t)
+	valid, _ := robot.New("ci-deployer", []string{"deployers"}, time.Hour, "")
+	revoked, _ := robot.New("old-deployer", nil, time.Hour, "")
+	unknown, _ := robot.New("unknown", nil, time.Hour, "")
+	for _, r := range []*robot.Robot{valid, revoked} {
+		if err := store.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Revoke(revoked.TokenID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name             string
+		token            *token.AuthToken
+		store            *robot.Store
+		expectedCode     int
+		expectedUsername string
+	}{
+		{"valid", valid.Token(), store, http.StatusOK, "robot:ci-deployer"},
+		{"revoked", revoked.Token(), store, http.StatusUnauthorized, ""},
+		{"unknown", unknown.Token(), store, http.StatusUnauthorized, ""},
+		{"disabled", valid.Token(), nil, http.StatusUnauthorized, ""},
+		{"user", &token.AuthToken{Username: "alice"}, nil, http.StatusOK, "alice"},
+		{"user posing as robot", &token.AuthToken{Username: "robot:ci-deployer"}, store, http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		tw := NewTokenWebhook(&dummyVerifier{token: c.token})
+		tw.Robots = c.store
+
+		req, _ := http.NewRequest(http.MethodPost, "", strings.NewReader(`{"spec": {"token": "someToken"}}`))
+		rec := httptest.NewRecorder()
+		tw.ServeHTTP(rec, req)
+
+		if rec.Code != c.expectedCode {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.expectedCode, rec.Code, rec.Body.String())
+			continue
+		}
+		if c.expectedUsername == "" {
+			continue
+		}
+		trr := &TokenReviewRequest{}
+		if err := json.Unmarshal(rec.Body.Bytes(), trr); err != nil || trr.Status.User.Username != c.expectedUsername {
+			t.Errorf("%s: unexpected response %q (%v)", c.name, rec.Body.String(), err)
+		}
+	}
+}
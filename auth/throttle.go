@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
+)
+
+var (
+	localLockouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_local_lockouts_total",
+			Help: "Total number of temporary lockouts by key (username or ip).",
+		},
+		[]string{"key"},
+	)
+)
+
+// RegisterThrottleMetrics registers the metrics for login throttling
+func RegisterThrottleMetrics() {
+	prometheus.MustRegister(localLockouts)
+}
+
+// throttledError is a login refused by a limiter.
+type throttledError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+// write writes the 429 response telling the client when to retry.
+func (e *throttledError) write(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(e.retryAfter.Seconds()))))
+	resp.WriteHeader(http.StatusTooManyRequests)
+	resp.Write([]byte(fmt.Sprintf("\nError: %s, retry in %s", e.err, e.retryAfter.Round(time.Second))))
+}
+
+// allowLogin checks the login attempt against the username and source IP
+// limiters. It writes a 429 response and returns the reason if the attempt
+// must not reach LDAP. An empty user only checks the source IP.
+//
+// Directories which resolve the username first are asked to check the
+// account it resolved to as well, see checkAccount.
+func (lti *LDAPTokenIssuer) allowLogin(resp http.ResponseWriter, req *http.Request, user string) error {
+	limits := []struct {
+		limiter *ratelimit.Limiter
+		key     string
+	}{
+		{lti.UserLimiter, strings.ToLower(user)},
+		{lti.IPLimiter, lti.sourceIP(req)},
+	}
+
+	for _, l := range limits {
+		if l.limiter == nil || l.key == "" {
+			continue
+		}
+		retryAfter, err := l.limiter.Allow(l.key)
+		if err == nil {
+			continue
+		}
+
+		glog.Warningf("Throttling token request of user %q from %s: %v", user, lti.sourceIP(req), err)
+		throttled := &throttledError{retryAfter, err}
+		throttled.write(resp)
+		return throttled
+	}
+	return nil
+}
+
+// checkAccount is the identity.AccountCheck of logins, refusing accounts
+// locked out by the user limiter. Usernames like "al*ice" or "ALICE"
+// resolve to the account of alice, so that failures count against the
+// account rather than against each spelling of its username.
+func (lti *LDAPTokenIssuer) checkAccount(account string) error {
+	if lti.UserLimiter == nil {
+		return nil
+	}
+	retryAfter, err := lti.UserLimiter.Allow(strings.ToLower(account))
+	if err != nil {
+		glog.Warningf("Throttling token request of account %q: %v", account, err)
+		return &throttledError{retryAfter, err}
+	}
+	return nil
+}
+
+// writeThrottled writes the 429 response if the authentication err was
+// refused by checkAccount, and returns true if so.
+func writeThrottled(resp http.ResponseWriter, err error) bool {
+	var throttled *throttledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	throttled.write(resp)
+	return true
+}
+
+// failedAccount returns the key of the account whose credentials err
+// rejected: the account the directory resolved user to if known, else
+// user.
+func failedAccount(user string, err error) string {
+	if account := ldap.AccountOf(err); account != "" {
+		return account
+	}
+	return user
+}
+
+// loginFailed records a failed login attempt against both limiters, or
+// only against the source IP if the user is empty. user is the key of
+// the account if it is known, see failedAccount and
+// identity.Identity.Account.
+func (lti *LDAPTokenIssuer) loginFailed(req *http.Request, user string) {
+	if lti.UserLimiter != nil && user != "" && lti.UserLimiter.Failure(strings.ToLower(user)) {
+		localLockouts.WithLabelValues("username").Inc()
+		glog.Warningf("Locking out user %q after too many failed logins", user)
+	}
+	if lti.IPLimiter != nil && lti.IPLimiter.Failure(lti.sourceIP(req)) {
+		localLockouts.WithLabelValues("ip").Inc()
+		glog.Warningf("Locking out source %s after too many failed logins", lti.sourceIP(req))
+	}
+}
+
+// loginSucceeded forgets earlier failures of the users, e.g. of the
+// username and of the account it resolved to. Failures of the source IP
+// are kept so that one valid account can't be used to reset the backoff
+// of a guessing client.
+func (lti *LDAPTokenIssuer) loginSucceeded(users ...string) {
+	if lti.UserLimiter == nil {
+		return
+	}
+	for _, user := range users {
+		if user != "" {
+			lti.UserLimiter.Success(strings.ToLower(user))
+		}
+	}
+}
+
+// sourceIP returns the client address of the request, taken from the
+// last X-Forwarded-For entry when the issuer runs behind a trusted proxy.
+func (lti *LDAPTokenIssuer) sourceIP(req *http.Request) string {
+	return remoteIP(req, lti.TrustForwardedFor)
+}
+
+// remoteIP returns the address of the peer, or the last X-Forwarded-For
+// entry if trustForwardedFor is set. That entry was appended by the
+// trusted proxy, while earlier ones are chosen by the client.
+func remoteIP(req *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwarded := strings.Join(req.Header["X-Forwarded-For"], ","); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
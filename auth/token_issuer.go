@@ -1,30 +1,77 @@
 package auth
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"encoding/json"
-	"strings"
 	"time"
 
-	goldap "github.com/go-ldap/ldap"
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/audit"
 	"github.com/proofpoint/kubernetes-ldap/client"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
 	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
 	"github.com/proofpoint/kubernetes-ldap/token"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
 )
 
 // LDAPTokenIssuer issues cryptographically secure tokens after authenticating the
 // user against a backing LDAP directory.
 type LDAPTokenIssuer struct {
-	LDAPServer            string
+	LDAPServer string
+	// Authenticator authenticates users against any backend. It takes
+	// precedence over LDAPAuthenticator.
+	Authenticator identity.Authenticator
+	// LDAPAuthenticator is adapted if Authenticator is unset, taking the
+	// usernames from UsernameAttribute.
 	LDAPAuthenticator     ldap.Authenticator
 	TokenSigner           token.Signer
 	TTL                   time.Duration
 	UsernameAttribute     string
 	EnforceClientVersions bool
+
+	// MFA enables a TOTP second factor after a successful LDAP bind.
+	// Optional.
+	MFA *mfa.Authenticator
+	// MFASecretAttribute is the LDAP attribute holding the user's base32
+	// TOTP secret. When empty, secrets are read from the MFA store.
+	MFASecretAttribute string
+
+	// UserLimiter and IPLimiter throttle login attempts per username and
+	// per source IP before they reach LDAP. Optional.
+	UserLimiter *ratelimit.Limiter
+	IPLimiter   *ratelimit.Limiter
+	// TrustForwardedFor takes the source IP from the last entry of the
+	// X-Forwarded-For header, which the trusted proxy appended.
+	TrustForwardedFor bool
+
+	// Audit records every token request. Optional.
+	Audit *audit.Logger
+
+	// PasswordChanger enables ServeChangePassword, which users whose
+	// password expired are pointed to. Optional.
+	PasswordChanger ldap.PasswordChanger
+
+	// Kerberos accepts the service tickets of Authorization: Negotiate
+	// headers in addition to passwords. Optional.
+	Kerberos *kerberos.Authenticator
+
+	// CertLookup enables ServeCertAuth, finding the users of client
+	// certificates by their name selected by CertName, one of CertNames.
+	// Optional.
+	CertLookup identity.Lookup
+	CertName   string
+	// CertRoots optionally restricts ServeCertAuth to client certificates
+	// issued by these CAs.
+	CertRoots *x509.CertPool
 }
 
 var (
@@ -60,8 +107,62 @@ var (
 	)
 )
 
-//RegisterIssueTokenMetrics registers the metrics for the token generation
-func RegisterIssueTokenMetrics() {
+var (
+	tokenRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_token_requests_total",
+			Help: "Total number of requests to get new token by result.",
+		},
+		[]string{"result"},
+	)
+	tokenRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kubernetes_ldap_token_request_duration_seconds",
+			Help:    "End-to-end duration of requests to get new token by result.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"result"},
+	)
+	signTokenDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "kubernetes_ldap_sign_token_duration_seconds",
+			Help:    "Duration of signing new tokens.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 12),
+		},
+	)
+)
+
+// Results of token requests used as metric labels
+const (
+	resultSuccess        = "success"
+	resultNoAuth         = "no_auth"
+	resultClientVersion  = "client_version"
+	resultThrottled      = "throttled"
+	resultLDAPAuthFailed = "ldap_auth_failed"
+	resultLDAPError      = "ldap_error"
+	resultMFARequired    = "mfa_required"
+	resultMFANotEnrolled = "mfa_not_enrolled"
+	resultMFAInvalid     = "mfa_invalid"
+	resultSigningError   = "signing_error"
+	resultInternalError  = "internal_error"
+	resultInvalidMethod  = "invalid_method"
+	resultInvalidRequest = "invalid_request"
+	resultInvalidToken   = "invalid_token"
+	resultInvalidTicket  = "invalid_ticket"
+	resultNoCertificate  = "no_certificate"
+	resultRevokedToken   = "revoked_token"
+)
+
+// RegisterIssueTokenMetrics registers the metrics for the token generation.
+// The unlabeled counters of earlier releases are only registered if legacy is set.
+func RegisterIssueTokenMetrics(legacy bool) {
+	prometheus.MustRegister(tokenRequests)
+	prometheus.MustRegister(tokenRequestDuration)
+	prometheus.MustRegister(signTokenDuration)
+	if !legacy {
+		return
+	}
+
 	prometheus.MustRegister(newTokenRequests)
 	prometheus.MustRegister(noauthTokenRequests)
 	prometheus.MustRegister(unauthTokenRequests)
@@ -71,57 +172,162 @@ func RegisterIssueTokenMetrics() {
 
 func (lti *LDAPTokenIssuer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	newTokenRequests.Inc()
+
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "LDAPTokenIssuer.ServeHTTP", tracing.KindServer)
+	defer span.Finish()
+
+	start := time.Now()
+	result := resultInternalError
+	defer func() {
+		span.SetAttribute("result", result)
+		tokenRequests.WithLabelValues(result).Inc()
+		tokenRequestDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	event := &audit.Event{
+		Type:           audit.TokenIssue,
+		Result:         audit.Failure,
+		SourceIP:       lti.sourceIP(req),
+		UserAgent:      req.UserAgent(),
+		PluginVersion:  req.Header.Get("x-pfpt-k8sldapctl-version"),
+		KubectlVersion: req.Header.Get("x-pfpt-kubectl-version"),
+	}
+	defer lti.Audit.Log(event)
+
+	if lti.Kerberos != nil {
+		if ticket, ok := negotiateToken(req); ok {
+			result = lti.serveNegotiate(ctx, resp, req, ticket, event)
+			return
+		}
+	}
+
 	user, password, ok := req.BasicAuth()
+	event.Username = user
 	if !ok {
 		noauthTokenRequests.Inc()
+		result = resultNoAuth
+		event.Reason = "no basic auth credentials"
+		if lti.Kerberos != nil {
+			resp.Header().Add("WWW-Authenticate", negotiateScheme)
+		}
 		resp.Header().Add("WWW-Authenticate", `Basic realm="kubernetes ldap"`)
 		resp.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	if lti.EnforceClientVersions {
-		pluginVersion := req.Header.Get("x-pfpt-k8sldapctl-version")
-		kubectlVersion := req.Header.Get("x-pfpt-kubectl-version")
-
-		if pluginVersion == "" || kubectlVersion == "" {
-			resp.WriteHeader(http.StatusBadRequest)
-			resp.Write([]byte(fmt.Sprintf("\nError: you are using an old version of k8sldapctl plugin. Please upgrade to minimum of %q", client.MinimumPluginVersion)))
-			return
-		}
+	if err := lti.checkClientVersions(resp, req); err != nil {
+		result = resultClientVersion
+		event.Reason = err.Error()
+		return
+	}
 
-		err := client.Validate(pluginVersion, kubectlVersion)
-		if err != nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			resp.Write([]byte(fmt.Sprintf("\nError: %s", err.Error())))
-			return
-		}
+	if err := lti.allowLogin(resp, req, user); err != nil {
+		result = resultThrottled
+		event.Reason = err.Error()
+		return
 	}
 
 	// Authenticate the user via LDAP
-	ldapEntry, err := lti.LDAPAuthenticator.Authenticate(user, password)
+	id, err := lti.authenticate(ctx, user, password)
+	if id != nil && id.Source != nil {
+		event.Directory = id.Source.Name
+		event.BreakGlass = id.Source.BreakGlass
+		span.SetAttribute("directory", id.Source.Name)
+	}
 	if err != nil {
+		span.RecordError(err)
 		unauthTokenRequests.Inc()
+		event.Reason = err.Error()
+		if writeThrottled(resp, err) {
+			result = resultThrottled
+			return
+		}
 		glog.Errorf("Error authenticating user: %v", err)
-		resp.WriteHeader(http.StatusUnauthorized)
+
+		// failures of the directory neither count against the user nor
+		// the source IP
+		loginErr := newLoginError(err)
+		lti.offerPasswordChange(&loginErr, err)
+		result = resultLDAPError
+		if loginErr.credentialsRejected() {
+			result = resultLDAPAuthFailed
+			lti.loginFailed(req, failedAccount(user, err))
+		}
+		loginErr.write(resp)
 		return
 	}
 
+	result = lti.issueToken(ctx, resp, req, user, id, event)
+}
+
+// checkClientVersions writes a 400 response and returns the reason if
+// client versions are enforced and the client's are missing or too old.
+func (lti *LDAPTokenIssuer) checkClientVersions(resp http.ResponseWriter, req *http.Request) error {
+	if !lti.EnforceClientVersions {
+		return nil
+	}
+	pluginVersion := req.Header.Get("x-pfpt-k8sldapctl-version")
+	kubectlVersion := req.Header.Get("x-pfpt-kubectl-version")
+
+	if pluginVersion == "" || kubectlVersion == "" {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("\nError: you are using an old version of k8sldapctl plugin. Please upgrade to minimum of %q", client.MinimumPluginVersion)))
+		return errors.New("client versions missing")
+	}
+
+	err := client.Validate(pluginVersion, kubectlVersion)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("\nError: %s", err.Error())))
+	}
+	return err
+}
+
+// issueToken creates, signs and writes the token of an authenticated
+// user, verifying its second factor if required. It returns the result
+// for the metrics.
+func (lti *LDAPTokenIssuer) issueToken(ctx context.Context, resp http.ResponseWriter, req *http.Request, user string, id *identity.Identity, event *audit.Event) string {
 	// Auth was successful, create token
-	token := lti.createToken(ldapEntry)
+	token := lti.createToken(id)
+	event.Username = token.Username
+	event.Groups = token.Groups
+	event.TokenID = token.ID
+	event.Expiration = token.Expiration
+
+	// client certificates of machines are a factor of possession, and
+	// automation can't answer TOTP challenges. Accounts required to use a
+	// second factor can't log in with certificates instead.
+	if lti.MFA != nil && event.Method == audit.MethodClientCert {
+		if lti.MFA.Required(token.Groups) {
+			event.Reason = "MFA is required for the account of the client certificate"
+			glog.Warningf("Rejecting client certificate of %s, who is required to use MFA", token.Username)
+			errCertMFARequired.write(resp)
+			return resultMFARequired
+		}
+	} else if lti.MFA != nil {
+		if err := lti.verifySecondFactor(resp, req, id, token); err != nil {
+			event.Reason = err.Error()
+			return secondFactorResult(err)
+		}
+	}
+	lti.loginSucceeded(user, id.Account())
 
 	// Sign token and return
-	signedToken, err := lti.TokenSigner.Sign(token)
+	signed, err := lti.sign(ctx, token)
 	if err != nil {
+		tracing.SpanFromContext(ctx).RecordError(err)
 		errorSigningToken.Inc()
+		event.Reason = "signing token failed"
 		glog.Errorf("Error signing token: %v", err)
 		resp.WriteHeader(http.StatusInternalServerError)
-		return
+		return resultSigningError
 	}
 
 	successfulTokens.Inc()
+	event.Result = audit.Success
 	if req.Header.Get("Accept") == "application/json" {
 		data := map[string]interface{}{
-			"token":               signedToken,
+			"token":               signed.Serialized,
 			"expirationTimestamp": token.Expiration,
 		}
 
@@ -129,60 +335,80 @@ func (lti *LDAPTokenIssuer) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 		if err != nil {
 			glog.Errorf("Error marshalling json %s", err.Error())
 			resp.WriteHeader(http.StatusInternalServerError)
-			return
+			return resultInternalError
 		}
 
 		resp.Header().Add("Content-Type", "application/json")
 		resp.Write(jsondata)
-		return
+		return resultSuccess
 	}
 
 	resp.Header().Add("Content-Type", "text/plain")
-	resp.Write([]byte(signedToken))
+	resp.Write([]byte(signed.Serialized))
+	return resultSuccess
 }
 
-func (lti *LDAPTokenIssuer) getGroupsFromMembersOf(membersOf []string) []string {
-	groupsOf := []string{}
-	uniqueGroups := make(map[string]struct{})
-
-	for _, memberOf := range membersOf {
-		splittedStr := strings.Split(memberOf, ",")
-		for _, element := range splittedStr {
-			element = strings.ToLower(element)
-			if !strings.Contains(element, "cn=") {
-				continue
-			}
+// authenticate returns the identity of the user, which also describes the
+// backend if the authenticator knows it. Locked out accounts are refused
+// with a *throttledError.
+func (lti *LDAPTokenIssuer) authenticate(ctx context.Context, user, password string) (*identity.Identity, error) {
+	ctx = identity.WithAccountCheck(ctx, lti.checkAccount)
+	authenticator := lti.Authenticator
+	if authenticator == nil {
+		authenticator = ldap.UpgradeAuthenticator(lti.LDAPAuthenticator, lti.UsernameAttribute)
+	}
+	return authenticator.AuthenticateIdentity(ctx, user, password)
+}
 
-			group := strings.Replace(element, "cn=", "", -1)
+func (lti *LDAPTokenIssuer) sign(ctx context.Context, tok *token.AuthToken) (*token.SignedToken, error) {
+	ctx, span := tracing.Start(ctx, "Signer.Sign", tracing.KindInternal)
+	defer span.Finish()
 
-			if _, ok := uniqueGroups[group]; ok {
-				//this group has been considered and added already
-				continue
-			}
+	start := time.Now()
+	signed, err := token.UpgradeSigner(lti.TokenSigner).SignContext(ctx, tok)
+	signTokenDuration.Observe(time.Since(start).Seconds())
+	span.RecordError(err)
+	return signed, err
+}
 
-			groupsOf = append(groupsOf, group)
-			uniqueGroups[group] = struct{}{}
-		}
+// createToken returns the token of an authenticated user, asserting where
+// it was authenticated. The username gets the prefix of its source.
+func (lti *LDAPTokenIssuer) createToken(id *identity.Identity) *token.AuthToken {
+	tokenID, err := token.NewID()
+	if err != nil {
+		glog.Errorf("Error generating token ID: %v", err)
 	}
 
-	return groupsOf
-}
-
-func (lti *LDAPTokenIssuer) createToken(ldapEntry *goldap.Entry) *token.AuthToken {
-	username := ldapEntry.DN
-	if lti.UsernameAttribute != "" {
-		username = ldapEntry.GetAttributeValue(lti.UsernameAttribute)
+	username := id.Username
+	if id.Source != nil {
+		username = id.Source.UsernamePrefix + username
 	}
 
-	return &token.AuthToken{
-		Username: username,
-		Groups:   lti.getGroupsFromMembersOf(ldapEntry.GetAttributeValues("memberOf")),
-		Assertions: map[string]string{
-			"ldapServer": lti.LDAPServer,
-			"userDN":     ldapEntry.DN,
-		},
+	tok := &token.AuthToken{
+		ID:         tokenID,
+		Username:   username,
+		Groups:     id.Groups,
+		Assertions: map[string]string{},
 		Expiration: lti.getExpirationTime(),
 	}
+	if tok.Groups == nil {
+		tok.Groups = []string{}
+	}
+	if id.DN != "" {
+		tok.Assertions["userDN"] = id.DN
+	}
+	if id.UID != "" {
+		tok.Assertions["uid"] = id.UID
+	}
+	if id.Source == nil {
+		tok.Assertions["ldapServer"] = lti.LDAPServer
+	} else {
+		if id.Source.Server != "" {
+			tok.Assertions["ldapServer"] = id.Source.Server
+		}
+		tok.Assertions["directory"] = id.Source.Name
+	}
+	return tok
 }
 
 func (lti *LDAPTokenIssuer) getExpirationTime() int64 {
@@ -1,13 +1,21 @@
 package auth
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	kldap "github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
 	"github.com/proofpoint/kubernetes-ldap/token"
 	"time"
 )
@@ -139,6 +147,7 @@ func TestCreateToken(t *testing.T) {
 	cases := []struct {
 		name               string
 		tokenIssuer        LDAPTokenIssuer
+		directory          *kldap.Directory
 		expectedAssertions map[string]string
 		expectedUsername   string
 		expectedGroups     []string
@@ -159,6 +168,66 @@ func TestCreateToken(t *testing.T) {
 				"sg-grp2",
 			},
 		},
+		{
+			name: "directory overrides username attribute",
+			tokenIssuer: LDAPTokenIssuer{
+				UsernameAttribute: "uid",
+			},
+			directory: &kldap.Directory{
+				Name:              "acme",
+				Server:            "dc1.acme.com",
+				UsernameAttribute: "mail",
+			},
+			expectedAssertions: map[string]string{
+				"ldapServer": "dc1.acme.com",
+				"directory":  "acme",
+				"userDN":     e.DN,
+			},
+			expectedUsername: "username@example.com",
+			expectedGroups: []string{
+				"sg-grp1",
+				"sg-grp2",
+			},
+		},
+		{
+			name: "directory asserts the UID",
+			directory: &kldap.Directory{
+				Name:              "acme",
+				Server:            "dc1.acme.com",
+				UsernameAttribute: "mail",
+				UIDAttribute:      "uid",
+			},
+			expectedAssertions: map[string]string{
+				"ldapServer": "dc1.acme.com",
+				"directory":  "acme",
+				"userDN":     e.DN,
+				"uid":        "username",
+			},
+			expectedUsername: "username@example.com",
+			expectedGroups: []string{
+				"sg-grp1",
+				"sg-grp2",
+			},
+		},
+		{
+			name: "directory prefixes the username",
+			directory: &kldap.Directory{
+				Name:              "contractors",
+				Server:            "ldap.contractors.com",
+				UsernameAttribute: "uid",
+				UsernamePrefix:    "contractors:",
+			},
+			expectedAssertions: map[string]string{
+				"ldapServer": "ldap.contractors.com",
+				"directory":  "contractors",
+				"userDN":     e.DN,
+			},
+			expectedUsername: "contractors:username",
+			expectedGroups: []string{
+				"sg-grp1",
+				"sg-grp2",
+			},
+		},
 		{
 			name: "verify backward compatibility",
 			tokenIssuer: LDAPTokenIssuer{
@@ -177,10 +246,16 @@ func TestCreateToken(t *testing.T) {
 	}
 
 	for _, testcase := range cases {
-		tok := testcase.tokenIssuer.createToken(e)
+		tok := testcase.tokenIssuer.createToken(kldap.NewIdentity(e, testcase.directory, testcase.tokenIssuer.UsernameAttribute))
 		if tok.Username != testcase.expectedUsername {
 			t.Errorf("Unexpected username in token. Expected: '%s'. Got: '%s'.", testcase.expectedUsername, tok.Username)
 		}
+		if strings.Join(tok.Groups, ",") != strings.Join(testcase.expectedGroups, ",") {
+			t.Errorf("Unexpected groups in token. Expected: %v. Got: %v.", testcase.expectedGroups, tok.Groups)
+		}
+		if len(tok.Assertions) != len(testcase.expectedAssertions) {
+			t.Errorf("Unexpected assertions in token. Expected: %v. Got: %v.", testcase.expectedAssertions, tok.Assertions)
+		}
 
 		for k, v := range testcase.expectedAssertions {
 			if tok.Assertions[k] != v {
@@ -190,9 +265,25 @@ func TestCreateToken(t *testing.T) {
 	}
 }
 
+func TestCreateTokenWithoutDirectory(t *testing.T) {
+	lti := LDAPTokenIssuer{LDAPServer: "some-ldap-server"}
+	tok := lti.createToken(&identity.Identity{
+		Username: "ci",
+		Source:   &identity.Source{Name: "robots"},
+	})
+
+	if tok.Username != "ci" || tok.Groups == nil || len(tok.Groups) != 0 {
+		t.Errorf("Unexpected token %+v", tok)
+	}
+	if len(tok.Assertions) != 1 || tok.Assertions["directory"] != "robots" {
+		t.Errorf("Expected only the source to be asserted, got %v", tok.Assertions)
+	}
+}
+
 func TestTTL(t *testing.T) {
-	e := &ldap.Entry{
-		DN: "some-dn",
+	id := &identity.Identity{
+		Username: "some-dn",
+		DN:       "some-dn",
 	}
 
 	cases := []struct {
@@ -214,7 +305,7 @@ func TestTTL(t *testing.T) {
 			TTL:        c.TTL,
 		}
 
-		tok := lti.createToken(e)
+		tok := lti.createToken(id)
 		now := time.Now().UnixNano() / int64(time.Millisecond)
 		expectedExpiration := now + int64(time.Duration(c.TTL)/time.Millisecond)
 
@@ -225,8 +316,9 @@ func TestTTL(t *testing.T) {
 }
 
 func TestTokenExpired(t *testing.T) {
-	e := &ldap.Entry{
-		DN: "some-dn",
+	id := &identity.Identity{
+		Username: "some-dn",
+		DN:       "some-dn",
 	}
 
 	cases := []struct {
@@ -252,7 +344,7 @@ func TestTokenExpired(t *testing.T) {
 			TTL:        c.TTL,
 		}
 
-		tok := lti.createToken(e)
+		tok := lti.createToken(id)
 
 		time.Sleep(c.sleep)
 		tokenExpired := token.TokenExpired(tok)
@@ -262,3 +354,230 @@ func TestTokenExpired(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenIssuerThrottling(t *testing.T) {
+	lti := LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{nil, errors.New("Invalid username/password")},
+		TokenSigner:       dummySigner{"signedToken", nil},
+		UserLimiter:       &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute},
+		IPLimiter:         &ratelimit.Limiter{PerMinute: 2},
+	}
+
+	expected := []int{
+		http.StatusUnauthorized,
+		http.StatusUnauthorized,
+		// user is locked out locally
+		http.StatusTooManyRequests,
+		// source IP exhausted its rate
+		http.StatusTooManyRequests,
+	}
+
+	for i, code := range expected {
+		user := "user"
+		if i == 3 {
+			user = "other"
+		}
+		req, _ := http.NewRequest("GET", "", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.SetBasicAuth(user, "password")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+
+		if rec.Code != code {
+			t.Errorf("Attempt %d: expected %d, got %d", i, code, rec.Code)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Attempt %d: expected Retry-After header", i)
+		}
+	}
+}
+
+// resolvingAuthenticator resolves usernames like a directory ignoring
+// case and surrounding spaces, and vets the account before the password.
+type resolvingAuthenticator struct {
+	passwords map[string]string
+	binds     int
+}
+
+func (r *resolvingAuthenticator) AuthenticateIdentity(ctx context.Context, username, password string) (*identity.Identity, error) {
+	name := strings.ToLower(strings.TrimSpace(username))
+	expected, ok := r.passwords[name]
+	if !ok {
+		return nil, &kldap.Error{Reason: kldap.ReasonUserNotFound}
+	}
+	id := &identity.Identity{Username: name, DN: "uid=" + name, Source: &identity.Source{Name: "example"}}
+	if err := identity.CheckAccount(ctx, id.Account()); err != nil {
+		return nil, &kldap.Error{Reason: kldap.ReasonThrottled, Err: err, Account: id.Account()}
+	}
+	r.binds++
+	if password != expected {
+		return nil, &kldap.Error{Reason: kldap.ReasonInvalidCredentials, Account: id.Account()}
+	}
+	return id, nil
+}
+
+func TestTokenIssuerThrottlingResolvedAccount(t *testing.T) {
+	authenticator := &resolvingAuthenticator{passwords: map[string]string{"alice": "alice-pw"}}
+	lti := LDAPTokenIssuer{
+		Authenticator: authenticator,
+		TokenSigner:   dummySigner{"signedToken", nil},
+		UserLimiter:   &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute},
+	}
+
+	// each spelling of alice's username would get a bucket of its own
+	attempts := []struct {
+		user, password string
+		code           int
+	}{
+		{"alice", "wrong", http.StatusUnauthorized},
+		{" alice", "wrong", http.StatusUnauthorized},
+		{"alice ", "alice-pw", http.StatusTooManyRequests},
+		{"a*ice", "alice-pw", http.StatusUnauthorized},
+	}
+	for i, a := range attempts {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.SetBasicAuth(a.user, a.password)
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+		if rec.Code != a.code {
+			t.Errorf("Attempt %d of %q: expected %d, got %d", i, a.user, a.code, rec.Code)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Attempt %d: expected Retry-After header", i)
+		}
+	}
+	if authenticator.binds != 2 {
+		t.Errorf("Expected the password of the locked out account not to be tried, got %d binds", authenticator.binds)
+	}
+}
+
+func TestTokenIssuerThrottlingForwardedFor(t *testing.T) {
+	lti := LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{nil, errors.New("Invalid username/password")},
+		TokenSigner:       dummySigner{"signedToken", nil},
+		IPLimiter:         &ratelimit.Limiter{LockoutThreshold: 2, LockoutDuration: time.Minute},
+		TrustForwardedFor: true,
+	}
+
+	expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i, code := range expected {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.RemoteAddr = "10.0.0.254:12345"
+		// the client rotates the entries it sends, the proxy appends
+		// the real address
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d, 10.0.0.1", i))
+		req.SetBasicAuth(fmt.Sprintf("user%d", i), "password")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("Attempt %d: expected %d, got %d", i, code, rec.Code)
+		}
+	}
+}
+
+func TestTokenIssuerLoginErrors(t *testing.T) {
+	cases := []struct {
+		ldapErr       error
+		expectedCode  int
+		expectedError string
+	}{
+		{errors.New("Invalid username/password"), http.StatusUnauthorized, "invalid_credentials"},
+		{&kldap.Error{Reason: kldap.ReasonInvalidCredentials}, http.StatusUnauthorized, "invalid_credentials"},
+		// unknown users look like wrong passwords
+		{&kldap.Error{Reason: kldap.ReasonUserNotFound}, http.StatusUnauthorized, "invalid_credentials"},
+		{&kldap.Error{Reason: kldap.ReasonAmbiguousUser}, http.StatusUnauthorized, "invalid_credentials"},
+		{&kldap.Error{Reason: kldap.ReasonAccountDisabled}, http.StatusForbidden, "account_disabled"},
+		{&kldap.Error{Reason: kldap.ReasonPasswordExpired}, http.StatusForbidden, "password_expired"},
+		{&kldap.Error{Reason: kldap.ReasonMustChangePassword}, http.StatusForbidden, "must_change_password"},
+		{&kldap.Error{Reason: kldap.ReasonServerUnavailable}, http.StatusServiceUnavailable, "server_unavailable"},
+		{&kldap.Error{Reason: kldap.ReasonTimeout}, http.StatusGatewayTimeout, "timeout"},
+		{&kldap.Error{Reason: kldap.ReasonCanceled}, 499, "canceled"},
+		{&kldap.Error{Reason: kldap.ReasonDirectoryError}, http.StatusBadGateway, "directory_error"},
+	}
+
+	for _, c := range cases {
+		lti := LDAPTokenIssuer{
+			LDAPAuthenticator: dummyLDAP{nil, c.ldapErr},
+			TokenSigner:       dummySigner{"signedToken", nil},
+		}
+		req, _ := http.NewRequest("GET", "", nil)
+		req.SetBasicAuth("user", "password")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+
+		if rec.Code != c.expectedCode {
+			t.Errorf("%v: expected %d, got %d", c.ldapErr, c.expectedCode, rec.Code)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%v: expected a JSON body, got %q", c.ldapErr, contentType)
+		}
+		var body loginError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%v: invalid body %q: %v", c.ldapErr, rec.Body.String(), err)
+		}
+		if body.Error != c.expectedError || body.Message == "" {
+			t.Errorf("%v: unexpected body %q", c.ldapErr, rec.Body.String())
+		}
+	}
+}
+
+func TestTokenIssuerThrottlingIgnoresOutages(t *testing.T) {
+	lti := LDAPTokenIssuer{
+		LDAPAuthenticator: dummyLDAP{nil, &kldap.Error{Reason: kldap.ReasonServerUnavailable}},
+		TokenSigner:       dummySigner{"signedToken", nil},
+		UserLimiter:       &ratelimit.Limiter{LockoutThreshold: 1, LockoutDuration: time.Minute},
+	}
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.SetBasicAuth("user", "password")
+
+		rec := httptest.NewRecorder()
+		lti.ServeHTTP(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Attempt %d: expected %d, got %d", i, http.StatusServiceUnavailable, rec.Code)
+		}
+	}
+}
+
+func TestTokenIssuerAudit(t *testing.T) {
+	cases := []struct {
+		ldapErr        error
+		expectedResult string
+	}{
+		{expectedResult: audit.Success},
+		{ldapErr: errors.New("Invalid username/password"), expectedResult: audit.Failure},
+	}
+
+	for i, c := range cases {
+		buf := &bytes.Buffer{}
+		lti := LDAPTokenIssuer{
+			LDAPAuthenticator: dummyLDAP{&ldap.Entry{DN: "some-dn"}, c.ldapErr},
+			TokenSigner:       dummySigner{"signedToken", nil},
+			Audit:             audit.NewLogger(buf),
+		}
+
+		req, _ := http.NewRequest("GET", "", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.SetBasicAuth("user", "secret-password")
+		lti.ServeHTTP(httptest.NewRecorder(), req)
+
+		event := &audit.Event{}
+		if err := json.Unmarshal(buf.Bytes(), event); err != nil {
+			t.Fatalf("Case: %d. Error decoding audit event %q: %v", i, buf.String(), err)
+		}
+		if event.Result != c.expectedResult || event.SourceIP != "10.0.0.1" {
+			t.Errorf("Case: %d. Unexpected audit event %+v", i, event)
+		}
+		if c.expectedResult == audit.Success && event.TokenID == "" {
+			t.Errorf("Case: %d. Expected token ID in audit event", i)
+		}
+		if strings.Contains(buf.String(), "secret-password") || strings.Contains(buf.String(), "signedToken") {
+			t.Errorf("Case: %d. Audit event contains credentials: %s", i, buf.String())
+		}
+	}
+}
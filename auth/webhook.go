@@ -1,12 +1,20 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/audit"
+	"github.com/proofpoint/kubernetes-ldap/robot"
 	"github.com/proofpoint/kubernetes-ldap/token"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
 )
 
 var (
@@ -42,8 +50,33 @@ var (
 	)
 )
 
-//RegisterVerifyTokenMetrics registers the metrics for the token generation
-func RegisterVerifyTokenMetrics() {
+var (
+	verifyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_verify_requests_total",
+			Help: "Total number of requests to verify token by result.",
+		},
+		[]string{"result"},
+	)
+	verifyRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kubernetes_ldap_verify_request_duration_seconds",
+			Help:    "Duration of requests to verify token by result.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+		},
+		[]string{"result"},
+	)
+)
+
+// RegisterVerifyTokenMetrics registers the metrics for the token generation.
+// The unlabeled counters of earlier releases are only registered if legacy is set.
+func RegisterVerifyTokenMetrics(legacy bool) {
+	prometheus.MustRegister(verifyRequests)
+	prometheus.MustRegister(verifyRequestDuration)
+	if !legacy {
+		return
+	}
+
 	prometheus.MustRegister(verifyTokenRequests)
 	prometheus.MustRegister(invalidMethodRequests)
 	prometheus.MustRegister(invalidTokenRequests)
@@ -54,6 +87,13 @@ func RegisterVerifyTokenMetrics() {
 // TokenWebhook responds to requests from the K8s authentication webhook
 type TokenWebhook struct {
 	tokenVerifier token.Verifier
+
+	// Audit records every verification decision. Optional.
+	Audit *audit.Logger
+
+	// Robots holds the robot tokens which weren't revoked. Without it
+	// robot tokens are rejected.
+	Robots *robot.Store
 }
 
 // NewTokenWebhook returns a TokenWebhook with the given verifier
@@ -67,8 +107,30 @@ func NewTokenWebhook(verifier token.Verifier) *TokenWebhook {
 // back if the token is valid.
 func (tw *TokenWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	verifyTokenRequests.Inc()
+
+	ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "TokenWebhook.ServeHTTP", tracing.KindServer)
+	defer span.Finish()
+
+	start := time.Now()
+	result := resultInternalError
+	defer func() {
+		span.SetAttribute("result", result)
+		verifyRequests.WithLabelValues(result).Inc()
+		verifyRequestDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	event := &audit.Event{
+		Type:      audit.TokenVerify,
+		Result:    audit.Failure,
+		SourceIP:  remoteIP(req, false),
+		UserAgent: req.UserAgent(),
+	}
+	defer tw.Audit.Log(event)
+
 	if req.Method != http.MethodPost {
 		invalidMethodRequests.Inc()
+		result = resultInvalidMethod
+		event.Reason = "invalid HTTP method"
 		resp.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -77,6 +139,8 @@ func (tw *TokenWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	err := json.NewDecoder(req.Body).Decode(trr)
 	if err != nil {
 		invalidJSONBody.Inc()
+		result = resultInvalidRequest
+		event.Reason = "invalid TokenReview request"
 		glog.Errorf("Error unmarshalling request: %v", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
@@ -84,9 +148,15 @@ func (tw *TokenWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
 	// Verify token
-	token, err := tw.tokenVerifier.Verify(trr.Spec.Token)
+	token, err := tw.verify(ctx, trr.Spec.Token)
 	if err != nil {
+		span.RecordError(err)
 		invalidTokenRequests.Inc()
+		result = resultInvalidToken
+		if errors.Is(err, robot.ErrRevoked) {
+			result = resultRevokedToken
+		}
+		event.Reason = err.Error()
 		glog.Errorf("Token is invalid: %v", err)
 		resp.WriteHeader(http.StatusUnauthorized)
 		resp.Header().Add("Content-Type", "text/plain")
@@ -95,10 +165,19 @@ func (tw *TokenWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	// Token is valid.
+	username := token.Username
+	if robot.IsRobot(token.AuthToken) {
+		username = robot.UsernamePrefix + token.Username
+	}
+	event.Username = username
+	event.Groups = token.Groups
+	event.TokenID = token.ID
+	event.Expiration = token.Expiration
+
 	trr.Status = TokenReviewStatus{
 		Authenticated: true,
 		User: UserInfo{
-			Username: token.Username,
+			Username: username,
 			Groups:   token.Groups,
 		},
 	}
@@ -111,6 +190,47 @@ func (tw *TokenWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	successfulVerification.Inc()
+	result = resultSuccess
+	event.Result = audit.Success
 	resp.Header().Add("Content-Type", "application/json")
 	resp.Write(respJSON)
 }
+
+func (tw *TokenWebhook) verify(ctx context.Context, s string) (*token.VerifiedToken, error) {
+	ctx, span := tracing.Start(ctx, "Verifier.Verify", tracing.KindInternal)
+	defer span.Finish()
+
+	tok, err := token.UpgradeVerifier(tw.tokenVerifier).VerifyContext(ctx, s)
+	span.RecordError(err)
+	if tok != nil && tok.PreviousKey {
+		span.SetAttribute("token.previous_key", true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.checkRobot(tok.AuthToken); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return tok, nil
+}
+
+// checkRobot rejects robot tokens which were revoked, and tokens of users
+// posing as robots.
+func (tw *TokenWebhook) checkRobot(tok *token.AuthToken) error {
+	if !robot.IsRobot(tok) {
+		if strings.HasPrefix(tok.Username, robot.UsernamePrefix) {
+			return fmt.Errorf("user %q has the username prefix of robots", tok.Username)
+		}
+		return nil
+	}
+
+	if tw.Robots == nil {
+		return errors.New("robot tokens are disabled")
+	}
+	if err := tw.Robots.Check(tok.ID); err != nil {
+		return fmt.Errorf("robot %s: %w", tok.Username, err)
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/proofpoint/kubernetes-ldap/auth"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/local"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/reload"
+	"github.com/proofpoint/kubernetes-ldap/robot"
+	"github.com/proofpoint/kubernetes-ldap/tlsconfig"
+	"github.com/proofpoint/kubernetes-ldap/token"
+	"github.com/spf13/viper"
+)
+
+// Config holds every option of the server. Keys of the config file are
+// the names of the flags, plus "directories". Flags override the file.
+type Config struct {
+	KeypairDir string `mapstructure:"keypair-dir"`
+	GenKeypair bool   `mapstructure:"gen-keypair"`
+
+	LDAPHost                   string `mapstructure:"ldap-host"`
+	LDAPPort                   uint   `mapstructure:"ldap-port"`
+	LDAPBaseDN                 string `mapstructure:"ldap-base-dn"`
+	LDAPUserAttribute          string `mapstructure:"ldap-user-attribute"`
+	LDAPSearchUserDN           string `mapstructure:"ldap-search-user-dn"`
+	LDAPSearchUserPassword     string `mapstructure:"ldap-search-user-password"`
+	LDAPSearchUserPasswordFile string `mapstructure:"ldap-search-user-password-file"`
+	UsernameAttribute          string `mapstructure:"username-attribute"`
+	LDAPUIDAttribute           string `mapstructure:"ldap-uid-attribute"`
+	LDAPGroupBaseDN            string `mapstructure:"ldap-group-base-dn"`
+	LDAPGroupFilter            string `mapstructure:"ldap-group-filter"`
+	LDAPPasswordChange         string `mapstructure:"ldap-password-change"`
+
+	LDAPDialTimeout   time.Duration `mapstructure:"ldap-dial-timeout"`
+	LDAPBindTimeout   time.Duration `mapstructure:"ldap-bind-timeout"`
+	LDAPSearchTimeout time.Duration `mapstructure:"ldap-search-timeout"`
+	LDAPTimeout       time.Duration `mapstructure:"ldap-timeout"`
+
+	LDAPSkipTLSVerification bool     `mapstructure:"ldap-skip-tls-verification"`
+	UseInsecure             bool     `mapstructure:"use-insecure"`
+	LDAPTLSMinVersion       string   `mapstructure:"ldap-tls-min-version"`
+	LDAPTLSMaxVersion       string   `mapstructure:"ldap-tls-max-version"`
+	LDAPTLSCipherSuites     []string `mapstructure:"ldap-tls-cipher-suites"`
+	LDAPTLSCurvePreferences []string `mapstructure:"ldap-tls-curve-preferences"`
+	LDAPCAFile              string   `mapstructure:"ldap-ca-file"`
+	LDAPClientCert          string   `mapstructure:"ldap-client-cert"`
+	LDAPClientKey           string   `mapstructure:"ldap-client-key"`
+	LDAPServerName          string   `mapstructure:"ldap-server-name"`
+	LDAPSASLExternal        bool     `mapstructure:"ldap-sasl-external"`
+
+	// Directories replace the --ldap-* flags, see directoryConfig.
+	Directories           []directoryConfig `mapstructure:"directories"`
+	LDAPTryAllDirectories bool              `mapstructure:"ldap-try-all-directories"`
+
+	LocalUsersFile  string `mapstructure:"local-users-file"`
+	LocalGroupsFile string `mapstructure:"local-groups-file"`
+	LocalUsersMode  string `mapstructure:"local-users-mode"`
+
+	KerberosKeytab           string        `mapstructure:"kerberos-keytab"`
+	KerberosServicePrincipal string        `mapstructure:"kerberos-service-principal"`
+	KerberosRealms           []string      `mapstructure:"kerberos-realms"`
+	KerberosStripRealm       bool          `mapstructure:"kerberos-strip-realm"`
+	KerberosMaxClockSkew     time.Duration `mapstructure:"kerberos-max-clock-skew"`
+
+	Port                  uint          `mapstructure:"port"`
+	TLSCertFile           string        `mapstructure:"tls-cert-file"`
+	TLSPrivateKeyFile     string        `mapstructure:"tls-private-key-file"`
+	TLSMinVersion         string        `mapstructure:"tls-min-version"`
+	TLSMaxVersion         string        `mapstructure:"tls-max-version"`
+	TLSCipherSuites       []string      `mapstructure:"tls-cipher-suites"`
+	TLSCurvePreferences   []string      `mapstructure:"tls-curve-preferences"`
+	HTTP2                 bool          `mapstructure:"http2"`
+	TokenTTL              time.Duration `mapstructure:"token-ttl"`
+	EnforceClientVersions bool          `mapstructure:"enforce-client-versions"`
+
+	MFAStoreFile       string   `mapstructure:"mfa-store-file"`
+	MFAKeyFile         string   `mapstructure:"mfa-key-file"`
+	MFASecretAttribute string   `mapstructure:"mfa-secret-attribute"`
+	MFARequiredGroups  []string `mapstructure:"mfa-required-groups"`
+	MFAIssuer          string   `mapstructure:"mfa-issuer"`
+
+	LoginUserRateLimit      int           `mapstructure:"login-user-rate-limit"`
+	LoginIPRateLimit        int           `mapstructure:"login-ip-rate-limit"`
+	LoginBackoffBase        time.Duration `mapstructure:"login-backoff-base"`
+	LoginBackoffMax         time.Duration `mapstructure:"login-backoff-max"`
+	LoginLockoutThreshold   int           `mapstructure:"login-lockout-threshold"`
+	LoginIPLockoutThreshold int           `mapstructure:"login-ip-lockout-threshold"`
+	LoginLockoutDuration    time.Duration `mapstructure:"login-lockout-duration"`
+	LoginTrustForwardedFor  bool          `mapstructure:"login-trust-forwarded-for"`
+
+	AuditLog           string `mapstructure:"audit-log"`
+	AuditLogMaxSize    int64  `mapstructure:"audit-log-max-size"`
+	AuditLogMaxBackups int    `mapstructure:"audit-log-max-backups"`
+
+	LegacyMetrics bool `mapstructure:"legacy-metrics"`
+
+	OTLPEndpoint       string            `mapstructure:"otlp-endpoint"`
+	OTLPHeaders        map[string]string `mapstructure:"otlp-headers"`
+	TracingSampleRatio float64           `mapstructure:"tracing-sample-ratio"`
+	TracingServiceName string            `mapstructure:"tracing-service-name"`
+
+	ClientCAFile           string   `mapstructure:"client-ca-file"`
+	ClientCertEndpoints    []string `mapstructure:"client-cert-endpoints"`
+	ClientCertAllowedNames []string `mapstructure:"client-cert-allowed-names"`
+	ClientCertLoginName    string   `mapstructure:"client-cert-login-name"`
+	ClientCertLoginFilter  string   `mapstructure:"client-cert-login-filter"`
+	ClientCertLoginCAFile  string   `mapstructure:"client-cert-login-ca-file"`
+
+	RobotStoreFile  string        `mapstructure:"robot-store-file"`
+	RobotAdminNames []string      `mapstructure:"robot-admin-names"`
+	RobotMaxTTL     time.Duration `mapstructure:"robot-max-ttl"`
+
+	WatchFiles bool `mapstructure:"watch-files"`
+
+	AdminAddress    string        `mapstructure:"admin-address"`
+	ShutdownDelay   time.Duration `mapstructure:"shutdown-delay"`
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout"`
+
+	ReadinessLDAPInterval    time.Duration `mapstructure:"readiness-ldap-interval"`
+	ReadinessCertMinValidity time.Duration `mapstructure:"readiness-cert-min-validity"`
+}
+
+// serverTLSOptions returns the --tls-* options of the serving listener.
+func (c *Config) serverTLSOptions() tlsconfig.Options {
+	return tlsconfig.Options{
+		MinVersion:       c.TLSMinVersion,
+		MaxVersion:       c.TLSMaxVersion,
+		CipherSuites:     c.TLSCipherSuites,
+		CurvePreferences: c.TLSCurvePreferences,
+	}
+}
+
+// ldapTLSOptions returns the --ldap-tls-* options of LDAP connections.
+func (c *Config) ldapTLSOptions() tlsconfig.Options {
+	return tlsconfig.Options{
+		MinVersion:       c.LDAPTLSMinVersion,
+		MaxVersion:       c.LDAPTLSMaxVersion,
+		CipherSuites:     c.LDAPTLSCipherSuites,
+		CurvePreferences: c.LDAPTLSCurvePreferences,
+	}
+}
+
+// envPrefix prefixes the environment variables setting options.
+const envPrefix = "KUBERNETES_LDAP"
+
+// bindEnv lets environment variables like
+// KUBERNETES_LDAP_LDAP_SEARCH_USER_PASSWORD_FILE set options. They override
+// the config file but not flags.
+func bindEnv() {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+}
+
+// loadConfig decodes the flags and the config file. Keys of the config
+// file which aren't options are rejected, so that typos don't silently
+// fall back to defaults.
+func loadConfig() (*Config, error) {
+	c := &Config{}
+	err := viper.Unmarshal(c, func(dc *mapstructure.DecoderConfig) {
+		dc.ErrorUnused = true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+// validationError lists all problems found in a configuration.
+type validationError []string
+
+func (e validationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the options for consistency and reads the files they
+// refer to, so that a broken configuration is found before deploying it.
+func (c *Config) Validate() error {
+	var errs validationError
+	check := func(failed bool, format string, args ...interface{}) {
+		if failed {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	checkErr := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf(format, args...)+": "+err.Error())
+		}
+	}
+
+	// the --ldap-* flags are only required without directories
+	if len(c.Directories) == 0 {
+		check(c.LDAPHost == "", "--ldap-host is required")
+		check(c.LDAPBaseDN == "", "--ldap-base-dn is required")
+		check(c.LDAPPort == 0 || c.LDAPPort > 65535, "--ldap-port %d is not a valid port", c.LDAPPort)
+		check(c.LDAPClientCert == "" != (c.LDAPClientKey == ""), "--ldap-client-cert and --ldap-client-key must be set together")
+		check(c.LDAPSASLExternal && c.LDAPClientCert == "", "--ldap-sasl-external requires --ldap-client-cert")
+		check(c.LDAPSASLExternal && c.UseInsecure, "--ldap-sasl-external requires TLS and can't be used with --use-insecure")
+		check(c.LDAPSearchUserPassword != "" && c.LDAPSearchUserPasswordFile != "", "set either --ldap-search-user-password or --ldap-search-user-password-file")
+	}
+	// same-named users of several directories would share their
+	// Kubernetes username, MFA enrollment and lockouts
+	names, usernamePrefixes := map[string]bool{}, map[string]bool{}
+	for i, d := range c.Directories {
+		if d.Name == "" {
+			errs = append(errs, fmt.Sprintf("directory %d has no name", i+1))
+			continue
+		}
+		check(names[d.Name], "directory name %q is used twice", d.Name)
+		names[d.Name] = true
+
+		check(d.Host == "" || d.BaseDN == "", "directory %q needs a host and a baseDN", d.Name)
+		check(d.Port > 65535, "directory %q: port %d is not a valid port", d.Name, d.Port)
+		check(d.ClientCert == "" != (d.ClientKey == ""), "directory %q needs both clientCert and clientKey", d.Name)
+		check(d.SASLExternal && (d.ClientCert == "" || d.Insecure), "directory %q needs TLS and a client certificate for SASL EXTERNAL", d.Name)
+		check(d.SearchUserPassword != "" && d.SearchUserPasswordFile != "", "directory %q: set either searchUserPassword or searchUserPasswordFile", d.Name)
+		check(usernamePrefixes[d.UsernamePrefix], "directory %q: usernamePrefix %q is used by another directory", d.Name, d.UsernamePrefix)
+		check(strings.HasPrefix(d.UsernamePrefix, robot.UsernamePrefix), "directory %q: usernamePrefix %q is reserved for robots", d.Name, d.UsernamePrefix)
+		usernamePrefixes[d.UsernamePrefix] = true
+	}
+	check(c.LDAPTryAllDirectories && len(c.Directories) < 2, "--ldap-try-all-directories requires several directories")
+	for _, d := range c.directories() {
+		if d.CAFile != "" {
+			_, err := loadCertPool(d.CAFile)
+			checkErr(err, "loading LDAP CAs %s", d.CAFile)
+		}
+		if d.SearchUserPasswordFile != "" {
+			_, err := reload.NewSecret(d.SearchUserPasswordFile)
+			checkErr(err, "reading LDAP search user password")
+		}
+		if d.ClientCert != "" && d.ClientKey != "" {
+			_, err := tls.LoadX509KeyPair(d.ClientCert, d.ClientKey)
+			checkErr(err, "loading LDAP client certificate %s", d.ClientCert)
+		}
+
+		passwordChange := "--ldap-password-change"
+		if d.Name != "" {
+			passwordChange = fmt.Sprintf("directory %q: passwordChange", d.Name)
+		}
+		timeouts := "--ldap-*-timeout"
+		if d.Name != "" {
+			timeouts = fmt.Sprintf("directory %q: timeouts", d.Name)
+		}
+		check(d.DialTimeout < 0 || d.BindTimeout < 0 || d.SearchTimeout < 0 || d.Timeout < 0, "%s must not be negative", timeouts)
+
+		_, err := ldap.ParsePasswordChange(d.PasswordChange)
+		checkErr(err, "%s", passwordChange)
+		if d.PasswordChange != "" {
+			check(d.Insecure, "%s %s requires TLS", passwordChange, d.PasswordChange)
+		}
+		if d.PasswordChange == ldap.PasswordChangeAD {
+			check(d.SearchUserDN == "" && !d.SASLExternal, "%s %s requires a search user", passwordChange, d.PasswordChange)
+		}
+	}
+
+	check(c.Port == 0 || c.Port > 65535, "--port %d is not a valid port", c.Port)
+	check(c.TLSCertFile == "", "--tls-cert-file is required")
+	check(c.TLSPrivateKeyFile == "", "--tls-private-key-file is required")
+	if c.TLSCertFile != "" && c.TLSPrivateKeyFile != "" {
+		_, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSPrivateKeyFile)
+		checkErr(err, "loading serving certificate %s", c.TLSCertFile)
+	}
+	checkErr(c.serverTLSOptions().Apply(&tls.Config{}), "invalid --tls-* options")
+	checkErr(c.ldapTLSOptions().Apply(&tls.Config{}), "invalid --ldap-tls-* options")
+
+	if c.ClientCAFile != "" {
+		_, err := loadCertPool(c.ClientCAFile)
+		checkErr(err, "loading client CAs %s", c.ClientCAFile)
+	}
+	for _, endpoint := range c.ClientCertEndpoints {
+		check(!strings.HasPrefix(endpoint, "/"), "--client-cert-endpoints: %q is not a path", endpoint)
+	}
+	if c.ClientCertLoginName != "" {
+		check(!contains(auth.CertNames, c.ClientCertLoginName), "--client-cert-login-name %q is not one of %s", c.ClientCertLoginName, strings.Join(auth.CertNames, ", "))
+		check(c.ClientCAFile == "" && c.ClientCertLoginCAFile == "", "--client-cert-login-name requires --client-ca-file or --client-cert-login-ca-file")
+		// the login attribute of the directory would let certificates log in
+		// as human users
+		check(c.ClientCertLoginFilter == "", "--client-cert-login-name requires --client-cert-login-filter")
+		check(c.ClientCertLoginFilter != "" && !strings.Contains(c.ClientCertLoginFilter, "{name}"), "--client-cert-login-filter must contain {name}")
+		// the users of certificates are looked up without their password
+		for _, d := range c.directories() {
+			check(d.SearchUserDN == "" && !d.SASLExternal, "--client-cert-login-name requires a search user in directory %s", d.Host)
+		}
+	}
+	if c.ClientCertLoginCAFile != "" {
+		check(c.ClientCertLoginName == "", "--client-cert-login-ca-file requires --client-cert-login-name")
+		_, err := loadCertPool(c.ClientCertLoginCAFile)
+		checkErr(err, "loading client certificate login CAs %s", c.ClientCertLoginCAFile)
+	}
+
+	if c.RobotStoreFile != "" {
+		check(c.ClientCAFile == "", "--robot-store-file requires --client-ca-file")
+		check(len(c.RobotAdminNames) == 0, "--robot-store-file requires --robot-admin-names")
+		_, err := robot.NewStore(c.RobotStoreFile)
+		checkErr(err, "opening robot store %s", c.RobotStoreFile)
+	}
+	check(c.RobotMaxTTL < 0, "--robot-max-ttl must not be negative")
+
+	if !c.GenKeypair {
+		if !token.KeypairExists(c.KeypairDir) {
+			errs = append(errs, fmt.Sprintf("keypair not found in dir %q", c.KeypairDir))
+		} else {
+			_, err := token.NewKeyring(c.KeypairDir)
+			checkErr(err, "loading token keypair from %s", c.KeypairDir)
+		}
+	}
+
+	if c.MFAStoreFile != "" && c.MFASecretAttribute == "" {
+		if c.MFAKeyFile == "" {
+			errs = append(errs, "--mfa-key-file is required with --mfa-store-file")
+		} else {
+			_, err := mfa.NewFileStore(c.MFAStoreFile, c.MFAKeyFile)
+			checkErr(err, "opening MFA store %s", c.MFAStoreFile)
+		}
+	}
+
+	_, err := local.ParseMode(c.LocalUsersMode)
+	checkErr(err, "invalid --local-users-mode")
+	if c.LocalUsersFile != "" {
+		_, err := local.NewUsers(c.LocalUsersFile, c.LocalGroupsFile)
+		checkErr(err, "reading local users")
+	}
+	check(c.LocalUsersFile == "" && c.LocalGroupsFile != "", "--local-groups-file requires --local-users-file")
+
+	if c.KerberosKeytab != "" {
+		_, err := kerberos.NewKeytabFile(c.KerberosKeytab)
+		checkErr(err, "reading --kerberos-keytab")
+		if c.KerberosServicePrincipal != "" {
+			_, err := kerberos.ParsePrincipal(c.KerberosServicePrincipal)
+			checkErr(err, "invalid --kerberos-service-principal")
+		}
+		check(c.KerberosMaxClockSkew <= 0, "--kerberos-max-clock-skew must be positive")
+		// the users of tickets are looked up without their password
+		for _, d := range c.directories() {
+			check(d.SearchUserDN == "" && !d.SASLExternal, "--kerberos-keytab requires a search user in directory %s", d.Host)
+		}
+	}
+
+	check(c.TokenTTL <= 0, "--token-ttl must be positive")
+	check(c.ShutdownDelay < 0, "--shutdown-delay must not be negative")
+	check(c.ShutdownTimeout < 0, "--shutdown-timeout must not be negative")
+	check(c.ReadinessLDAPInterval < 0, "--readiness-ldap-interval must not be negative")
+	check(c.ReadinessCertMinValidity < 0, "--readiness-cert-min-validity must not be negative")
+	check(c.LoginUserRateLimit < 0 || c.LoginIPRateLimit < 0, "--login-*-rate-limit must not be negative")
+	check(c.LoginBackoffBase < 0 || c.LoginBackoffMax < 0, "--login-backoff-* must not be negative")
+	check(c.LoginLockoutThreshold < 0 || c.LoginIPLockoutThreshold < 0, "--login-*-lockout-threshold must not be negative")
+	check((c.LoginLockoutThreshold > 0 || c.LoginIPLockoutThreshold > 0) && c.LoginLockoutDuration <= 0,
+		"--login-lockout-duration must be positive when lockouts are enabled")
+
+	check(c.AuditLogMaxSize <= 0, "--audit-log-max-size must be positive")
+	check(c.AuditLogMaxBackups < 0, "--audit-log-max-backups must not be negative")
+
+	if c.OTLPEndpoint != "" {
+		u, err := url.Parse(c.OTLPEndpoint)
+		check(err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "",
+			"--otlp-endpoint %q is not an http(s) URL", c.OTLPEndpoint)
+	}
+	check(c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1, "--tracing-sample-ratio must be between 0 and 1")
+
+	if c.AdminAddress != "" {
+		_, _, err := net.SplitHostPort(c.AdminAddress)
+		checkErr(err, "invalid --admin-address")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// directories returns the configured directories with defaults applied,
+// or a single one from the --ldap-* flags if none are listed.
+func (c *Config) directories() []directoryConfig {
+	if len(c.Directories) == 0 {
+		return []directoryConfig{{
+			Host:                   c.LDAPHost,
+			Port:                   c.LDAPPort,
+			Insecure:               c.UseInsecure,
+			SkipTLSVerification:    c.LDAPSkipTLSVerification,
+			ServerName:             c.LDAPServerName,
+			CAFile:                 c.LDAPCAFile,
+			ClientCert:             c.LDAPClientCert,
+			ClientKey:              c.LDAPClientKey,
+			SASLExternal:           c.LDAPSASLExternal,
+			BaseDN:                 c.LDAPBaseDN,
+			UserAttribute:          c.LDAPUserAttribute,
+			SearchUserDN:           c.LDAPSearchUserDN,
+			SearchUserPassword:     c.LDAPSearchUserPassword,
+			SearchUserPasswordFile: c.LDAPSearchUserPasswordFile,
+			UsernameAttribute:      c.UsernameAttribute,
+			UIDAttribute:           c.LDAPUIDAttribute,
+			GroupBaseDN:            c.LDAPGroupBaseDN,
+			GroupFilter:            c.LDAPGroupFilter,
+			PasswordChange:         c.LDAPPasswordChange,
+			DialTimeout:            c.LDAPDialTimeout,
+			BindTimeout:            c.LDAPBindTimeout,
+			SearchTimeout:          c.LDAPSearchTimeout,
+			Timeout:                c.LDAPTimeout,
+		}}
+	}
+
+	directories := make([]directoryConfig, len(c.Directories))
+	for i, d := range c.Directories {
+		if d.Port == 0 {
+			d.Port = 636
+			if d.Insecure {
+				d.Port = 389
+			}
+		}
+		if d.UserAttribute == "" {
+			d.UserAttribute = "uid"
+		}
+		if d.UsernameAttribute == "" {
+			d.UsernameAttribute = c.UsernameAttribute
+		}
+		if d.UIDAttribute == "" {
+			d.UIDAttribute = c.LDAPUIDAttribute
+		}
+		if d.DialTimeout == 0 {
+			d.DialTimeout = c.LDAPDialTimeout
+		}
+		if d.BindTimeout == 0 {
+			d.BindTimeout = c.LDAPBindTimeout
+		}
+		if d.SearchTimeout == 0 {
+			d.SearchTimeout = c.LDAPSearchTimeout
+		}
+		if d.Timeout == 0 {
+			d.Timeout = c.LDAPTimeout
+		}
+		directories[i] = d
+	}
+	return directories
+}
+
+// mustLoadConfig loads and validates the configuration, exiting on errors.
+func mustLoadConfig() *Config {
+	c, err := loadConfig()
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kubernetes-ldap: %v\n", err)
+		os.Exit(1)
+	}
+	return c
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("ldap-host", "ldap.example.com")
+	if _, err := loadConfig(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	viper.Set("ldap-hots", "ldap.example.com")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "ldap-hots") {
+		t.Errorf("Expected error naming the unknown key, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := &Config{
+		LDAPPort:              389,
+		Port:                  70000,
+		TokenTTL:              -time.Hour,
+		GenKeypair:            true,
+		LocalUsersMode:        "sometimes",
+		AuditLogMaxSize:       100,
+		TLSMinVersion:         "VersionTLS12",
+		KerberosKeytab:        "/nonexistent/krb5.keytab",
+		ClientCertLoginName:   "serial",
+		ClientCertLoginFilter: "(cn=alice)",
+		RobotStoreFile:        "robots.json",
+		RobotMaxTTL:           -time.Hour,
+		ShutdownDelay:         -time.Second,
+		Directories: []directoryConfig{
+			{Name: "acme", Host: "dc1.acme.com", BaseDN: "dc=acme,dc=com"},
+			{Name: "acme", Host: "dc2.acme.com"},
+			{Name: "legacy", Host: "ldap.legacy.com", BaseDN: "dc=legacy,dc=com", Insecure: true, PasswordChange: "ad"},
+			{Name: "other", Host: "ldap.other.com", BaseDN: "dc=other,dc=com", PasswordChange: "kpasswd", BindTimeout: -time.Second},
+			{Name: "plain", Host: "ldap.plain.com", BaseDN: "dc=plain,dc=com", Insecure: true, PasswordChange: "rfc3062", UsernamePrefix: "robot:plain:"},
+		},
+	}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors")
+	}
+	for _, expected := range []string{
+		"--port 70000",
+		"--tls-cert-file is required",
+		"--token-ttl must be positive",
+		"--local-users-mode",
+		`directory name "acme" is used twice`,
+		`directory "acme" needs a host and a baseDN`,
+		`directory "legacy": passwordChange ad requires TLS`,
+		`directory "legacy": passwordChange ad requires a search user`,
+		`directory "other": passwordChange: unknown password change method "kpasswd"`,
+		`directory "plain": passwordChange rfc3062 requires TLS`,
+		`directory "other": timeouts must not be negative`,
+		`directory "legacy": usernamePrefix "" is used by another directory`,
+		`directory "plain": usernamePrefix "robot:plain:" is reserved for robots`,
+		"reading --kerberos-keytab",
+		"--kerberos-max-clock-skew must be positive",
+		"--kerberos-keytab requires a search user in directory dc1.acme.com",
+		`--client-cert-login-name "serial" is not one of cn, dns, email, uri`,
+		"--client-cert-login-name requires --client-ca-file or --client-cert-login-ca-file",
+		"--client-cert-login-filter must contain {name}",
+		"--robot-store-file requires --client-ca-file",
+		"--robot-store-file requires --robot-admin-names",
+		"--robot-max-ttl must not be negative",
+		"--shutdown-delay must not be negative",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "--ldap-host") {
+		t.Errorf("Expected --ldap-host not to be required with directories: %v", err)
+	}
+}
+
+func TestValidateTryAllDirectories(t *testing.T) {
+	c := &Config{LDAPHost: "ldap.example.com", LDAPBaseDN: "dc=example,dc=com", LDAPTryAllDirectories: true}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "--ldap-try-all-directories requires several directories") {
+		t.Errorf("Expected --ldap-try-all-directories to require several directories, got %v", err)
+	}
+}
+
+func TestValidateClientCertLogin(t *testing.T) {
+	cases := []struct {
+		config   Config
+		expected []string
+	}{
+		{
+			Config{ClientCertLoginName: "dns", ClientCertLoginCAFile: "/nonexistent/ca.pem"},
+			[]string{"--client-cert-login-name requires --client-cert-login-filter", "loading client certificate login CAs"},
+		},
+		{
+			Config{ClientCertLoginCAFile: "/nonexistent/ca.pem"},
+			[]string{"--client-cert-login-ca-file requires --client-cert-login-name"},
+		},
+	}
+	for _, c := range cases {
+		err := c.config.Validate()
+		for _, expected := range c.expected {
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q in %v", expected, err)
+			}
+		}
+	}
+}
+
+func TestDirectoriesDefaults(t *testing.T) {
+	c := &Config{LDAPBindTimeout: 5 * time.Second, UsernameAttribute: "mail", Directories: []directoryConfig{
+		{Name: "secure"},
+		{Name: "insecure", Insecure: true},
+		{Name: "custom", Port: 3269, UserAttribute: "sAMAccountName", BindTimeout: time.Minute},
+	}}
+
+	directories := c.directories()
+	for i, expected := range []struct {
+		port          uint
+		userAttribute string
+	}{{636, "uid"}, {389, "uid"}, {3269, "sAMAccountName"}} {
+		if directories[i].Port != expected.port || directories[i].UserAttribute != expected.userAttribute {
+			t.Errorf("Directory %d: expected port %d and %s, got %d and %s", i, expected.port, expected.userAttribute,
+				directories[i].Port, directories[i].UserAttribute)
+		}
+	}
+	if directories[0].UsernameAttribute != "mail" {
+		t.Errorf("Expected the username attribute to default to the flag, got %q", directories[0].UsernameAttribute)
+	}
+	if directories[0].BindTimeout != 5*time.Second || directories[2].BindTimeout != time.Minute {
+		t.Errorf("Expected timeouts to default to the flags, got %v and %v", directories[0].BindTimeout, directories[2].BindTimeout)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	defer viper.Reset()
+	viper.SetDefault("token-ttl", "24h")
+	viper.SetDefault("mfa-required-groups", []string{})
+	viper.Set("ldap-host", "ldap.example.com")
+	bindEnv()
+
+	os.Setenv("KUBERNETES_LDAP_TOKEN_TTL", "2h")
+	os.Setenv("KUBERNETES_LDAP_MFA_REQUIRED_GROUPS", "admins,deployers")
+	os.Setenv("KUBERNETES_LDAP_LDAP_HOST", "ignored.example.com")
+	defer os.Unsetenv("KUBERNETES_LDAP_TOKEN_TTL")
+	defer os.Unsetenv("KUBERNETES_LDAP_MFA_REQUIRED_GROUPS")
+	defer os.Unsetenv("KUBERNETES_LDAP_LDAP_HOST")
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.TokenTTL != 2*time.Hour {
+		t.Errorf("Expected token TTL from the environment, got %s", c.TokenTTL)
+	}
+	if !reflect.DeepEqual(c.MFARequiredGroups, []string{"admins", "deployers"}) {
+		t.Errorf("Expected groups from the environment, got %v", c.MFARequiredGroups)
+	}
+	if c.LDAPHost != "ldap.example.com" {
+		t.Errorf("Expected explicitly set host to override the environment, got %s", c.LDAPHost)
+	}
+}
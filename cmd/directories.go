@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/local"
+	"github.com/proofpoint/kubernetes-ldap/reload"
+)
+
+// watchFunc reloads target when one of its files changes.
+type watchFunc func(target string, reload func() error, files ...string)
+
+// directoryConfig configures one LDAP directory. A single directory is
+// configured with the --ldap-* flags, several are listed under
+// "directories" in the config file.
+type directoryConfig struct {
+	// Name identifies the directory in tokens, logs and readiness checks.
+	Name string `mapstructure:"name"`
+
+	Host                string `mapstructure:"host"`
+	Port                uint   `mapstructure:"port"`
+	Insecure            bool   `mapstructure:"insecure"`
+	SkipTLSVerification bool   `mapstructure:"skipTLSVerification"`
+	ServerName          string `mapstructure:"serverName"`
+	CAFile              string `mapstructure:"caFile"`
+	ClientCert          string `mapstructure:"clientCert"`
+	ClientKey           string `mapstructure:"clientKey"`
+	SASLExternal        bool   `mapstructure:"saslExternal"`
+
+	BaseDN             string `mapstructure:"baseDN"`
+	UserAttribute      string `mapstructure:"userAttribute"`
+	UsernameAttribute  string `mapstructure:"usernameAttribute"`
+	UIDAttribute       string `mapstructure:"uidAttribute"`
+	SearchUserDN       string `mapstructure:"searchUserDN"`
+	SearchUserPassword string `mapstructure:"searchUserPassword"`
+	// SearchUserPasswordFile is read instead of SearchUserPassword and
+	// reloaded when it changes.
+	SearchUserPasswordFile string `mapstructure:"searchUserPasswordFile"`
+
+	// GroupBaseDN switches from reading memberOf to searching the groups
+	// with GroupFilter.
+	GroupBaseDN string `mapstructure:"groupBaseDN"`
+	GroupFilter string `mapstructure:"groupFilter"`
+
+	// UsernamePrefix prefixes the usernames of the directory in tokens,
+	// see ldap.Client.UsernamePrefix. Required to be distinct with several
+	// directories.
+	UsernamePrefix string `mapstructure:"usernamePrefix"`
+
+	// Suffixes, StripSuffix and Prefixes route users to the directory,
+	// see ldap.Route.
+	Suffixes    []string `mapstructure:"suffixes"`
+	StripSuffix bool     `mapstructure:"stripSuffix"`
+	Prefixes    []string `mapstructure:"prefixes"`
+
+	// PasswordChange enables changing expired passwords, see
+	// ldap.Client.PasswordChange.
+	PasswordChange string `mapstructure:"passwordChange"`
+
+	// Timeouts default to the --ldap-*-timeout flags, see
+	// ldap.Client.Timeout.
+	DialTimeout   time.Duration `mapstructure:"dialTimeout"`
+	BindTimeout   time.Duration `mapstructure:"bindTimeout"`
+	SearchTimeout time.Duration `mapstructure:"searchTimeout"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+}
+
+// newAuthenticator returns the authenticator of the directories, which
+// authenticates against a single directory or routes to one of several,
+// combined with the local users if configured. The router lists the
+// clients of all directories.
+func newAuthenticator(directories []directoryConfig, watch watchFunc) (identity.Authenticator, *ldap.Router, error) {
+	var ldapAuthenticator ldap.Authenticator
+	router := &ldap.Router{TryAll: config.LDAPTryAllDirectories}
+	for _, d := range directories {
+		client, err := newLDAPClient(d, watch)
+		if err != nil {
+			return nil, nil, fmt.Errorf("directory %s: %v", d.Host, err)
+		}
+		ldapAuthenticator = client
+		router.Routes = append(router.Routes, ldap.Route{
+			Client:      client,
+			Suffixes:    d.Suffixes,
+			StripSuffix: d.StripSuffix,
+			Prefixes:    d.Prefixes,
+		})
+	}
+	if len(router.Routes) > 1 {
+		ldapAuthenticator = router
+	}
+
+	if config.LocalUsersFile != "" {
+		localUsers, err := local.NewUsers(config.LocalUsersFile, config.LocalGroupsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading local users: %v", err)
+		}
+		watch("local_users", localUsers.Reload, localUsers.Files()...)
+		glog.Warningf("Break-glass local users from %s are enabled (mode %s)", config.LocalUsersFile, config.LocalUsersMode)
+
+		ldapAuthenticator = &local.Chain{
+			Users:     localUsers,
+			Directory: ldapAuthenticator,
+			Mode:      config.LocalUsersMode,
+		}
+	}
+
+	return ldap.UpgradeAuthenticator(ldapAuthenticator, config.UsernameAttribute), router, nil
+}
+
+// newLDAPClient returns the client of a directory. Its client certificate
+// is reloaded via watch.
+func newLDAPClient(d directoryConfig, watch watchFunc) (*ldap.Client, error) {
+	serverName := d.ServerName
+	if serverName == "" {
+		serverName = d.Host
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: d.SkipTLSVerification,
+	}
+	if err := config.ldapTLSOptions().Apply(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	if d.CAFile != "" {
+		rootCAs, err := loadCertPool(d.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading LDAP CAs: %v", err)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if d.ClientCert != "" {
+		clientCert, err := reload.NewCertificate(d.ClientCert, d.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading LDAP client certificate: %v", err)
+		}
+		tlsConfig.GetClientCertificate = clientCert.GetClientCertificate
+		watch(directoryTarget("ldap_client_cert", d), clientCert.Reload, clientCert.Files()...)
+	}
+
+	client := &ldap.Client{
+		Name:               d.Name,
+		BaseDN:             d.BaseDN,
+		LdapServer:         d.Host,
+		LdapPort:           d.Port,
+		UseInsecure:        d.Insecure,
+		UserLoginAttribute: d.UserAttribute,
+		SearchUserDN:       d.SearchUserDN,
+		SearchUserPassword: d.SearchUserPassword,
+		TLSConfig:          tlsConfig,
+		SASLExternal:       d.SASLExternal,
+		UsernameAttribute:  d.UsernameAttribute,
+		UsernamePrefix:     d.UsernamePrefix,
+		UIDAttribute:       d.UIDAttribute,
+		GroupBaseDN:        d.GroupBaseDN,
+		GroupFilter:        d.GroupFilter,
+		PasswordChange:     d.PasswordChange,
+		DialTimeout:        d.DialTimeout,
+		BindTimeout:        d.BindTimeout,
+		SearchTimeout:      d.SearchTimeout,
+		Timeout:            d.Timeout,
+	}
+
+	if d.SearchUserPasswordFile != "" {
+		password, err := reload.NewSecret(d.SearchUserPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading LDAP search user password: %v", err)
+		}
+		client.GetSearchUserPassword = password.Value
+		watch(directoryTarget("ldap_search_user_password", d), password.Reload, password.Files()...)
+	}
+	return client, nil
+}
+
+// directoryTarget names reload targets and readiness checks of a
+// directory. The names stay unchanged when a single directory is
+// configured by flags.
+func directoryTarget(target string, d directoryConfig) string {
+	if d.Name == "" {
+		return target
+	}
+	return target + "_" + d.Name
+}
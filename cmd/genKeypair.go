@@ -13,12 +13,12 @@ var genKeypairCmd = &cobra.Command{
 	Use:   "gen-keypair",
 	Short: "generate a new keypair for signing/verifying the token",
 	Run: func(cmd *cobra.Command, args []string) {
-		os.MkdirAll(keypairDir, 0700)
+		os.MkdirAll(config.KeypairDir, 0700)
 
-		if err := token.GenerateKeypair(keypairDir); err != nil {
+		if err := token.GenerateKeypair(config.KeypairDir); err != nil {
 			glog.Fatalf("Error generating key pair: %v", err)
 		}
-		fmt.Printf("Generated keypair in %s\n", keypairDir)
+		fmt.Printf("Generated keypair in %s\n", config.KeypairDir)
 	},
 }
 
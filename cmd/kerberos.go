@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+)
+
+// newKerberosAuthenticator returns the authenticator of Kerberos tickets
+// if --kerberos-keytab is set, and nil otherwise. Clients are looked up
+// via lookup, the keytab is reloaded via watch.
+func newKerberosAuthenticator(lookup identity.Lookup, watch watchFunc) (*kerberos.Authenticator, error) {
+	if config.KerberosKeytab == "" {
+		return nil, nil
+	}
+
+	keytab, err := kerberos.NewKeytabFile(config.KerberosKeytab)
+	if err != nil {
+		return nil, fmt.Errorf("reading keytab: %v", err)
+	}
+	watch("kerberos_keytab", keytab.Reload, keytab.Files()...)
+	glog.Infof("Accepting Kerberos tickets for the principals of %s", config.KerberosKeytab)
+
+	return &kerberos.Authenticator{
+		Keytab:           keytab.Keytab,
+		ServicePrincipal: config.KerberosServicePrincipal,
+		Realms:           config.KerberosRealms,
+		MaxClockSkew:     config.KerberosMaxClockSkew,
+		Lookup:           lookup,
+		StripRealm:       config.KerberosStripRealm,
+	}, nil
+}
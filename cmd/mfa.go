@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var mfaEnrollmentCodeOptions struct {
+	storeFile string
+	keyFile   string
+	ttl       time.Duration
+}
+
+// mfaEnrollmentCodeCmd issues the codes users need to enroll for MFA
+var mfaEnrollmentCodeCmd = &cobra.Command{
+	Use:   "mfa-enrollment-code USERNAME",
+	Short: "issue a one-time code which lets a user enroll for MFA",
+	Long: `mfa-enrollment-code writes a one-time enrollment code of the user to the MFA
+store and prints it. The user passes it in the X-Kubernetes-Ldap-Enrollment-Code
+header of /mfa/enroll. A new code replaces a pending enrollment of the user.
+The store and key files default to those of the config file.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := mfaEnrollmentCodeOptions
+		if opts.storeFile == "" {
+			opts.storeFile = viper.GetString("mfa-store-file")
+		}
+		if opts.keyFile == "" {
+			opts.keyFile = viper.GetString("mfa-key-file")
+		}
+		if opts.storeFile == "" || opts.keyFile == "" {
+			exitOnError(fmt.Errorf("--mfa-store-file and --mfa-key-file are required"))
+		}
+
+		store, err := mfa.NewFileStore(opts.storeFile, opts.keyFile)
+		exitOnError(err)
+		a := &mfa.Authenticator{Store: store, EnrollmentCodeTTL: opts.ttl}
+		code, err := a.IssueEnrollmentCode(args[0])
+		exitOnError(err)
+		fmt.Println(code)
+	},
+}
+
+func init() {
+	mfaEnrollmentCodeCmd.Flags().StringVar(&mfaEnrollmentCodeOptions.storeFile, "mfa-store-file", "", "File storing the encrypted TOTP enrollments")
+	mfaEnrollmentCodeCmd.Flags().StringVar(&mfaEnrollmentCodeOptions.keyFile, "mfa-key-file", "", "File containing the key of --mfa-store-file")
+	mfaEnrollmentCodeCmd.Flags().DurationVar(&mfaEnrollmentCodeOptions.ttl, "ttl", mfa.DefaultEnrollmentCodeTTL, "Validity of the code")
+	RootCmd.AddCommand(mfaEnrollmentCodeCmd)
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/auth"
+	"github.com/proofpoint/kubernetes-ldap/robot"
+	"github.com/spf13/cobra"
+)
+
+// newRobotStore returns the store of robot tokens if --robot-store-file
+// is set, and nil otherwise. The store is reloaded via watch, so that
+// revocations by other replicas take effect.
+func newRobotStore(watch watchFunc) (*robot.Store, error) {
+	if config.RobotStoreFile == "" {
+		return nil, nil
+	}
+
+	robots, err := robot.NewStore(config.RobotStoreFile)
+	if err != nil {
+		return nil, err
+	}
+	watch("robot_store", robots.Reload, robots.Files()...)
+	glog.Infof("Accepting robot tokens recorded in %s", config.RobotStoreFile)
+	return robots, nil
+}
+
+// robotClient calls /robots of a server as admin.
+type robotClient struct {
+	server     string
+	clientCert string
+	clientKey  string
+	caFile     string
+}
+
+var robotOptions robotClient
+
+// robotCmd groups the commands managing robot tokens
+var robotCmd = &cobra.Command{
+	Use:   "robot",
+	Short: "manage the tokens of robots like CI pipelines on a running server",
+	Long: `robot creates, lists and revokes long-lived tokens for automation via the
+/robots endpoint of a server started with --robot-store-file. It
+authenticates with a client certificate listed in --robot-admin-names.`,
+}
+
+var robotCreateOptions struct {
+	name   string
+	groups []string
+	ttl    time.Duration
+}
+
+var robotCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a robot and print its token",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		created := &auth.RobotResponse{}
+		err := robotOptions.do(http.MethodPost, auth.RobotsPath, &auth.RobotRequest{
+			Name:   robotCreateOptions.name,
+			Groups: robotCreateOptions.groups,
+			TTL:    robotCreateOptions.ttl.String(),
+		}, created)
+		exitOnError(err)
+
+		// only the token goes to stdout, so that it can be piped into a secret
+		fmt.Fprintf(os.Stderr, "Created robot %s with token ID %s, expiring %s\n", created.Name, created.TokenID, created.Expiration.Format(time.RFC3339))
+		fmt.Println(created.Token)
+	},
+}
+
+var robotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the robots and their token IDs",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var robots []robot.Robot
+		exitOnError(robotOptions.do(http.MethodGet, auth.RobotsPath, nil, &robots))
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TOKEN ID\tNAME\tGROUPS\tCREATED BY\tEXPIRES\tREVOKED")
+		for _, r := range robots {
+			revoked := "-"
+			if r.Revoked != nil {
+				revoked = r.Revoked.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.TokenID, r.Name, strings.Join(r.Groups, ","), r.CreatedBy, r.Expiration.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+	},
+}
+
+var robotRevokeCmd = &cobra.Command{
+	Use:   "revoke TOKEN_ID",
+	Short: "revoke the token of a robot",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revoked := &robot.Robot{}
+		exitOnError(robotOptions.do(http.MethodDelete, auth.RobotsPath+"/"+url.PathEscape(args[0]), nil, revoked))
+		fmt.Printf("Revoked token %s of robot %s\n", revoked.TokenID, revoked.Name)
+	},
+}
+
+func init() {
+	robotCmd.PersistentFlags().StringVar(&robotOptions.server, "server", "https://localhost:4000", "URL of the kubernetes-ldap server")
+	robotCmd.PersistentFlags().StringVar(&robotOptions.clientCert, "client-cert", "", "File containing the admin's client certificate")
+	robotCmd.PersistentFlags().StringVar(&robotOptions.clientKey, "client-key", "", "File containing the key of --client-cert")
+	robotCmd.PersistentFlags().StringVar(&robotOptions.caFile, "ca-file", "", "File containing the CA certificates verifying the server. Defaults to the system's")
+
+	robotCreateCmd.Flags().StringVar(&robotCreateOptions.name, "name", "", "Name of the robot, e.g. ci-deployer. Kubernetes sees it as robot:<name>")
+	robotCreateCmd.Flags().StringSliceVar(&robotCreateOptions.groups, "groups", nil, "Groups of the robot")
+	robotCreateCmd.Flags().DurationVar(&robotCreateOptions.ttl, "ttl", 720*time.Hour, "Lifetime of the token")
+	robotCreateCmd.MarkFlagRequired("name")
+
+	robotCmd.AddCommand(robotCreateCmd, robotListCmd, robotRevokeCmd)
+	RootCmd.AddCommand(robotCmd)
+}
+
+// do sends in as JSON body, if not nil, and decodes the response into out.
+func (c *robotClient) do(method, path string, in, out interface{}) error {
+	client, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.server, "/")+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *robotClient) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if c.caFile != "" {
+		pool, err := loadCertPool(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CAs: %v", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.clientCert != "" || c.clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// exitOnError prints err and exits, if err is not nil.
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kubernetes-ldap: %v\n", err)
+		os.Exit(1)
+	}
+}
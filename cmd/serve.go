@@ -15,21 +15,37 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/mitchellh/go-homedir"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/proofpoint/kubernetes-ldap/audit"
 	"github.com/proofpoint/kubernetes-ldap/auth"
+	"github.com/proofpoint/kubernetes-ldap/health"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
 	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/local"
+	"github.com/proofpoint/kubernetes-ldap/mfa"
+	"github.com/proofpoint/kubernetes-ldap/ratelimit"
+	"github.com/proofpoint/kubernetes-ldap/reload"
+	"github.com/proofpoint/kubernetes-ldap/robot"
+	"github.com/proofpoint/kubernetes-ldap/tlsconfig"
 	"github.com/proofpoint/kubernetes-ldap/token"
-	"github.com/spf13/cast"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -38,29 +54,8 @@ import (
 var (
 	cfgFile string
 
-	ldapHost string
-	ldapPort uint
-
-	ldapBaseDn        string
-	ldapUserAttribute string
-
-	ldapSearchUserDn       string
-	ldapSearchUserPassword string
-	usernameAttribute      string
-
-	serverPort              uint
-	serverTlsCertFile       string
-	serverTlsPrivateKeyFile string
-
-	ldapSkipTlsVerification bool
-	ldapUseInsecure         bool
-
-	tokenTtl time.Duration
-
-	keypairDir string
-	genKeypair bool
-
-	enforceClientVersions bool
+	// config holds the flags, and after validate() the whole configuration
+	config Config
 )
 
 // RootCmd represents the serve command
@@ -72,15 +67,23 @@ var RootCmd = &cobra.Command{
 	/authenticate - to verify the token`,
 	Run: func(cmd *cobra.Command, args []string) {
 		validate()
-		registerMetrics()
+		registerMetrics(config.LegacyMetrics)
 		serve()
 	},
 }
 
-func registerMetrics() {
-	auth.RegisterIssueTokenMetrics()
-	auth.RegisterVerifyTokenMetrics()
-	ldap.RegisterLDAPClientMetrics()
+func registerMetrics(legacy bool) {
+	auth.RegisterIssueTokenMetrics(legacy)
+	auth.RegisterVerifyTokenMetrics(legacy)
+	ldap.RegisterLDAPClientMetrics(legacy)
+	auth.RegisterMFAMetrics()
+	auth.RegisterPasswordChangeMetrics()
+	auth.RegisterThrottleMetrics()
+	auth.RegisterClientCertMetrics()
+	auth.RegisterRobotMetrics()
+	reload.RegisterReloadMetrics()
+	health.RegisterHealthMetrics()
+	local.RegisterLocalUserMetrics()
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -101,31 +104,108 @@ func init() {
 		"",
 		"config file (default is $HOME/.kubernetes-ldap.yaml)")
 
-	RootCmd.PersistentFlags().StringVar(&keypairDir, "keypair-dir", "keypair", "directory that contains keypair for signing/verifying tokens.")
-
-	RootCmd.Flags().StringVar(&ldapHost, "ldap-host", "", "(Required Host or IP of the LDAP server )")
-	RootCmd.Flags().UintVar(&ldapPort, "ldap-port", 389, "LDAP server port")
-
-	RootCmd.Flags().StringVar(&ldapBaseDn, "ldap-base-dn", "", "LDAP user base DN in for form 'dc=example,dc=com")
-	RootCmd.Flags().StringVar(&ldapUserAttribute, "ldap-user-attribute", "uid", "LDAP Username attribute for login")
-
-	RootCmd.Flags().StringVar(&ldapSearchUserDn, "ldap-search-user-dn", "", "Search user DN for this app to find users (e.g.: cn=admin,dc=example,dc=com).")
-	RootCmd.Flags().StringVar(&ldapSearchUserPassword, "ldap-search-user-password", "", "Search user password")
-	RootCmd.Flags().StringVar(&usernameAttribute, "username-attribute", "uid", "ldap attribute to use for Username inside token")
-
-	RootCmd.Flags().UintVar(&serverPort, "port", 4000, "Local port this proxy server will run on")
-	RootCmd.Flags().StringVar(&serverTlsCertFile, "tls-cert-file", "", "(Required) File containing x509 Certificate for HTTPS.  (CA cert, if any, concatenated after server cert) .")
-	RootCmd.Flags().StringVar(&serverTlsPrivateKeyFile, "tls-private-key-file", "", "(Required) File containing x509 private key matching --tls-cert-file.")
-
-	RootCmd.Flags().BoolVar(&ldapSkipTlsVerification, "ldap-skip-tls-verification", false, "Skip LDAP server TLS verification")
-	RootCmd.Flags().BoolVar(&ldapUseInsecure, "use-insecure", false, "Disable LDAP TLS")
-
-	RootCmd.Flags().DurationVar(&tokenTtl, "token-ttl", 24*time.Hour, "TTL for the token")
-	RootCmd.Flags().BoolVar(&genKeypair, "gen-keypair", false, "generate new keypair while starting server")
-
-	RootCmd.Flags().BoolVar(&enforceClientVersions, "enforce-client-versions", false, "if true enforces minimum version of k8sldapctl and kubectl")
+	RootCmd.PersistentFlags().StringVar(&config.KeypairDir, "keypair-dir", "keypair", "directory that contains keypair for signing/verifying tokens.")
+
+	RootCmd.Flags().StringVar(&config.LDAPHost, "ldap-host", "", "(Required Host or IP of the LDAP server )")
+	RootCmd.Flags().UintVar(&config.LDAPPort, "ldap-port", 389, "LDAP server port")
+
+	RootCmd.Flags().StringVar(&config.LDAPBaseDN, "ldap-base-dn", "", "LDAP user base DN in for form 'dc=example,dc=com")
+	RootCmd.Flags().StringVar(&config.LDAPUserAttribute, "ldap-user-attribute", "uid", "LDAP Username attribute for login")
+
+	RootCmd.Flags().StringVar(&config.LDAPSearchUserDN, "ldap-search-user-dn", "", "Search user DN for this app to find users (e.g.: cn=admin,dc=example,dc=com).")
+	RootCmd.Flags().StringVar(&config.LDAPSearchUserPassword, "ldap-search-user-password", "", "Search user password")
+	RootCmd.Flags().StringVar(&config.LDAPSearchUserPasswordFile, "ldap-search-user-password-file", "", "File containing the search user password, reloaded when it changes. Keeps the password out of the command line")
+	RootCmd.Flags().StringVar(&config.UsernameAttribute, "username-attribute", "uid", "ldap attribute to use for Username inside token")
+	RootCmd.Flags().StringVar(&config.LDAPUIDAttribute, "ldap-uid-attribute", "", "LDAP attribute identifying users permanently, e.g. entryUUID or objectGUID, asserted as uid inside tokens. Optional")
+	RootCmd.Flags().StringVar(&config.LDAPGroupBaseDN, "ldap-group-base-dn", "", "Base DN to search the groups of users in, for directories without memberOf. By default groups are read from memberOf")
+	RootCmd.Flags().StringVar(&config.LDAPGroupFilter, "ldap-group-filter", ldap.DefaultGroupFilter, "Filter finding the groups of a user below --ldap-group-base-dn. {dn} and {username} are replaced with the user's DN and login name")
+	RootCmd.Flags().DurationVar(&config.LDAPDialTimeout, "ldap-dial-timeout", ldap.DefaultDialTimeout, "Timeout of connecting to the LDAP server, including the TLS handshake")
+	RootCmd.Flags().DurationVar(&config.LDAPBindTimeout, "ldap-bind-timeout", ldap.DefaultBindTimeout, "Timeout of each LDAP bind")
+	RootCmd.Flags().DurationVar(&config.LDAPSearchTimeout, "ldap-search-timeout", ldap.DefaultSearchTimeout, "Timeout of each LDAP search, also sent to the server as time limit")
+	RootCmd.Flags().DurationVar(&config.LDAPTimeout, "ldap-timeout", ldap.DefaultTimeout, "Timeout of authenticating a user against an LDAP directory as a whole")
+	RootCmd.Flags().StringVar(&config.LDAPPasswordChange, "ldap-password-change", "", "Lets users change expired passwords on /changePassword over TLS: 'rfc3062' for the Password Modify extended operation, or 'ad' for Active Directory, which requires a search user")
+
+	RootCmd.Flags().StringVar(&config.LocalUsersFile, "local-users-file", "", "htpasswd file with bcrypt or argon2id hashes of break-glass users authenticated without LDAP")
+	RootCmd.Flags().StringVar(&config.LocalGroupsFile, "local-groups-file", "", "Group file ('group: user1 user2' per line) of the users in --local-users-file")
+	RootCmd.Flags().StringVar(&config.LocalUsersMode, "local-users-mode", local.ModeLast, "When to consult --local-users-file: 'first' before LDAP, 'last' if LDAP fails, or 'only' for its users, which are never sent to LDAP")
+
+	RootCmd.Flags().StringVar(&config.KerberosKeytab, "kerberos-keytab", "", "Keytab of the HTTP service principal. Enables Kerberos tickets (Authorization: Negotiate) on /ldapAuth, whose users are looked up in LDAP with the search user")
+	RootCmd.Flags().StringVar(&config.KerberosServicePrincipal, "kerberos-service-principal", "", "Only accept tickets for this principal of --kerberos-keytab, e.g. HTTP/auth.example.com@EXAMPLE.COM. By default any principal of the keytab is accepted")
+	RootCmd.Flags().StringSliceVar(&config.KerberosRealms, "kerberos-realms", nil, "Realms of accepted clients. Defaults to the realm of the service principal")
+	RootCmd.Flags().BoolVar(&config.KerberosStripRealm, "kerberos-strip-realm", true, "Look users up in LDAP by their principal without realm, e.g. alice instead of alice@EXAMPLE.COM")
+	RootCmd.Flags().DurationVar(&config.KerberosMaxClockSkew, "kerberos-max-clock-skew", kerberos.DefaultMaxClockSkew, "Maximum clock skew between clients and the server")
+
+	RootCmd.Flags().UintVar(&config.Port, "port", 4000, "Local port this proxy server will run on")
+	RootCmd.Flags().StringVar(&config.TLSCertFile, "tls-cert-file", "", "(Required) File containing x509 Certificate for HTTPS.  (CA cert, if any, concatenated after server cert) .")
+	RootCmd.Flags().StringVar(&config.TLSPrivateKeyFile, "tls-private-key-file", "", "(Required) File containing x509 private key matching --tls-cert-file.")
+
+	RootCmd.Flags().BoolVar(&config.LDAPSkipTLSVerification, "ldap-skip-tls-verification", false, "Skip LDAP server TLS verification")
+	RootCmd.Flags().BoolVar(&config.UseInsecure, "use-insecure", false, "Disable LDAP TLS")
+
+	addTLSFlags("", &config.TLSMinVersion, &config.TLSMaxVersion, &config.TLSCipherSuites, &config.TLSCurvePreferences)
+	RootCmd.Flags().BoolVar(&config.HTTP2, "http2", true, "Offer HTTP/2 via ALPN")
+
+	addTLSFlags("ldap-", &config.LDAPTLSMinVersion, &config.LDAPTLSMaxVersion, &config.LDAPTLSCipherSuites, &config.LDAPTLSCurvePreferences)
+	RootCmd.Flags().StringVar(&config.LDAPCAFile, "ldap-ca-file", "", "File containing the CA certificates used to verify the LDAP server. Defaults to the system roots")
+	RootCmd.Flags().StringVar(&config.LDAPClientCert, "ldap-client-cert", "", "File containing the x509 client certificate presented to the LDAP server")
+	RootCmd.Flags().StringVar(&config.LDAPClientKey, "ldap-client-key", "", "File containing the private key matching --ldap-client-cert")
+	RootCmd.Flags().StringVar(&config.LDAPServerName, "ldap-server-name", "", "Name expected in the LDAP server certificate, if it differs from --ldap-host (e.g. when connecting by IP)")
+	RootCmd.Flags().BoolVar(&config.LDAPSASLExternal, "ldap-sasl-external", false, "Bind with SASL EXTERNAL using --ldap-client-cert instead of --ldap-search-user-dn")
+	RootCmd.Flags().BoolVar(&config.LDAPTryAllDirectories, "ldap-try-all-directories", false, "Try usernames without the prefix or suffix of a directory against all directories in order, instead of only the first one. Sends their passwords to every directory which doesn't know them")
+
+	RootCmd.Flags().DurationVar(&config.TokenTTL, "token-ttl", 24*time.Hour, "TTL for the token")
+	RootCmd.Flags().BoolVar(&config.GenKeypair, "gen-keypair", false, "generate new keypair while starting server")
+
+	RootCmd.Flags().BoolVar(&config.EnforceClientVersions, "enforce-client-versions", false, "if true enforces minimum version of k8sldapctl and kubectl")
+
+	RootCmd.Flags().StringVar(&config.MFAStoreFile, "mfa-store-file", "", "File storing the encrypted TOTP enrollments. Enables MFA.")
+	RootCmd.Flags().StringVar(&config.MFAKeyFile, "mfa-key-file", "", "File containing the base64 encoded 256 bit key used to encrypt --mfa-store-file")
+	RootCmd.Flags().StringVar(&config.MFASecretAttribute, "mfa-secret-attribute", "", "LDAP attribute containing the user's base32 TOTP secret. Enables MFA, replaces --mfa-store-file.")
+	RootCmd.Flags().StringSliceVar(&config.MFARequiredGroups, "mfa-required-groups", nil, "Groups whose members must use MFA ('*' for everybody). Enrolled users always have to use it.")
+	RootCmd.Flags().StringVar(&config.MFAIssuer, "mfa-issuer", "kubernetes-ldap", "Issuer name shown in authenticator apps")
+
+	RootCmd.Flags().IntVar(&config.LoginUserRateLimit, "login-user-rate-limit", 10, "Login attempts allowed per username and minute (0 to disable)")
+	RootCmd.Flags().IntVar(&config.LoginIPRateLimit, "login-ip-rate-limit", 60, "Login attempts allowed per source IP and minute (0 to disable)")
+	RootCmd.Flags().DurationVar(&config.LoginBackoffBase, "login-backoff-base", time.Second, "Delay enforced after a failed login, doubled with each further failure (0 to disable)")
+	RootCmd.Flags().DurationVar(&config.LoginBackoffMax, "login-backoff-max", time.Minute, "Maximum delay enforced after failed logins, 1h if 0")
+	RootCmd.Flags().IntVar(&config.LoginLockoutThreshold, "login-lockout-threshold", 5, "Failed logins after which a username is locked out locally. Keep below the directory's lockout threshold (0 to disable)")
+	RootCmd.Flags().IntVar(&config.LoginIPLockoutThreshold, "login-ip-lockout-threshold", 20, "Failed logins after which a source IP is locked out locally (0 to disable)")
+	RootCmd.Flags().DurationVar(&config.LoginLockoutDuration, "login-lockout-duration", 15*time.Minute, "Duration of local lockouts, and after which failed logins are forgotten")
+	RootCmd.Flags().BoolVar(&config.LoginTrustForwardedFor, "login-trust-forwarded-for", false, "Use the last X-Forwarded-For entry, which the proxy appended, as source IP. Only enable behind a single trusted proxy")
+
+	RootCmd.Flags().StringVar(&config.AuditLog, "audit-log", "", "File to write the JSON audit log of token issuance and verification to, '-' for stdout")
+	RootCmd.Flags().Int64Var(&config.AuditLogMaxSize, "audit-log-max-size", 100, "Size in megabytes after which the audit log file is rotated")
+	RootCmd.Flags().IntVar(&config.AuditLogMaxBackups, "audit-log-max-backups", 5, "Number of rotated audit log files to keep")
+
+	RootCmd.Flags().BoolVar(&config.LegacyMetrics, "legacy-metrics", false, "Also expose the unlabeled counters of earlier releases, e.g. kubernetes_ldap_failed_ldap_auth")
+
+	RootCmd.Flags().StringVar(&config.ClientCAFile, "client-ca-file", "", "File containing the CA certificates used to verify client certificates. Enables client certificate authentication.")
+	RootCmd.Flags().StringSliceVar(&config.ClientCertEndpoints, "client-cert-endpoints", []string{"/authenticate"}, "Endpoints requiring a client certificate verified against --client-ca-file")
+	RootCmd.Flags().StringSliceVar(&config.ClientCertAllowedNames, "client-cert-allowed-names", nil, "If set, only client certificates with one of these subject CNs or SANs are accepted on --client-cert-endpoints")
+	RootCmd.Flags().StringVar(&config.ClientCertLoginName, "client-cert-login-name", "", "Name of client certificates identifying users: 'cn', or the first 'dns', 'email' or 'uri' SAN. Enables /certAuth, which issues tokens to the clients of certificates verified against --client-cert-login-ca-file or --client-ca-file")
+	RootCmd.Flags().StringVar(&config.ClientCertLoginFilter, "client-cert-login-filter", "", "LDAP filter finding the machine account of a client certificate on /certAuth, e.g. '(&(objectClass=computer)(dNSHostName={name}))'. {name} is replaced with the certificate's name. Required with --client-cert-login-name")
+	RootCmd.Flags().StringVar(&config.ClientCertLoginCAFile, "client-cert-login-ca-file", "", "File containing the CA certificates of the client certificates accepted on /certAuth. If set, only they are accepted there, and only --client-ca-file elsewhere. Defaults to --client-ca-file")
+
+	RootCmd.Flags().StringVar(&config.RobotStoreFile, "robot-store-file", "", "File recording the robot tokens issued by admins. Enables /robots and robot tokens, which Kubernetes sees as robot:<name>. Replicas may share it with --watch-files")
+	RootCmd.Flags().StringSliceVar(&config.RobotAdminNames, "robot-admin-names", nil, "Subject CNs or SANs of the client certificates allowed to create, list and revoke robot tokens on /robots")
+	RootCmd.Flags().DurationVar(&config.RobotMaxTTL, "robot-max-ttl", 365*24*time.Hour, "Maximum lifetime of robot tokens, 0 for no limit")
+
+	RootCmd.Flags().BoolVar(&config.WatchFiles, "watch-files", true, "Reload the serving certificate and the signing keypair when their files change")
+
+	RootCmd.Flags().StringVar(&config.AdminAddress, "admin-address", "", "Address of a separate plain HTTP listener for /metrics, /health, /livez, /readyz and /debug/pprof (e.g. 127.0.0.1:9090). If empty, all but /debug/pprof are served on --port")
+	RootCmd.Flags().DurationVar(&config.ShutdownDelay, "shutdown-delay", 5*time.Second, "Time to keep serving after failing /readyz on SIGTERM, so load balancers stop sending new requests")
+	RootCmd.Flags().DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests to finish on SIGTERM")
+
+	RootCmd.Flags().DurationVar(&config.ReadinessLDAPInterval, "readiness-ldap-interval", 30*time.Second, "Minimum interval between LDAP connectivity checks of /readyz. Results are cached in between")
+	RootCmd.Flags().DurationVar(&config.ReadinessCertMinValidity, "readiness-cert-min-validity", 0, "Report not ready if the serving certificate expires within this duration")
+
+	RootCmd.Flags().StringVar(&config.OTLPEndpoint, "otlp-endpoint", "", "Base URL of the OpenTelemetry collector receiving traces via OTLP/HTTP (e.g. http://otel-collector:4318). Enables tracing.")
+	RootCmd.Flags().StringToStringVar(&config.OTLPHeaders, "otlp-headers", nil, "Headers sent with every OTLP export request, e.g. for authentication")
+	RootCmd.Flags().Float64Var(&config.TracingSampleRatio, "tracing-sample-ratio", 1, "Ratio of traces to sample. Traces continued from a traceparent header are only sampled if the caller sampled them, and then at this ratio")
+	RootCmd.Flags().StringVar(&config.TracingServiceName, "tracing-service-name", "kubernetes-ldap", "service.name resource attribute of exported spans")
 
 	viper.BindPFlags(RootCmd.Flags())
+	viper.BindPFlag("keypair-dir", RootCmd.PersistentFlags().Lookup("keypair-dir"))
 	flag.CommandLine.Parse([]string{})
 }
 
@@ -144,127 +224,378 @@ func initConfig() {
 		viper.SetConfigName(".kubernetes-ldap")
 	}
 
-	// If a config file is found, read it in.
+	bindEnv()
+
+	// If a config file is found, read it in. An explicit --config must
+	// be readable.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		fmt.Fprintf(os.Stderr, "kubernetes-ldap: error reading config file %s: %v\n", cfgFile, err)
+		os.Exit(1)
 	}
 }
 
+// validate loads the configuration and exits if it is invalid.
 func validate() {
-	ldapHost = viper.GetString("ldap-host")
-	ldapPort = cast.ToUint(viper.Get("ldap-port"))
+	config = *mustLoadConfig()
+}
+
+// addTLSFlags adds the flags for the TLS versions, cipher suites and
+// curves, prefixed with prefix.
+func addTLSFlags(prefix string, minVersion, maxVersion *string, cipherSuites, curvePreferences *[]string) {
+	RootCmd.Flags().StringVar(minVersion, prefix+"tls-min-version", tlsconfig.DefaultMinVersion, "Minimum TLS version (VersionTLS10, VersionTLS11, VersionTLS12 or VersionTLS13)")
+	RootCmd.Flags().StringVar(maxVersion, prefix+"tls-max-version", "", "Maximum TLS version. Defaults to the highest supported version")
+	RootCmd.Flags().StringSliceVar(cipherSuites, prefix+"tls-cipher-suites", nil, "Comma-separated list of TLS 1.2 cipher suites (IANA names). Defaults to the Go defaults")
+	RootCmd.Flags().StringSliceVar(curvePreferences, prefix+"tls-curve-preferences", nil, "Comma-separated list of elliptic curves in order of preference (X25519, P256, P384, P521)")
+}
+
+func serve() error {
+	if config.GenKeypair {
+		if err := token.GenerateKeypair(config.KeypairDir); err != nil {
+			glog.Errorf("Error generating key pair: %v", err)
+			os.Exit(1)
+		}
+	}
 
-	ldapBaseDn = viper.GetString("ldap-base-dn")
-	ldapUserAttribute = viper.GetString("ldap-user-attribute")
+	if !token.KeypairExists(config.KeypairDir) {
+		glog.Errorf("keypair not found in dir %q", config.KeypairDir)
+		os.Exit(1)
+	}
 
-	ldapSearchUserPassword = viper.GetString("ldap-search-user-password")
-	ldapSearchUserDn = viper.GetString("ldap-search-user-dn")
+	// the keyring signs and verifies tokens, and is reloaded on key rotation
+	keyring, err := token.NewKeyring(config.KeypairDir)
+	if err != nil {
+		glog.Errorf("Error loading token keypair: %v", err)
+	}
 
-	serverTlsPrivateKeyFile = viper.GetString("tls-private-key-file")
-	serverTlsCertFile = viper.GetString("tls-cert-file")
+	servingCert, err := reload.NewCertificate(config.TLSCertFile, config.TLSPrivateKeyFile)
+	if err != nil {
+		glog.Errorf("Error loading serving certificate: %v", err)
+		os.Exit(1)
+	}
 
-	ldapUseInsecure = viper.GetBool("use-insecure")
-	ldapSkipTlsVerification = viper.GetBool("ldap-skip-tls-verification")
+	// stop is closed on shutdown to end background work
+	stop := make(chan struct{})
+	defer close(stop)
 
-	tokenTtl = viper.GetDuration("token-ttl")
-	serverPort = cast.ToUint(viper.Get("port"))
+	var watcher *reload.Watcher
+	if config.WatchFiles {
+		watcher, err = reload.NewWatcher()
+		if err != nil {
+			glog.Errorf("Error watching files: %v", err)
+			os.Exit(1)
+		}
+		go watcher.Run(stop)
+	}
 
-	requireFlag("--ldap-host", ldapHost)
-	requireFlag("--ldap-base-dn", ldapBaseDn)
+	// watch reloads target when one of its files changes
+	watch := func(target string, reload func() error, files ...string) {
+		if watcher == nil {
+			return
+		}
+		if err := watcher.Add(target, reload, files...); err != nil {
+			glog.Errorf("Error watching files of %s: %v", target, err)
+			os.Exit(1)
+		}
+	}
 
-	requireFlag("--tls-cert-file", serverTlsCertFile)
-	if _, err := os.Stat(serverTlsCertFile); os.IsNotExist(err) {
+	watch("serving_cert", servingCert.Reload, servingCert.Files()...)
+	watch("signing_keys", keyring.Reload, keyring.Files()...)
 
-		fmt.Fprintf(os.Stderr, "file %s does not exist\n", serverTlsCertFile)
+	directories := config.directories()
+	authenticator, router, err := newAuthenticator(directories, watch)
+	if err != nil {
+		glog.Errorf("Error configuring authentication: %v", err)
 		os.Exit(1)
 	}
-
-	requireFlag("--tls-private-key", serverTlsPrivateKeyFile)
-	if _, err := os.Stat(serverTlsPrivateKeyFile); os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "file %s does not exist\n", serverTlsPrivateKeyFile)
+	kerberosAuthenticator, err := newKerberosAuthenticator(router, watch)
+	if err != nil {
+		glog.Errorf("Error configuring Kerberos: %v", err)
 		os.Exit(1)
 	}
-}
+	robots, err := newRobotStore(watch)
+	if err != nil {
+		glog.Errorf("Error opening robot store: %v", err)
+		os.Exit(1)
+	}
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Port)}
+
+	if config.OTLPEndpoint != "" {
+		exporter := tracing.NewOTLPExporter(config.OTLPEndpoint, config.TracingServiceName, config.OTLPHeaders)
+		defer exporter.Shutdown(context.Background())
+		tracing.SetTracer(tracing.NewTracer(exporter, config.TracingSampleRatio))
+	}
+
+	auditLogger := newAuditLogger()
+	defer auditLogger.Close()
 
-func requireFlag(flagName string, flagValue string) {
-	if flagValue == "" {
-		fmt.Fprintf(os.Stderr, "kubernetes-ldap: %s is required. \nUse -h flag for help.\n", flagName)
+	readiness := &health.Handler{}
+	for i, route := range router.Routes {
+		readiness.Add(directoryTarget("ldap", directories[i]), health.Cached(route.Client.Ping, config.ReadinessLDAPInterval))
+	}
+	readiness.Add("signing_keys", health.SigningCheck(keyring, keyring))
+	readiness.Add("serving_cert", health.CertificateCheck(servingCert.GetCertificate, config.ReadinessCertMinValidity))
+
+	server.Handler, err = newHandler(keyring, authenticator, router, kerberosAuthenticator, robots, auditLogger, readiness)
+	if err != nil {
+		glog.Errorf("Error configuring endpoints: %v", err)
 		os.Exit(1)
 	}
-}
 
-func serve() error {
-	if genKeypair {
-		if err := token.GenerateKeypair(keypairDir); err != nil {
-			glog.Errorf("Error generating key pair: %v", err)
+	var adminServer *http.Server
+	if config.AdminAddress != "" {
+		adminServer = &http.Server{Addr: config.AdminAddress, Handler: newAdminMux(readiness)}
+	}
+
+	server.TLSConfig = &tls.Config{
+		GetCertificate: servingCert.GetCertificate,
+	}
+	config.serverTLSOptions().Apply(server.TLSConfig)
+
+	if !config.HTTP2 {
+		// a non-nil map keeps net/http from enabling HTTP/2
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	if config.ClientCAFile != "" || config.ClientCertLoginCAFile != "" {
+		clientCAs, err := loadCertPool(nonEmpty(config.ClientCAFile, config.ClientCertLoginCAFile)...)
+		if err != nil {
+			glog.Errorf("Error loading client CAs: %v", err)
 			os.Exit(1)
 		}
+
+		// Client certificates are optional on the TLS level so that end users
+		// can reach /ldapAuth. They are enforced per endpoint.
+		server.TLSConfig.ClientCAs = clientCAs
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 
-	if !token.KeypairExists(keypairDir) {
-		glog.Errorf("keypair not found in dir %q", keypairDir)
-		os.Exit(1)
+	serverErrors := make(chan error, 2)
+	go func() {
+		glog.Infof("Serving on %s", server.Addr)
+		// the certificate is served by servingCert.GetCertificate
+		serverErrors <- server.ListenAndServeTLS("", "")
+	}()
+	if adminServer != nil {
+		go func() {
+			glog.Infof("Serving admin endpoints on %s", adminServer.Addr)
+			serverErrors <- adminServer.ListenAndServe()
+		}()
 	}
 
-	var err error
-	tokenSigner, err := token.NewSigner(keypairDir)
-	if err != nil {
-		glog.Errorf("Error creating token issuer: %v", err)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-serverErrors:
+		glog.Fatal(err)
+	case sig := <-signals:
+		glog.Infof("Received %s, draining requests for up to %s", sig, config.ShutdownTimeout)
 	}
 
-	tokenVerifier, err := token.NewVerifier(keypairDir)
-	if err != nil {
-		glog.Errorf("Error creating token verifier: %v", err)
+	readiness.Shutdown()
+
+	// Give load balancers and endpoint controllers time to observe the failing
+	// /readyz before the listeners close.
+	time.Sleep(config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		glog.Errorf("Error shutting down server: %v", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			glog.Errorf("Error shutting down admin server: %v", err)
+		}
 	}
 
-	ldapTLSConfig := &tls.Config{
-		ServerName:         ldapHost,
-		InsecureSkipVerify: ldapSkipTlsVerification,
+	glog.Info("Shut down")
+	glog.Flush()
+	return nil
+}
+
+// newHandler returns the endpoints served on --port. Tokens are signed
+// and verified with keyring, passwords are changed in the directories of
+// router. Kerberos tickets are accepted if kerberosAuthenticator is set.
+func newHandler(keyring *token.Keyring, authenticator identity.Authenticator, router *ldap.Router, kerberosAuthenticator *kerberos.Authenticator, robots *robot.Store, auditLogger *audit.Logger, readiness http.Handler) (http.Handler, error) {
+	webhook := auth.NewTokenWebhook(keyring)
+	webhook.Audit = auditLogger
+	webhook.Robots = robots
+
+	ldapTokenIssuer := &auth.LDAPTokenIssuer{
+		Authenticator:         authenticator,
+		TokenSigner:           keyring,
+		TTL:                   config.TokenTTL,
+		UsernameAttribute:     config.UsernameAttribute,
+		EnforceClientVersions: config.EnforceClientVersions,
+		MFASecretAttribute:    config.MFASecretAttribute,
+		Kerberos:              kerberosAuthenticator,
+		TrustForwardedFor:     config.LoginTrustForwardedFor,
+		Audit:                 auditLogger,
+		UserLimiter: &ratelimit.Limiter{
+			PerMinute:        config.LoginUserRateLimit,
+			BackoffBase:      config.LoginBackoffBase,
+			BackoffMax:       config.LoginBackoffMax,
+			LockoutThreshold: config.LoginLockoutThreshold,
+			LockoutDuration:  config.LoginLockoutDuration,
+		},
+		IPLimiter: &ratelimit.Limiter{
+			PerMinute:        config.LoginIPRateLimit,
+			LockoutThreshold: config.LoginIPLockoutThreshold,
+			LockoutDuration:  config.LoginLockoutDuration,
+		},
 	}
 
-	ldapClient := &ldap.Client{
-		BaseDN:             ldapBaseDn,
-		LdapServer:         ldapHost,
-		LdapPort:           ldapPort,
-		UseInsecure:        ldapUseInsecure,
-		UserLoginAttribute: ldapUserAttribute,
-		SearchUserDN:       ldapSearchUserDn,
-		SearchUserPassword: ldapSearchUserPassword,
-		TLSConfig:          ldapTLSConfig,
+	mux := http.NewServeMux()
+
+	// handle registers the handler, requiring a client certificate on
+	// the endpoints configured for it
+	clientCertPolicy := &auth.ClientCertPolicy{AllowedNames: config.ClientCertAllowedNames}
+	var clientCAs *x509.CertPool
+	if config.ClientCertLoginCAFile != "" && config.ClientCAFile != "" {
+		// the server verifies the certificates of both CAs, keep the
+		// machines of /certAuth off the other endpoints
+		var err error
+		clientCAs, err = loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCertPolicy.Roots = clientCAs
+	}
+	handle := func(endpoint string, handler http.Handler) {
+		if config.ClientCAFile != "" && contains(config.ClientCertEndpoints, endpoint) {
+			handler = clientCertPolicy.Wrap(endpoint, handler)
+		}
+		mux.Handle(endpoint, handler)
 	}
 
-	server := &http.Server{Addr: fmt.Sprintf(":%d", serverPort)}
+	if config.MFAStoreFile != "" || config.MFASecretAttribute != "" {
+		ldapTokenIssuer.MFA = &mfa.Authenticator{
+			Issuer:         config.MFAIssuer,
+			RequiredGroups: config.MFARequiredGroups,
+		}
 
-	webhook := auth.NewTokenWebhook(tokenVerifier)
+		if config.MFASecretAttribute == "" {
+			var err error
+			ldapTokenIssuer.MFA.Store, err = mfa.NewFileStore(config.MFAStoreFile, config.MFAKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("opening MFA store: %v", err)
+			}
 
-	ldapTokenIssuer := &auth.LDAPTokenIssuer{
-		LDAPAuthenticator:     ldapClient,
-		TokenSigner:           tokenSigner,
-		TTL:                   tokenTtl,
-		UsernameAttribute:     usernameAttribute,
-		EnforceClientVersions: enforceClientVersions,
+			// Endpoints for enrolling a TOTP second factor
+			handle("/mfa/enroll", http.HandlerFunc(ldapTokenIssuer.ServeMFAEnroll))
+			handle("/mfa/confirm", http.HandlerFunc(ldapTokenIssuer.ServeMFAConfirm))
+		}
 	}
 
 	// Endpoint for authenticating with token
-	http.Handle("/authenticate", webhook)
+	handle("/authenticate", webhook)
 
 	// Endpoint for token issuance after LDAP auth
-	http.Handle("/ldapAuth", ldapTokenIssuer)
-	//for prometheus metrics
-	http.Handle("/metrics", promhttp.Handler())
+	handle("/ldapAuth", ldapTokenIssuer)
+
+	// Endpoint for token issuance to the clients of certificates
+	if config.ClientCertLoginName != "" {
+		ldapTokenIssuer.CertLookup = &ldap.FilterLookup{Router: router, Filter: config.ClientCertLoginFilter}
+		ldapTokenIssuer.CertName = config.ClientCertLoginName
+		if config.ClientCertLoginCAFile != "" {
+			certRoots, err := loadCertPool(config.ClientCertLoginCAFile)
+			if err != nil {
+				return nil, err
+			}
+			ldapTokenIssuer.CertRoots = certRoots
+		}
+		handle(auth.CertAuthPath, http.HandlerFunc(ldapTokenIssuer.ServeCertAuth))
+	}
 
-	//health
-	http.Handle("/health", &healthHandler{})
+	// Endpoints for admins managing robot tokens, always requiring an
+	// admin's client certificate
+	if robots != nil {
+		robotAdmin := &auth.RobotAdmin{
+			Store:       robots,
+			TokenSigner: keyring,
+			MaxTTL:      config.RobotMaxTTL,
+			Audit:       auditLogger,
+		}
+		adminPolicy := &auth.ClientCertPolicy{AllowedNames: config.RobotAdminNames, Roots: clientCAs}
+		mux.Handle(auth.RobotsPath, adminPolicy.Wrap(auth.RobotsPath, robotAdmin))
+		mux.Handle(auth.RobotsPath+"/", adminPolicy.Wrap(auth.RobotsPath, robotAdmin))
+	}
 
-	glog.Infof("Serving on %s", fmt.Sprintf(":%d", serverPort))
+	// Endpoint for changing expired passwords, if a directory allows it
+	for _, route := range router.Routes {
+		if route.Client.PasswordChange != "" {
+			ldapTokenIssuer.PasswordChanger = router
+			handle(auth.ChangePasswordPath, http.HandlerFunc(ldapTokenIssuer.ServeChangePassword))
+			break
+		}
+	}
 
-	server.TLSConfig = &tls.Config{
-		// Change default from SSLv3 to TLSv1.0 (because of POODLE vulnerability)
-		MinVersion: tls.VersionTLS10,
+	// without an admin listener its endpoints are served here
+	if config.AdminAddress == "" {
+		//for prometheus metrics
+		handle("/metrics", promhttp.Handler())
+
+		//health
+		handle("/health", &healthHandler{})
+		handle("/livez", &healthHandler{})
+		handle("/readyz", readiness)
 	}
+	return mux, nil
+}
 
-	glog.Fatal(server.ListenAndServeTLS(serverTlsCertFile, serverTlsPrivateKeyFile))
-	return nil
+func newAuditLogger() *audit.Logger {
+	switch config.AuditLog {
+	case "":
+		return nil
+	case "-":
+		return audit.NewLogger(os.Stdout)
+	}
+
+	return audit.NewLogger(&audit.RotatingFile{
+		Filename:   config.AuditLog,
+		MaxSize:    config.AuditLogMaxSize * 1024 * 1024,
+		MaxBackups: config.AuditLogMaxBackups,
+	})
+}
+
+func loadCertPool(filenames ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, filename := range filenames {
+		pem, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", filename)
+		}
+	}
+	return pool, nil
+}
+
+// nonEmpty returns the non-empty strings of list.
+func nonEmpty(list ...string) []string {
+	var result []string
+	for _, s := range list {
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 type healthHandler struct{}
@@ -273,3 +604,19 @@ func (t *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "OK")
 }
+
+// newAdminMux returns the handlers of the admin listener.
+func newAdminMux(readiness http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/health", &healthHandler{})
+	mux.Handle("/livez", &healthHandler{})
+	mux.Handle("/readyz", readiness)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
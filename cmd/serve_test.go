@@ -0,0 +1,534 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/auth"
+	"github.com/proofpoint/kubernetes-ldap/client"
+	"github.com/proofpoint/kubernetes-ldap/kerberostest"
+	"github.com/proofpoint/kubernetes-ldap/ldaptest"
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+const testLDIF = `
+dn: dc=example,dc=com
+objectClass: domain
+
+dn: uid=svc,dc=example,dc=com
+uid: svc
+userPassword: svc-pw
+
+dn: uid=alice,dc=example,dc=com
+objectClass: person
+uid: alice
+userPassword: alice-pw
+
+dn: cn=admins,dc=example,dc=com
+member: uid=alice,dc=example,dc=com
+
+dn: cn=developers,dc=example,dc=com
+member: uid=alice,dc=example,dc=com
+`
+
+// testServer is the handler stack of the serve command in-process,
+// authenticating against an in-memory directory.
+type testServer struct {
+	*httptest.Server
+	directory *ldaptest.Server
+	keyring   *token.Keyring
+}
+
+// newTestServer configures the serve command against a fresh directory
+// and keypair. modify adjusts the configuration before the handlers are
+// built.
+func newTestServer(t *testing.T, modify func(*Config)) *testServer {
+	directory := ldaptest.NewUnstartedServer()
+	if err := directory.LoadLDIF(strings.NewReader(testLDIF)); err != nil {
+		t.Fatal(err)
+	}
+	directory.MemberOf = true
+
+	keyring := newTestKeyring(t)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = Config{
+		LDAPHost:               directory.Host(),
+		LDAPPort:               directory.Port(),
+		UseInsecure:            true,
+		LDAPBaseDN:             "dc=example,dc=com",
+		LDAPUserAttribute:      "uid",
+		LDAPSearchUserDN:       "uid=svc,dc=example,dc=com",
+		LDAPSearchUserPassword: "svc-pw",
+		UsernameAttribute:      "uid",
+		TokenTTL:               time.Hour,
+	}
+	if modify != nil {
+		modify(&config)
+	}
+	if config.UseInsecure {
+		directory.Start()
+	} else {
+		config.LDAPCAFile = writeCA(t, directory.CACertificate())
+		directory.StartTLS()
+	}
+
+	watch := func(string, func() error, ...string) {}
+	authenticator, router, err := newAuthenticator(config.directories(), watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kerberosAuthenticator, err := newKerberosAuthenticator(router, watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	robots, err := newRobotStore(watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := newHandler(keyring, authenticator, router, kerberosAuthenticator, robots, nil, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		Server:    httptest.NewServer(handler),
+		directory: directory,
+		keyring:   keyring,
+	}
+	t.Cleanup(s.Close)
+	t.Cleanup(directory.Close)
+	return s
+}
+
+// writeCA writes cert to a temporary PEM file and returns its path.
+func writeCA(t *testing.T, cert *x509.Certificate) string {
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func newTestKeyring(t *testing.T) *token.Keyring {
+	dir, err := ioutil.TempDir("", "keypair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if err := token.GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := token.NewKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// login requests a token from /ldapAuth.
+func (s *testServer) login(t *testing.T, user, password string, header http.Header) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/ldapAuth", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(user, password)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// review sends a TokenReview of apiVersion to /authenticate.
+func (s *testServer) review(t *testing.T, apiVersion, signed string) (int, *auth.TokenReviewRequest) {
+	body, err := json.Marshal(&auth.TokenReviewRequest{
+		Kind:       "TokenReview",
+		APIVersion: apiVersion,
+		Spec:       auth.TokenReviewSpec{Token: signed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(s.URL+"/authenticate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	review := &auth.TokenReviewRequest{}
+	if err := json.NewDecoder(resp.Body).Decode(review); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, review
+}
+
+func TestEndToEnd(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	code, signed := s.login(t, "alice", "alice-pw", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %d: %s", code, signed)
+	}
+
+	for _, apiVersion := range []string{"authentication.k8s.io/v1beta1", "authentication.k8s.io/v1"} {
+		code, review := s.review(t, apiVersion, signed)
+		if code != http.StatusOK {
+			t.Fatalf("%s: expected token to be accepted, got %d", apiVersion, code)
+		}
+		if review.APIVersion != apiVersion || review.Kind != "TokenReview" {
+			t.Errorf("%s: unexpected response %s %s", apiVersion, review.APIVersion, review.Kind)
+		}
+		if !review.Status.Authenticated {
+			t.Errorf("%s: expected authenticated status", apiVersion)
+		}
+		if review.Status.User.Username != "alice" {
+			t.Errorf("%s: unexpected username %q", apiVersion, review.Status.User.Username)
+		}
+		if groups := strings.Join(review.Status.User.Groups, ","); groups != "admins,developers" {
+			t.Errorf("%s: unexpected groups %s", apiVersion, groups)
+		}
+	}
+}
+
+func TestEndToEndJSON(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	code, body := s.login(t, "alice", "alice-pw", http.Header{"Accept": {"application/json"}})
+	if code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %d: %s", code, body)
+	}
+	var issued struct {
+		Token               string `json:"token"`
+		ExpirationTimestamp int64  `json:"expirationTimestamp"`
+	}
+	if err := json.Unmarshal([]byte(body), &issued); err != nil {
+		t.Fatal(err)
+	}
+
+	expiration := time.Unix(0, issued.ExpirationTimestamp*int64(time.Millisecond))
+	if d := time.Until(expiration); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("Expected the token to expire in an hour, got %v", d)
+	}
+	if code, _ := s.review(t, "authentication.k8s.io/v1", issued.Token); code != http.StatusOK {
+		t.Errorf("Expected token to be accepted, got %d", code)
+	}
+}
+
+func TestEndToEndRejected(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	if code, _ := s.login(t, "alice", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong password to be rejected, got %d", code)
+	}
+	if code, _ := s.login(t, "mallory", "alice-pw", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected unknown user to be rejected, got %d", code)
+	}
+
+	code, signed := s.login(t, "alice", "alice-pw", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %d: %s", code, signed)
+	}
+
+	// flip a character of the signature
+	parts := strings.Split(signed, ".")
+	sig := []byte(parts[len(parts)-1])
+	if sig[0] == 'A' {
+		sig[0] = 'B'
+	} else {
+		sig[0] = 'A'
+	}
+	parts[len(parts)-1] = string(sig)
+
+	otherKeyring := newTestKeyring(t)
+	otherSigned, err := otherKeyring.Sign(&token.AuthToken{
+		Username:   "alice",
+		Groups:     []string{"admins"},
+		Expiration: time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredSigned, err := s.keyring.Sign(&token.AuthToken{
+		Username:   "alice",
+		Groups:     []string{"admins"},
+		Expiration: time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, signed := range map[string]string{
+		"tampered":  strings.Join(parts, "."),
+		"wrong key": otherSigned,
+		"expired":   expiredSigned,
+		"garbage":   "not-a-token",
+	} {
+		if code, _ := s.review(t, "authentication.k8s.io/v1", signed); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected token to be rejected, got %d", name, code)
+		}
+	}
+}
+
+func TestEndToEndClientVersions(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.EnforceClientVersions = true
+	})
+
+	cases := []struct {
+		pluginVersion  string
+		kubectlVersion string
+		expectedCode   int
+	}{
+		{"", "", http.StatusBadRequest},
+		{client.MinimumPluginVersion, "", http.StatusBadRequest},
+		{"1.0", client.MinimumKubectlVersion, http.StatusBadRequest},
+		{client.MinimumPluginVersion, "1.10.0", http.StatusBadRequest},
+		{client.MinimumPluginVersion, client.MinimumKubectlVersion, http.StatusOK},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		if c.pluginVersion != "" {
+			header.Set("x-pfpt-k8sldapctl-version", c.pluginVersion)
+		}
+		if c.kubectlVersion != "" {
+			header.Set("x-pfpt-kubectl-version", c.kubectlVersion)
+		}
+		if code, body := s.login(t, "alice", "alice-pw", header); code != c.expectedCode {
+			t.Errorf("plugin %q kubectl %q: expected %d, got %d: %s", c.pluginVersion, c.kubectlVersion, c.expectedCode, code, body)
+		}
+	}
+}
+
+func TestEndToEndChangePassword(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.UseInsecure = false
+		c.LDAPPasswordChange = "rfc3062"
+	})
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+auth.ChangePasswordPath, strings.NewReader(`{"newPassword":"new-secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "alice-pw")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the password change to succeed, got %d", resp.StatusCode)
+	}
+
+	if code, _ := s.login(t, "alice", "alice-pw", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected the old password to be rejected, got %d", code)
+	}
+	if code, body := s.login(t, "alice", "new-secret", nil); code != http.StatusOK {
+		t.Errorf("Expected the new password to be accepted, got %d: %s", code, body)
+	}
+}
+
+func TestEndToEndKerberos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keytab := filepath.Join(dir, "krb5.keytab")
+
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	if err := kdc.WriteKeytab("HTTP/auth.example.com", keytab); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(c *Config) {
+		c.KerberosKeytab = keytab
+		c.KerberosStripRealm = true
+	})
+
+	cases := []struct {
+		client       string
+		expectedCode int
+	}{
+		{"alice", http.StatusOK},
+		{"mallory", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		negotiate, err := kdc.Negotiate(c.client, "HTTP/auth.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/ldapAuth", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", negotiate)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.expectedCode {
+			t.Fatalf("%s: expected %d, got %d: %s", c.client, c.expectedCode, resp.StatusCode, body)
+		}
+		if c.expectedCode != http.StatusOK {
+			continue
+		}
+
+		code, review := s.review(t, "authentication.k8s.io/v1", string(body))
+		if code != http.StatusOK || !review.Status.Authenticated {
+			t.Fatalf("%s: expected token to be accepted, got %d", c.client, code)
+		}
+		if review.Status.User.Username != "alice" {
+			t.Errorf("%s: unexpected username %q", c.client, review.Status.User.Username)
+		}
+		if groups := strings.Join(review.Status.User.Groups, ","); groups != "admins,developers" {
+			t.Errorf("%s: unexpected groups %s", c.client, groups)
+		}
+	}
+}
+
+func TestEndToEndCertAuth(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ClientCertLoginName = auth.CertNameDNS
+		c.ClientCertLoginFilter = "(&(objectClass=person)(uid={name}))"
+	})
+
+	cases := []struct {
+		name         string
+		cert         *x509.Certificate
+		expectedCode int
+	}{
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"known", &x509.Certificate{DNSNames: []string{"alice"}}, http.StatusOK},
+		{"unknown", &x509.Certificate{DNSNames: []string{"svc"}}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		// the handler is called directly, as httptest can't verify client
+		// certificates against the configured CAs
+		req := httptest.NewRequest(http.MethodGet, auth.CertAuthPath, nil)
+		if c.cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{c.cert}}}
+		}
+		rec := httptest.NewRecorder()
+		s.Config.Handler.ServeHTTP(rec, req)
+		if rec.Code != c.expectedCode {
+			t.Fatalf("%s: expected %d, got %d: %s", c.name, c.expectedCode, rec.Code, rec.Body.String())
+		}
+		if c.expectedCode != http.StatusOK {
+			continue
+		}
+
+		code, review := s.review(t, "authentication.k8s.io/v1", rec.Body.String())
+		if code != http.StatusOK || !review.Status.Authenticated {
+			t.Fatalf("%s: expected token to be accepted, got %d", c.name, code)
+		}
+		if review.Status.User.Username != "alice" {
+			t.Errorf("%s: unexpected username %q", c.name, review.Status.User.Username)
+		}
+		if groups := strings.Join(review.Status.User.Groups, ","); groups != "admins,developers" {
+			t.Errorf("%s: unexpected groups %s", c.name, groups)
+		}
+	}
+}
+
+func TestEndToEndRobots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(t, func(c *Config) {
+		c.RobotStoreFile = filepath.Join(dir, "robots.json")
+		c.RobotAdminNames = []string{"admin"}
+	})
+
+	// the handler is called directly, as httptest can't verify client
+	// certificates against the configured CAs
+	serve := func(method, path, body, cn string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rec := httptest.NewRecorder()
+		s.Config.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := `{"name": "ci-deployer", "groups": ["deployers"], "ttl": "720h"}`
+	if rec := serve(http.MethodPost, auth.RobotsPath, body, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without certificate, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if rec := serve(http.MethodPost, auth.RobotsPath, body, "alice"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected %d for a non-admin, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec := serve(http.MethodPost, auth.RobotsPath, body, "admin")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	created := &auth.RobotResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if created.CreatedBy != "admin" {
+		t.Errorf("Expected the robot to be created by admin, got %q", created.CreatedBy)
+	}
+
+	code, review := s.review(t, "authentication.k8s.io/v1", created.Token)
+	if code != http.StatusOK || !review.Status.Authenticated {
+		t.Fatalf("Expected robot token to be accepted, got %d", code)
+	}
+	if user := review.Status.User; user.Username != "robot:ci-deployer" || strings.Join(user.Groups, ",") != "deployers" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	rec = serve(http.MethodGet, auth.RobotsPath, "", "admin")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), created.TokenID) {
+		t.Errorf("Expected the robot to be listed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := serve(http.MethodDelete, auth.RobotsPath+"/"+created.TokenID, "", "admin"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if code, _ := s.review(t, "authentication.k8s.io/v1", created.Token); code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked robot token to be rejected, got %d", code)
+	}
+}
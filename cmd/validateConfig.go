@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// validateConfigCmd represents the validate-config command
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "validate the configuration and exit",
+	Long: `validate-config checks the config file and flags like the server does on
+startup: unknown keys, ports, durations and TLS options, and that the
+certificates, keys, keypair and users files it refers to can be read.
+It exits non-zero on errors, e.g. to check a config in CI before deploying it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mustLoadConfig()
+		fmt.Println("Configuration is valid")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(validateConfigCmd)
+
+	// accept the flags of the server, so that its command line can be
+	// checked along with the config file
+	validateConfigCmd.Flags().AddFlagSet(RootCmd.Flags())
+}
@@ -0,0 +1,68 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+// probeUsername is the username of the tokens signed by SigningCheck.
+const probeUsername = "kubernetes-ldap:readiness-check"
+
+// SigningCheck signs a short-lived token and verifies it again, which
+// fails if the keypair wasn't loaded or the keys don't match.
+func SigningCheck(signer token.Signer, verifier token.Verifier) Check {
+	return func(ctx context.Context) error {
+		signed, err := signer.Sign(&token.AuthToken{
+			Username:   probeUsername,
+			Expiration: time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			return fmt.Errorf("signing token: %v", err)
+		}
+
+		verified, err := verifier.Verify(signed)
+		if err != nil {
+			return fmt.Errorf("verifying token: %v", err)
+		}
+		if verified.Username != probeUsername {
+			return errors.New("verified token does not match the signed token")
+		}
+		return nil
+	}
+}
+
+// CertificateCheck fails if the certificate returned by getCertificate
+// expires within minValidity or is not valid yet.
+func CertificateCheck(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), minValidity time.Duration) Check {
+	return func(ctx context.Context) error {
+		cert, err := getCertificate(nil)
+		if err != nil {
+			return err
+		}
+		if cert == nil || len(cert.Certificate) == 0 {
+			return errors.New("no certificate loaded")
+		}
+
+		leaf := cert.Leaf
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		switch {
+		case now.Before(leaf.NotBefore):
+			return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+		case now.Add(minValidity).After(leaf.NotAfter):
+			return fmt.Errorf("certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
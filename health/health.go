@@ -0,0 +1,218 @@
+// Package health implements the readiness endpoint, which runs a set of
+// named checks (directory reachable, tokens can be signed, certificate
+// valid) and reports each of them as JSON.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTimeout bounds the time a readiness request waits for its checks.
+const DefaultTimeout = 5 * time.Second
+
+// Status values of checks and of the overall result
+const (
+	StatusOK           = "ok"
+	StatusFailed       = "failed"
+	StatusShuttingDown = "shutting_down"
+)
+
+var (
+	checkSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kubernetes_ldap_readiness_check_success",
+			Help: "Whether the last run of a readiness check succeeded (1) or failed (0), by check.",
+		},
+		[]string{"check"},
+	)
+)
+
+// RegisterHealthMetrics registers the metrics for readiness checks
+func RegisterHealthMetrics() {
+	prometheus.MustRegister(checkSuccess)
+}
+
+// Check returns nil if the checked dependency is usable.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Duration  float64   `json:"durationSeconds"`
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Handler serves the readiness report. It answers 503 if a check fails
+// or once Shutdown was called, so that no new requests are routed to a
+// broken or draining instance.
+type Handler struct {
+	// Timeout bounds the time spent running the checks. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	checks       []namedCheck
+	shuttingDown int32
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Add registers a check. It must not be called while serving.
+func (h *Handler) Add(name string, check Check) {
+	h.checks = append(h.checks, namedCheck{name, check})
+}
+
+// Shutdown makes the handler report not ready from now on.
+func (h *Handler) Shutdown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+// Run runs all checks concurrently and returns their report.
+func (h *Handler) Run(ctx context.Context) *Report {
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		return &Report{Status: StatusShuttingDown}
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	report := &Report{Status: StatusOK, Checks: make([]Result, len(h.checks))}
+
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			report.Checks[i] = run(ctx, c.name, c.check)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusFailed
+		}
+	}
+	return report
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Run(r.Context())
+
+	jsondata, err := json.Marshal(report)
+	if err != nil {
+		glog.Errorf("Error marshalling json %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsondata)
+}
+
+func run(ctx context.Context, name string, check Check) Result {
+	start := time.Now()
+	result := Result{Name: name, Status: StatusOK, CheckedAt: start}
+
+	errc := make(chan error, 1)
+	go func() { errc <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result.Duration = time.Since(start).Seconds()
+
+	if err != nil {
+		glog.Warningf("Readiness check %s failed: %v", name, err)
+		result.Status = StatusFailed
+		result.Error = err.Error()
+		checkSuccess.WithLabelValues(name).Set(0)
+	} else {
+		checkSuccess.WithLabelValues(name).Set(1)
+	}
+	return result
+}
+
+// Cached returns a check which runs check at most once per interval and
+// otherwise returns the last result, so that frequent probes from several
+// kubelets and load balancers don't turn into load on the dependency.
+// Only one run is in flight at a time; concurrent callers get the last
+// result instead of waiting for it, unless there is none yet.
+func Cached(check Check, interval time.Duration) Check {
+	c := &cachedCheck{check: check, interval: interval}
+	return c.run
+}
+
+type cachedCheck struct {
+	check    Check
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+	running chan struct{}
+}
+
+func (c *cachedCheck) run(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.interval {
+		defer c.mu.Unlock()
+		return c.err
+	}
+	if running := c.running; running != nil {
+		if !c.checked.IsZero() {
+			defer c.mu.Unlock()
+			return c.err
+		}
+		c.mu.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	}
+	running := make(chan struct{})
+	c.running = running
+	c.mu.Unlock()
+
+	err := c.check(ctx)
+
+	c.mu.Lock()
+	c.err = err
+	c.checked = time.Now()
+	c.running = nil
+	close(running)
+	c.mu.Unlock()
+	return err
+}
@@ -0,0 +1,197 @@
+package health
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+func serve(t *testing.T, h *Handler) (int, *Report) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	report := &Report{}
+	if err := json.Unmarshal(rec.Body.Bytes(), report); err != nil {
+		t.Fatalf("Unexpected error decoding %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, report
+}
+
+func TestHandler(t *testing.T) {
+	var ldapErr error
+	h := &Handler{}
+	h.Add("ldap", func(context.Context) error { return ldapErr })
+	h.Add("signing_keys", func(context.Context) error { return nil })
+
+	code, report := serve(t, h)
+	if code != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("Expected ready, got %d %+v", code, report)
+	}
+	if len(report.Checks) != 2 || report.Checks[0].Name != "ldap" || report.Checks[1].Status != StatusOK {
+		t.Errorf("Unexpected checks %+v", report.Checks)
+	}
+
+	ldapErr = errors.New("connection refused")
+	code, report = serve(t, h)
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailed {
+		t.Errorf("Expected not ready, got %d %+v", code, report)
+	}
+	if report.Checks[0].Status != StatusFailed || report.Checks[0].Error != "connection refused" {
+		t.Errorf("Expected the ldap check to fail, got %+v", report.Checks[0])
+	}
+
+	h.Shutdown()
+	code, report = serve(t, h)
+	if code != http.StatusServiceUnavailable || report.Status != StatusShuttingDown {
+		t.Errorf("Expected shutting down, got %d %+v", code, report)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	h := &Handler{Timeout: 10 * time.Millisecond}
+	h.Add("slow", func(context.Context) error {
+		<-block
+		return nil
+	})
+
+	code, report := serve(t, h)
+	if code != http.StatusServiceUnavailable || report.Checks[0].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the slow check to time out, got %d %+v", code, report)
+	}
+}
+
+func TestCached(t *testing.T) {
+	calls := 0
+	check := Cached(func(context.Context) error {
+		calls++
+		return errors.New("unreachable")
+	}, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Errorf("Expected the cached error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected one call within the interval, got %d", calls)
+	}
+}
+
+func TestCachedDoesNotBlockOnRunningCheck(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	check := Cached(func(context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("unreachable")
+		}
+		<-release
+		return nil
+	}, time.Nanosecond)
+
+	if err := check(context.Background()); err == nil {
+		t.Fatal("Expected the first run to fail")
+	}
+	time.Sleep(time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- check(context.Background()) }()
+	for atomic.LoadInt32(&calls) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The second run is blocked; further callers get the last result.
+	if err := check(context.Background()); err == nil || err.Error() != "unreachable" {
+		t.Errorf("Expected the last result while a run is in flight, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected a single run in flight, got %d calls", n)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSigningCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring, _ := token.NewKeyring(dir)
+	check := SigningCheck(keyring, keyring)
+	if err := check(context.Background()); err == nil {
+		t.Errorf("Expected an empty keyring to fail the check")
+	}
+
+	if err := token.GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func certificate(t *testing.T, notAfter time.Time) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+}
+
+func TestCertificateCheck(t *testing.T) {
+	tests := []struct {
+		notAfter    time.Time
+		minValidity time.Duration
+		valid       bool
+	}{
+		{time.Now().Add(48 * time.Hour), 0, true},
+		{time.Now().Add(48 * time.Hour), 24 * time.Hour, true},
+		{time.Now().Add(12 * time.Hour), 24 * time.Hour, false},
+		{time.Now().Add(-time.Minute), 0, false},
+	}
+
+	for _, test := range tests {
+		err := CertificateCheck(certificate(t, test.notAfter), test.minValidity)(context.Background())
+		if test.valid && err != nil {
+			t.Errorf("Unexpected error for a certificate valid until %s: %v", test.notAfter, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected an error for a certificate valid until %s with minimum validity %s", test.notAfter, test.minValidity)
+		}
+	}
+}
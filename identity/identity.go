@@ -0,0 +1,98 @@
+// Package identity describes authenticated users independently of the
+// backend which authenticated them, so that tokens can be issued for users
+// of LDAP directories, local users and other backends alike.
+package identity
+
+import "context"
+
+// Identity is an authenticated user.
+type Identity struct {
+	// Username is the name of the user in tokens.
+	Username string
+	// UID identifies the user permanently, e.g. across renames. Optional.
+	UID string
+	// DN is the distinguished name of users of directories. Optional.
+	DN string
+	// Groups are the names of the groups of the user.
+	Groups []string
+	// Attributes holds further attributes of the user by name, e.g. its
+	// TOTP secret.
+	Attributes map[string][]string
+	// Source describes the backend which authenticated the user, nil if
+	// unknown.
+	Source *Source
+}
+
+// Source describes where a user was authenticated.
+type Source struct {
+	// Name is recorded in tokens and audit events.
+	Name string
+	// UsernamePrefix prefixes the usernames of the source in tokens, so
+	// that same-named users of different sources are different subjects
+	// in Kubernetes. Optional.
+	UsernamePrefix string
+	// Server is the server which authenticated the user. Optional.
+	Server string
+	// BreakGlass marks emergency accounts kept outside of the directory,
+	// whose use is audited prominently.
+	BreakGlass bool
+}
+
+// Attribute returns the first value of the attribute name, or "" if the
+// identity has none.
+func (i *Identity) Attribute(name string) string {
+	if values := i.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Account returns the key of the account of the identity, which is the
+// same for every spelling of its username: the source and DN of users of
+// directories, else the username.
+func (i *Identity) Account() string {
+	if i.DN != "" && i.Source != nil {
+		return i.Source.Name + "/" + i.DN
+	}
+	return i.Username
+}
+
+// AccountCheck vets the account a username resolved to before its
+// password is verified, e.g. refusing accounts locked out after too many
+// failed logins. account is the key of Identity.Account.
+type AccountCheck func(account string) error
+
+type accountCheckKey struct{}
+
+// WithAccountCheck returns a context asking authenticators to vet accounts
+// with check.
+func WithAccountCheck(ctx context.Context, check AccountCheck) context.Context {
+	return context.WithValue(ctx, accountCheckKey{}, check)
+}
+
+// CheckAccount vets account with the AccountCheck of ctx, if any.
+// Authenticators which resolve usernames before verifying passwords call
+// it in between, and refuse the login on errors.
+func CheckAccount(ctx context.Context, account string) error {
+	if check, ok := ctx.Value(accountCheckKey{}).(AccountCheck); ok && check != nil {
+		return check(account)
+	}
+	return nil
+}
+
+// Authenticator authenticates users by password.
+type Authenticator interface {
+	// AuthenticateIdentity returns the identity of the user if password
+	// is valid. ctx bounds, traces and cancels the operations of the
+	// backend. On failure the identity is nil or only describes the
+	// source which rejected the user.
+	AuthenticateIdentity(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// Lookup finds users who were authenticated by other means than a
+// password, e.g. by a Kerberos ticket or a client certificate.
+type Lookup interface {
+	// LookupIdentity returns the identity of the user named username.
+	// On failure the identity is nil or only describes the source.
+	LookupIdentity(ctx context.Context, username string) (*Identity, error)
+}
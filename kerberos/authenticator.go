@@ -0,0 +1,201 @@
+// Package kerberos authenticates users by the Kerberos service tickets
+// which domain-joined clients send in Authorization: Negotiate headers
+// (SPNEGO, RFC 4559), validating them with the keys of a keytab.
+package kerberos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// DefaultMaxClockSkew is the clock skew Kerberos tolerates by default.
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// ErrInvalidTicket is wrapped by the errors of rejected tokens, unlike
+// the errors of looking up the user.
+var ErrInvalidTicket = errors.New("invalid Kerberos ticket")
+
+// Authenticator validates Kerberos service tickets and looks up the
+// identity of their client, e.g. its groups in LDAP.
+type Authenticator struct {
+	// Keytab returns the keys of the service.
+	Keytab func() *Keytab
+	// ServicePrincipal restricts tickets to one principal of the keytab,
+	// e.g. HTTP/auth.example.com@EXAMPLE.COM. By default tickets for any
+	// principal of the keytab are accepted.
+	ServicePrincipal string
+	// Realms are the realms of accepted clients, by default the realm
+	// of the service.
+	Realms []string
+	// MaxClockSkew defaults to DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+
+	// Lookup finds the identity of clients.
+	Lookup identity.Lookup
+	// StripRealm looks clients up by their principal without realm, e.g.
+	// alice instead of alice@EXAMPLE.COM.
+	StripRealm bool
+
+	replays replayCache
+}
+
+// Authenticate validates the token of an Authorization: Negotiate header
+// and returns the identity of its client. The returned token answers
+// clients which require mutual authentication and is nil otherwise.
+func (a *Authenticator) Authenticate(ctx context.Context, token []byte) (*identity.Identity, []byte, error) {
+	ctx, span := tracing.Start(ctx, "kerberos.Authenticator.Authenticate", tracing.KindInternal)
+	defer span.Finish()
+
+	client, response, err := a.accept(token, time.Now())
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+	span.SetAttribute("kerberos.principal", client.String())
+
+	username := client.String()
+	if a.StripRealm {
+		username = client.Name()
+	}
+	id, err := a.Lookup.LookupIdentity(ctx, username)
+	span.RecordError(err)
+	return id, response, err
+}
+
+// accept validates the token at time now and returns its client.
+func (a *Authenticator) accept(token []byte, now time.Time) (Principal, []byte, error) {
+	invalid := func(format string, args ...interface{}) (Principal, []byte, error) {
+		return Principal{}, nil, fmt.Errorf("%w: %s", ErrInvalidTicket, fmt.Sprintf(format, args...))
+	}
+	skew := a.MaxClockSkew
+	if skew <= 0 {
+		skew = DefaultMaxClockSkew
+	}
+
+	data, spnegoMech, err := unwrapAPReq(token)
+	if err != nil {
+		return invalid("%v", err)
+	}
+	var req apReq
+	if err := unmarshalApplication(data, tagAPReq, &req); err != nil || req.PVNO != 5 || req.MsgType != tagAPReq {
+		return invalid("malformed AP-REQ: %v", err)
+	}
+	var tkt ticket
+	if err := unmarshalApplication(req.Ticket.Bytes, tagTicket, &tkt); err != nil {
+		return invalid("malformed ticket: %v", err)
+	}
+
+	service := tkt.SName.principal(tkt.Realm)
+	if a.ServicePrincipal != "" {
+		expected, err := ParsePrincipal(a.ServicePrincipal)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		if !service.matches(expected) {
+			return invalid("ticket for %s instead of %s", service, expected)
+		}
+	}
+	key, err := a.Keytab().Key(service, tkt.EncPart.EncType, uint32(tkt.EncPart.KVNO))
+	if err != nil {
+		return invalid("%v", err)
+	}
+	plaintext, err := Decrypt(key, KeyUsageTicket, tkt.EncPart.Cipher)
+	if err != nil {
+		return invalid("decrypting ticket for %s: %v", service, err)
+	}
+	var part encTicketPart
+	if err := unmarshalApplication(plaintext, tagEncTicketPart, &part); err != nil {
+		return invalid("malformed ticket: %v", err)
+	}
+
+	client := part.CName.principal(part.CRealm)
+	start := part.StartTime
+	if start.IsZero() {
+		start = part.AuthTime
+	}
+	switch {
+	case part.Flags.At(ticketFlagInvalid) == 1:
+		return invalid("ticket of %s is marked invalid", client)
+	case start.After(now.Add(skew)):
+		return invalid("ticket of %s is not valid before %s", client, start)
+	case now.After(part.EndTime.Add(skew)):
+		return invalid("ticket of %s expired at %s", client, part.EndTime)
+	case !a.acceptsRealm(client.Realm, service.Realm):
+		return invalid("realm of %s is not accepted", client)
+	case len(client.Components) != 1:
+		return invalid("%s is not a user", client)
+	}
+
+	plaintext, err = Decrypt(part.Key, KeyUsageAuthenticator, req.Authenticator.Cipher)
+	if err != nil {
+		return invalid("decrypting authenticator of %s: %v", client, err)
+	}
+	var auth authenticator
+	if err := unmarshalApplication(plaintext, tagAuthenticator, &auth); err != nil {
+		return invalid("malformed authenticator: %v", err)
+	}
+	if !auth.CName.principal(auth.CRealm).matches(client) {
+		return invalid("authenticator of %s for ticket of %s", auth.CName.principal(auth.CRealm), client)
+	}
+	if auth.CTime.Before(now.Add(-skew)) || auth.CTime.After(now.Add(skew)) {
+		return invalid("authenticator of %s from %s exceeds the clock skew", client, auth.CTime)
+	}
+	if !a.replays.add(fmt.Sprintf("%s %s %d", client, auth.CTime.Format(time.RFC3339), auth.CUSec), now, 2*skew) {
+		return invalid("replayed authenticator of %s", client)
+	}
+
+	var response []byte
+	if req.APOptions.At(apOptionMutualRequired) == 1 {
+		if response, err = marshalAPRep(part.Key, &auth, spnegoMech); err != nil {
+			return Principal{}, nil, err
+		}
+	}
+	return client, response, nil
+}
+
+func (a *Authenticator) acceptsRealm(realm, serviceRealm string) bool {
+	if len(a.Realms) == 0 {
+		return strings.EqualFold(realm, serviceRealm)
+	}
+	for _, r := range a.Realms {
+		if strings.EqualFold(realm, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayCache remembers authenticators until they exceed the clock skew.
+type replayCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+// add returns false if the authenticator was seen before, and otherwise
+// remembers it for ttl.
+func (c *replayCache) add(key string, now time.Time, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expires == nil {
+		c.expires = make(map[string]time.Time)
+	}
+	for k, e := range c.expires {
+		if now.After(e) {
+			delete(c.expires, k)
+		}
+	}
+
+	if _, ok := c.expires[key]; ok {
+		return false
+	}
+	c.expires[key] = now.Add(ttl)
+	return true
+}
@@ -0,0 +1,165 @@
+// The tests of the authenticator are an external package, as tickets
+// are issued by kerberostest, which imports kerberos.
+package kerberos_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+	"github.com/proofpoint/kubernetes-ldap/kerberostest"
+)
+
+const service = "HTTP/auth.example.com"
+
+type dummyLookup struct {
+	username string
+}
+
+func (l *dummyLookup) LookupIdentity(ctx context.Context, username string) (*identity.Identity, error) {
+	l.username = username
+	if username == "nobody" || username == "nobody@EXAMPLE.COM" {
+		return nil, errors.New("user not found")
+	}
+	return &identity.Identity{Username: username, Groups: []string{"developers"}}, nil
+}
+
+func newTestAuthenticator(t *testing.T, kdc *kerberostest.KDC) (*kerberos.Authenticator, *dummyLookup) {
+	keytab, err := kdc.Keytab(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := &dummyLookup{}
+	return &kerberos.Authenticator{
+		Keytab: func() *kerberos.Keytab { return keytab },
+		Lookup: lookup,
+	}, lookup
+}
+
+func TestAuthenticate(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	a, lookup := newTestAuthenticator(t, kdc)
+
+	for _, raw := range []bool{false, true} {
+		token, _, err := kdc.Token(kerberostest.Ticket{Client: "alice", Service: service, Raw: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, response, err := a.Authenticate(context.Background(), token)
+		if err != nil {
+			t.Fatalf("Raw %v: unexpected error: %v", raw, err)
+		}
+		if id.Username != "alice@EXAMPLE.COM" || lookup.username != "alice@EXAMPLE.COM" {
+			t.Errorf("Raw %v: expected alice@EXAMPLE.COM, got %+v", raw, id)
+		}
+		if response != nil {
+			t.Errorf("Raw %v: expected no response without mutual authentication", raw)
+		}
+
+		if _, _, err := a.Authenticate(context.Background(), token); !errors.Is(err, kerberos.ErrInvalidTicket) {
+			t.Errorf("Raw %v: expected replays to be rejected, got %v", raw, err)
+		}
+	}
+
+	a.StripRealm = true
+	token, _, err := kdc.Token(kerberostest.Ticket{Client: "bob", Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := a.Authenticate(context.Background(), token); err != nil || id.Username != "bob" {
+		t.Errorf("Expected bob without realm, got %+v (%v)", id, err)
+	}
+
+	token, _, err = kdc.Token(kerberostest.Ticket{Client: "nobody", Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Authenticate(context.Background(), token); err == nil || errors.Is(err, kerberos.ErrInvalidTicket) {
+		t.Errorf("Expected the error of the lookup, got %v", err)
+	}
+}
+
+func TestAuthenticateMutual(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	a, _ := newTestAuthenticator(t, kdc)
+
+	for _, raw := range []bool{false, true} {
+		token, sessionKey, err := kdc.Token(kerberostest.Ticket{Client: "alice", Service: service, MutualRequired: true, Raw: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, response, err := a.Authenticate(context.Background(), token)
+		if err != nil {
+			t.Fatalf("Raw %v: unexpected error: %v", raw, err)
+		}
+		if err := kerberostest.VerifyResponse(response, sessionKey); err != nil {
+			t.Errorf("Raw %v: expected a valid response, got %v", raw, err)
+		}
+	}
+}
+
+func TestAuthenticateInvalid(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	other := kerberostest.NewKDC("EXAMPLE.COM")
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		kdc    *kerberostest.KDC
+		ticket kerberostest.Ticket
+	}{
+		{"key of another KDC", other, kerberostest.Ticket{Client: "alice", Service: service}},
+		{"another service", kdc, kerberostest.Ticket{Client: "alice", Service: "HTTP/other.example.com"}},
+		{"expired", kdc, kerberostest.Ticket{Client: "alice", Service: service, AuthTime: now.Add(-11 * time.Hour), EndTime: now.Add(-time.Hour)}},
+		{"not yet valid", kdc, kerberostest.Ticket{Client: "alice", Service: service, AuthTime: now.Add(time.Hour)}},
+		{"clock skew", kdc, kerberostest.Ticket{Client: "alice", Service: service, Time: now.Add(-10 * time.Minute)}},
+		{"foreign realm", kdc, kerberostest.Ticket{Client: "alice", ClientRealm: "OTHER.COM", Service: service}},
+	}
+	for _, c := range cases {
+		a, lookup := newTestAuthenticator(t, kdc)
+		token, _, err := c.kdc.Token(c.ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := a.Authenticate(context.Background(), token); !errors.Is(err, kerberos.ErrInvalidTicket) {
+			t.Errorf("%s: expected an invalid ticket, got %v", c.name, err)
+		}
+		if lookup.username != "" {
+			t.Errorf("%s: expected no lookup, got %s", c.name, lookup.username)
+		}
+	}
+
+	a, _ := newTestAuthenticator(t, kdc)
+	for _, token := range [][]byte{nil, []byte("garbage"), {0x60, 0x00}} {
+		if _, _, err := a.Authenticate(context.Background(), token); !errors.Is(err, kerberos.ErrInvalidTicket) {
+			t.Errorf("Token %x: expected an invalid ticket, got %v", token, err)
+		}
+	}
+
+	// clients of other realms are accepted if configured
+	a.Realms = []string{"EXAMPLE.COM", "OTHER.COM"}
+	token, _, err := kdc.Token(kerberostest.Ticket{Client: "alice", ClientRealm: "OTHER.COM", Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := a.Authenticate(context.Background(), token); err != nil || id.Username != "alice@OTHER.COM" {
+		t.Errorf("Expected alice@OTHER.COM, got %+v (%v)", id, err)
+	}
+}
+
+func TestAuthenticateServicePrincipal(t *testing.T) {
+	kdc := kerberostest.NewKDC("EXAMPLE.COM")
+	a, _ := newTestAuthenticator(t, kdc)
+	a.ServicePrincipal = "HTTP/other.example.com@EXAMPLE.COM"
+
+	token, _, err := kdc.Token(kerberostest.Ticket{Client: "alice", Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Authenticate(context.Background(), token); !errors.Is(err, kerberos.ErrInvalidTicket) {
+		t.Errorf("Expected tickets for other principals to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types of keys and tickets. Only the AES types of RFC 3962
+// are supported, which Active Directory uses since Windows Server 2008.
+const (
+	EncTypeAES128 int32 = 17 // aes128-cts-hmac-sha1-96
+	EncTypeAES256 int32 = 18 // aes256-cts-hmac-sha1-96
+)
+
+// Key usages of RFC 4120 section 7.5.1
+const (
+	KeyUsageTicket        uint32 = 2
+	KeyUsageAuthenticator uint32 = 11
+	KeyUsageAPRepEncPart  uint32 = 12
+)
+
+// macSize is the length of the truncated HMAC-SHA1 of ciphertexts.
+const macSize = 12
+
+var errIntegrity = errors.New("integrity check failed")
+
+// EncryptionKey is a key of the encryption type EncType.
+type EncryptionKey struct {
+	EncType int32  `asn1:"explicit,tag:0"`
+	Value   []byte `asn1:"explicit,tag:1"`
+}
+
+// NewKey returns a random key of the encryption type.
+func NewKey(encType int32) (EncryptionKey, error) {
+	size, err := keySize(encType)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	key := EncryptionKey{EncType: encType, Value: make([]byte, size)}
+	_, err = rand.Read(key.Value)
+	return key, err
+}
+
+func keySize(encType int32) (int, error) {
+	switch encType {
+	case EncTypeAES128:
+		return 16, nil
+	case EncTypeAES256:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unsupported encryption type %d", encType)
+}
+
+func (k EncryptionKey) check() error {
+	size, err := keySize(k.EncType)
+	if err != nil {
+		return err
+	}
+	if len(k.Value) != size {
+		return fmt.Errorf("invalid key length %d of encryption type %d", len(k.Value), k.EncType)
+	}
+	return nil
+}
+
+// Encrypt encrypts plaintext with a random confounder as specified by
+// RFC 3962. The keys of the encryption and its checksum are derived from
+// key for usage.
+func Encrypt(key EncryptionKey, usage uint32, plaintext []byte) ([]byte, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	ke, ki := deriveKey(key.Value, usage, 0xaa), deriveKey(key.Value, usage, 0x55)
+
+	data := make([]byte, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(data[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(data[aes.BlockSize:], plaintext)
+
+	ciphertext, err := encryptCTS(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ciphertext, mac(ki, data)...), nil
+}
+
+// Decrypt decrypts and verifies ciphertext produced by Encrypt.
+func Decrypt(key EncryptionKey, usage uint32, ciphertext []byte) ([]byte, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aes.BlockSize+macSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	ke, ki := deriveKey(key.Value, usage, 0xaa), deriveKey(key.Value, usage, 0x55)
+
+	data, checksum := ciphertext[:len(ciphertext)-macSize], ciphertext[len(ciphertext)-macSize:]
+	plaintext, err := decryptCTS(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(checksum, mac(ki, plaintext)) {
+		return nil, errIntegrity
+	}
+	return plaintext[aes.BlockSize:], nil
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:macSize]
+}
+
+// deriveKey derives the key of a usage for encryption (0xaa) or
+// integrity (0x55).
+func deriveKey(key []byte, usage uint32, kind byte) []byte {
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = kind
+	return dk(key, constant)
+}
+
+// dk is DK of RFC 3961 for AES, whose random-to-key is the identity. key
+// has been checked to be a valid AES key.
+func dk(key, constant []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	in := nfold(constant, aes.BlockSize)
+	derived := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(derived) < len(key) {
+		block.Encrypt(in, in)
+		derived = append(derived, in...)
+	}
+	return derived[:len(key)]
+}
+
+// nfold stretches or folds in to size bytes as specified by RFC 3961
+// section 5.1, following the reference implementation of MIT Kerberos.
+func nfold(in []byte, size int) []byte {
+	inBits := len(in) * 8
+	lcm := len(in) * size / gcd(len(in), size)
+	out := make([]byte, size)
+
+	carry := 0
+	for i := lcm - 1; i >= 0; i-- {
+		// the most significant bit of the input byte of this output byte,
+		// in the input rotated by 13 bits per repetition
+		msbit := (inBits - 1 + (inBits+13)*(i/len(in)) + (len(in)-i%len(in))*8) % inBits
+		value := (int(in[(len(in)-1-msbit/8)%len(in)])<<8 | int(in[(len(in)-msbit/8)%len(in)])) >> (msbit%8 + 1) & 0xff
+
+		value += carry + int(out[i%size])
+		out[i%size] = byte(value)
+		carry = value >> 8
+	}
+	for i := size - 1; carry != 0 && i >= 0; i-- {
+		value := int(out[i]) + carry
+		out[i] = byte(value)
+		carry = value >> 8
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// encryptCTS encrypts at least one block in CBC mode with ciphertext
+// stealing and a zero IV, which swaps the last two blocks (CBC-CS3).
+func encryptCTS(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < aes.BlockSize {
+		return nil, errors.New("plaintext shorter than a block")
+	}
+
+	padded := make([]byte, (len(plaintext)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plaintext)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+
+	if n := len(padded); n > aes.BlockSize {
+		last := append([]byte(nil), padded[n-aes.BlockSize:]...)
+		copy(padded[n-aes.BlockSize:], padded[n-2*aes.BlockSize:n-aes.BlockSize])
+		copy(padded[n-2*aes.BlockSize:], last)
+	}
+	return padded[:len(plaintext)], nil
+}
+
+// decryptCTS reverses encryptCTS.
+func decryptCTS(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(ciphertext)
+	if n < aes.BlockSize {
+		return nil, errors.New("ciphertext shorter than a block")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if n == aes.BlockSize {
+		plaintext := make([]byte, n)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return plaintext, nil
+	}
+
+	// The ciphertext ends with the last block and the truncated second to
+	// last block. The decrypted last block ends with the stolen bytes of
+	// the second to last block, which restores the CBC ciphertext.
+	tail := n % aes.BlockSize
+	if tail == 0 {
+		tail = aes.BlockSize
+	}
+	prefix := n - aes.BlockSize - tail
+	last := ciphertext[prefix : prefix+aes.BlockSize]
+	stolen := make([]byte, aes.BlockSize)
+	block.Decrypt(stolen, last)
+
+	cbc := make([]byte, prefix+2*aes.BlockSize)
+	copy(cbc, ciphertext[:prefix])
+	copy(cbc[prefix:], ciphertext[prefix+aes.BlockSize:])
+	copy(cbc[prefix+tail:], stolen[tail:])
+	copy(cbc[prefix+aes.BlockSize:], last)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(cbc, cbc)
+	return cbc[:n], nil
+}
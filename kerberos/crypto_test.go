@@ -0,0 +1,183 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// RFC 3961 appendix A.1 test vectors.
+func TestNfold(t *testing.T) {
+	cases := []struct {
+		bits     int
+		in       string
+		expected string
+	}{
+		{64, "012345", "be072631276b1955"},
+		{56, "password", "78a07b6caf85fa"},
+		{64, "Rough Consensus, and Running Code", "bb6ed30870b7f0e0"},
+		{168, "password", "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{192, "MASSACHVSETTS INSTITVTE OF TECHNOLOGY", "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{168, "Q", "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{168, "ba", "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{64, "kerberos", "6b65726265726f73"},
+		{128, "kerberos", "6b65726265726f737b9b5b2b93132b93"},
+		{256, "kerberos", "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+
+	for _, c := range cases {
+		if folded := hex.EncodeToString(nfold([]byte(c.in), c.bits/8)); folded != c.expected {
+			t.Errorf("%d-fold(%q): expected %s, got %s", c.bits, c.in, c.expected, folded)
+		}
+	}
+}
+
+// RFC 3962 appendix B test vectors: the keys derived from the PBKDF2 of
+// passwords with the constant "kerberos".
+func TestDeriveKey(t *testing.T) {
+	cases := []struct {
+		pbkdf2   string
+		expected string
+	}{
+		{"cdedb5281bb2f801565a1122b2563515", "42263c6e89f4fc28b8df68ee09799f15"},
+		{"5c08eb61fdf71e4e4ec3cf6ba1f5512b", "4c01cd46d632d01e6dbe230a01ed642a"},
+		{"cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837", "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{"5c08eb61fdf71e4e4ec3cf6ba1f5512ba7e52ddbc5e5142f708a31e2e62b1e13", "55a6ac740ad17b4846941051e1e8b0a7548d93b0ab30a8bc3ff16280382b8c2a"},
+	}
+
+	for _, c := range cases {
+		key, _ := hex.DecodeString(c.pbkdf2)
+		if derived := hex.EncodeToString(dk(key, []byte("kerberos"))); derived != c.expected {
+			t.Errorf("DK(%s): expected %s, got %s", c.pbkdf2, c.expected, derived)
+		}
+	}
+}
+
+// RFC 3962 appendix B test vectors.
+func TestCTS(t *testing.T) {
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	cases := []struct {
+		plaintext  string
+		ciphertext string
+	}{
+		{"4920776f756c64206c696b652074686520", "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320", "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043", "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c", "97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20", "97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20616e6420776f6e746f6e20736f75702e", "97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8"},
+	}
+
+	for i, c := range cases {
+		plaintext, _ := hex.DecodeString(c.plaintext)
+		ciphertext, err := encryptCTS(key, plaintext)
+		if err != nil || hex.EncodeToString(ciphertext) != c.ciphertext {
+			t.Errorf("Case %d: expected ciphertext %s, got %x (%v)", i, c.ciphertext, ciphertext, err)
+		}
+
+		ciphertext, _ = hex.DecodeString(c.ciphertext)
+		decrypted, err := decryptCTS(key, ciphertext)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Case %d: expected plaintext %s, got %x (%v)", i, c.plaintext, decrypted, err)
+		}
+	}
+}
+
+// asRep and encKDCRepPart parse the AS-REP of a KDC, which is encrypted
+// with the key of the user (RFC 4120 section 5.4.2).
+type asRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	PAData  asn1.RawValue `asn1:"optional,explicit,tag:2"`
+	CRealm  string        `asn1:"explicit,tag:3"`
+	CName   principalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart encryptedData `asn1:"explicit,tag:6"`
+}
+
+type encKDCRepPart struct {
+	Key     EncryptionKey `asn1:"explicit,tag:0"`
+	LastReq asn1.RawValue `asn1:"explicit,tag:1"`
+	Nonce   int64         `asn1:"explicit,tag:2"`
+}
+
+// testdata/mit-as-rep.der was issued by an MIT KDC to the user of
+// testdata/mit-testuser1.keytab, so that its decryption checks the
+// encryption against another implementation.
+func TestDecryptMITASRep(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/mit-testuser1.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt, err := ParseKeytab(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	user, _ := ParsePrincipal("testuser1@TEST.GOKRB5")
+	key, err := kt.Key(user, EncTypeAES256, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err = ioutil.ReadFile("testdata/mit-as-rep.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep asRep
+	if err := unmarshalApplication(data, 11, &rep); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if client := rep.CName.principal(rep.CRealm); !client.matches(user) || rep.EncPart.EncType != EncTypeAES256 {
+		t.Fatalf("Unexpected AS-REP of %s with encryption type %d", client, rep.EncPart.EncType)
+	}
+
+	plaintext, err := Decrypt(key, 3, rep.EncPart.Cipher)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// MIT tags the EncASRepPart as EncTGSRepPart, as RFC 4120 allows
+	var part encKDCRepPart
+	if err := unmarshalApplication(plaintext, 26, &part); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if part.Nonce != 2069991465 || part.Key.EncType != EncTypeAES256 || part.Key.check() != nil {
+		t.Errorf("Unexpected nonce %d and session key %+v", part.Nonce, part.Key)
+	}
+
+	if _, err := Decrypt(key, KeyUsageTicket, rep.EncPart.Cipher); err != errIntegrity {
+		t.Errorf("Expected other usages to fail, got %v", err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	for _, encType := range []int32{EncTypeAES128, EncTypeAES256} {
+		key, err := NewKey(encType)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		plaintext := []byte("ticket")
+
+		ciphertext, err := Encrypt(key, KeyUsageTicket, plaintext)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		decrypted, err := Decrypt(key, KeyUsageTicket, ciphertext)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Type %d: expected %q, got %q (%v)", encType, plaintext, decrypted, err)
+		}
+
+		if _, err := Decrypt(key, KeyUsageAuthenticator, ciphertext); err != errIntegrity {
+			t.Errorf("Type %d: expected other usages to fail, got %v", encType, err)
+		}
+		ciphertext[3] ^= 1
+		if _, err := Decrypt(key, KeyUsageTicket, ciphertext); err != errIntegrity {
+			t.Errorf("Type %d: expected modified ciphertexts to fail, got %v", encType, err)
+		}
+	}
+
+	if _, err := NewKey(23); err == nil {
+		t.Errorf("Expected RC4 to be unsupported")
+	}
+}
@@ -0,0 +1,128 @@
+//go:build go1.18
+// +build go1.18
+
+package kerberos
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// The fuzz tests feed the parsers of untrusted tokens and of keytabs with
+// mutations of the captured fixtures of testdata. Without -fuzz they run
+// the seeds only.
+
+func readFixtures(f *testing.F, files ...string) [][]byte {
+	var fixtures [][]byte
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		fixtures = append(fixtures, data)
+	}
+	return fixtures
+}
+
+func FuzzParseKeytab(f *testing.F) {
+	for _, data := range readFixtures(f, "testdata/mit-http.keytab", "testdata/mit-testuser1.keytab") {
+		f.Add(data)
+	}
+	f.Add([]byte{0x05, 0x02, 0x80, 0x00, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kt, err := ParseKeytab(data)
+		if err != nil {
+			return
+		}
+		// parsed keytabs survive a round trip
+		parsed, err := ParseKeytab(kt.Marshal())
+		if err != nil {
+			t.Fatalf("Error parsing marshalled keytab: %v", err)
+		}
+		if len(parsed.Entries) != len(kt.Entries) {
+			t.Fatalf("Expected %d entries, got %d", len(kt.Entries), len(parsed.Entries))
+		}
+	})
+}
+
+func FuzzUnwrapAPReq(f *testing.F) {
+	for _, data := range readFixtures(f, "testdata/spnego-negtokeninit.der", "testdata/krb5-ap-req.der") {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, token []byte) {
+		data, _, err := unwrapAPReq(token)
+		if err != nil {
+			return
+		}
+		var req apReq
+		if err := unmarshalApplication(data, tagAPReq, &req); err != nil {
+			return
+		}
+		var tkt ticket
+		unmarshalApplication(req.Ticket.Bytes, tagTicket, &tkt)
+	})
+}
+
+// FuzzUnmarshalApplication covers the messages parsed after decryption,
+// which only holders of the service key can forge.
+func FuzzUnmarshalApplication(f *testing.F) {
+	messages := []struct {
+		tag int
+		new func() interface{}
+	}{
+		{tagAPReq, func() interface{} { return &apReq{} }},
+		{tagTicket, func() interface{} { return &ticket{} }},
+		{tagEncTicketPart, func() interface{} { return &encTicketPart{} }},
+		{tagAuthenticator, func() interface{} { return &authenticator{} }},
+		{tagAPRep, func() interface{} { return &apRep{} }},
+		{tagEncAPRepPart, func() interface{} { return &encAPRepPart{} }},
+	}
+	for _, data := range readFixtures(f, "testdata/krb5-ap-req.der", "testdata/mit-as-rep.der") {
+		for i := range messages {
+			f.Add(uint8(i), data)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, message uint8, data []byte) {
+		m := messages[int(message)%len(messages)]
+		unmarshalApplication(data, m.tag, m.new())
+	})
+}
+
+func FuzzAccept(f *testing.F) {
+	fixtures := readFixtures(f, "testdata/mit-http.keytab", "testdata/spnego-negtokeninit.der", "testdata/krb5-ap-req.der")
+	kt, err := ParseKeytab(fixtures[0])
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, token := range fixtures[1:] {
+		f.Add(token)
+	}
+
+	a := &Authenticator{Keytab: func() *Keytab { return kt }}
+	now := time.Now()
+	f.Fuzz(func(t *testing.T, token []byte) {
+		a.accept(token, now)
+	})
+}
+
+func FuzzDecrypt(f *testing.F) {
+	fixtures := readFixtures(f, "testdata/mit-testuser1.keytab", "testdata/mit-as-rep.der")
+	kt, err := ParseKeytab(fixtures[0])
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(uint32(KeyUsageTicket), fixtures[1])
+	f.Add(uint32(KeyUsageAuthenticator), make([]byte, 44))
+
+	f.Fuzz(func(t *testing.T, usage uint32, ciphertext []byte) {
+		for _, entry := range kt.Entries {
+			if entry.Key.check() == nil {
+				Decrypt(entry.Key, usage, ciphertext)
+			}
+		}
+	})
+}
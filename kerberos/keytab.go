@@ -0,0 +1,270 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keytabVersion is the version 0x502 of MIT keytabs, which ktutil and
+// ktpass write. Version 0x501 in host byte order isn't supported.
+const keytabVersion = 0x502
+
+// NameTypePrincipal is the name type of users and, in keytabs, of
+// services.
+const NameTypePrincipal int32 = 1
+
+// Principal is a Kerberos principal name like alice@EXAMPLE.COM or
+// HTTP/auth.example.com@EXAMPLE.COM.
+type Principal struct {
+	NameType   int32
+	Components []string
+	Realm      string
+}
+
+// ParsePrincipal parses a principal name of the form
+// component/component@REALM.
+func ParsePrincipal(name string) (Principal, error) {
+	i := strings.LastIndex(name, "@")
+	if i <= 0 || i == len(name)-1 {
+		return Principal{}, fmt.Errorf("principal %q has no realm", name)
+	}
+	return Principal{NameType: NameTypePrincipal, Components: strings.Split(name[:i], "/"), Realm: name[i+1:]}, nil
+}
+
+// Name returns the principal without realm.
+func (p Principal) Name() string {
+	return strings.Join(p.Components, "/")
+}
+
+func (p Principal) String() string {
+	return p.Name() + "@" + p.Realm
+}
+
+// matches compares principals case-insensitively like Active Directory.
+func (p Principal) matches(other Principal) bool {
+	return strings.EqualFold(p.Name(), other.Name()) && strings.EqualFold(p.Realm, other.Realm)
+}
+
+// Keytab holds the keys of service principals.
+type Keytab struct {
+	Entries []KeytabEntry
+}
+
+// KeytabEntry is a version of the key of a principal.
+type KeytabEntry struct {
+	Principal Principal
+	Timestamp time.Time
+	KVNO      uint32
+	Key       EncryptionKey
+}
+
+// Key returns the key of principal with the encryption type and key
+// version. A kvno of 0 picks the latest version.
+func (kt *Keytab) Key(principal Principal, encType int32, kvno uint32) (EncryptionKey, error) {
+	var key *KeytabEntry
+	for i, entry := range kt.Entries {
+		if !entry.Principal.matches(principal) || entry.Key.EncType != encType {
+			continue
+		}
+		if entry.KVNO == kvno || (kvno == 0 && (key == nil || entry.KVNO > key.KVNO)) {
+			key = &kt.Entries[i]
+		}
+	}
+	if key == nil {
+		return EncryptionKey{}, fmt.Errorf("no key of %s with encryption type %d and version %d in keytab", principal, encType, kvno)
+	}
+	return key.Key, nil
+}
+
+// ParseKeytab parses a keytab file.
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != keytabVersion {
+		return nil, errors.New("not a keytab of version 0x502")
+	}
+
+	kt := &Keytab{}
+	r := &keytabReader{data: data[2:]}
+	for len(r.data) >= 4 {
+		size := int32(r.uint32())
+		if size == 0 {
+			break
+		}
+		// holes of deleted entries
+		record := r.bytes(int(abs(size)))
+		if r.err != nil {
+			return nil, r.err
+		}
+		if size < 0 {
+			continue
+		}
+
+		entry, err := parseKeytabEntry(record)
+		if err != nil {
+			return nil, fmt.Errorf("keytab entry %d: %v", len(kt.Entries), err)
+		}
+		kt.Entries = append(kt.Entries, entry)
+	}
+	return kt, nil
+}
+
+func parseKeytabEntry(record []byte) (KeytabEntry, error) {
+	r := &keytabReader{data: record}
+	var entry KeytabEntry
+
+	components := int(r.uint16())
+	entry.Principal.Realm = r.string()
+	for i := 0; i < components; i++ {
+		entry.Principal.Components = append(entry.Principal.Components, r.string())
+	}
+	entry.Principal.NameType = int32(r.uint32())
+	entry.Timestamp = time.Unix(int64(r.uint32()), 0)
+	entry.KVNO = uint32(r.uint8())
+	entry.Key.EncType = int32(r.uint16())
+	entry.Key.Value = r.bytes(int(r.uint16()))
+	// the 8 bit version is extended by a 32 bit one if present
+	if len(r.data) >= 4 {
+		if kvno := r.uint32(); kvno != 0 {
+			entry.KVNO = kvno
+		}
+	}
+	return entry, r.err
+}
+
+// Marshal returns the keytab in the file format.
+func (kt *Keytab) Marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(keytabVersion))
+	for _, entry := range kt.Entries {
+		var record bytes.Buffer
+		w := func(v interface{}) { binary.Write(&record, binary.BigEndian, v) }
+		counted := func(b []byte) {
+			w(uint16(len(b)))
+			record.Write(b)
+		}
+
+		w(uint16(len(entry.Principal.Components)))
+		counted([]byte(entry.Principal.Realm))
+		for _, component := range entry.Principal.Components {
+			counted([]byte(component))
+		}
+		w(uint32(entry.Principal.NameType))
+		w(uint32(entry.Timestamp.Unix()))
+		w(uint8(entry.KVNO))
+		w(uint16(entry.Key.EncType))
+		counted(entry.Key.Value)
+		w(entry.KVNO)
+
+		binary.Write(&buf, binary.BigEndian, int32(record.Len()))
+		buf.Write(record.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// keytabReader reads big endian fields, recording the first error.
+type keytabReader struct {
+	data []byte
+	err  error
+}
+
+func (r *keytabReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	// negative sizes are records of -2^31 bytes
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("truncated keytab")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *keytabReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *keytabReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func abs(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// KeytabFile holds a keytab read from a file, which can be reloaded when
+// the keys are rotated.
+type KeytabFile struct {
+	filename string
+
+	mu     sync.RWMutex
+	keytab *Keytab
+}
+
+// NewKeytabFile reads the keytab from filename.
+func NewKeytabFile(filename string) (*KeytabFile, error) {
+	f := &KeytabFile{filename: filename}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again. On error or if the keytab has no keys the
+// previous keytab is kept.
+func (f *KeytabFile) Reload() error {
+	data, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	keytab, err := ParseKeytab(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.filename, err)
+	}
+	if len(keytab.Entries) == 0 {
+		return fmt.Errorf("%s has no keys", f.filename)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keytab = keytab
+	return nil
+}
+
+// Files returns the keytab file.
+func (f *KeytabFile) Files() []string {
+	return []string{f.filename}
+}
+
+// Keytab returns the current keytab.
+func (f *KeytabFile) Keytab() *Keytab {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.keytab
+}
@@ -0,0 +1,166 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeytab(t *testing.T) *Keytab {
+	service, err := ParsePrincipal("HTTP/auth.example.com@EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt := &Keytab{}
+	for _, kvno := range []uint32{2, 3, 300} {
+		for _, encType := range []int32{EncTypeAES128, EncTypeAES256} {
+			key, err := NewKey(encType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kt.Entries = append(kt.Entries, KeytabEntry{Principal: service, Timestamp: time.Unix(1600000000, 0), KVNO: kvno, Key: key})
+		}
+	}
+	return kt
+}
+
+func TestKeytab(t *testing.T) {
+	kt := newTestKeytab(t)
+
+	parsed, err := ParseKeytab(kt.Marshal())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, kt) {
+		t.Errorf("Expected %+v, got %+v", kt, parsed)
+	}
+
+	service, _ := ParsePrincipal("http/AUTH.example.com@example.com")
+	cases := []struct {
+		encType  int32
+		kvno     uint32
+		expected int
+	}{
+		{EncTypeAES128, 2, 0},
+		{EncTypeAES256, 3, 3},
+		{EncTypeAES256, 300, 5},
+		{EncTypeAES256, 0, 5},
+		{EncTypeAES256, 4, -1},
+		{23, 0, -1},
+	}
+	for _, c := range cases {
+		key, err := parsed.Key(service, c.encType, c.kvno)
+		if c.expected < 0 {
+			if err == nil {
+				t.Errorf("Type %d version %d: expected no key", c.encType, c.kvno)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(key.Value, kt.Entries[c.expected].Key.Value) {
+			t.Errorf("Type %d version %d: expected entry %d, got %v", c.encType, c.kvno, c.expected, err)
+		}
+	}
+}
+
+// testdata/mit-http.keytab was written by MIT kadmin for a service with
+// two key versions.
+func TestParseMITKeytab(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/mit-http.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt, err := ParseKeytab(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	service, _ := ParsePrincipal("HTTP/host.test.gokrb5@TEST.GOKRB5")
+	var entries []string
+	for _, entry := range kt.Entries {
+		if !entry.Principal.matches(service) || entry.Principal.NameType != 1 {
+			t.Errorf("Unexpected principal %+v", entry.Principal)
+		}
+		if size, _ := keySize(entry.Key.EncType); size != len(entry.Key.Value) {
+			t.Errorf("Unexpected %d byte key of type %d", len(entry.Key.Value), entry.Key.EncType)
+		}
+		entries = append(entries, fmt.Sprintf("%d/%d", entry.KVNO, entry.Key.EncType))
+	}
+	if expected := "1/17 1/18 2/17 2/18"; strings.Join(entries, " ") != expected {
+		t.Errorf("Expected entries %s, got %v", expected, entries)
+	}
+	if !kt.Entries[0].Timestamp.Equal(time.Date(2017, 5, 6, 12, 43, 8, 0, time.UTC)) {
+		t.Errorf("Unexpected timestamp %s", kt.Entries[0].Timestamp)
+	}
+}
+
+func TestParseKeytab(t *testing.T) {
+	kt := newTestKeytab(t)
+	data := kt.Marshal()
+
+	// a hole of a deleted entry before the first one
+	hole := []byte{0x05, 0x02, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0}
+	parsed, err := ParseKeytab(append(hole, data[2:]...))
+	if err != nil || len(parsed.Entries) != len(kt.Entries) {
+		t.Errorf("Expected holes to be skipped, got %v", err)
+	}
+
+	if _, err := ParseKeytab(data[:len(data)-10]); err == nil {
+		t.Errorf("Expected truncated keytabs to fail")
+	}
+	binary.BigEndian.PutUint16(data, 0x501)
+	if _, err := ParseKeytab(data); err == nil {
+		t.Errorf("Expected keytabs of version 0x501 to fail")
+	}
+}
+
+func TestParsePrincipal(t *testing.T) {
+	p, err := ParsePrincipal("HTTP/auth.example.com@EXAMPLE.COM")
+	if err != nil || p.Name() != "HTTP/auth.example.com" || p.Realm != "EXAMPLE.COM" || p.String() != "HTTP/auth.example.com@EXAMPLE.COM" {
+		t.Errorf("Unexpected principal %+v (%v)", p, err)
+	}
+	for _, name := range []string{"alice", "alice@", "@EXAMPLE.COM"} {
+		if _, err := ParsePrincipal(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestKeytabFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "krb5.keytab")
+
+	first := newTestKeytab(t)
+	if err := ioutil.WriteFile(filename, first.Marshal(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewKeytabFile(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	second := newTestKeytab(t)
+	if err := ioutil.WriteFile(filename, second.Marshal(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil || !reflect.DeepEqual(f.Keytab(), second) {
+		t.Errorf("Expected the keytab to be reloaded, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte{0x05, 0x02}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err == nil || !reflect.DeepEqual(f.Keytab(), second) {
+		t.Errorf("Expected empty keytabs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package kerberos
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Application tags of the messages of RFC 4120 section 5
+const (
+	tagTicket        = 1
+	tagAuthenticator = 2
+	tagEncTicketPart = 3
+	tagAPReq         = 14
+	tagAPRep         = 15
+	tagEncAPRepPart  = 27
+)
+
+// Flags of AP-REQs and tickets, numbered from the most significant bit
+const (
+	apOptionMutualRequired = 2
+	ticketFlagInvalid      = 7
+)
+
+// GSS-API token IDs of RFC 4121 section 4.1
+var (
+	tokenIDAPReq = []byte{0x01, 0x00}
+	tokenIDAPRep = []byte{0x02, 0x00}
+)
+
+var (
+	oidSPNEGO   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKerberos = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	// oidMSKerberos is the Kerberos OID with a truncated arc, which
+	// Windows clients offer first.
+	oidMSKerberos = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+type principalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+func (n principalName) principal(realm string) Principal {
+	return Principal{NameType: n.NameType, Components: n.NameString, Realm: realm}
+}
+
+type encryptedData struct {
+	EncType int32  `asn1:"explicit,tag:0"`
+	KVNO    int64  `asn1:"optional,explicit,tag:1"`
+	Cipher  []byte `asn1:"explicit,tag:2"`
+}
+
+// apReq keeps the ticket raw, as encoding/asn1 can't parse a field with
+// both an explicit and an application tag. Its Bytes are the ticket.
+type apReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+// encTicketPart omits the optional trailing fields, renew-till, caddr
+// and authorization-data.
+type encTicketPart struct {
+	Flags     asn1.BitString `asn1:"explicit,tag:0"`
+	Key       EncryptionKey  `asn1:"explicit,tag:1"`
+	CRealm    string         `asn1:"explicit,tag:2"`
+	CName     principalName  `asn1:"explicit,tag:3"`
+	Transited asn1.RawValue  `asn1:"explicit,tag:4"`
+	AuthTime  time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime time.Time      `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime   time.Time      `asn1:"generalized,explicit,tag:7"`
+}
+
+// authenticator omits the optional trailing fields, subkey, seq-number
+// and authorization-data.
+type authenticator struct {
+	AVNO     int           `asn1:"explicit,tag:0"`
+	CRealm   string        `asn1:"explicit,tag:1"`
+	CName    principalName `asn1:"explicit,tag:2"`
+	Checksum asn1.RawValue `asn1:"optional,explicit,tag:3"`
+	CUSec    int           `asn1:"explicit,tag:4"`
+	CTime    time.Time     `asn1:"generalized,explicit,tag:5"`
+}
+
+type apRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart encryptedData `asn1:"explicit,tag:2"`
+}
+
+type encAPRepPart struct {
+	CTime time.Time `asn1:"generalized,explicit,tag:0"`
+	CUSec int       `asn1:"explicit,tag:1"`
+}
+
+// negTokenInit is the initial SPNEGO token of clients (RFC 4178).
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+// negTokenResp is the SPNEGO token of the response.
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+}
+
+// negStateAcceptCompleted completes the SPNEGO negotiation.
+const negStateAcceptCompleted = 0
+
+// unmarshalApplication parses a message tagged with an application tag.
+func unmarshalApplication(data []byte, tag int, v interface{}) error {
+	rest, err := asn1.UnmarshalWithParams(data, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+	if err == nil && len(rest) > 0 {
+		err = errors.New("trailing data")
+	}
+	return err
+}
+
+// parseGSSToken splits the framing of the initial token of a GSS-API
+// mechanism (RFC 2743 section 3.1) into its mechanism and inner token.
+func parseGSSToken(data []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var token asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 || token.Class != asn1.ClassApplication || token.Tag != 0 || !token.IsCompound {
+		return nil, nil, errors.New("not a GSS-API token")
+	}
+
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(token.Bytes, &mech)
+	return mech, inner, err
+}
+
+// marshalGSSToken frames an inner token of the mechanism.
+func marshalGSSToken(mech asn1.ObjectIdentifier, inner []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(oid, inner...)})
+}
+
+func isKerberos(mech asn1.ObjectIdentifier) bool {
+	return mech.Equal(oidKerberos) || mech.Equal(oidMSKerberos)
+}
+
+// unwrapAPReq returns the AP-REQ of an SPNEGO token or of a plain
+// Kerberos token, along with the mechanism of SPNEGO tokens which the
+// response must be wrapped for.
+func unwrapAPReq(token []byte) ([]byte, asn1.ObjectIdentifier, error) {
+	mech, inner, err := parseGSSToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var spnegoMech asn1.ObjectIdentifier
+	if mech.Equal(oidSPNEGO) {
+		var init negTokenInit
+		if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+			return nil, nil, fmt.Errorf("parsing SPNEGO token: %v", err)
+		}
+		// the mechanism token is for the preferred mechanism
+		if len(init.MechTypes) == 0 || !isKerberos(init.MechTypes[0]) || len(init.MechToken) == 0 {
+			return nil, nil, fmt.Errorf("client offered no Kerberos token but %v", init.MechTypes)
+		}
+		spnegoMech = init.MechTypes[0]
+
+		mech, inner, err = parseGSSToken(init.MechToken)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !isKerberos(mech) {
+		return nil, nil, fmt.Errorf("unsupported mechanism %v", mech)
+	}
+	if len(inner) < 2 || inner[0] != tokenIDAPReq[0] || inner[1] != tokenIDAPReq[1] {
+		return nil, nil, errors.New("not an AP-REQ")
+	}
+	return inner[2:], spnegoMech, nil
+}
+
+// marshalAPRep returns the token authenticating the service to the
+// client, wrapped for SPNEGO if spnegoMech is set.
+func marshalAPRep(sessionKey EncryptionKey, auth *authenticator, spnegoMech asn1.ObjectIdentifier) ([]byte, error) {
+	part, err := asn1.MarshalWithParams(encAPRepPart{CTime: auth.CTime.UTC(), CUSec: auth.CUSec}, fmt.Sprintf("application,explicit,tag:%d", tagEncAPRepPart))
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := Encrypt(sessionKey, KeyUsageAPRepEncPart, part)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := asn1.MarshalWithParams(apRep{
+		PVNO:    5,
+		MsgType: tagAPRep,
+		EncPart: encryptedData{EncType: sessionKey.EncType, Cipher: cipher},
+	}, fmt.Sprintf("application,explicit,tag:%d", tagAPRep))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := marshalGSSToken(oidKerberos, append(append([]byte(nil), tokenIDAPRep...), rep...))
+	if err != nil || spnegoMech == nil {
+		return token, err
+	}
+	return asn1.MarshalWithParams(negTokenResp{
+		NegState:      negStateAcceptCompleted,
+		SupportedMech: spnegoMech,
+		ResponseToken: token,
+	}, "explicit,tag:1")
+}
@@ -0,0 +1,77 @@
+package kerberos
+
+import (
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/spnego-negtokeninit.der and testdata/krb5-ap-req.der are the
+// SPNEGO and plain Kerberos tokens of MIT clients. Their service keys
+// weren't captured, so their tickets can't be decrypted.
+func TestUnwrapAPReq(t *testing.T) {
+	cases := []struct {
+		file         string
+		expectedMech asn1.ObjectIdentifier
+		expectedKVNO int64
+	}{
+		{"testdata/spnego-negtokeninit.der", oidKerberos, 2},
+		{"testdata/krb5-ap-req.der", nil, 3},
+	}
+
+	for _, c := range cases {
+		token, err := ioutil.ReadFile(c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, mech, err := unwrapAPReq(token)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.file, err)
+		}
+		if !mech.Equal(c.expectedMech) {
+			t.Errorf("%s: expected mechanism %v, got %v", c.file, c.expectedMech, mech)
+		}
+
+		var req apReq
+		if err := unmarshalApplication(data, tagAPReq, &req); err != nil || req.PVNO != 5 || req.MsgType != tagAPReq {
+			t.Fatalf("%s: unexpected AP-REQ %+v: %v", c.file, req, err)
+		}
+		if req.Authenticator.EncType != EncTypeAES256 {
+			t.Errorf("%s: unexpected authenticator encryption type %d", c.file, req.Authenticator.EncType)
+		}
+		var tkt ticket
+		if err := unmarshalApplication(req.Ticket.Bytes, tagTicket, &tkt); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.file, err)
+		}
+		service := tkt.SName.principal(tkt.Realm)
+		if service.String() != "HTTP/host.test.gokrb5@TEST.GOKRB5" || tkt.EncPart.EncType != EncTypeAES256 || tkt.EncPart.KVNO != c.expectedKVNO {
+			t.Errorf("%s: unexpected ticket for %s with encryption type %d and version %d", c.file, service, tkt.EncPart.EncType, tkt.EncPart.KVNO)
+		}
+	}
+}
+
+func TestAcceptCapturedToken(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/mit-http.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt, err := ParseKeytab(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ioutil.ReadFile("testdata/spnego-negtokeninit.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keytab has a key of the ticket's type and version, but not the
+	// one the ticket was encrypted with
+	a := &Authenticator{Keytab: func() *Keytab { return kt }, ServicePrincipal: "HTTP/host.test.gokrb5@TEST.GOKRB5"}
+	_, _, err = a.accept(token, time.Now())
+	if !errors.Is(err, ErrInvalidTicket) || !strings.Contains(err.Error(), "decrypting ticket for HTTP/host.test.gokrb5@TEST.GOKRB5") {
+		t.Errorf("Expected the ticket to reach decryption, got %v", err)
+	}
+}
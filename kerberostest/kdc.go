@@ -0,0 +1,249 @@
+// Package kerberostest provides a stand-in for a Kerberos KDC in tests,
+// in the spirit of ldaptest. It generates the keytabs of services and
+// issues service tickets for users as the tokens of Authorization:
+// Negotiate headers, without speaking the protocols of a KDC.
+package kerberostest
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+)
+
+// KDC issues tickets of a realm.
+type KDC struct {
+	Realm string
+	// EncType of the generated keys, defaults to aes256-cts-hmac-sha1-96.
+	EncType int32
+
+	mu   sync.Mutex
+	keys map[string]kerberos.KeytabEntry
+}
+
+// NewKDC returns a KDC of realm.
+func NewKDC(realm string) *KDC {
+	return &KDC{Realm: realm, keys: make(map[string]kerberos.KeytabEntry)}
+}
+
+// Keytab returns the keytab of a service principal without realm, e.g.
+// HTTP/auth.example.com. Its key is generated on first use.
+func (k *KDC) Keytab(service string) (*kerberos.Keytab, error) {
+	entry, err := k.key(service)
+	if err != nil {
+		return nil, err
+	}
+	return &kerberos.Keytab{Entries: []kerberos.KeytabEntry{entry}}, nil
+}
+
+// WriteKeytab writes the keytab of service to filename.
+func (k *KDC) WriteKeytab(service, filename string) error {
+	keytab, err := k.Keytab(service)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, keytab.Marshal(), 0600)
+}
+
+func (k *KDC) key(service string) (kerberos.KeytabEntry, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if entry, ok := k.keys[service]; ok {
+		return entry, nil
+	}
+	principal, err := kerberos.ParsePrincipal(service + "@" + k.Realm)
+	if err != nil {
+		return kerberos.KeytabEntry{}, err
+	}
+	encType := k.EncType
+	if encType == 0 {
+		encType = kerberos.EncTypeAES256
+	}
+	key, err := kerberos.NewKey(encType)
+	if err != nil {
+		return kerberos.KeytabEntry{}, err
+	}
+	entry := kerberos.KeytabEntry{Principal: principal, Timestamp: time.Now(), KVNO: 1, Key: key}
+	k.keys[service] = entry
+	return entry, nil
+}
+
+// Ticket describes a service ticket to issue.
+type Ticket struct {
+	// Client is the principal of the user without realm, e.g. alice.
+	Client string
+	// ClientRealm defaults to the realm of the KDC.
+	ClientRealm string
+	// Service is the principal of the service without realm.
+	Service string
+	// AuthTime and EndTime bound the validity of the ticket and default
+	// to now and ten hours later.
+	AuthTime time.Time
+	EndTime  time.Time
+	// Time is the time of the authenticator of the client, by default
+	// now.
+	Time time.Time
+	// MutualRequired asks the service to authenticate itself.
+	MutualRequired bool
+	// Raw omits the SPNEGO framing of the Kerberos token.
+	Raw bool
+}
+
+// Negotiate returns the value of the Authorization header of a user for
+// a service.
+func (k *KDC) Negotiate(client, service string) (string, error) {
+	token, _, err := k.Token(Ticket{Client: client, Service: service})
+	if err != nil {
+		return "", err
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+// Token issues the ticket and returns the token the client sends along
+// with the session key shared by the client and the service.
+func (k *KDC) Token(t Ticket) ([]byte, kerberos.EncryptionKey, error) {
+	var sessionKey kerberos.EncryptionKey
+	serviceKey, err := k.key(t.Service)
+	if err != nil {
+		return nil, sessionKey, err
+	}
+	if sessionKey, err = kerberos.NewKey(serviceKey.Key.EncType); err != nil {
+		return nil, sessionKey, err
+	}
+
+	now := time.Now()
+	defaultTime := func(t, def time.Time) time.Time {
+		if t.IsZero() {
+			t = def
+		}
+		return t.UTC().Truncate(time.Second)
+	}
+	clientRealm := t.ClientRealm
+	if clientRealm == "" {
+		clientRealm = k.Realm
+	}
+	client := principalName{NameType: kerberos.NameTypePrincipal, NameString: generalStrings(t.Client)}
+
+	// the ticket encrypted for the service
+	part, err := asn1.MarshalWithParams(encTicketPart{
+		Flags:     asn1.BitString{Bytes: []byte{0x40, 0, 0, 0}, BitLength: 32}, // forwardable
+		Key:       sessionKey,
+		CRealm:    explicit(2, generalString(clientRealm)),
+		CName:     client,
+		Transited: transitedEncoding{Contents: []byte{}},
+		AuthTime:  defaultTime(t.AuthTime, now),
+		EndTime:   defaultTime(t.EndTime, now.Add(10*time.Hour)),
+	}, "application,explicit,tag:3")
+	if err != nil {
+		return nil, sessionKey, err
+	}
+	cipher, err := kerberos.Encrypt(serviceKey.Key, kerberos.KeyUsageTicket, part)
+	if err != nil {
+		return nil, sessionKey, err
+	}
+	ticket, err := asn1.MarshalWithParams(ticket{
+		TktVNO:  5,
+		Realm:   explicit(1, generalString(k.Realm)),
+		SName:   principalName{NameType: kerberos.NameTypePrincipal, NameString: generalStrings(serviceKey.Principal.Components...)},
+		EncPart: encryptedData{EncType: serviceKey.Key.EncType, KVNO: int64(serviceKey.KVNO), Cipher: cipher},
+	}, "application,explicit,tag:1")
+	if err != nil {
+		return nil, sessionKey, err
+	}
+
+	// the authenticator of the client, with the GSS-API checksum of RFC
+	// 4121 section 4.1.1 requesting mutual authentication if required
+	options := asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32}
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum, 16)
+	if t.MutualRequired {
+		options.Bytes[0] = 0x20
+		binary.LittleEndian.PutUint32(checksum[20:], 2)
+	}
+	auth, err := asn1.MarshalWithParams(authenticator{
+		AVNO:     5,
+		CRealm:   explicit(1, generalString(clientRealm)),
+		CName:    client,
+		Checksum: checksumType{Type: 0x8003, Checksum: checksum},
+		CUSec:    now.Nanosecond() / 1000,
+		CTime:    defaultTime(t.Time, now),
+	}, "application,explicit,tag:2")
+	if err != nil {
+		return nil, sessionKey, err
+	}
+	if cipher, err = kerberos.Encrypt(sessionKey, kerberos.KeyUsageAuthenticator, auth); err != nil {
+		return nil, sessionKey, err
+	}
+
+	req, err := asn1.MarshalWithParams(apReq{
+		PVNO:          5,
+		MsgType:       14,
+		APOptions:     options,
+		Ticket:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: ticket},
+		Authenticator: encryptedData{EncType: sessionKey.EncType, Cipher: cipher},
+	}, "application,explicit,tag:14")
+	if err != nil {
+		return nil, sessionKey, err
+	}
+
+	token, err := gssToken(oidKerberos, append([]byte{0x01, 0x00}, req...))
+	if err != nil || t.Raw {
+		return token, sessionKey, err
+	}
+	init, err := asn1.MarshalWithParams(negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{oidKerberos},
+		MechToken: token,
+	}, "explicit,tag:0")
+	if err != nil {
+		return nil, sessionKey, err
+	}
+	token, err = gssToken(oidSPNEGO, init)
+	return token, sessionKey, err
+}
+
+// VerifyResponse checks that the response token of a service to a
+// ticket requiring mutual authentication is encrypted with the session
+// key, like a client does.
+func VerifyResponse(response []byte, sessionKey kerberos.EncryptionKey) error {
+	var resp negTokenResp
+	if _, err := asn1.UnmarshalWithParams(response, &resp, "explicit,tag:1"); err == nil {
+		if resp.NegState != 0 {
+			return fmt.Errorf("negotiation state %d", resp.NegState)
+		}
+		response = resp.ResponseToken
+	}
+
+	var token asn1.RawValue
+	if _, err := asn1.Unmarshal(response, &token); err != nil {
+		return err
+	}
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(token.Bytes, &mech)
+	if err != nil {
+		return err
+	}
+	if !mech.Equal(oidKerberos) || len(inner) < 2 || inner[0] != 0x02 || inner[1] != 0x00 {
+		return errors.New("not an AP-REP")
+	}
+
+	var rep apRep
+	if _, err := asn1.UnmarshalWithParams(inner[2:], &rep, "application,explicit,tag:15"); err != nil {
+		return err
+	}
+	part, err := kerberos.Decrypt(sessionKey, kerberos.KeyUsageAPRepEncPart, rep.EncPart.Cipher)
+	if err != nil {
+		return err
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(part, &raw); err != nil || raw.Class != asn1.ClassApplication || raw.Tag != 27 {
+		return fmt.Errorf("malformed EncAPRepPart: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package kerberostest
+
+import (
+	"encoding/asn1"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/kerberos"
+)
+
+// The messages of RFC 4120 as sent by clients. encoding/asn1 can't
+// marshal the GeneralStrings of Kerberos, which are raw values instead.
+// It ignores the tags of raw values, so those are tagged by explicit.
+
+var (
+	oidSPNEGO   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKerberos = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+)
+
+func generalString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagGeneralString, Bytes: []byte(s)}
+}
+
+// explicit tags a raw value with a context-specific tag.
+func explicit(tag int, v asn1.RawValue) asn1.RawValue {
+	data, err := asn1.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: data}
+}
+
+func generalStrings(s ...string) []asn1.RawValue {
+	values := make([]asn1.RawValue, len(s))
+	for i := range s {
+		values[i] = generalString(s[i])
+	}
+	return values
+}
+
+type principalName struct {
+	NameType   int32           `asn1:"explicit,tag:0"`
+	NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+}
+
+type encryptedData struct {
+	EncType int32  `asn1:"explicit,tag:0"`
+	KVNO    int64  `asn1:"optional,explicit,tag:1"`
+	Cipher  []byte `asn1:"explicit,tag:2"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   asn1.RawValue // [1]
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+type transitedEncoding struct {
+	Type     int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+type encTicketPart struct {
+	Flags     asn1.BitString         `asn1:"explicit,tag:0"`
+	Key       kerberos.EncryptionKey `asn1:"explicit,tag:1"`
+	CRealm    asn1.RawValue          // [2]
+	CName     principalName          `asn1:"explicit,tag:3"`
+	Transited transitedEncoding      `asn1:"explicit,tag:4"`
+	AuthTime  time.Time              `asn1:"generalized,explicit,tag:5"`
+	EndTime   time.Time              `asn1:"generalized,explicit,tag:7"`
+}
+
+type checksumType struct {
+	Type     int32  `asn1:"explicit,tag:0"`
+	Checksum []byte `asn1:"explicit,tag:1"`
+}
+
+type authenticator struct {
+	AVNO     int           `asn1:"explicit,tag:0"`
+	CRealm   asn1.RawValue // [1]
+	CName    principalName `asn1:"explicit,tag:2"`
+	Checksum checksumType  `asn1:"explicit,tag:3"`
+	CUSec    int           `asn1:"explicit,tag:4"`
+	CTime    time.Time     `asn1:"generalized,explicit,tag:5"`
+}
+
+type apReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  // [3]
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+type apRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart encryptedData `asn1:"explicit,tag:2"`
+}
+
+type negTokenInit struct {
+	MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	MechToken []byte                  `asn1:"optional,explicit,tag:2"`
+}
+
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+}
+
+// gssToken frames the inner token of a GSS-API mechanism.
+func gssToken(mech asn1.ObjectIdentifier, inner []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(oid, inner...)})
+}
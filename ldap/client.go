@@ -1,12 +1,18 @@
 package ldap
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
 )
 
 // Authenticator authenticates a user against an LDAP directory
@@ -14,9 +20,50 @@ type Authenticator interface {
 	Authenticate(username, password string) (*ldap.Entry, error)
 }
 
+// DirectoryAuthenticator is implemented by authenticators which report
+// the directory that authenticated the user, e.g. the Router.
+type DirectoryAuthenticator interface {
+	AuthenticateDirectory(ctx context.Context, username, password string) (*ldap.Entry, *Directory, error)
+}
+
+// Directory describes where a user was authenticated.
+type Directory struct {
+	// Name is recorded in tokens and audit events.
+	Name   string
+	Server string
+	// UsernameAttribute overrides the attribute used as username in tokens.
+	UsernameAttribute string
+	// UsernamePrefix prefixes usernames in tokens, see
+	// identity.Source.UsernamePrefix.
+	UsernamePrefix string
+	// UIDAttribute is the attribute identifying users permanently.
+	UIDAttribute string
+	// BreakGlass marks emergency accounts kept outside of the directory,
+	// whose use is audited prominently.
+	BreakGlass bool
+}
+
+// Source describes the directory as source of identities.
+func (d *Directory) Source() *identity.Source {
+	return &identity.Source{Name: d.Name, Server: d.Server, UsernamePrefix: d.UsernamePrefix, BreakGlass: d.BreakGlass}
+}
+
+// DefaultGroupFilter finds the groups listing the user as member.
+const DefaultGroupFilter = "(member={dn})"
+
+// Default timeouts of a Client
+const (
+	DefaultDialTimeout   = 5 * time.Second
+	DefaultBindTimeout   = 10 * time.Second
+	DefaultSearchTimeout = 10 * time.Second
+	DefaultTimeout       = 30 * time.Second
+)
+
 // Client represents a connection, and associated lookup strategy,
 // for authentication via an LDAP server.
 type Client struct {
+	// Name identifies the directory in tokens when several are configured.
+	Name               string
 	BaseDN             string
 	LdapServer         string
 	LdapPort           uint
@@ -24,7 +71,48 @@ type Client struct {
 	UserLoginAttribute string
 	SearchUserDN       string
 	SearchUserPassword string
-	TLSConfig          *tls.Config
+	// GetSearchUserPassword overrides SearchUserPassword, e.g. to read a
+	// password which is rotated while serving.
+	GetSearchUserPassword func() string
+	TLSConfig             *tls.Config
+	// SASLExternal binds with the client certificate of TLSConfig instead
+	// of the search user.
+	SASLExternal bool
+	// UsernameAttribute is the attribute used as username in tokens for
+	// users of this directory, their DN if empty.
+	UsernameAttribute string
+	// UsernamePrefix prefixes the usernames of users of this directory in
+	// tokens, e.g. "contractors:". Optional.
+	UsernamePrefix string
+	// UIDAttribute is the attribute identifying users permanently, e.g.
+	// entryUUID or objectGUID. Optional.
+	UIDAttribute string
+	// GroupBaseDN enables searching the groups of a user, for directories
+	// without memberOf. The DNs of the groups found are added to the
+	// memberOf attribute of the returned entry.
+	GroupBaseDN string
+	// GroupFilter finds the groups of a user. {dn} and {username} are
+	// replaced with the escaped DN and login name of the user. Defaults to
+	// DefaultGroupFilter.
+	GroupFilter string
+	// PasswordChange enables ChangePassword with PasswordChangeRFC3062
+	// or PasswordChangeAD.
+	PasswordChange string
+	// DialTimeout limits connecting including the TLS handshake,
+	// BindTimeout and SearchTimeout each bind and search, and Timeout a
+	// whole authentication or password change. They default to
+	// DefaultDialTimeout and so on.
+	DialTimeout   time.Duration
+	BindTimeout   time.Duration
+	SearchTimeout time.Duration
+	Timeout       time.Duration
+}
+
+// conn is an LDAP connection whose operations can be aborted through the
+// network connection, as go-ldap can't cancel them.
+type conn struct {
+	*ldap.Conn
+	netConn net.Conn
 }
 
 var (
@@ -66,8 +154,49 @@ var (
 	)
 )
 
+var (
+	ldapErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_ldap_errors_total",
+			Help: "Total number of LDAP errors by server and reason.",
+		},
+		[]string{"server", "reason"},
+	)
+	ldapOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kubernetes_ldap_ldap_operation_duration_seconds",
+			Help:    "Duration of LDAP dial, bind and search operations by server and outcome.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"server", "operation", "outcome"},
+	)
+)
+
+// LDAP operations and error reasons used as metric labels
+const (
+	opDial           = "dial"
+	opBind           = "bind"
+	opSearch         = "search"
+	opUserBind       = "user_bind"
+	opGroupSearch    = "group_search"
+	opPasswordChange = "password_change"
+
+	reasonConnection         = "connection"
+	reasonBinding            = "binding"
+	reasonSearch             = "search"
+	reasonNoUser             = "no_user"
+	reasonMultipleUsers      = "multiple_users"
+	reasonInvalidCredentials = "invalid_credentials"
+)
+
 //RegisterLDAPClientMetrics registers the metrics for the token generation
-func RegisterLDAPClientMetrics() {
+func RegisterLDAPClientMetrics(legacy bool) {
+	prometheus.MustRegister(ldapErrors)
+	prometheus.MustRegister(ldapOperationDuration)
+	if !legacy {
+		return
+	}
+
 	prometheus.MustRegister(ldapConnectionError)
 	prometheus.MustRegister(ldapBindingError)
 	prometheus.MustRegister(userSearchFailed)
@@ -79,86 +208,435 @@ func RegisterLDAPClientMetrics() {
 // Authenticate a user against the LDAP directory. Returns an LDAP entry if password
 // is valid, otherwise returns an error.
 func (c *Client) Authenticate(username, password string) (*ldap.Entry, error) {
-	conn, err := c.dial()
+	return c.AuthenticateContext(context.Background(), username, password)
+}
+
+// AuthenticateContext is Authenticate recording the LDAP operations as
+// spans of the trace in ctx. The LDAP operations are aborted when ctx is
+// done, e.g. because the client disconnected.
+func (c *Client) AuthenticateContext(ctx context.Context, username, password string) (*ldap.Entry, error) {
+	ctx, span := tracing.Start(ctx, "ldap.Client.Authenticate", tracing.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("ldap.server", c.LdapServer)
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(c.Timeout, DefaultTimeout))
+	defer cancel()
+
+	entry, err := c.authenticate(ctx, username, password)
+	span.RecordError(err)
+	return entry, err
+}
+
+func (c *Client) authenticate(ctx context.Context, username, password string) (*ldap.Entry, error) {
+	conn, entry, err := c.findUser(ctx, c.userFilter(ldap.EscapeFilter(username)), username, password)
 	if err != nil {
-		ldapConnectionError.Inc()
-		return nil, fmt.Errorf("Error opening LDAP connection: %v", err)
+		return nil, err
 	}
 	defer conn.Close()
 
-	// Bind user to perform the search
-	if c.SearchUserDN != "" && c.SearchUserPassword != "" {
-		err = conn.Bind(c.SearchUserDN, c.SearchUserPassword)
-	} else {
-		err = conn.Bind(username, password)
+	// Now that we know the user exists within the BaseDN scope
+	// let's do user bind to check credentials using the full DN instead of
+	// the attribute used for search
+	if c.hasServiceAccount() {
+		account, err := c.checkAccount(ctx, entry, username)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.bind(ctx, conn, opUserBind, entry.DN, password)
+		if err != nil {
+			invalidUserCredentials.Inc()
+			c.countError(reasonInvalidCredentials)
+			e := newError(err, ReasonInvalidCredentials, fmt.Sprintf("Error binding user %s", username))
+			e.Account = account
+			return nil, e
+		}
+	}
+
+	if err := c.addGroups(ctx, conn, entry, username); err != nil {
+		return nil, err
+	}
+
+	// Single user entry found
+	return entry, nil
+}
+
+// findUser connects to the directory and searches the entry of username
+// by filter. The connection is closed on errors.
+func (c *Client) findUser(ctx context.Context, filter, username, password string) (*conn, *ldap.Entry, error) {
+	done := c.startOperation(ctx, opDial)
+	conn, err := c.dial(ctx)
+	done(err)
+	if err != nil {
+		ldapConnectionError.Inc()
+		c.countError(reasonConnection)
+		return nil, nil, newError(err, ReasonServerUnavailable, "Error opening LDAP connection")
+	}
+
+	entry, err := c.searchUser(ctx, conn, filter, username, password)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, entry, nil
+}
+
+// searchUser binds conn as the search user or, without one, as the user
+// and searches the entry of username by filter.
+func (c *Client) searchUser(ctx context.Context, conn *conn, filter, username, password string) (*ldap.Entry, error) {
+	var err error
+
+	// Bind user to perform the search. With SASL EXTERNAL the connection
+	// is already bound.
+	// A rejected search user is an error of the configuration, not of
+	// the credentials of the user.
+	bindReason := ReasonDirectoryError
+	if !c.SASLExternal {
+		if c.hasServiceAccount() {
+			err = c.bind(ctx, conn, opBind, c.SearchUserDN, c.searchUserPassword())
+		} else {
+			bindReason = ReasonInvalidCredentials
+			err = c.bind(ctx, conn, opBind, username, password)
+		}
 	}
 
 	if err != nil {
 		ldapBindingError.Inc()
-		return nil, fmt.Errorf("Error binding user to LDAP server: %v", err)
+		c.countError(reasonBinding)
+		return nil, newError(err, bindReason, "Error binding user to LDAP server")
 	}
 
-	req := c.newUserSearchRequest(username)
+	req := c.newUserSearchRequest(filter)
 
 	// Do a search to ensure the user exists within the BaseDN scope
-	res, err := conn.Search(req)
+	res, err := c.search(ctx, conn, opSearch, req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		// more entries than the size limit of 2
+		multipleUsersFound.Inc()
+		c.countError(reasonMultipleUsers)
+		return nil, &Error{Reason: ReasonAmbiguousUser, Message: fmt.Sprintf("Multiple entries found for the search filter '%s'", req.Filter), Err: err}
+	}
 	if err != nil {
 		userSearchFailed.Inc()
-		return nil, fmt.Errorf("Error searching for user %s: %v", username, err)
+		c.countError(reasonSearch)
+		return nil, newError(err, ReasonDirectoryError, fmt.Sprintf("Error searching for user %s", username))
 	}
 
 	switch {
 	case len(res.Entries) == 0:
 		noUserFound.Inc()
-		return nil, fmt.Errorf("No result for the search filter '%s'", req.Filter)
+		c.countError(reasonNoUser)
+		return nil, &Error{Reason: ReasonUserNotFound, Message: fmt.Sprintf("No result for the search filter '%s'", req.Filter)}
 	case len(res.Entries) > 1:
 		multipleUsersFound.Inc()
-		return nil, fmt.Errorf("Multiple entries found for the search filter '%s': %+v", req.Filter, res.Entries)
+		c.countError(reasonMultipleUsers)
+		// only the DNs, as the message ends up in logs and the audit log
+		dns := make([]string, len(res.Entries))
+		for i, entry := range res.Entries {
+			dns[i] = entry.DN
+		}
+		return nil, &Error{Reason: ReasonAmbiguousUser, Message: fmt.Sprintf("Multiple entries found for the search filter '%s': %d entries, %s", req.Filter, len(dns), strings.Join(dns, "; "))}
 	}
 
-	// Now that we know the user exists within the BaseDN scope
-	// let's do user bind to check credentials using the full DN instead of
-	// the attribute used for search
-	if c.SearchUserDN != "" && c.SearchUserPassword != "" {
-		err = conn.Bind(res.Entries[0].DN, password)
+	return res.Entries[0], nil
+}
+
+// AuthenticateDirectory is AuthenticateContext also describing the directory.
+func (c *Client) AuthenticateDirectory(ctx context.Context, username, password string) (*ldap.Entry, *Directory, error) {
+	entry, err := c.AuthenticateContext(ctx, username, password)
+	return entry, c.Directory(), err
+}
+
+// Directory describes the directory of the client. Its name defaults to
+// the server.
+func (c *Client) Directory() *Directory {
+	name := c.Name
+	if name == "" {
+		name = c.LdapServer
+	}
+	return &Directory{
+		Name:              name,
+		Server:            c.LdapServer,
+		UsernameAttribute: c.UsernameAttribute,
+		UsernamePrefix:    c.UsernamePrefix,
+		UIDAttribute:      c.UIDAttribute,
+	}
+}
+
+// addGroups searches the groups of entry if GroupBaseDN is set.
+func (c *Client) addGroups(ctx context.Context, conn *conn, entry *ldap.Entry, username string) error {
+	if c.GroupBaseDN == "" {
+		return nil
+	}
+	if err := c.searchGroups(ctx, conn, entry, username); err != nil {
+		userSearchFailed.Inc()
+		c.countError(reasonSearch)
+		return newError(err, ReasonDirectoryError, fmt.Sprintf("Error searching groups of user %s", username))
+	}
+	return nil
+}
+
+// searchGroups adds the DNs of the groups of entry to its memberOf attribute.
+func (c *Client) searchGroups(ctx context.Context, conn *conn, entry *ldap.Entry, username string) error {
+	filter := c.GroupFilter
+	if filter == "" {
+		filter = DefaultGroupFilter
+	}
+	filter = strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(entry.DN),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(filter)
+
+	res, err := c.search(ctx, conn, opGroupSearch, &ldap.SearchRequest{
+		BaseDN:       c.GroupBaseDN,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		TimeLimit:    c.searchTimeLimit(),
+		Filter:       filter,
+		Attributes:   []string{"1.1"}, // no attributes, only DNs
+	})
+	if err != nil {
+		return err
+	}
+
+	var memberOf *ldap.EntryAttribute
+	for _, attribute := range entry.Attributes {
+		if attribute.Name == "memberOf" {
+			memberOf = attribute
+		}
+	}
+	if memberOf == nil {
+		memberOf = &ldap.EntryAttribute{Name: "memberOf"}
+		entry.Attributes = append(entry.Attributes, memberOf)
+	}
+	for _, group := range res.Entries {
+		memberOf.Values = append(memberOf.Values, group.DN)
+		memberOf.ByteValues = append(memberOf.ByteValues, []byte(group.DN))
+	}
+	return nil
+}
+
+// Ping checks that the directory can be reached and, if a search user is
+// configured, that it can bind. It is meant for readiness checks and is
+// not counted in the LDAP metrics.
+func (c *Client) Ping(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "ldap.Client.Ping", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("ldap.server", c.LdapServer)
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("Error opening LDAP connection: %v", err)
+	}
+	defer conn.Close()
+
+	if !c.SASLExternal && c.SearchUserDN != "" && c.searchUserPassword() != "" {
+		if err := c.run(ctx, conn, timeoutOrDefault(c.BindTimeout, DefaultBindTimeout), func() error {
+			return conn.Bind(c.SearchUserDN, c.searchUserPassword())
+		}); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("Error binding search user to LDAP server: %v", err)
+		}
+	}
+	return nil
+}
+
+// hasServiceAccount returns true if users are searched with an account of
+// this app rather than with their own credentials.
+func (c *Client) hasServiceAccount() bool {
+	return c.SASLExternal || (c.SearchUserDN != "" && c.searchUserPassword() != "")
+}
+
+func (c *Client) searchUserPassword() string {
+	if c.GetSearchUserPassword != nil {
+		return c.GetSearchUserPassword()
+	}
+	return c.SearchUserPassword
+}
+
+// startOperation starts timing an LDAP operation. The returned function
+// records its duration and span once the operation finished.
+func (c *Client) startOperation(ctx context.Context, operation string) func(error) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "ldap."+operation, tracing.KindClient)
+	span.SetAttribute("ldap.server", c.LdapServer)
+
+	return func(err error) {
+		outcome := "success"
 		if err != nil {
-			invalidUserCredentials.Inc()
-			return nil, fmt.Errorf("Error binding user %s, invalid credentials: %v", username, err)
+			outcome = "error"
 		}
+		ldapOperationDuration.WithLabelValues(c.LdapServer, operation, outcome).Observe(time.Since(start).Seconds())
+
+		span.RecordError(err)
+		span.Finish()
 	}
+}
 
-	// Single user entry found
-	return res.Entries[0], nil
+func (c *Client) countError(reason string) {
+	ldapErrors.WithLabelValues(c.LdapServer, reason).Inc()
 }
 
-// Create a new TCP connection to the LDAP server
-func (c *Client) dial() (*ldap.Conn, error) {
-	address := fmt.Sprintf("%s:%d", c.LdapServer, c.LdapPort)
+// bind binds conn as dn within BindTimeout, timed as operation.
+func (c *Client) bind(ctx context.Context, conn *conn, operation, dn, password string) error {
+	done := c.startOperation(ctx, operation)
+	err := c.run(ctx, conn, timeoutOrDefault(c.BindTimeout, DefaultBindTimeout), func() error {
+		return conn.Bind(dn, password)
+	})
+	done(err)
+	return err
+}
+
+// search searches within SearchTimeout, timed as operation.
+func (c *Client) search(ctx context.Context, conn *conn, operation string, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	var res *ldap.SearchResult
+	done := c.startOperation(ctx, operation)
+	err := c.run(ctx, conn, timeoutOrDefault(c.SearchTimeout, DefaultSearchTimeout), func() error {
+		var err error
+		res, err = conn.Search(req)
+		return err
+	})
+	done(err)
+	return res, err
+}
+
+// run runs an LDAP operation on conn. If it takes longer than timeout or
+// ctx is done first, the connection is aborted and can't be used anymore.
+func (c *Client) run(ctx context.Context, conn *conn, timeout time.Duration, operation func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stop := abortOnDone(ctx, conn.netConn)
+	err := operation()
+	stop()
+	return contextError(ctx, err)
+}
+
+// abortOnDone fails all reads and writes of netConn once ctx is done,
+// unless the returned function is called before. go-ldap then closes the
+// connection.
+func abortOnDone(ctx context.Context, netConn net.Conn) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.SetDeadline(time.Unix(1, 0))
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// contextError attributes err to ctx if ctx is done, as operations
+// aborted by abortOnDone fail with unspecific errors of the connection.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+// timeoutOrDefault returns timeout, or def if timeout is not positive.
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	if timeout <= 0 {
+		return def
+	}
+	return timeout
+}
+
+// searchTimeLimit is the time limit of searches in seconds, so that the
+// server gives up on searches as the client does.
+func (c *Client) searchTimeLimit() int {
+	timeout := timeoutOrDefault(c.SearchTimeout, DefaultSearchTimeout)
+	return int((timeout + time.Second - 1) / time.Second)
+}
+
+// Create a new TCP connection to the LDAP server within DialTimeout
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	address := net.JoinHostPort(c.LdapServer, fmt.Sprint(c.LdapPort))
 
-	if c.TLSConfig != nil && !c.UseInsecure {
-		return ldap.DialTLS("tcp", address, c.TLSConfig)
+	if c.SASLExternal && (c.TLSConfig == nil || c.UseInsecure) {
+		return nil, errors.New("SASL EXTERNAL binds require TLS")
+	}
+	// TLSConfig was not specified, and insecure flag not set
+	if c.TLSConfig == nil && !c.UseInsecure {
+		return nil, errors.New("The LDAP TLS Configuration was not set.")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(c.DialTimeout, DefaultDialTimeout))
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
 	}
 
 	// This will send passwords in clear text (LDAP doesn't obfuscate password in any way),
 	// thus we use a flag to enable this mode
 	if c.UseInsecure {
-		return ldap.Dial("tcp", address)
+		ldapConn := ldap.NewConn(netConn, false)
+		ldapConn.Start()
+		return &conn{Conn: ldapConn, netConn: netConn}, nil
 	}
 
-	// TLSConfig was not specified, and insecure flag not set
-	return nil, errors.New("The LDAP TLS Configuration was not set.")
+	tlsConfig := c.TLSConfig
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = c.LdapServer
+	}
+	tlsConn := tls.Client(netConn, tlsConfig)
+
+	stop := abortOnDone(ctx, netConn)
+	err = tlsConn.Handshake()
+	if err == nil && c.SASLExternal {
+		err = ExternalBind(tlsConn, timeoutOrDefault(c.BindTimeout, DefaultBindTimeout))
+	}
+	stop()
+	if err = contextError(ctx, err); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	ldapConn := ldap.NewConn(tlsConn, true)
+	ldapConn.Start()
+	return &conn{Conn: ldapConn, netConn: netConn}, nil
+}
+
+// userFilter returns the filter finding username by its login attribute.
+// username must be escaped with ldap.EscapeFilter.
+func (c *Client) userFilter(username string) string {
+	return fmt.Sprintf("(%s=%s)", c.UserLoginAttribute, username)
 }
 
-func (c *Client) newUserSearchRequest(username string) *ldap.SearchRequest {
-	// TODO(abrand): sanitize
-	userFilter := fmt.Sprintf("(%s=%s)", c.UserLoginAttribute, username)
+// checkAccount returns the key of the account of entry, see
+// identity.Identity.Account, or an error if the identity.AccountCheck of
+// ctx refuses it, e.g. after too many failed logins under other spellings
+// of the username.
+func (c *Client) checkAccount(ctx context.Context, entry *ldap.Entry, username string) (string, error) {
+	id := identity.Identity{DN: entry.DN, Source: c.Directory().Source()}
+	account := id.Account()
+	if err := identity.CheckAccount(ctx, account); err != nil {
+		return account, &Error{Reason: ReasonThrottled, Message: fmt.Sprintf("Refusing login of user %s", username), Err: err, Account: account}
+	}
+	return account, nil
+}
+
+func (c *Client) newUserSearchRequest(userFilter string) *ldap.SearchRequest {
+	// all user attributes, and the UID, which is operational in OpenLDAP
+	var attributes []string
+	if c.UIDAttribute != "" {
+		attributes = []string{"*", c.UIDAttribute}
+	}
 	return &ldap.SearchRequest{
 		BaseDN:       c.BaseDN,
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases, // ????
 		SizeLimit:    2,
-		TimeLimit:    10, // make configurable?
+		TimeLimit:    c.searchTimeLimit(),
 		TypesOnly:    false,
 		Filter:       userFilter,
+		Attributes:   attributes,
 	}
 }
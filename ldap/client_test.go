@@ -0,0 +1,431 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/ldaptest"
+)
+
+const testLDIF = `
+dn: dc=example,dc=com
+objectClass: domain
+
+dn: uid=svc,dc=example,dc=com
+uid: svc
+userPassword: svc-pw
+
+dn: uid=alice,dc=example,dc=com
+objectClass: person
+uid: alice
+userPrincipalName: alice@example.com
+cn: Shared
+userPassword: alice-pw
+
+dn: uid=bob,dc=example,dc=com
+objectClass: person
+uid: bob
+cn: Shared
+userPassword: bob-pw
+
+dn: ou=groups,dc=example,dc=com
+objectClass: organizationalUnit
+
+dn: cn=admins,ou=groups,dc=example,dc=com
+member: uid=alice,dc=example,dc=com
+
+dn: cn=developers,ou=groups,dc=example,dc=com
+member: uid=alice,dc=example,dc=com
+member: uid=bob,dc=example,dc=com
+`
+
+// newTestDirectory starts an LDAPS server with testLDIF and returns a
+// client using its search user.
+func newTestDirectory(t *testing.T) (*ldaptest.Server, *Client) {
+	server := ldaptest.NewUnstartedServer()
+	if err := server.LoadLDIF(strings.NewReader(testLDIF)); err != nil {
+		t.Fatal(err)
+	}
+	server.MemberOf = true
+	server.StartTLS()
+
+	return server, &Client{
+		BaseDN:             "dc=example,dc=com",
+		LdapServer:         server.Host(),
+		LdapPort:           server.Port(),
+		UserLoginAttribute: "uid",
+		SearchUserDN:       "uid=svc,dc=example,dc=com",
+		SearchUserPassword: "svc-pw",
+		TLSConfig:          server.ClientTLSConfig(),
+	}
+}
+
+func TestClientAuthenticate(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	entry, err := client.Authenticate("alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if entry.DN != "uid=alice,dc=example,dc=com" {
+		t.Errorf("Unexpected entry %s", entry.DN)
+	}
+	expected := []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=developers,ou=groups,dc=example,dc=com"}
+	if groups := entry.GetAttributeValues("memberOf"); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected groups %v, got %v", expected, groups)
+	}
+
+	cases := []struct {
+		name          string
+		configure     func(*Client)
+		username      string
+		password      string
+		expectedError string
+		reason        Reason
+	}{
+		{"wrong password", nil, "alice", "wrong", "invalid credentials", ReasonInvalidCredentials},
+		{"unknown user", nil, "carol", "carol-pw", "No result", ReasonUserNotFound},
+		// wildcards don't find alice
+		{"wildcard username", nil, "a*ice", "alice-pw", "No result", ReasonUserNotFound},
+		{"wildcard only", nil, "*", "alice-pw", "No result", ReasonUserNotFound},
+		{"ambiguous user", func(c *Client) { c.UserLoginAttribute = "cn" }, "Shared", "alice-pw", "Multiple entries", ReasonAmbiguousUser},
+		{"wrong search user password", func(c *Client) { c.SearchUserPassword = "wrong" }, "alice", "alice-pw", "Error binding user", ReasonDirectoryError},
+		{"untrusted certificate", func(c *Client) { c.TLSConfig = &tls.Config{ServerName: server.Host()} }, "alice", "alice-pw", "Error opening LDAP connection", ReasonServerUnavailable},
+		{"no TLS configuration", func(c *Client) { c.TLSConfig = nil }, "alice", "alice-pw", "TLS Configuration was not set", ReasonServerUnavailable},
+	}
+	for _, c := range cases {
+		testClient := *client
+		if c.configure != nil {
+			c.configure(&testClient)
+		}
+		_, err := testClient.Authenticate(c.username, c.password)
+		if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.expectedError, err)
+		}
+		if reason := ReasonOf(err); reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %s", c.name, c.reason, reason)
+		}
+		if c.reason == ReasonAmbiguousUser && (!strings.Contains(err.Error(), "uid=alice,dc=example,dc=com") || strings.Contains(err.Error(), "Attributes")) {
+			t.Errorf("%s: expected only the DNs of the entries, got %v", c.name, err)
+		}
+	}
+}
+
+func TestClientAccountCheck(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.Name = "example"
+
+	var checked []string
+	refuse := errors.New("locked out")
+	ctx := identity.WithAccountCheck(context.Background(), func(account string) error {
+		checked = append(checked, account)
+		if len(checked) > 1 {
+			return refuse
+		}
+		return nil
+	})
+
+	const account = "example/uid=alice,dc=example,dc=com"
+	_, err := client.AuthenticateContext(ctx, "alice", "wrong")
+	if ReasonOf(err) != ReasonInvalidCredentials || AccountOf(err) != account {
+		t.Errorf("Expected invalid credentials of %s, got %v of %q", account, err, AccountOf(err))
+	}
+
+	_, err = client.AuthenticateContext(ctx, "alice", "alice-pw")
+	if ReasonOf(err) != ReasonThrottled || !errors.Is(err, refuse) || AccountOf(err) != account {
+		t.Errorf("Expected refused account %s, got %v", account, err)
+	}
+	if !reflect.DeepEqual(checked, []string{account, account}) {
+		t.Errorf("Expected checks of %s, got %v", account, checked)
+	}
+
+	// unknown users have no account to check
+	checked = nil
+	if _, err := client.AuthenticateContext(ctx, "carol", "carol-pw"); ReasonOf(err) != ReasonUserNotFound || AccountOf(err) != "" {
+		t.Errorf("Expected unknown user without account, got %v", err)
+	}
+	if len(checked) != 0 {
+		t.Errorf("Unexpected checks %v", checked)
+	}
+}
+
+func TestClientActiveDirectoryErrors(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	cases := []struct {
+		subCode string
+		reason  Reason
+	}{
+		{"52e", ReasonInvalidCredentials},
+		{"532", ReasonPasswordExpired},
+		{"533", ReasonAccountDisabled},
+		{"701", ReasonAccountDisabled},
+		{"773", ReasonMustChangePassword},
+		{"775", ReasonAccountDisabled},
+		{"999", ReasonInvalidCredentials},
+	}
+	for _, c := range cases {
+		server.BindResult = func(dn, password string) *ldaptest.Result {
+			if dn != "uid=alice,dc=example,dc=com" {
+				return nil
+			}
+			return &ldaptest.Result{
+				Code:    49,
+				Message: "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data " + c.subCode + ", v3839",
+			}
+		}
+
+		_, err := client.Authenticate("alice", "alice-pw")
+		if reason := ReasonOf(err); reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %s (%v)", c.subCode, c.reason, reason, err)
+		}
+		var e *Error
+		if errors.As(err, &e) && e.SubCode != c.subCode {
+			t.Errorf("%s: unexpected sub-code %q", c.subCode, e.SubCode)
+		}
+	}
+
+	// the sub-codes of a rejected search user don't describe the user
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		return &ldaptest.Result{Code: 49, Message: "AcceptSecurityContext error, data 532, v3839"}
+	}
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonDirectoryError {
+		t.Errorf("Expected a directory error, got %v", err)
+	}
+}
+
+func TestClientServerUnavailable(t *testing.T) {
+	server, client := newTestDirectory(t)
+	server.Close()
+
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonServerUnavailable {
+		t.Errorf("Expected the server to be unavailable, got %v", err)
+	}
+
+	server, client = newTestDirectory(t)
+	defer server.Close()
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		return &ldaptest.Result{Code: 51, Message: "busy"}
+	}
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonServerUnavailable {
+		t.Errorf("Expected a busy server to be unavailable, got %v", err)
+	}
+}
+
+func TestClientWithoutSearchUser(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	// like Active Directory, users bind with their userPrincipalName
+	client.SearchUserDN, client.SearchUserPassword = "", ""
+	client.UserLoginAttribute = "userPrincipalName"
+
+	if _, err := client.Authenticate("alice@example.com", "alice-pw"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := client.Authenticate("alice@example.com", "wrong"); err == nil {
+		t.Errorf("Expected an error for a wrong password")
+	}
+}
+
+func TestClientGroupSearch(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	server.MemberOf = false
+
+	client.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	entry, err := client.Authenticate("bob", "bob-pw")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"cn=developers,ou=groups,dc=example,dc=com"}
+	if groups := entry.GetAttributeValues("memberOf"); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected groups %v, got %v", expected, groups)
+	}
+}
+
+func TestClientSearchUserPasswordFunc(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	password := "wrong"
+	client.SearchUserPassword = ""
+	client.GetSearchUserPassword = func() string { return password }
+	if _, err := client.Authenticate("alice", "alice-pw"); err == nil {
+		t.Errorf("Expected an error with the wrong search user password")
+	}
+
+	password = "svc-pw"
+	if _, err := client.Authenticate("alice", "alice-pw"); err != nil {
+		t.Errorf("Unexpected error after the password changed: %v", err)
+	}
+}
+
+func TestClientInsecure(t *testing.T) {
+	server := ldaptest.NewUnstartedServer()
+	if err := server.LoadLDIF(strings.NewReader(testLDIF)); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	client := &Client{
+		BaseDN:             "dc=example,dc=com",
+		LdapServer:         server.Host(),
+		LdapPort:           server.Port(),
+		UseInsecure:        true,
+		UserLoginAttribute: "uid",
+		SearchUserDN:       "uid=svc,dc=example,dc=com",
+		SearchUserPassword: "svc-pw",
+	}
+	if _, err := client.Authenticate("bob", "bob-pw"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestClientSASLExternal(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	var bound string
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		if !strings.HasPrefix(dn, "uid=") {
+			bound = dn
+		}
+		return nil
+	}
+
+	client.SearchUserDN, client.SearchUserPassword = "", ""
+	client.SASLExternal = true
+	client.TLSConfig.Certificates = []tls.Certificate{server.ClientCertificate("kubernetes-ldap")}
+
+	if _, err := client.Authenticate("alice", "alice-pw"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if bound != "cn=kubernetes-ldap" {
+		t.Errorf("Expected a SASL EXTERNAL bind as the client certificate, got %q", bound)
+	}
+
+	client.TLSConfig.Certificates = nil
+	if _, err := client.Authenticate("alice", "alice-pw"); err == nil {
+		t.Errorf("Expected SASL EXTERNAL to fail without a client certificate")
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	server, client := newTestDirectory(t)
+
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	client.SearchUserPassword = "wrong"
+	if err := client.Ping(context.Background()); err == nil {
+		t.Errorf("Expected an error with a wrong search user password")
+	}
+
+	server.Close()
+	client.SearchUserPassword = "svc-pw"
+	if err := client.Ping(context.Background()); err == nil {
+		t.Errorf("Expected an error with the directory down")
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.BindTimeout = 50 * time.Millisecond
+
+	// binds of alice hang until the test finishes
+	release := make(chan struct{})
+	defer close(release)
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		if dn == "uid=alice,dc=example,dc=com" {
+			<-release
+		}
+		return nil
+	}
+
+	start := time.Now()
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonTimeout {
+		t.Errorf("Expected the bind to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the bind to be aborted, took %v", elapsed)
+	}
+
+	// the overall timeout applies to the operations together
+	client.BindTimeout = 0
+	client.Timeout = 50 * time.Millisecond
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonTimeout {
+		t.Errorf("Expected the authentication to time out, got %v", err)
+	}
+
+	// other users are unaffected
+	if _, err := client.Authenticate("bob", "bob-pw"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestClientCanceled(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		if dn == "uid=alice,dc=example,dc=com" {
+			// the client disconnects while the directory is busy
+			cancel()
+			<-release
+		}
+		return nil
+	}
+
+	if _, err := client.AuthenticateContext(ctx, "alice", "alice-pw"); ReasonOf(err) != ReasonCanceled {
+		t.Errorf("Expected the authentication to be canceled, got %v", err)
+	}
+}
+
+func TestClientDialTimeout(t *testing.T) {
+	// a server which accepts connections but never completes the TLS
+	// handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	client := &Client{
+		BaseDN:             "dc=example,dc=com",
+		LdapServer:         address.IP.String(),
+		LdapPort:           uint(address.Port),
+		UserLoginAttribute: "uid",
+		TLSConfig:          &tls.Config{},
+		DialTimeout:        50 * time.Millisecond,
+	}
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonTimeout {
+		t.Errorf("Expected the handshake to time out, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+)
+
+// Reason classifies why authenticating a user failed.
+type Reason string
+
+// Reasons of authentication failures
+const (
+	ReasonInvalidCredentials Reason = "invalid_credentials"
+	ReasonUserNotFound       Reason = "user_not_found"
+	ReasonAmbiguousUser      Reason = "ambiguous_user"
+	// ReasonAccountDisabled includes accounts which expired or are locked
+	// out.
+	ReasonAccountDisabled    Reason = "account_disabled"
+	ReasonPasswordExpired    Reason = "password_expired"
+	ReasonMustChangePassword Reason = "must_change_password"
+	// ReasonPasswordRejected is a new password which violates the
+	// password policy of the directory.
+	ReasonPasswordRejected  Reason = "password_rejected"
+	ReasonServerUnavailable Reason = "server_unavailable"
+	ReasonTimeout           Reason = "timeout"
+	// ReasonCanceled is an authentication aborted because its request
+	// was canceled, e.g. by the client disconnecting.
+	ReasonCanceled Reason = "canceled"
+	// ReasonDirectoryError is any other failure of the directory, e.g. a
+	// rejected search user or a missing base DN.
+	ReasonDirectoryError Reason = "directory_error"
+	// ReasonThrottled is a login refused by the identity.AccountCheck of
+	// the caller before the password was tried.
+	ReasonThrottled Reason = "throttled"
+)
+
+// Error is an authentication failure classified by its reason.
+type Error struct {
+	Reason Reason
+	// Message describes the failure for logs and audit events.
+	Message string
+	// SubCode is the Active Directory error like "52e" of failed binds.
+	SubCode string
+	// Err is the error of the LDAP operation, if any.
+	Err error
+	// Account is the key of the entry the username resolved to, see
+	// identity.Identity.Account. Empty if the entry is unknown.
+	Account string
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the LDAP operation.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ReasonOf returns the reason of an authentication error, or an empty
+// reason for errors which aren't an *Error.
+func ReasonOf(err error) Reason {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Reason
+	}
+	return ""
+}
+
+// AccountOf returns the account of the entry an authentication error
+// resolved the username to, or "" if unknown.
+func AccountOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Account
+	}
+	return ""
+}
+
+// adSubCodes maps the "data" codes in the diagnostic messages of failed
+// Active Directory binds to reasons.
+var adSubCodes = map[string]Reason{
+	"525": ReasonUserNotFound,
+	"52e": ReasonInvalidCredentials,
+	"530": ReasonAccountDisabled, // logon not permitted at this time
+	"531": ReasonAccountDisabled, // logon not permitted at this workstation
+	"532": ReasonPasswordExpired,
+	"533": ReasonAccountDisabled,
+	"701": ReasonAccountDisabled, // account expired
+	"773": ReasonMustChangePassword,
+	"775": ReasonAccountDisabled, // account locked out
+}
+
+// adSubCodePattern matches the sub-code in diagnostic messages like
+// "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839".
+var adSubCodePattern = regexp.MustCompile(`\bdata ([0-9a-fA-F]{3,8})\b`)
+
+// newError classifies err of an LDAP operation. Errors which can't be
+// attributed to the network or the account get the reason fallback.
+func newError(err error, fallback Reason, message string) *Error {
+	e := &Error{Reason: fallback, Message: message, Err: err}
+
+	// operations aborted by their context, see Client.run
+	switch {
+	case errors.Is(err, context.Canceled):
+		e.Reason = ReasonCanceled
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Reason = ReasonTimeout
+		return e
+	}
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		if isTimeout(err) {
+			e.Reason = ReasonTimeout
+		} else if _, ok := err.(net.Error); ok {
+			e.Reason = ReasonServerUnavailable
+		}
+		return e
+	}
+
+	switch ldapErr.ResultCode {
+	case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable,
+		ldap.LDAPResultServerDown, ldap.LDAPResultConnectError:
+		e.Reason = ReasonServerUnavailable
+		if isTimeout(ldapErr.Err) {
+			e.Reason = ReasonTimeout
+		}
+
+	case ldap.LDAPResultTimeLimitExceeded, ldap.LDAPResultTimeout:
+		e.Reason = ReasonTimeout
+
+	case ldap.LDAPResultInvalidCredentials:
+		if ldapErr.Err == nil {
+			break
+		}
+		if m := adSubCodePattern.FindStringSubmatch(ldapErr.Err.Error()); m != nil {
+			e.SubCode = strings.ToLower(m[1])
+			if reason, ok := adSubCodes[e.SubCode]; ok && fallback == ReasonInvalidCredentials {
+				e.Reason = reason
+			}
+		}
+	}
+	return e
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reasonPriority orders the reasons of failures in several directories,
+// the most telling one first: a directory which knows the user explains
+// the failure better than those which don't.
+var reasonPriority = []Reason{
+	ReasonThrottled,
+	ReasonAccountDisabled,
+	ReasonPasswordExpired,
+	ReasonMustChangePassword,
+	ReasonPasswordRejected,
+	ReasonInvalidCredentials,
+	ReasonAmbiguousUser,
+	ReasonCanceled,
+	ReasonTimeout,
+	ReasonServerUnavailable,
+	ReasonDirectoryError,
+	ReasonUserNotFound,
+}
+
+// mostTelling returns the reason of errs first in reasonPriority.
+func mostTelling(errs []error) Reason {
+	best := len(reasonPriority)
+	for _, err := range errs {
+		for i, reason := range reasonPriority {
+			if reason == ReasonOf(err) && i < best {
+				best = i
+			}
+		}
+	}
+	if best == len(reasonPriority) {
+		return ReasonDirectoryError
+	}
+	return reasonPriority[best]
+}
@@ -0,0 +1,68 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNewError(t *testing.T) {
+	cases := []struct {
+		err      error
+		fallback Reason
+		reason   Reason
+	}{
+		{ldap.NewError(ldap.ErrorNetwork, timeoutError{}), ReasonServerUnavailable, ReasonTimeout},
+		{ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused")), ReasonDirectoryError, ReasonServerUnavailable},
+		{ldap.NewError(ldap.LDAPResultTimeLimitExceeded, errors.New("time limit")), ReasonDirectoryError, ReasonTimeout},
+		{ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable")), ReasonDirectoryError, ReasonServerUnavailable},
+		{ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("data 773")), ReasonInvalidCredentials, ReasonMustChangePassword},
+		{ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("data 773")), ReasonDirectoryError, ReasonDirectoryError},
+		{ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object")), ReasonDirectoryError, ReasonDirectoryError},
+		{timeoutError{}, ReasonDirectoryError, ReasonTimeout},
+		{errors.New("TLS not configured"), ReasonServerUnavailable, ReasonServerUnavailable},
+		// aborted user binds aren't wrong passwords
+		{fmt.Errorf("%w: unable to read LDAP response packet", context.DeadlineExceeded), ReasonInvalidCredentials, ReasonTimeout},
+		{fmt.Errorf("%w: unable to read LDAP response packet", context.Canceled), ReasonInvalidCredentials, ReasonCanceled},
+	}
+	for _, c := range cases {
+		err := newError(c.err, c.fallback, "failed")
+		if err.Reason != c.reason {
+			t.Errorf("%v: expected reason %s, got %s", c.err, c.reason, err.Reason)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("%v: expected the error to wrap the LDAP error", c.err)
+		}
+	}
+}
+
+func TestReasonOf(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &Error{Reason: ReasonPasswordExpired})
+	if reason := ReasonOf(err); reason != ReasonPasswordExpired {
+		t.Errorf("Expected reason of wrapped error, got %q", reason)
+	}
+	if reason := ReasonOf(errors.New("plain")); reason != "" {
+		t.Errorf("Expected no reason, got %q", reason)
+	}
+
+	errs := []error{
+		&Error{Reason: ReasonUserNotFound},
+		&Error{Reason: ReasonServerUnavailable},
+		&Error{Reason: ReasonInvalidCredentials},
+	}
+	if reason := mostTelling(errs); reason != ReasonInvalidCredentials {
+		t.Errorf("Expected the reason of the directory knowing the user, got %s", reason)
+	}
+	if reason := mostTelling(errs[:1]); reason != ReasonUserNotFound {
+		t.Errorf("Expected user not found, got %s", reason)
+	}
+}
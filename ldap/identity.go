@@ -0,0 +1,145 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+)
+
+// AuthenticatorV2 is the successor of Authenticator, taking the context of
+// the request and returning backend-neutral identities.
+type AuthenticatorV2 = identity.Authenticator
+
+// contextAuthenticator is implemented by authenticators which take the
+// request context but don't describe the directory.
+type contextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, username, password string) (*ldap.Entry, error)
+}
+
+// UpgradeAuthenticator returns a as AuthenticatorV2. Authenticators which
+// don't implement it are adapted, passing the context and describing the
+// directory if they support it. The identities of adapted authenticators
+// are extracted by NewIdentity with usernameAttribute.
+func UpgradeAuthenticator(a Authenticator, usernameAttribute string) AuthenticatorV2 {
+	if v2, ok := a.(AuthenticatorV2); ok {
+		return v2
+	}
+	return authenticatorAdapter{a, usernameAttribute}
+}
+
+type authenticatorAdapter struct {
+	Authenticator
+	usernameAttribute string
+}
+
+func (a authenticatorAdapter) AuthenticateIdentity(ctx context.Context, username, password string) (*identity.Identity, error) {
+	var entry *ldap.Entry
+	var directory *Directory
+	var err error
+	switch v1 := a.Authenticator.(type) {
+	case DirectoryAuthenticator:
+		entry, directory, err = v1.AuthenticateDirectory(ctx, username, password)
+	case contextAuthenticator:
+		entry, err = v1.AuthenticateContext(ctx, username, password)
+	default:
+		entry, err = v1.Authenticate(username, password)
+	}
+	return NewIdentity(entry, directory, a.usernameAttribute), err
+}
+
+// NewIdentity extracts the identity of a user from its entry:
+//   - the username from the UsernameAttribute of the directory, else from
+//     usernameAttribute, else the DN,
+//   - the UID from the UIDAttribute of the directory,
+//   - the groups from the CNs of the memberOf DNs.
+//
+// Without entry the identity only describes the directory, and is nil if
+// that is unknown as well.
+func NewIdentity(entry *ldap.Entry, directory *Directory, usernameAttribute string) *identity.Identity {
+	if entry == nil {
+		if directory == nil {
+			return nil
+		}
+		return &identity.Identity{Source: directory.Source()}
+	}
+
+	var uidAttribute string
+	if directory != nil {
+		if directory.UsernameAttribute != "" {
+			usernameAttribute = directory.UsernameAttribute
+		}
+		uidAttribute = directory.UIDAttribute
+	}
+
+	id := &identity.Identity{
+		Username:   entry.DN,
+		DN:         entry.DN,
+		Groups:     groupsOf(entry.GetAttributeValues("memberOf")),
+		Attributes: make(map[string][]string, len(entry.Attributes)),
+	}
+	if usernameAttribute != "" {
+		id.Username = entry.GetAttributeValue(usernameAttribute)
+	}
+	if uidAttribute != "" {
+		id.UID = uidOf(entry, uidAttribute)
+	}
+	for _, attribute := range entry.Attributes {
+		id.Attributes[attribute.Name] = attribute.Values
+	}
+	if directory != nil {
+		id.Source = directory.Source()
+	}
+	return id
+}
+
+// groupsOf returns the lower-cased CNs of the groups, e.g. "admins" of
+// "CN=admins,OU=Groups,DC=example,DC=com".
+func groupsOf(memberOf []string) []string {
+	groups := []string{}
+	unique := make(map[string]struct{})
+
+	for _, dn := range memberOf {
+		for _, element := range strings.Split(dn, ",") {
+			element = strings.ToLower(element)
+			if !strings.Contains(element, "cn=") {
+				continue
+			}
+
+			group := strings.Replace(element, "cn=", "", -1)
+			if _, ok := unique[group]; ok {
+				continue
+			}
+			groups = append(groups, group)
+			unique[group] = struct{}{}
+		}
+	}
+	return groups
+}
+
+// uidOf returns the value of the attribute identifying the user. Binary
+// objectGUIDs of Active Directory are formatted as GUIDs.
+func uidOf(entry *ldap.Entry, attribute string) string {
+	if value := entry.GetRawAttributeValue(attribute); strings.EqualFold(attribute, "objectGUID") && len(value) == 16 {
+		// the first three fields are little endian
+		return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x",
+			value[3], value[2], value[1], value[0], value[5], value[4], value[7], value[6], value[8:10], value[10:])
+	}
+	return entry.GetAttributeValue(attribute)
+}
+
+// AuthenticateIdentity authenticates the user and extracts its identity
+// from its entry.
+func (c *Client) AuthenticateIdentity(ctx context.Context, username, password string) (*identity.Identity, error) {
+	entry, directory, err := c.AuthenticateDirectory(ctx, username, password)
+	return NewIdentity(entry, directory, ""), err
+}
+
+// AuthenticateIdentity authenticates the user against the directory of
+// its domain and extracts its identity from its entry.
+func (r *Router) AuthenticateIdentity(ctx context.Context, username, password string) (*identity.Identity, error) {
+	entry, directory, err := r.AuthenticateDirectory(ctx, username, password)
+	return NewIdentity(entry, directory, ""), err
+}
@@ -0,0 +1,137 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+type plainAuthenticator struct{}
+
+func (plainAuthenticator) Authenticate(username, password string) (*ldap.Entry, error) {
+	if password != "secret" {
+		return nil, errors.New("invalid password")
+	}
+	return ldap.NewEntry("uid="+username, nil), nil
+}
+
+type contextKey struct{}
+
+type tracingAuthenticator struct {
+	plainAuthenticator
+}
+
+func (a tracingAuthenticator) AuthenticateContext(ctx context.Context, username, password string) (*ldap.Entry, error) {
+	if ctx.Value(contextKey{}) == nil {
+		return nil, errors.New("context not passed")
+	}
+	return a.Authenticate(username, password)
+}
+
+type directoryAuthenticator struct {
+	plainAuthenticator
+}
+
+func (a directoryAuthenticator) AuthenticateDirectory(ctx context.Context, username, password string) (*ldap.Entry, *Directory, error) {
+	entry, err := a.Authenticate(username, password)
+	return entry, &Directory{Name: "example"}, err
+}
+
+func TestUpgradeAuthenticator(t *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey{}, true)
+	cases := []struct {
+		authenticator Authenticator
+		directory     string
+	}{
+		{plainAuthenticator{}, ""},
+		{tracingAuthenticator{}, ""},
+		{directoryAuthenticator{}, "example"},
+	}
+	for _, c := range cases {
+		a := UpgradeAuthenticator(c.authenticator, "")
+
+		identity, err := a.AuthenticateIdentity(ctx, "alice", "secret")
+		if err != nil {
+			t.Fatalf("%T: unexpected error: %v", c.authenticator, err)
+		}
+		if identity.DN != "uid=alice" || identity.Username != "uid=alice" {
+			t.Errorf("%T: unexpected identity %+v", c.authenticator, identity)
+		}
+		if source := identity.Source; (source == nil) != (c.directory == "") || (source != nil && source.Name != c.directory) {
+			t.Errorf("%T: expected directory %q, got %+v", c.authenticator, c.directory, source)
+		}
+
+		// failures still describe the directory if known
+		identity, err = a.AuthenticateIdentity(ctx, "alice", "wrong")
+		if err == nil {
+			t.Errorf("%T: expected an error", c.authenticator)
+		}
+		if (identity != nil) != (c.directory != "") {
+			t.Errorf("%T: unexpected identity %+v of failed login", c.authenticator, identity)
+		}
+	}
+
+	client := &Client{}
+	if UpgradeAuthenticator(client, "") != AuthenticatorV2(client) {
+		t.Errorf("Expected the client not to be adapted")
+	}
+}
+
+func TestNewIdentity(t *testing.T) {
+	entry := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":         {"alice"},
+		"mail":        {"alice@example.com"},
+		"employeeID":  {"4711"},
+		"memberOf":    {"cn=Admins,ou=groups,dc=example,dc=com", "cn=admins,ou=legacy,dc=example,dc=com", "cn=dev,ou=groups,dc=example,dc=com"},
+		"totpSecret":  {"JBSWY3DPEHPK3PXP"},
+		"description": nil,
+	})
+
+	cases := []struct {
+		directory         *Directory
+		usernameAttribute string
+		expectedUsername  string
+		expectedUID       string
+	}{
+		{nil, "", "uid=alice,ou=people,dc=example,dc=com", ""},
+		{nil, "uid", "alice", ""},
+		{&Directory{Name: "example"}, "mail", "alice@example.com", ""},
+		{&Directory{Name: "example", UsernameAttribute: "uid", UIDAttribute: "employeeID"}, "mail", "alice", "4711"},
+	}
+	for i, c := range cases {
+		id := NewIdentity(entry, c.directory, c.usernameAttribute)
+		if id.Username != c.expectedUsername || id.UID != c.expectedUID {
+			t.Errorf("Case %d: expected username %q and UID %q, got %q and %q", i, c.expectedUsername, c.expectedUID, id.Username, id.UID)
+		}
+		if len(id.Groups) != 2 || id.Groups[0] != "admins" || id.Groups[1] != "dev" {
+			t.Errorf("Case %d: unexpected groups %v", i, id.Groups)
+		}
+		if id.Attribute("totpSecret") != "JBSWY3DPEHPK3PXP" || id.Attribute("unknown") != "" {
+			t.Errorf("Case %d: unexpected attributes %v", i, id.Attributes)
+		}
+		if (id.Source == nil) != (c.directory == nil) {
+			t.Errorf("Case %d: unexpected source %+v", i, id.Source)
+		}
+	}
+
+	if NewIdentity(nil, nil, "uid") != nil {
+		t.Errorf("Expected no identity without entry and directory")
+	}
+	if id := NewIdentity(nil, &Directory{Name: "example"}, "uid"); id == nil || id.Source.Name != "example" || id.DN != "" {
+		t.Errorf("Expected an identity describing the directory, got %+v", id)
+	}
+}
+
+func TestObjectGUID(t *testing.T) {
+	guid := []byte{0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	entry := &ldap.Entry{DN: "cn=alice", Attributes: []*ldap.EntryAttribute{
+		{Name: "objectGUID", Values: []string{string(guid)}, ByteValues: [][]byte{guid}},
+	}}
+
+	id := NewIdentity(entry, &Directory{UIDAttribute: "objectGUID"}, "")
+	if expected := "00112233-4455-6677-8899-aabbccddeeff"; id.UID != expected {
+		t.Errorf("Expected UID %s, got %s", expected, id.UID)
+	}
+}
@@ -0,0 +1,86 @@
+package ldap
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// LookupContext returns the entry of a user who was authenticated by
+// other means, e.g. by a Kerberos ticket, including its groups as
+// AuthenticateContext. It requires a search user or SASL EXTERNAL, as
+// there are no credentials of the user to search with.
+func (c *Client) LookupContext(ctx context.Context, username string) (*ldap.Entry, error) {
+	return c.LookupFilterContext(ctx, "", username)
+}
+
+// LookupFilterContext is LookupContext finding the entry by filter
+// instead of the login attribute, e.g. a computer by the name of its
+// client certificate. {name} in filter is replaced with the escaped name.
+// An empty filter searches the login attribute.
+func (c *Client) LookupFilterContext(ctx context.Context, filter, name string) (*ldap.Entry, error) {
+	ctx, span := tracing.Start(ctx, "ldap.Client.Lookup", tracing.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("ldap.server", c.LdapServer)
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(c.Timeout, DefaultTimeout))
+	defer cancel()
+
+	entry, err := c.lookup(ctx, filter, name)
+	span.RecordError(err)
+	return entry, err
+}
+
+func (c *Client) lookup(ctx context.Context, filter, name string) (*ldap.Entry, error) {
+	if !c.hasServiceAccount() {
+		return nil, &Error{Reason: ReasonDirectoryError, Message: "Looking up users requires a search user"}
+	}
+
+	// unlike passwords, names from tickets and certificates may contain
+	// characters of filters
+	if filter == "" {
+		filter = c.userFilter(ldap.EscapeFilter(name))
+	} else {
+		filter = strings.Replace(filter, "{name}", ldap.EscapeFilter(name), -1)
+	}
+	conn, entry, err := c.findUser(ctx, filter, name, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := c.addGroups(ctx, conn, entry, name); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// LookupIdentity looks up the user and extracts its identity from its
+// entry.
+func (c *Client) LookupIdentity(ctx context.Context, username string) (*identity.Identity, error) {
+	return c.lookupIdentity(ctx, "", username)
+}
+
+func (c *Client) lookupIdentity(ctx context.Context, filter, name string) (*identity.Identity, error) {
+	entry, err := c.LookupFilterContext(ctx, filter, name)
+	return NewIdentity(entry, c.Directory(), ""), err
+}
+
+// FilterLookup finds users by a search filter instead of their login
+// attribute in the directories of Router, e.g. machines by the names of
+// their client certificates.
+type FilterLookup struct {
+	Router *Router
+	// Filter finds the entry of a name, which replaces {name}. By default
+	// the login attribute of the directory is searched.
+	Filter string
+}
+
+// LookupIdentity looks up the entry matching name like
+// Router.LookupIdentity.
+func (l *FilterLookup) LookupIdentity(ctx context.Context, name string) (*identity.Identity, error) {
+	return l.Router.lookupIdentity(ctx, l.Filter, name)
+}
@@ -0,0 +1,96 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClientLookup(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.UserLoginAttribute = "userPrincipalName"
+	client.UsernameAttribute = "uid"
+
+	id, err := client.LookupIdentity(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id.Username != "alice" || id.DN != "uid=alice,dc=example,dc=com" || len(id.Groups) != 2 {
+		t.Errorf("Unexpected identity %+v", id)
+	}
+
+	cases := []struct {
+		name      string
+		configure func(*Client)
+		username  string
+		reason    Reason
+	}{
+		{"unknown user", nil, "carol@example.com", ReasonUserNotFound},
+		{"filter characters", nil, "*", ReasonUserNotFound},
+		{"no search user", func(c *Client) { c.SearchUserDN = "" }, "alice@example.com", ReasonDirectoryError},
+	}
+	for _, c := range cases {
+		testClient := *client
+		if c.configure != nil {
+			c.configure(&testClient)
+		}
+		id, err := testClient.LookupIdentity(context.Background(), c.username)
+		if reason := ReasonOf(err); reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %v", c.name, c.reason, err)
+		}
+		if id == nil || id.DN != "" || id.Source == nil {
+			t.Errorf("%s: expected an identity describing the directory, got %+v", c.name, id)
+		}
+	}
+}
+
+func TestRouterLookup(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	other := *client
+	other.Name = "other"
+	other.BaseDN = "ou=groups,dc=example,dc=com"
+
+	router := &Router{Routes: []Route{{Client: &other}, {Client: client}}, TryAll: true}
+	id, err := router.LookupIdentity(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id.DN != "uid=bob,dc=example,dc=com" || id.Source.Name != server.Host() {
+		t.Errorf("Expected bob to be found in the second directory, got %+v", id)
+	}
+
+	if _, err := router.LookupIdentity(context.Background(), "carol"); ReasonOf(err) != ReasonUserNotFound {
+		t.Errorf("Expected carol not to be found, got %v", err)
+	}
+}
+
+func TestFilterLookup(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.UsernameAttribute = "uid"
+
+	lookup := &FilterLookup{
+		Router: &Router{Routes: []Route{{Client: client}}},
+		Filter: "(&(objectClass=person)(userPrincipalName={name}))",
+	}
+	id, err := lookup.LookupIdentity(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id.Username != "alice" || len(id.Groups) != 2 {
+		t.Errorf("Unexpected identity %+v", id)
+	}
+
+	for _, name := range []string{"alice", "*"} {
+		if _, err := lookup.LookupIdentity(context.Background(), name); ReasonOf(err) != ReasonUserNotFound {
+			t.Errorf("%s: expected no entry, got %v", name, err)
+		}
+	}
+
+	// without filter the login attribute is searched
+	lookup.Filter = ""
+	if id, err := lookup.LookupIdentity(context.Background(), "bob"); err != nil || id.Username != "bob" {
+		t.Errorf("Expected bob, got %+v (%v)", id, err)
+	}
+}
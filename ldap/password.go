@@ -0,0 +1,157 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/tracing"
+)
+
+// Methods of changing passwords
+const (
+	// PasswordChangeRFC3062 binds as the user and sends the Password
+	// Modify extended operation, e.g. to OpenLDAP.
+	PasswordChangeRFC3062 = "rfc3062"
+	// PasswordChangeAD replaces the unicodePwd attribute of the user,
+	// bound as the search user, proving the current password like
+	// Windows does. Active Directory requires TLS for it.
+	PasswordChangeAD = "ad"
+)
+
+// PasswordChanger changes the password of a user, e.g. after it expired.
+type PasswordChanger interface {
+	// ChangePassword returns the identity of the user like
+	// AuthenticateIdentity with the new password.
+	ChangePassword(ctx context.Context, username, oldPassword, newPassword string) (*identity.Identity, error)
+}
+
+// ParsePasswordChange returns an error for unknown password change
+// methods. An empty method disables password changes.
+func ParsePasswordChange(method string) (string, error) {
+	switch method {
+	case "", PasswordChangeRFC3062, PasswordChangeAD:
+		return method, nil
+	}
+	return "", fmt.Errorf("unknown password change method %q, expected %s or %s", method, PasswordChangeRFC3062, PasswordChangeAD)
+}
+
+// ChangePassword changes the password of a user who knows the current
+// one, and authenticates the user with the new password.
+func (c *Client) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) (*identity.Identity, error) {
+	ctx, span := tracing.Start(ctx, "ldap.Client.ChangePassword", tracing.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("ldap.server", c.LdapServer)
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(c.Timeout, DefaultTimeout))
+	defer cancel()
+
+	err := c.changePassword(ctx, username, oldPassword, newPassword)
+	span.RecordError(err)
+	if err != nil {
+		return NewIdentity(nil, c.Directory(), ""), err
+	}
+
+	entry, err := c.authenticate(ctx, username, newPassword)
+	span.RecordError(err)
+	return NewIdentity(entry, c.Directory(), ""), err
+}
+
+func (c *Client) changePassword(ctx context.Context, username, oldPassword, newPassword string) error {
+	switch c.PasswordChange {
+	case PasswordChangeRFC3062:
+	case PasswordChangeAD:
+		if !c.hasServiceAccount() {
+			return &Error{Reason: ReasonDirectoryError, Message: "Changing Active Directory passwords requires a search user"}
+		}
+	default:
+		return &Error{Reason: ReasonDirectoryError, Message: fmt.Sprintf("Password changes are disabled for directory %s", c.Directory().Name)}
+	}
+
+	conn, entry, err := c.findUser(ctx, c.userFilter(ldap.EscapeFilter(username)), username, oldPassword)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var account string
+	if c.hasServiceAccount() {
+		account, err = c.checkAccount(ctx, entry, username)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.PasswordChange == PasswordChangeRFC3062 && c.hasServiceAccount() {
+		err = c.bind(ctx, conn, opUserBind, entry.DN, oldPassword)
+		if err != nil {
+			invalidUserCredentials.Inc()
+			c.countError(reasonInvalidCredentials)
+			e := newError(err, ReasonInvalidCredentials, fmt.Sprintf("Error binding user %s", username))
+			e.Account = account
+			return e
+		}
+	}
+
+	done := c.startOperation(ctx, opPasswordChange)
+	err = c.run(ctx, conn, timeoutOrDefault(c.BindTimeout, DefaultBindTimeout), func() error {
+		if c.PasswordChange == PasswordChangeAD {
+			// deleting the old value and adding the new one is a change,
+			// replacing the value would be a reset requiring more
+			// privileges
+			req := ldap.NewModifyRequest(entry.DN, nil)
+			req.Delete("unicodePwd", []string{encodeUnicodePwd(oldPassword)})
+			req.Add("unicodePwd", []string{encodeUnicodePwd(newPassword)})
+			return conn.Modify(req)
+		}
+		// an empty identity changes the password of the bound user
+		_, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("", oldPassword, newPassword))
+		return err
+	})
+	done(err)
+	if err != nil {
+		e := passwordChangeError(err, fmt.Sprintf("Error changing password of user %s", username))
+		e.Account = account
+		return e
+	}
+	return nil
+}
+
+// passwordChangeError classifies errors of password changes. Directories
+// report new passwords violating their policy as constraint violations.
+func passwordChangeError(err error, message string) *Error {
+	e := newError(err, ReasonDirectoryError, message)
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return e
+	}
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultInvalidCredentials:
+		e.Reason = ReasonInvalidCredentials
+	case ldap.LDAPResultConstraintViolation:
+		e.Reason = ReasonPasswordRejected
+		// Active Directory rejects wrong current passwords with
+		// ERROR_INVALID_PASSWORD
+		if ldapErr.Err != nil && strings.HasPrefix(ldapErr.Err.Error(), "00000056") {
+			e.Reason = ReasonInvalidCredentials
+		}
+	}
+	return e
+}
+
+// encodeUnicodePwd encodes a password as value of the Active Directory
+// attribute unicodePwd: quoted and in UTF-16LE.
+func encodeUnicodePwd(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	buf := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		buf[2*i] = byte(r)
+		buf[2*i+1] = byte(r >> 8)
+	}
+	return string(buf)
+}
@@ -0,0 +1,103 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/proofpoint/kubernetes-ldap/ldaptest"
+)
+
+func TestClientChangePasswordAD(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.PasswordChange = PasswordChangeAD
+
+	// the password of alice expired
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		if dn == "uid=alice,dc=example,dc=com" && password == "alice-pw" {
+			return &ldaptest.Result{Code: 49, Message: "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 532, v3839"}
+		}
+		return nil
+	}
+	server.PasswordResult = func(dn, password string) *ldaptest.Result {
+		if len(password) < 8 {
+			return &ldaptest.Result{Code: 19, Message: "0000052D: Constraint violation - check_password_restrictions: the password is too short"}
+		}
+		return nil
+	}
+
+	if _, err := client.Authenticate("alice", "alice-pw"); ReasonOf(err) != ReasonPasswordExpired {
+		t.Fatalf("Expected the password to be expired, got %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		oldPassword string
+		newPassword string
+		reason      Reason
+	}{
+		{"wrong password", "wrong", "new-secret", ReasonInvalidCredentials},
+		{"too short", "alice-pw", "short", ReasonPasswordRejected},
+	}
+	for _, c := range cases {
+		_, err := client.ChangePassword(context.Background(), "alice", c.oldPassword, c.newPassword)
+		if reason := ReasonOf(err); reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %v", c.name, c.reason, err)
+		}
+	}
+
+	id, err := client.ChangePassword(context.Background(), "alice", "alice-pw", "new-secret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id.DN != "uid=alice,dc=example,dc=com" || len(id.Groups) != 2 {
+		t.Errorf("Unexpected identity %s with groups %v", id.DN, id.Groups)
+	}
+	if id.Source.Name != server.Host() {
+		t.Errorf("Unexpected directory %s", id.Source.Name)
+	}
+	if _, err := client.Authenticate("alice", "new-secret"); err != nil {
+		t.Errorf("Expected the new password to be valid: %v", err)
+	}
+}
+
+func TestClientChangePasswordRFC3062(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.PasswordChange = PasswordChangeRFC3062
+
+	if _, err := client.ChangePassword(context.Background(), "bob", "wrong", "new-secret"); ReasonOf(err) != ReasonInvalidCredentials {
+		t.Errorf("Expected invalid credentials, got %v", err)
+	}
+	if _, err := client.ChangePassword(context.Background(), "b*", "bob-pw", "new-secret"); err == nil {
+		t.Errorf("Expected the username to be escaped in the search filter")
+	}
+	if _, err := client.ChangePassword(context.Background(), "bob", "bob-pw", "new-secret"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := client.Authenticate("bob", "bob-pw"); ReasonOf(err) != ReasonInvalidCredentials {
+		t.Errorf("Expected the old password to be invalid, got %v", err)
+	}
+	if _, err := client.Authenticate("bob", "new-secret"); err != nil {
+		t.Errorf("Expected the new password to be valid: %v", err)
+	}
+
+	// without search user, users bind as themselves
+	client.SearchUserDN, client.SearchUserPassword = "", ""
+	client.UserLoginAttribute = "userPrincipalName"
+	if _, err := client.ChangePassword(context.Background(), "alice@example.com", "alice-pw", "new-secret"); err != nil {
+		t.Errorf("Unexpected error without search user: %v", err)
+	}
+}
+
+func TestClientChangePasswordDisabled(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+
+	if _, err := client.ChangePassword(context.Background(), "bob", "bob-pw", "new-secret"); ReasonOf(err) != ReasonDirectoryError {
+		t.Errorf("Expected password changes to be disabled, got %v", err)
+	}
+	if _, err := client.Authenticate("bob", "bob-pw"); err != nil {
+		t.Errorf("Expected the password to be unchanged: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+)
+
+// Route sends the users of a domain to a directory.
+type Route struct {
+	Client *Client
+	// Suffixes are username suffixes like "@acme.com" of users of the
+	// directory.
+	Suffixes []string
+	// StripSuffix removes the matched suffix before authenticating, for
+	// directories which know their users by their short name.
+	StripSuffix bool
+	// Prefixes are NetBIOS domain names like "ACME" of usernames like
+	// ACME\bob. The prefix is always removed before authenticating.
+	Prefixes []string
+}
+
+// Router authenticates users against one of several directories, picked
+// by the domain in the username. Usernames without a known domain go to
+// the first directory, or are tried against all directories in order if
+// TryAll is set.
+type Router struct {
+	Routes []Route
+	// TryAll tries usernames without a known domain against all
+	// directories until one knows the user, rather than only against the
+	// first directory. The password then reaches every directory which
+	// doesn't know the user.
+	TryAll bool
+}
+
+// Authenticate a user against the directory of its domain.
+func (r *Router) Authenticate(username, password string) (*ldap.Entry, error) {
+	return r.AuthenticateContext(context.Background(), username, password)
+}
+
+// AuthenticateContext is Authenticate with the request context.
+func (r *Router) AuthenticateContext(ctx context.Context, username, password string) (*ldap.Entry, error) {
+	entry, _, err := r.AuthenticateDirectory(ctx, username, password)
+	return entry, err
+}
+
+// AuthenticateDirectory authenticates the user and describes the directory
+// which accepted the credentials, or which rejected the credentials of a
+// user it knows.
+func (r *Router) AuthenticateDirectory(ctx context.Context, username, password string) (*ldap.Entry, *Directory, error) {
+	routes, name := r.match(username)
+	if len(routes) == 0 {
+		return nil, nil, errors.New("no LDAP directory configured")
+	}
+
+	var errs []error
+	var messages []string
+	for _, route := range routes {
+		entry, err := route.Client.AuthenticateContext(ctx, name, password)
+		if err == nil {
+			return entry, route.Client.Directory(), nil
+		}
+		// other directories aren't tried once the request was canceled
+		// or timed out, nor once a directory knowing the user rejected
+		// the credentials, so that a guess only counts against one
+		// account
+		if len(routes) == 1 || ctx.Err() != nil || AccountOf(err) != "" {
+			return nil, route.Client.Directory(), err
+		}
+		directory := route.Client.Directory().Name
+		glog.V(2).Infof("Authenticating %s against directory %s failed: %v", username, directory, err)
+		errs = append(errs, err)
+		messages = append(messages, fmt.Sprintf("%s: %v", directory, err))
+	}
+	return nil, nil, &Error{
+		Reason:  mostTelling(errs),
+		Message: "Error authenticating user against all directories: " + strings.Join(messages, "; "),
+	}
+}
+
+// ChangePassword changes the password of a user in the directory of its
+// domain. With TryAll, usernames without a known domain are looked up in
+// all directories which allow password changes, and changed in the first
+// one knowing the user.
+func (r *Router) ChangePassword(ctx context.Context, username, oldPassword, newPassword string) (*identity.Identity, error) {
+	routes, name := r.match(username)
+	if len(routes) == 0 {
+		return nil, errors.New("no LDAP directory configured")
+	}
+	if len(routes) == 1 {
+		return routes[0].Client.ChangePassword(ctx, name, oldPassword, newPassword)
+	}
+
+	var errs []error
+	var messages []string
+	for _, route := range routes {
+		if route.Client.PasswordChange == "" {
+			continue
+		}
+		id, err := route.Client.ChangePassword(ctx, name, oldPassword, newPassword)
+		if err == nil || ReasonOf(err) != ReasonUserNotFound {
+			return id, err
+		}
+		errs = append(errs, err)
+		messages = append(messages, fmt.Sprintf("%s: %v", route.Client.Directory().Name, err))
+	}
+	if len(errs) == 0 {
+		return nil, &Error{Reason: ReasonDirectoryError, Message: "Password changes are disabled for all directories"}
+	}
+	return nil, &Error{
+		Reason:  mostTelling(errs),
+		Message: "Error changing password in all directories: " + strings.Join(messages, "; "),
+	}
+}
+
+// LookupIdentity looks up a user in the directory of its domain. With
+// TryAll, usernames without a known domain are looked up in all
+// directories, and the first one knowing the user is used.
+func (r *Router) LookupIdentity(ctx context.Context, username string) (*identity.Identity, error) {
+	return r.lookupIdentity(ctx, "", username)
+}
+
+func (r *Router) lookupIdentity(ctx context.Context, filter, username string) (*identity.Identity, error) {
+	routes, name := r.match(username)
+	if len(routes) == 0 {
+		return nil, errors.New("no LDAP directory configured")
+	}
+	if len(routes) == 1 {
+		return routes[0].Client.lookupIdentity(ctx, filter, name)
+	}
+
+	var errs []error
+	var messages []string
+	for _, route := range routes {
+		id, err := route.Client.lookupIdentity(ctx, filter, name)
+		if err == nil || ReasonOf(err) != ReasonUserNotFound {
+			return id, err
+		}
+		errs = append(errs, err)
+		messages = append(messages, fmt.Sprintf("%s: %v", route.Client.Directory().Name, err))
+	}
+	return nil, &Error{
+		Reason:  mostTelling(errs),
+		Message: "Error looking up user in all directories: " + strings.Join(messages, "; "),
+	}
+}
+
+// match returns the routes to try for username along with the name to
+// authenticate with. Usernames without a known domain get the first
+// route, or all of them with TryAll.
+func (r *Router) match(username string) ([]Route, string) {
+	if i := strings.Index(username, `\`); i >= 0 {
+		prefix, name := username[:i], username[i+1:]
+		for _, route := range r.Routes {
+			for _, p := range route.Prefixes {
+				if strings.EqualFold(p, prefix) {
+					return []Route{route}, name
+				}
+			}
+		}
+	}
+
+	lower := strings.ToLower(username)
+	for _, route := range r.Routes {
+		for _, suffix := range route.Suffixes {
+			if strings.HasSuffix(lower, strings.ToLower(suffix)) {
+				if route.StripSuffix {
+					return []Route{route}, username[:len(username)-len(suffix)]
+				}
+				return []Route{route}, username
+			}
+		}
+	}
+
+	if r.TryAll || len(r.Routes) == 0 {
+		return r.Routes, username
+	}
+	return r.Routes[:1], username
+}
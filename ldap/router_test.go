@@ -0,0 +1,97 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/proofpoint/kubernetes-ldap/ldaptest"
+)
+
+func TestRouterMatch(t *testing.T) {
+	acme := &Client{Name: "acme"}
+	initech := &Client{Name: "initech"}
+	contractors := &Client{Name: "contractors"}
+
+	router := &Router{Routes: []Route{
+		{Client: acme, Suffixes: []string{"@acme.com"}, Prefixes: []string{"ACME"}},
+		{Client: initech, Suffixes: []string{"@initech.com", "@corp.initech.com"}, Prefixes: []string{"INITECH"}},
+		{Client: contractors, Suffixes: []string{"@contractors.acme.com"}, StripSuffix: true},
+	}}
+
+	cases := []struct {
+		tryAll          bool
+		username        string
+		expectedClients []*Client
+		expectedName    string
+	}{
+		{false, "bob@acme.com", []*Client{acme}, "bob@acme.com"},
+		{false, "Bob@ACME.com", []*Client{acme}, "Bob@ACME.com"},
+		{false, "alice@corp.initech.com", []*Client{initech}, "alice@corp.initech.com"},
+		{false, `ACME\bob`, []*Client{acme}, "bob"},
+		{false, `initech\alice`, []*Client{initech}, "alice"},
+		{false, "carol@contractors.acme.com", []*Client{contractors}, "carol"},
+		// unqualified names go to the first directory unless all are tried
+		{false, "dave", []*Client{acme}, "dave"},
+		{false, `OTHER\dave`, []*Client{acme}, `OTHER\dave`},
+		{true, "dave", []*Client{acme, initech, contractors}, "dave"},
+		{true, `OTHER\dave`, []*Client{acme, initech, contractors}, `OTHER\dave`},
+		{true, "carol@contractors.acme.com", []*Client{contractors}, "carol"},
+	}
+
+	for _, testcase := range cases {
+		router.TryAll = testcase.tryAll
+		routes, name := router.match(testcase.username)
+		if name != testcase.expectedName {
+			t.Errorf("Expected %q to be authenticated as %q, got %q", testcase.username, testcase.expectedName, name)
+		}
+		if len(routes) != len(testcase.expectedClients) {
+			t.Errorf("Expected %q to be routed to %d directories, got %d", testcase.username, len(testcase.expectedClients), len(routes))
+			continue
+		}
+		for i, route := range routes {
+			if route.Client != testcase.expectedClients[i] {
+				t.Errorf("Expected %q to be routed to %s, got %s", testcase.username, testcase.expectedClients[i].Name, route.Client.Name)
+			}
+		}
+	}
+}
+
+func TestRouterTryAll(t *testing.T) {
+	server, client := newTestDirectory(t)
+	defer server.Close()
+	client.Name = "example"
+	client.UsernamePrefix = "example:"
+	empty := *client
+	empty.Name = "empty"
+	empty.UsernamePrefix = ""
+	empty.BaseDN = "ou=groups,dc=example,dc=com"
+	second := *client
+	second.Name = "second"
+	second.UsernamePrefix = "second:"
+
+	var guesses int
+	server.BindResult = func(dn, password string) *ldaptest.Result {
+		if password == "wrong" {
+			guesses++
+		}
+		return nil
+	}
+
+	router := &Router{Routes: []Route{{Client: &empty}, {Client: client}, {Client: &second}}, TryAll: true}
+	entry, directory, err := router.AuthenticateDirectory(context.Background(), "bob", "bob-pw")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if entry.DN != "uid=bob,dc=example,dc=com" || directory.Name != "example" || directory.Source().UsernamePrefix != "example:" {
+		t.Errorf("Expected bob in directory example, got %s in %+v", entry.DN, directory)
+	}
+
+	// the guess isn't tried against the further directory knowing bob
+	_, directory, err = router.AuthenticateDirectory(context.Background(), "bob", "wrong")
+	if ReasonOf(err) != ReasonInvalidCredentials || directory == nil || directory.Name != "example" {
+		t.Errorf("Expected invalid credentials in directory example, got %v", err)
+	}
+	if guesses != 1 {
+		t.Errorf("Expected the guess to reach one directory, got %d binds", guesses)
+	}
+}
@@ -0,0 +1,77 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// saslExternal is the SASL mechanism authenticating the client by the
+// identity established outside of LDAP, i.e. its TLS client certificate.
+const saslExternal = "EXTERNAL"
+
+// externalBindMessageID is the message ID of the bind request. It is sent
+// before the connection is handed to go-ldap, whose IDs start at 1 as
+// well, but IDs only need to be unique among outstanding requests.
+const externalBindMessageID = 1
+
+// DialExternal opens a TLS connection and binds with SASL EXTERNAL
+// (RFC 4513, section 5.2.3), so that the directory authenticates the
+// client certificate of config.
+func DialExternal(network, addr string, config *tls.Config) (*ldap.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: ldap.DefaultTimeout}, network, addr, config)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	if err := ExternalBind(conn, ldap.DefaultTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := ldap.NewConn(conn, true)
+	c.Start()
+	return c, nil
+}
+
+// ExternalBind sends a SASL EXTERNAL bind request on conn and waits up to
+// timeout for the response. go-ldap doesn't support SASL binds, so this
+// has to happen before the connection is passed to ldap.NewConn.
+func ExternalBind(conn net.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, externalBindMessageID, "MessageID"))
+
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "User Name"))
+
+	// authentication choice [3] SaslCredentials, without credentials so
+	// that the authorization identity is derived from the certificate
+	credentials := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL Credentials")
+	credentials.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, saslExternal, "Mechanism"))
+	request.AppendChild(credentials)
+	packet.AppendChild(request)
+
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	response, err := ber.ReadPacket(conn)
+	if err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	if len(response.Children) < 2 || response.Children[1].Tag != ldap.ApplicationBindResponse {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("ldap: expected a bind response"))
+	}
+	return ldap.GetLDAPError(response)
+}
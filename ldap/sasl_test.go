@@ -0,0 +1,70 @@
+package ldap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// serveBind reads one request from conn and answers with a bind response
+// carrying resultCode. It returns the received request.
+func serveBind(t *testing.T, conn net.Conn, resultCode int64) <-chan *ber.Packet {
+	requests := make(chan *ber.Packet, 1)
+	go func() {
+		defer close(requests)
+		request, err := ber.ReadPacket(conn)
+		if err != nil {
+			t.Errorf("Unexpected error reading request: %v", err)
+			return
+		}
+		requests <- request
+
+		response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, externalBindMessageID, "MessageID"))
+		bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "Bind Response")
+		bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "Result Code"))
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+		bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+		response.AppendChild(bind)
+		conn.Write(response.Bytes())
+	}()
+	return requests
+}
+
+func TestExternalBind(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	requests := serveBind(t, server, ldap.LDAPResultSuccess)
+	if err := ExternalBind(client, ldap.DefaultTimeout); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	request := <-requests
+	bind := request.Children[1]
+	if bind.Tag != ldap.ApplicationBindRequest || len(bind.Children) != 3 {
+		t.Fatalf("Expected a bind request, got %+v", bind)
+	}
+	credentials := bind.Children[2]
+	if credentials.ClassType != ber.ClassContext || credentials.Tag != 3 {
+		t.Fatalf("Expected SASL credentials, got %+v", credentials)
+	}
+	if mechanism := credentials.Children[0].Data.String(); mechanism != saslExternal {
+		t.Errorf("Expected mechanism %s, got %s", saslExternal, mechanism)
+	}
+}
+
+func TestExternalBindRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serveBind(t, server, ldap.LDAPResultInappropriateAuthentication)
+	err := ExternalBind(client, ldap.DefaultTimeout)
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInappropriateAuthentication) {
+		t.Errorf("Expected inappropriate authentication, got %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package ldaptest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// matchingRuleInChain is the Active Directory matching rule which matches
+// nested group memberships, e.g. (memberOf:1.2.840.113556.1.4.1941:=cn=g).
+const matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+type attribute struct {
+	name   string
+	values []string
+}
+
+type entry struct {
+	dn         string
+	parsed     dn
+	attributes []*attribute
+}
+
+// values returns the values of the attribute name, ignoring its case.
+func (e *entry) values(name string) []string {
+	for _, a := range e.attributes {
+		if strings.EqualFold(a.name, name) {
+			return a.values
+		}
+	}
+	return nil
+}
+
+// selected returns the requested attributes: all for none or "*", none
+// for "1.1".
+func (e *entry) selected(requested []string) []*attribute {
+	if len(requested) == 0 {
+		return e.attributes
+	}
+	var selected []*attribute
+	for _, a := range e.attributes {
+		for _, name := range requested {
+			if name == "*" || strings.EqualFold(name, a.name) {
+				selected = append(selected, a)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// AddEntry adds an entry to the directory. Passwords of simple binds are
+// checked against its userPassword attribute in clear text.
+func (s *Server) AddEntry(dn string, attributes map[string][]string) error {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]*attribute, len(names))
+	for i, name := range names {
+		list[i] = &attribute{name: name, values: attributes[name]}
+	}
+	return s.addEntry(dn, list)
+}
+
+func (s *Server) addEntry(dn string, attributes []*attribute) error {
+	parsed, err := parseDN(dn)
+	if err != nil {
+		return fmt.Errorf("invalid DN %q: %v", dn, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.parsed.equal(parsed) {
+			return fmt.Errorf("entry %q already exists", dn)
+		}
+	}
+	s.entries = append(s.entries, &entry{dn: dn, parsed: parsed, attributes: attributes})
+	return nil
+}
+
+// findBindEntry returns the entry of dn, or like Active Directory of the
+// userPrincipalName dn.
+func (s *Server) findBindEntry(dn string) *entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if parsed, err := parseDN(dn); err == nil && len(parsed) > 0 {
+		for _, e := range s.entries {
+			if e.parsed.equal(parsed) {
+				return e
+			}
+		}
+		return nil
+	}
+
+	for _, e := range s.entries {
+		for _, upn := range e.values("userPrincipalName") {
+			if strings.EqualFold(upn, dn) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// find returns the entries below baseDN within scope matching filter.
+func (s *Server) find(baseDN string, scope int, filter *ber.Packet) ([]*entry, *Result) {
+	base, err := parseDN(baseDN)
+	if err != nil {
+		return nil, &Result{Code: ldap.LDAPResultInvalidDNSyntax, Message: err.Error()}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exists := len(base) == 0
+	var found []*entry
+	for _, e := range s.entries {
+		inScope := false
+		switch {
+		case base.equal(e.parsed):
+			exists = true
+			inScope = scope == ldap.ScopeBaseObject || scope == ldap.ScopeWholeSubtree
+		case base.ancestorOf(e.parsed):
+			exists = true
+			inScope = scope == ldap.ScopeWholeSubtree ||
+				(scope == ldap.ScopeSingleLevel && len(e.parsed) == len(base)+1)
+		}
+		if !inScope {
+			continue
+		}
+
+		e = s.view(e)
+		matched, err := s.match(e, filter)
+		if err != nil {
+			return nil, &Result{Code: ldap.LDAPResultProtocolError, Message: err.Error()}
+		}
+		if matched {
+			found = append(found, e)
+		}
+	}
+
+	if !exists {
+		return nil, &Result{Code: ldap.LDAPResultNoSuchObject, Message: "no such object " + baseDN}
+	}
+	return found, nil
+}
+
+// view returns e as returned to clients, with memberOf if enabled.
+// s.mu must be held.
+func (s *Server) view(e *entry) *entry {
+	if !s.MemberOf || e.values("memberOf") != nil {
+		return e
+	}
+	groups := s.groups(e.parsed)
+	if len(groups) == 0 {
+		return e
+	}
+	attributes := append(append([]*attribute{}, e.attributes...), &attribute{name: "memberOf", values: groups})
+	return &entry{dn: e.dn, parsed: e.parsed, attributes: attributes}
+}
+
+// groups returns the DNs of the entries listing dn as member. s.mu must
+// be held.
+func (s *Server) groups(member dn) []string {
+	var groups []string
+	for _, group := range s.entries {
+		for _, value := range group.values("member") {
+			if parsed, err := parseDN(value); err == nil && parsed.equal(member) {
+				groups = append(groups, group.dn)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// nestedGroups returns the groups of e including the groups of its
+// groups. s.mu must be held.
+func (s *Server) nestedGroups(e *entry) []string {
+	seen := map[string]bool{}
+	var all []string
+	queue := e.values("memberOf")
+	if s.MemberOf && queue == nil {
+		queue = s.groups(e.parsed)
+	}
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		key := strings.ToLower(group)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		all = append(all, group)
+
+		if parsed, err := parseDN(group); err == nil {
+			for _, g := range s.entries {
+				if g.parsed.equal(parsed) {
+					queue = append(queue, s.view(g).values("memberOf")...)
+				}
+			}
+		}
+	}
+	return all
+}
+
+// match evaluates an RFC 4511 filter against e. Values are compared case
+// insensitively, and as DNs if both are DNs.
+func (s *Server) match(e *entry, filter *ber.Packet) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if ok, err := s.match(e, child); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if ok, err := s.match(e, child); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, fmt.Errorf("invalid not filter")
+		}
+		ok, err := s.match(e, filter.Children[0])
+		return !ok, err
+
+	case ldap.FilterPresent:
+		return len(e.values(filter.Data.String())) > 0, nil
+
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid %s filter", ldap.FilterMap[uint64(filter.Tag)])
+		}
+		name, assertion := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for _, value := range e.values(name) {
+			if compare(value, assertion, filter.Tag) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false, fmt.Errorf("invalid substrings filter")
+		}
+		name := filter.Children[0].Data.String()
+		for _, value := range e.values(name) {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case ldap.FilterExtensibleMatch:
+		var rule, name, assertion string
+		for _, child := range filter.Children {
+			switch child.Tag {
+			case 1:
+				rule = child.Data.String()
+			case 2:
+				name = child.Data.String()
+			case 3:
+				assertion = child.Data.String()
+			}
+		}
+		values := e.values(name)
+		if rule == matchingRuleInChain && strings.EqualFold(name, "memberOf") {
+			values = s.nestedGroups(e)
+		}
+		for _, value := range values {
+			if compare(value, assertion, ldap.FilterEqualityMatch) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported filter %d", filter.Tag)
+}
+
+func compare(value, assertion string, tag ber.Tag) bool {
+	switch tag {
+	case ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		cmp := strings.Compare(strings.ToLower(value), strings.ToLower(assertion))
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if a, err := strconv.ParseInt(assertion, 10, 64); err == nil {
+				cmp = 0
+				if v < a {
+					cmp = -1
+				} else if v > a {
+					cmp = 1
+				}
+			}
+		}
+		if tag == ldap.FilterGreaterOrEqual {
+			return cmp >= 0
+		}
+		return cmp <= 0
+	}
+
+	if strings.EqualFold(value, assertion) {
+		return true
+	}
+	if !strings.Contains(value, "=") || !strings.Contains(assertion, "=") {
+		return false
+	}
+	v, err := parseDN(value)
+	if err != nil {
+		return false
+	}
+	a, err := parseDN(assertion)
+	return err == nil && v.equal(a)
+}
+
+func matchSubstrings(value string, substrings []*ber.Packet) bool {
+	for _, substring := range substrings {
+		part := strings.ToLower(substring.Data.String())
+		switch substring.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, part) {
+				return false
+			}
+			value = value[len(part):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, part)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(part):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, part) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
+
+// dn is a parsed DN with its RDNs normalized for comparison: attribute
+// types and values are lower case and trimmed, and multi-valued RDNs
+// sorted.
+type dn []string
+
+func parseDN(s string) (dn, error) {
+	parsed, err := ldap.ParseDN(s)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(dn, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		attributes := make([]string, len(rdn.Attributes))
+		for j, a := range rdn.Attributes {
+			attributes[j] = strings.ToLower(strings.TrimSpace(a.Type)) + "=" + strings.ToLower(strings.TrimSpace(a.Value))
+		}
+		sort.Strings(attributes)
+		normalized[i] = strings.Join(attributes, "+")
+	}
+	return normalized, nil
+}
+
+func (d dn) equal(other dn) bool {
+	return len(d) == len(other) && d.suffixOf(other)
+}
+
+// ancestorOf returns true if other is below d.
+func (d dn) ancestorOf(other dn) bool {
+	return len(d) < len(other) && d.suffixOf(other)
+}
+
+func (d dn) suffixOf(other dn) bool {
+	offset := len(other) - len(d)
+	for i := range d {
+		if d[i] != other[offset+i] {
+			return false
+		}
+	}
+	return true
+}
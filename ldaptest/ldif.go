@@ -0,0 +1,132 @@
+package ldaptest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LoadLDIF adds the entries of an LDIF file (RFC 2849) to the directory.
+// Only content records and "changetype: add" are supported.
+func (s *Server) LoadLDIF(r io.Reader) error {
+	var (
+		dn         string
+		attributes []*attribute
+		lines      []string
+	)
+
+	add := func() error {
+		if dn == "" {
+			return nil
+		}
+		err := s.addEntry(dn, attributes)
+		dn, attributes = "", nil
+		return err
+	}
+
+	// parse handles a logical line, with continuations folded.
+	parse := func(n int, line string) error {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("line %d: expected attribute: value", n)
+		}
+		name, value := line[:i], line[i+1:]
+		switch {
+		case strings.HasPrefix(value, ":"):
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return fmt.Errorf("line %d: %v", n, err)
+			}
+			value = string(decoded)
+		case strings.HasPrefix(value, "<"):
+			return fmt.Errorf("line %d: URL values are not supported", n)
+		default:
+			value = strings.TrimLeft(value, " ")
+		}
+
+		switch {
+		case strings.EqualFold(name, "version") && dn == "":
+			return nil
+		case strings.EqualFold(name, "dn"):
+			if dn != "" {
+				return fmt.Errorf("line %d: expected an empty line before dn", n)
+			}
+			dn = value
+			return nil
+		case dn == "":
+			return fmt.Errorf("line %d: expected dn", n)
+		case strings.EqualFold(name, "changetype"):
+			if value != "add" {
+				return fmt.Errorf("line %d: unsupported changetype %s", n, value)
+			}
+			return nil
+		}
+
+		for _, a := range attributes {
+			if strings.EqualFold(a.name, name) {
+				a.values = append(a.values, value)
+				return nil
+			}
+		}
+		attributes = append(attributes, &attribute{name: name, values: []string{value}})
+		return nil
+	}
+
+	// flush parses the buffered logical line
+	start := 0
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		line := strings.Join(lines, "")
+		lines = nil
+		return parse(start, line)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, " ") && len(lines) > 0:
+			lines = append(lines, line[1:])
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "" {
+			if err := add(); err != nil {
+				return err
+			}
+			continue
+		}
+		start = n
+		lines = []string{line}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return add()
+}
+
+// LoadLDIFFile adds the entries of an LDIF file to the directory.
+func (s *Server) LoadLDIFFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.LoadLDIF(f); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
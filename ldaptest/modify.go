@@ -0,0 +1,222 @@
+package ldaptest
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// passwordModifyOID is the name of the Password Modify extended operation
+// (RFC 3062).
+const passwordModifyOID = "1.3.6.1.4.1.4203.1.11.1"
+
+// set replaces the values of the attribute name, removing it if values is
+// empty.
+func (e *entry) set(name string, values []string) {
+	for i, a := range e.attributes {
+		if strings.EqualFold(a.name, name) {
+			if len(values) == 0 {
+				e.attributes = append(e.attributes[:i], e.attributes[i+1:]...)
+			} else {
+				a.values = values
+			}
+			return
+		}
+	}
+	if len(values) > 0 {
+		e.attributes = append(e.attributes, &attribute{name: name, values: values})
+	}
+}
+
+// modify applies the changes of a modify request. Like Active Directory,
+// changes of unicodePwd change the userPassword of the entry; they require
+// TLS and deleting the current password proves knowing it.
+func (s *Server) modify(sess *session, messageID int64, request *ber.Packet) error {
+	if len(request.Children) < 2 {
+		return errors.New("invalid modify request")
+	}
+	dn, _ := request.Children[0].Value.(string)
+	result := s.applyChanges(sess, dn, request.Children[1].Children)
+	return s.respond(sess, messageID, ldap.ApplicationModifyResponse, result, nil)
+}
+
+func (s *Server) applyChanges(sess *session, dn string, changes []*ber.Packet) *Result {
+	if sess.bound == "" {
+		return &Result{Code: ldap.LDAPResultInsufficientAccessRights, Message: "anonymous modify not allowed"}
+	}
+	parsed, err := parseDN(dn)
+	if err != nil {
+		return &Result{Code: ldap.LDAPResultInvalidDNSyntax, Message: err.Error()}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var target *entry
+	for _, candidate := range s.entries {
+		if candidate.parsed.equal(parsed) {
+			target = candidate
+		}
+	}
+	if target == nil {
+		return &Result{Code: ldap.LDAPResultNoSuchObject, Message: "no such object " + dn}
+	}
+
+	// the changes are applied to a copy, so that they are applied
+	// atomically
+	e := &entry{dn: target.dn, parsed: target.parsed}
+	for _, a := range target.attributes {
+		e.attributes = append(e.attributes, &attribute{name: a.name, values: a.values})
+	}
+
+	for _, change := range changes {
+		if len(change.Children) < 2 || len(change.Children[1].Children) < 2 {
+			return &Result{Code: ldap.LDAPResultProtocolError, Message: "invalid change"}
+		}
+		operation, _ := change.Children[0].Value.(int64)
+		name := change.Children[1].Children[0].Data.String()
+		var values []string
+		for _, v := range change.Children[1].Children[1].Children {
+			values = append(values, v.Data.String())
+		}
+
+		if strings.EqualFold(name, "unicodePwd") {
+			if _, ok := sess.conn.(*tls.Conn); !ok {
+				return &Result{Code: ldap.LDAPResultUnwillingToPerform, Message: "0000001F: SvcErr: DSID-031A12D2, problem 5003 (WILL_NOT_PERFORM), data 0"}
+			}
+			name = "userPassword"
+			for i, v := range values {
+				values[i] = decodeUnicodePwd(v)
+			}
+			switch operation {
+			case ldap.DeleteAttribute:
+				if !contains(e.values(name), values) {
+					return &Result{Code: ldap.LDAPResultConstraintViolation, Message: "00000056: AtrErr: DSID-03190F80, #1:\n\t0: 00000056: DSID-03190F80, problem 1005 (CONSTRAINT_ATT_TYPE), data 0, Att 9005a (unicodePwd)"}
+				}
+			case ldap.AddAttribute, ldap.ReplaceAttribute:
+				for _, password := range values {
+					if result := s.checkPassword(e.dn, password); result != nil {
+						return result
+					}
+				}
+				operation = ldap.ReplaceAttribute
+			}
+		}
+
+		switch operation {
+		case ldap.AddAttribute:
+			e.set(name, append(append([]string{}, e.values(name)...), values...))
+		case ldap.DeleteAttribute:
+			if len(values) == 0 {
+				e.set(name, nil)
+				break
+			}
+			var kept []string
+			for _, v := range e.values(name) {
+				if !contains([]string{v}, values) {
+					kept = append(kept, v)
+				}
+			}
+			e.set(name, kept)
+		case ldap.ReplaceAttribute:
+			e.set(name, values)
+		default:
+			return &Result{Code: ldap.LDAPResultProtocolError, Message: "invalid modify operation"}
+		}
+	}
+	target.attributes = e.attributes
+	return nil
+}
+
+// passwordModify changes the userPassword of an entry with the Password
+// Modify extended operation. Without user identity, the password of the
+// bound user is changed.
+func (s *Server) passwordModify(sess *session, messageID int64, request *ber.Packet) error {
+	var identity, oldPassword, newPassword string
+	if len(request.Children) > 1 {
+		value, err := ber.DecodePacketErr(request.Children[1].Data.Bytes())
+		if err != nil {
+			return err
+		}
+		for _, field := range value.Children {
+			switch field.Tag {
+			case 0:
+				identity = field.Data.String()
+			case 1:
+				oldPassword = field.Data.String()
+			case 2:
+				newPassword = field.Data.String()
+			}
+		}
+	}
+
+	result := s.changePassword(sess, identity, oldPassword, newPassword)
+	return s.respond(sess, messageID, ldap.ApplicationExtendedResponse, result, nil)
+}
+
+func (s *Server) changePassword(sess *session, identity, oldPassword, newPassword string) *Result {
+	if sess.bound == "" {
+		return &Result{Code: ldap.LDAPResultInsufficientAccessRights, Message: "anonymous password change not allowed"}
+	}
+	if identity == "" {
+		identity = sess.bound
+	}
+	if newPassword == "" {
+		return &Result{Code: ldap.LDAPResultUnwillingToPerform, Message: "password generation not supported"}
+	}
+
+	e := s.findBindEntry(identity)
+	if e == nil {
+		return &Result{Code: ldap.LDAPResultNoSuchObject, Message: "no such object " + identity}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if oldPassword != "" && !contains(e.values("userPassword"), []string{oldPassword}) {
+		return &Result{Code: ldap.LDAPResultUnwillingToPerform, Message: "unwilling to verify old password"}
+	}
+	if result := s.checkPassword(e.dn, newPassword); result != nil {
+		return result
+	}
+	e.set("userPassword", []string{newPassword})
+	return nil
+}
+
+// checkPassword calls the PasswordResult hook.
+func (s *Server) checkPassword(dn, password string) *Result {
+	if s.PasswordResult == nil {
+		return nil
+	}
+	return s.PasswordResult(dn, password)
+}
+
+// contains returns true if values contains all of wanted.
+func contains(values, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, v := range values {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeUnicodePwd decodes the quoted UTF-16LE value of the Active
+// Directory attribute unicodePwd.
+func decodeUnicodePwd(value string) string {
+	encoded := make([]uint16, len(value)/2)
+	for i := range encoded {
+		encoded[i] = uint16(value[2*i]) | uint16(value[2*i+1])<<8
+	}
+	return strings.Trim(string(utf16.Decode(encoded)), `"`)
+}
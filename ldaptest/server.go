@@ -0,0 +1,448 @@
+// Package ldaptest provides an in-memory LDAP v3 server for tests, in the
+// spirit of net/http/httptest. It supports simple and SASL EXTERNAL binds,
+// searches with filters, modifications and password changes, LDAPS and
+// StartTLS with generated certificates, and Active Directory style
+// memberOf attributes.
+package ldaptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// startTLSOID is the name of the StartTLS extended operation (RFC 4511).
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Result is an LDAP result returned by hooks to make an operation fail.
+type Result struct {
+	Code uint16
+	// Message is sent as diagnostic message, e.g. the "data 52e" details
+	// of Active Directory.
+	Message string
+}
+
+// Error returns the message of the result.
+func (r *Result) Error() string {
+	return fmt.Sprintf("LDAP Result Code %d %q: %s", r.Code, ldap.LDAPResultCodeMap[r.Code], r.Message)
+}
+
+// Server is an LDAP server listening on a random port of the loopback
+// interface.
+type Server struct {
+	Listener net.Listener
+
+	// TLS is the configuration of LDAPS and StartTLS. It is created with
+	// a generated certificate by NewUnstartedServer and may be changed
+	// before the server is started.
+	TLS *tls.Config
+
+	// MemberOf adds the DNs of the groups listing an entry in their member
+	// attribute to its memberOf attribute, as Active Directory does.
+	MemberOf bool
+
+	// BindResult, if set, is called for every bind before the credentials
+	// are checked. A non-nil result is returned instead of checking them.
+	// SASL EXTERNAL binds pass the subject of the client certificate.
+	BindResult func(dn, password string) *Result
+
+	// SearchResult, if set, is called for every search. A non-nil result
+	// is returned instead of searching.
+	SearchResult func(baseDN, filter string) *Result
+
+	// PasswordResult, if set, is called for every password change with
+	// the new password. A non-nil result rejects it, e.g. as violating
+	// the password policy.
+	PasswordResult func(dn, password string) *Result
+
+	// Delay delays every response, e.g. to test timeouts.
+	Delay time.Duration
+
+	ca *authority
+
+	mu      sync.RWMutex
+	entries []*entry
+	conns   map[net.Conn]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a plain LDAP server, which offers StartTLS.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts an LDAPS server.
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a server listening on a random port which
+// doesn't accept connections until Start or StartTLS is called.
+func NewUnstartedServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("ldaptest: failed to listen on a port: %v", err))
+	}
+
+	ca, err := newAuthority()
+	if err != nil {
+		panic(fmt.Sprintf("ldaptest: failed to generate certificates: %v", err))
+	}
+
+	return &Server{
+		Listener: listener,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{ca.serverCert},
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		ca:    ca,
+		conns: map[net.Conn]bool{},
+	}
+}
+
+// Start accepts plain LDAP connections.
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// StartTLS accepts LDAPS connections.
+func (s *Server) StartTLS() {
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.Start()
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.Listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Host returns the IP address the server listens on.
+func (s *Server) Host() string {
+	return s.Listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() uint {
+	return uint(s.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Addr returns the host:port address of the server.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host(), strconv.Itoa(int(s.Port())))
+}
+
+// Certificate returns the generated certificate of the server.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.ca.serverCert.Leaf
+}
+
+// CACertificate returns the certificate of the CA which issued the server
+// and client certificates.
+func (s *Server) CACertificate() *x509.Certificate {
+	return s.ca.cert
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the server.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.ca.pool, ServerName: s.Host()}
+}
+
+// ClientCertificate returns a client certificate for cn, signed by the CA
+// trusted by the server for SASL EXTERNAL binds.
+func (s *Server) ClientCertificate(cn string) tls.Certificate {
+	cert, err := s.ca.issue(cn, false)
+	if err != nil {
+		panic(fmt.Sprintf("ldaptest: failed to issue client certificate: %v", err))
+	}
+	return cert
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// session is the state of a connection.
+type session struct {
+	conn net.Conn
+	// bound is the DN the connection is bound as, empty if anonymous.
+	bound string
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{conn: conn}
+
+	for {
+		packet, err := ber.ReadPacket(sess.conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		request := packet.Children[1]
+
+		if s.Delay > 0 && request.Tag != ldap.ApplicationUnbindRequest {
+			time.Sleep(s.Delay)
+		}
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			err = s.bind(sess, messageID, request)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			err = s.search(sess, messageID, request)
+		case ldap.ApplicationModifyRequest:
+			err = s.modify(sess, messageID, request)
+		case ldap.ApplicationExtendedRequest:
+			err = s.extended(sess, messageID, request)
+		case ldap.ApplicationAbandonRequest:
+		default:
+			// the response of most operations has the tag following the
+			// one of the request
+			err = s.respond(sess, messageID, request.Tag+1, &Result{Code: ldap.LDAPResultUnwillingToPerform, Message: "operation not supported"}, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) bind(sess *session, messageID int64, request *ber.Packet) error {
+	if len(request.Children) < 3 {
+		return errors.New("invalid bind request")
+	}
+	dn, _ := request.Children[1].Value.(string)
+	auth := request.Children[2]
+
+	var result *Result
+	switch auth.Tag {
+	case 0:
+		password := auth.Data.String()
+		if s.BindResult != nil {
+			result = s.BindResult(dn, password)
+		}
+		if result == nil {
+			sess.bound, result = s.simpleBind(dn, password)
+		}
+
+	case 3:
+		var mechanism string
+		if len(auth.Children) > 0 {
+			mechanism, _ = auth.Children[0].Value.(string)
+		}
+		if mechanism != "EXTERNAL" {
+			result = &Result{Code: ldap.LDAPResultAuthMethodNotSupported, Message: "unsupported SASL mechanism " + mechanism}
+			break
+		}
+		tlsConn, ok := sess.conn.(*tls.Conn)
+		if !ok || len(tlsConn.ConnectionState().VerifiedChains) == 0 {
+			result = &Result{Code: ldap.LDAPResultInappropriateAuthentication, Message: "SASL EXTERNAL requires a verified client certificate"}
+			break
+		}
+		subject := "cn=" + tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		if s.BindResult != nil {
+			result = s.BindResult(subject, "")
+		}
+		if result == nil {
+			sess.bound = subject
+		}
+
+	default:
+		result = &Result{Code: ldap.LDAPResultAuthMethodNotSupported, Message: "unsupported authentication method"}
+	}
+
+	if result != nil {
+		sess.bound = ""
+	}
+	return s.respond(sess, messageID, ldap.ApplicationBindResponse, result, nil)
+}
+
+// simpleBind checks the password against the userPassword attribute of
+// dn. Like Active Directory, userPrincipalName may be used as dn.
+func (s *Server) simpleBind(dn, password string) (string, *Result) {
+	invalid := &Result{Code: ldap.LDAPResultInvalidCredentials, Message: "invalid credentials"}
+	if dn == "" {
+		if password != "" {
+			return "", invalid
+		}
+		return "", nil
+	}
+	if password == "" {
+		return "", &Result{Code: ldap.LDAPResultUnwillingToPerform, Message: "unauthenticated bind not allowed"}
+	}
+
+	e := s.findBindEntry(dn)
+	if e == nil {
+		return "", invalid
+	}
+	for _, p := range e.values("userPassword") {
+		if p == password {
+			return e.dn, nil
+		}
+	}
+	return "", invalid
+}
+
+func (s *Server) search(sess *session, messageID int64, request *ber.Packet) error {
+	if len(request.Children) < 8 {
+		return errors.New("invalid search request")
+	}
+	baseDN, _ := request.Children[0].Value.(string)
+	scope, _ := request.Children[1].Value.(int64)
+	sizeLimit, _ := request.Children[3].Value.(int64)
+	filter := request.Children[6]
+	var attributes []string
+	for _, a := range request.Children[7].Children {
+		if name, ok := a.Value.(string); ok {
+			attributes = append(attributes, name)
+		}
+	}
+
+	if s.SearchResult != nil {
+		filterString, _ := ldap.DecompileFilter(filter)
+		if result := s.SearchResult(baseDN, filterString); result != nil {
+			return s.respond(sess, messageID, ldap.ApplicationSearchResultDone, result, nil)
+		}
+	}
+
+	if sess.bound == "" {
+		return s.respond(sess, messageID, ldap.ApplicationSearchResultDone,
+			&Result{Code: ldap.LDAPResultInsufficientAccessRights, Message: "anonymous search not allowed"}, nil)
+	}
+
+	entries, result := s.find(baseDN, int(scope), filter)
+	if result == nil && sizeLimit > 0 && len(entries) > int(sizeLimit) {
+		entries = entries[:sizeLimit]
+		result = &Result{Code: ldap.LDAPResultSizeLimitExceeded, Message: "size limit exceeded"}
+	}
+
+	for _, e := range entries {
+		response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for _, a := range e.selected(attributes) {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.name, "Type"))
+			values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range a.values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attribute.AppendChild(values)
+			list.AppendChild(attribute)
+		}
+		response.AppendChild(list)
+		if err := s.write(sess, messageID, response); err != nil {
+			return err
+		}
+	}
+	return s.respond(sess, messageID, ldap.ApplicationSearchResultDone, result, nil)
+}
+
+func (s *Server) extended(sess *session, messageID int64, request *ber.Packet) error {
+	var name string
+	if len(request.Children) > 0 {
+		name = request.Children[0].Data.String()
+	}
+
+	if name == passwordModifyOID {
+		return s.passwordModify(sess, messageID, request)
+	}
+	if name != startTLSOID {
+		return s.respond(sess, messageID, ldap.ApplicationExtendedResponse,
+			&Result{Code: ldap.LDAPResultProtocolError, Message: "unsupported extended operation " + name}, nil)
+	}
+	if _, ok := sess.conn.(*tls.Conn); ok {
+		return s.respond(sess, messageID, ldap.ApplicationExtendedResponse,
+			&Result{Code: ldap.LDAPResultOperationsError, Message: "TLS already established"}, nil)
+	}
+
+	responseName := ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, startTLSOID, "Response Name")
+	if err := s.respond(sess, messageID, ldap.ApplicationExtendedResponse, nil, responseName); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(sess.conn, s.TLS)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	// closing the plain connection on Close closes tlsConn as well
+	sess.conn = tlsConn
+	return nil
+}
+
+// respond sends an LDAPResult with the given tag, successful if result is
+// nil. extra is appended, e.g. the name of an extended response.
+func (s *Server) respond(sess *session, messageID int64, tag ber.Tag, result *Result, extra *ber.Packet) error {
+	if result == nil {
+		result = &Result{Code: ldap.LDAPResultSuccess}
+	}
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(result.Code), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, result.Message, "Diagnostic Message"))
+	if extra != nil {
+		response.AppendChild(extra)
+	}
+	return s.write(sess, messageID, response)
+}
+
+func (s *Server) write(sess *session, messageID int64, response *ber.Packet) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(response)
+	_, err := sess.conn.Write(packet.Bytes())
+	return err
+}
@@ -0,0 +1,310 @@
+package ldaptest
+
+import (
+	"crypto/tls"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+func newTestServer(t *testing.T, start func(*Server)) *Server {
+	s := NewUnstartedServer()
+	if err := s.LoadLDIFFile("testdata/example.ldif"); err != nil {
+		t.Fatalf("Unexpected error loading LDIF: %v", err)
+	}
+	start(s)
+	return s
+}
+
+func bind(t *testing.T, conn *ldap.Conn) {
+	if err := conn.Bind("uid=alice,ou=people,dc=example,dc=com", "alice-pw"); err != nil {
+		t.Fatalf("Unexpected error binding: %v", err)
+	}
+}
+
+func search(t *testing.T, conn *ldap.Conn, filter string, attributes ...string) []string {
+	res, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, filter, attributes, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error searching %s: %v", filter, err)
+	}
+	var dns []string
+	for _, e := range res.Entries {
+		dns = append(dns, e.DN)
+	}
+	sort.Strings(dns)
+	return dns
+}
+
+func TestLDIF(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind(t, conn)
+
+	res, err := conn.Search(ldap.NewSearchRequest("uid=bob,ou=people,dc=example,dc=com", ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"cn", "description"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 {
+		t.Fatalf("Expected one entry, got %d", len(res.Entries))
+	}
+	if cn := res.Entries[0].GetAttributeValue("cn"); cn != "Bob" {
+		t.Errorf("Expected base64 value to be decoded, got %q", cn)
+	}
+	if d := res.Entries[0].GetAttributeValue("description"); d != "a very long description which is folded across two lines" {
+		t.Errorf("Expected folded value to be joined, got %q", d)
+	}
+	if p := res.Entries[0].GetAttributeValue("userPassword"); p != "" {
+		t.Errorf("Expected only requested attributes, got userPassword %q", p)
+	}
+
+	if err := s.LoadLDIF(strings.NewReader("dn: uid=alice,ou=people,dc=example,dc=com\nuid: alice\n")); err == nil {
+		t.Errorf("Expected an error adding a duplicate entry")
+	}
+	if err := s.LoadLDIF(strings.NewReader("uid: alice\n")); err == nil {
+		t.Errorf("Expected an error for a record without dn")
+	}
+}
+
+func TestBind(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cases := []struct {
+		dn, password string
+		code         uint16
+	}{
+		{"uid=alice,ou=people,dc=example,dc=com", "alice-pw", ldap.LDAPResultSuccess},
+		{"UID=Alice, OU=People, DC=Example, DC=Com", "alice-pw", ldap.LDAPResultSuccess},
+		{"alice@example.com", "alice-pw", ldap.LDAPResultSuccess},
+		{"uid=alice,ou=people,dc=example,dc=com", "wrong", ldap.LDAPResultInvalidCredentials},
+		{"uid=carol,ou=people,dc=example,dc=com", "alice-pw", ldap.LDAPResultInvalidCredentials},
+	}
+	for _, c := range cases {
+		err := conn.Bind(c.dn, c.password)
+		if c.code == ldap.LDAPResultSuccess {
+			if err != nil {
+				t.Errorf("Unexpected error binding as %s: %v", c.dn, err)
+			}
+		} else if !ldap.IsErrorWithCode(err, c.code) {
+			t.Errorf("Expected result %d binding as %s, got %v", c.code, c.dn, err)
+		}
+	}
+
+	_, err = conn.SimpleBind(&ldap.SimpleBindRequest{Username: "uid=alice,ou=people,dc=example,dc=com", AllowEmptyPassword: true})
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("Expected unauthenticated binds to be rejected, got %v", err)
+	}
+
+	s.BindResult = func(dn, password string) *Result {
+		return &Result{Code: ldap.LDAPResultInvalidCredentials, Message: "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839"}
+	}
+	err = conn.Bind("uid=alice,ou=people,dc=example,dc=com", "alice-pw")
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) || !strings.Contains(err.Error(), "data 775") {
+		t.Errorf("Expected the result of BindResult, got %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, "(uid=alice)", nil, nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) {
+		t.Errorf("Expected anonymous search to be denied, got %v", err)
+	}
+	bind(t, conn)
+
+	alice := "uid=alice,ou=people,dc=example,dc=com"
+	bob := "uid=bob,ou=people,dc=example,dc=com"
+	cases := []struct {
+		filter   string
+		expected []string
+	}{
+		{"(uid=alice)", []string{alice}},
+		{"(UID=ALICE)", []string{alice}},
+		{"(&(objectClass=inetOrgPerson)(!(uid=alice)))", []string{bob}},
+		{"(|(uid=alice)(uid=bob))", []string{alice, bob}},
+		{"(mail=*)", []string{alice}},
+		{"(cn=A*e)", []string{alice}},
+		{"(cn=*o*)", []string{"cn=developers,ou=groups,dc=example,dc=com", bob}},
+		{"(member=uid=alice,ou=people,dc=example,dc=com)", []string{
+			"cn=admins,ou=groups,dc=example,dc=com", "cn=developers,ou=groups,dc=example,dc=com"}},
+		{"(uid>=b)", []string{bob}},
+		{"(uid=carol)", nil},
+	}
+	for _, c := range cases {
+		if dns := search(t, conn, c.filter); !reflect.DeepEqual(dns, c.expected) {
+			t.Errorf("Expected %v for %s, got %v", c.expected, c.filter, dns)
+		}
+	}
+
+	_, err = conn.Search(ldap.NewSearchRequest("ou=people,dc=example,dc=com", ldap.ScopeSingleLevel, ldap.NeverDerefAliases,
+		1, 0, false, "(objectClass=*)", nil, nil))
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("Expected size limit to be exceeded after one entry, got %v", err)
+	}
+
+	_, err = conn.Search(ldap.NewSearchRequest("dc=missing,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, "(objectClass=*)", nil, nil))
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		t.Errorf("Expected no such object, got %v", err)
+	}
+
+	s.SearchResult = func(baseDN, filter string) *Result {
+		return &Result{Code: ldap.LDAPResultBusy}
+	}
+	if _, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, "(uid=alice)", nil, nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultBusy) {
+		t.Errorf("Expected the result of SearchResult, got %v", err)
+	}
+}
+
+func TestMemberOf(t *testing.T) {
+	s := newTestServer(t, func(s *Server) {
+		s.MemberOf = true
+		s.Start()
+	})
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind(t, conn)
+
+	res, err := conn.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, "(uid=alice)", []string{"memberOf"}, nil))
+	if err != nil || len(res.Entries) != 1 {
+		t.Fatalf("Unexpected result searching alice: %v", err)
+	}
+	expected := []string{"cn=developers,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"}
+	if groups := res.Entries[0].GetAttributeValues("memberOf"); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected memberOf %v, got %v", expected, groups)
+	}
+
+	if dns := search(t, conn, "(memberOf=cn=admins,ou=groups,dc=example,dc=com)"); len(dns) != 1 {
+		t.Errorf("Expected to find alice by memberOf, got %v", dns)
+	}
+	if dns := search(t, conn, "(&(objectClass=inetOrgPerson)(memberOf:1.2.840.113556.1.4.1941:=cn=engineering,ou=groups,dc=example,dc=com))"); len(dns) != 2 {
+		t.Errorf("Expected to find alice and bob by nested membership, got %v", dns)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	s := newTestServer(t, (*Server).StartTLS)
+	defer s.Close()
+
+	conn, err := ldap.DialTLS("tcp", s.Addr(), s.ClientTLSConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error connecting with LDAPS: %v", err)
+	}
+	bind(t, conn)
+	conn.Close()
+
+	if _, err := ldap.DialTLS("tcp", s.Addr(), &tls.Config{ServerName: s.Host()}); err == nil {
+		t.Errorf("Expected the generated certificate not to be trusted by default")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.StartTLS(s.ClientTLSConfig()); err != nil {
+		t.Fatalf("Unexpected error starting TLS: %v", err)
+	}
+	bind(t, conn)
+	if dns := search(t, conn, "(uid=bob)"); len(dns) != 1 {
+		t.Errorf("Expected to find bob after StartTLS, got %v", dns)
+	}
+}
+
+func TestModify(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind(t, conn)
+
+	req := ldap.NewModifyRequest("uid=bob,ou=people,dc=example,dc=com", nil)
+	req.Add("mail", []string{"bob@example.com"})
+	req.Replace("description", []string{"changed"})
+	if err := conn.Modify(req); err != nil {
+		t.Fatalf("Unexpected error modifying: %v", err)
+	}
+	if dns := search(t, conn, "(&(mail=bob@example.com)(description=changed))"); len(dns) != 1 {
+		t.Errorf("Expected the modified entry to match, got %v", dns)
+	}
+
+	// Active Directory only accepts unicodePwd over TLS
+	req = ldap.NewModifyRequest("uid=bob,ou=people,dc=example,dc=com", nil)
+	req.Replace("unicodePwd", []string{"\"\x00n\x00e\x00w\x00\"\x00"})
+	if err := conn.Modify(req); !ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("Expected unicodePwd to require TLS, got %v", err)
+	}
+}
+
+func TestPasswordModify(t *testing.T) {
+	s := newTestServer(t, (*Server).Start)
+	defer s.Close()
+	s.PasswordResult = func(dn, password string) *Result {
+		if password == "weak" {
+			return &Result{Code: ldap.LDAPResultConstraintViolation, Message: "password too weak"}
+		}
+		return nil
+	}
+
+	conn, err := ldap.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind(t, conn)
+
+	if _, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("", "alice-pw", "weak")); !ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation) {
+		t.Errorf("Expected the weak password to be rejected, got %v", err)
+	}
+	if _, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("", "wrong", "new-pw")); err == nil {
+		t.Errorf("Expected a wrong old password to be rejected")
+	}
+	if _, err := conn.PasswordModify(ldap.NewPasswordModifyRequest("", "alice-pw", "new-pw")); err != nil {
+		t.Fatalf("Unexpected error changing password: %v", err)
+	}
+	if err := conn.Bind("uid=alice,ou=people,dc=example,dc=com", "new-pw"); err != nil {
+		t.Errorf("Expected the new password to be valid: %v", err)
+	}
+}
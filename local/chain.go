@@ -0,0 +1,99 @@
+package local
+
+import (
+	"context"
+	"fmt"
+
+	goldap "github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+	"github.com/proofpoint/kubernetes-ldap/identity"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+)
+
+// Modes of consulting local users
+const (
+	// ModeFirst tries local users before the directory.
+	ModeFirst = "first"
+	// ModeLast tries local users if the directory rejected the login or
+	// couldn't be reached.
+	ModeLast = "last"
+	// ModeOnly authenticates the users of the password file only locally
+	// and everybody else only against the directory.
+	ModeOnly = "only"
+)
+
+// ParseMode returns an error for unknown modes.
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case ModeFirst, ModeLast, ModeOnly:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown local users mode %q, expected %s, %s or %s", mode, ModeFirst, ModeLast, ModeOnly)
+}
+
+// Chain combines local users with a directory.
+type Chain struct {
+	Users     *Users
+	Directory ldap.Authenticator
+	Mode      string
+}
+
+// Authenticate a user locally and against the directory as set by Mode.
+func (c *Chain) Authenticate(username, password string) (*goldap.Entry, error) {
+	return c.AuthenticateContext(context.Background(), username, password)
+}
+
+// AuthenticateContext is Authenticate with the request context.
+func (c *Chain) AuthenticateContext(ctx context.Context, username, password string) (*goldap.Entry, error) {
+	entry, _, err := c.AuthenticateDirectory(ctx, username, password)
+	return entry, err
+}
+
+// AuthenticateIdentity is AuthenticateDirectory returning the identity of
+// the user.
+func (c *Chain) AuthenticateIdentity(ctx context.Context, username, password string) (*identity.Identity, error) {
+	entry, directory, err := c.AuthenticateDirectory(ctx, username, password)
+	return ldap.NewIdentity(entry, directory, ""), err
+}
+
+// AuthenticateDirectory authenticates the user and describes whether the
+// local users or which directory accepted the credentials.
+func (c *Chain) AuthenticateDirectory(ctx context.Context, username, password string) (*goldap.Entry, *ldap.Directory, error) {
+	switch c.Mode {
+	case ModeOnly:
+		if c.Users.Has(username) {
+			return c.Users.AuthenticateDirectory(ctx, username, password)
+		}
+		return c.authenticateRemote(ctx, username, password)
+
+	case ModeLast:
+		// accounts locked out by the caller aren't guessed at locally
+		entry, directory, err := c.authenticateRemote(ctx, username, password)
+		if err == nil || ldap.ReasonOf(err) == ldap.ReasonThrottled || !c.Users.Has(username) {
+			return entry, directory, err
+		}
+		glog.Warningf("Directory login of %q failed, falling back to local users: %v", username, err)
+		localEntry, localDirectory, localErr := c.Users.AuthenticateDirectory(ctx, username, password)
+		if localErr != nil {
+			// the directory tells why the login failed, e.g. that the
+			// password expired, the local password only that it's wrong
+			return nil, directory, err
+		}
+		return localEntry, localDirectory, nil
+
+	default:
+		entry, directory, err := c.Users.AuthenticateDirectory(ctx, username, password)
+		if err == nil {
+			return entry, directory, nil
+		}
+		return c.authenticateRemote(ctx, username, password)
+	}
+}
+
+func (c *Chain) authenticateRemote(ctx context.Context, username, password string) (*goldap.Entry, *ldap.Directory, error) {
+	if da, ok := c.Directory.(ldap.DirectoryAuthenticator); ok {
+		return da.AuthenticateDirectory(ctx, username, password)
+	}
+	entry, err := c.Directory.Authenticate(username, password)
+	return entry, nil, err
+}
@@ -0,0 +1,301 @@
+// Package local authenticates break-glass users from an htpasswd file,
+// so that tokens can still be issued while the directory is unreachable.
+package local
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	goldap "github.com/go-ldap/ldap"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DirectoryName is recorded as directory in the tokens of local users.
+const DirectoryName = "local"
+
+// usernameAttribute holds the username in the entries of local users.
+const usernameAttribute = "uid"
+
+var (
+	// ErrUnknownUser is returned for users not listed in the password file.
+	ErrUnknownUser = errors.New("unknown local user")
+	// ErrInvalidPassword is returned if the password doesn't match the hash.
+	ErrInvalidPassword = errors.New("invalid password for local user")
+)
+
+// dummyHash is compared against for unknown users, so that they take as
+// long as known ones.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+var (
+	localLogins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_local_user_logins_total",
+			Help: "Total number of login attempts of local users by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+// RegisterLocalUserMetrics registers the metrics for local users
+func RegisterLocalUserMetrics() {
+	prometheus.MustRegister(localLogins)
+}
+
+// Users are read from an htpasswd file with bcrypt ($2y$) or argon2id
+// ($argon2id$) hashes, and optionally an Apache group file with lines like
+// "group: user1 user2".
+type Users struct {
+	passwordFile string
+	groupFile    string
+
+	mu     sync.RWMutex
+	hashes map[string]string
+	groups map[string][]string
+}
+
+// NewUsers reads the password and group files. groupFile may be empty.
+func NewUsers(passwordFile, groupFile string) (*Users, error) {
+	u := &Users{passwordFile: passwordFile, groupFile: groupFile}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload reads the files again. On error the previous users are kept.
+func (u *Users) Reload() error {
+	hashes := map[string]string{}
+	err := readLines(u.passwordFile, func(line string) error {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("expected user:hash")
+		}
+		if !supportedHash(parts[1]) {
+			return fmt.Errorf("unsupported hash for user %s, use bcrypt (htpasswd -B) or argon2id", parts[0])
+		}
+		if strings.HasPrefix(parts[1], "$argon2id$") {
+			if _, err := parseArgon2(parts[1]); err != nil {
+				return fmt.Errorf("user %s: %v", parts[0], err)
+			}
+		}
+		hashes[parts[0]] = parts[1]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	groups := map[string][]string{}
+	if u.groupFile != "" {
+		err := readLines(u.groupFile, func(line string) error {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return errors.New("expected group: user1 user2")
+			}
+			group := strings.TrimSpace(parts[0])
+			for _, user := range strings.Fields(parts[1]) {
+				groups[user] = append(groups[user], group)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hashes = hashes
+	u.groups = groups
+	return nil
+}
+
+// Files returns the password and group file.
+func (u *Users) Files() []string {
+	if u.groupFile == "" {
+		return []string{u.passwordFile}
+	}
+	return []string{u.passwordFile, u.groupFile}
+}
+
+// Has returns true if the user is listed in the password file.
+func (u *Users) Has(username string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.hashes[username]
+	return ok
+}
+
+// Authenticate checks the password of a local user and returns an entry
+// with its username in uid and its groups in memberOf.
+func (u *Users) Authenticate(username, password string) (*goldap.Entry, error) {
+	u.mu.RLock()
+	hash, ok := u.hashes[username]
+	groups := u.groups[username]
+	u.mu.RUnlock()
+
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		localLogins.WithLabelValues("unknown_user").Inc()
+		return nil, ErrUnknownUser
+	}
+
+	if err := compareHash(hash, password); err != nil {
+		localLogins.WithLabelValues("invalid_password").Inc()
+		glog.Warningf("LOCAL USER LOGIN FAILED: invalid password for break-glass user %q", username)
+		return nil, err
+	}
+
+	localLogins.WithLabelValues("success").Inc()
+	glog.Warningf("LOCAL USER LOGIN: break-glass user %q authenticated from the local users file", username)
+
+	memberOf := make([]string, len(groups))
+	for i, group := range groups {
+		memberOf[i] = "cn=" + group + ",ou=" + DirectoryName
+	}
+	return goldap.NewEntry("uid="+username+",ou="+DirectoryName, map[string][]string{
+		usernameAttribute: {username},
+		"memberOf":        memberOf,
+	}), nil
+}
+
+// Directory describes the local users as directory.
+func (u *Users) Directory() *ldap.Directory {
+	return &ldap.Directory{Name: DirectoryName, UsernameAttribute: usernameAttribute, BreakGlass: true}
+}
+
+// AuthenticateDirectory is Authenticate also describing the directory.
+func (u *Users) AuthenticateDirectory(ctx context.Context, username, password string) (*goldap.Entry, *ldap.Directory, error) {
+	entry, err := u.Authenticate(username, password)
+	return entry, u.Directory(), err
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareHash(hash, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return compareArgon2(hash, password)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Bounds of the parameters of argon2id hashes, so that a hash can't make
+// every login allocate gigabytes or run for minutes. The argon2 CLI
+// defaults to m=4096,t=3,p=1, OWASP recommends up to m=47104.
+const (
+	maxArgon2Memory  = 256 * 1024 // KiB
+	maxArgon2Time    = 16
+	maxArgon2Threads = 16
+	minArgon2KeyLen  = 16
+	maxArgon2KeyLen  = 64
+)
+
+// argon2Hash is a parsed argon2id hash.
+type argon2Hash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// parseArgon2 parses a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> written by the argon2 CLI,
+// rejecting parameters out of bounds.
+func parseArgon2(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2id version")
+	}
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	switch {
+	case h.memory < 8*uint32(h.threads) || h.memory > maxArgon2Memory:
+		return nil, fmt.Errorf("argon2id memory m=%d must be between 8*p and %d KiB", h.memory, maxArgon2Memory)
+	case h.time < 1 || h.time > maxArgon2Time:
+		return nil, fmt.Errorf("argon2id iterations t=%d must be between 1 and %d", h.time, maxArgon2Time)
+	case h.threads < 1 || h.threads > maxArgon2Threads:
+		return nil, fmt.Errorf("argon2id parallelism p=%d must be between 1 and %d", h.threads, maxArgon2Threads)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	// an empty key would match every password
+	if len(h.key) < minArgon2KeyLen || len(h.key) > maxArgon2KeyLen {
+		return nil, fmt.Errorf("argon2id hash of %d bytes must have between %d and %d", len(h.key), minArgon2KeyLen, maxArgon2KeyLen)
+	}
+	return h, nil
+}
+
+// compareArgon2 checks a password against an argon2id hash.
+func compareArgon2(hash, password string) error {
+	h, err := parseArgon2(hash)
+	if err != nil {
+		return err
+	}
+	actual := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(actual, h.key) != 1 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// readLines calls parse for every non-empty line of filename which isn't
+// a comment.
+func readLines(filename string, parse func(line string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+	}
+	return scanner.Err()
+}
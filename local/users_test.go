@@ -0,0 +1,206 @@
+package local
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap"
+	"github.com/proofpoint/kubernetes-ldap/ldap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeUsers(t *testing.T, dir string) *Users {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argonHash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon-pw"), salt, 1, 1024, 1, 32)))
+
+	passwordFile := filepath.Join(dir, "htpasswd")
+	groupFile := filepath.Join(dir, "htgroup")
+	ioutil.WriteFile(passwordFile, []byte(fmt.Sprintf("# break-glass accounts\nalice:%s\nbob:%s\n", bcryptHash, argonHash)), 0600)
+	ioutil.WriteFile(groupFile, []byte("cluster-admins: alice bob\noncall: alice\n"), 0600)
+
+	users, err := NewUsers(passwordFile, groupFile)
+	if err != nil {
+		t.Fatalf("Unexpected error reading users: %v", err)
+	}
+	return users
+}
+
+func TestUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := writeUsers(t, dir)
+
+	entry, err := users.Authenticate("alice", "bcrypt-pw")
+	if err != nil {
+		t.Fatalf("Unexpected error authenticating bcrypt user: %v", err)
+	}
+	if entry.GetAttributeValue("uid") != "alice" {
+		t.Errorf("Expected uid alice, got %q", entry.GetAttributeValue("uid"))
+	}
+	expectedGroups := []string{"cn=cluster-admins,ou=local", "cn=oncall,ou=local"}
+	if groups := entry.GetAttributeValues("memberOf"); !reflect.DeepEqual(groups, expectedGroups) {
+		t.Errorf("Expected groups %v, got %v", expectedGroups, groups)
+	}
+
+	if _, err := users.Authenticate("bob", "argon-pw"); err != nil {
+		t.Errorf("Unexpected error authenticating argon2id user: %v", err)
+	}
+	if _, err := users.Authenticate("bob", "bcrypt-pw"); err != ErrInvalidPassword {
+		t.Errorf("Expected invalid password, got %v", err)
+	}
+	if _, err := users.Authenticate("carol", "bcrypt-pw"); err != ErrUnknownUser {
+		t.Errorf("Expected unknown user, got %v", err)
+	}
+}
+
+func TestUsersRejectArgon2Parameters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	cases := []struct {
+		params   string
+		key      string
+		expected string
+	}{
+		{"m=4194304,t=1,p=1", key, "memory"},
+		{"m=4,t=1,p=1", key, "memory"},
+		{"m=1024,t=1000,p=1", key, "iterations"},
+		{"m=1024,t=0,p=1", key, "iterations"},
+		{"m=1024,t=1,p=0", key, "parallelism"},
+		{"m=1024,t=1,p=64", key, "parallelism"},
+		{"m=1024,t=1,p=1", "", "hash of 0 bytes"},
+	}
+	passwordFile := filepath.Join(dir, "htpasswd")
+	for _, c := range cases {
+		hash := fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, c.params, salt, c.key)
+		ioutil.WriteFile(passwordFile, []byte("alice:"+hash+"\n"), 0600)
+		if _, err := NewUsers(passwordFile, ""); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", c.params, c.expected, err)
+		}
+		if err := compareArgon2(hash, "password"); err == nil || err == ErrInvalidPassword {
+			t.Errorf("%s: expected the hash to be rejected, got %v", c.params, err)
+		}
+	}
+}
+
+func TestUsersRejectWeakHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(passwordFile, []byte("alice:$apr1$salt$hash\n"), 0600)
+	if _, err := NewUsers(passwordFile, ""); err == nil {
+		t.Errorf("Expected MD5 hashes to be rejected")
+	}
+}
+
+type fakeDirectory struct {
+	calls int
+	err   error
+}
+
+func (f *fakeDirectory) Authenticate(username, password string) (*goldap.Entry, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return goldap.NewEntry("uid="+username+",dc=example,dc=com", nil), nil
+}
+
+func TestChainLastKeepsDirectoryError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := writeUsers(t, dir)
+
+	cases := []struct {
+		password       string
+		directoryErr   error
+		expectedReason ldap.Reason
+	}{
+		{"wrong", &ldap.Error{Reason: ldap.ReasonPasswordExpired}, ldap.ReasonPasswordExpired},
+		{"wrong", &ldap.Error{Reason: ldap.ReasonAccountDisabled}, ldap.ReasonAccountDisabled},
+		{"wrong", &ldap.Error{Reason: ldap.ReasonServerUnavailable}, ldap.ReasonServerUnavailable},
+		// locked out accounts don't fall back to local users
+		{"bcrypt-pw", &ldap.Error{Reason: ldap.ReasonThrottled}, ldap.ReasonThrottled},
+	}
+	for _, c := range cases {
+		chain := &Chain{Users: users, Directory: &fakeDirectory{err: c.directoryErr}, Mode: ModeLast}
+		_, err := chain.Authenticate("alice", c.password)
+		if reason := ldap.ReasonOf(err); reason != c.expectedReason {
+			t.Errorf("%v: expected reason %s, got %v", c.directoryErr, c.expectedReason, err)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := writeUsers(t, dir)
+
+	cases := []struct {
+		mode              string
+		username          string
+		password          string
+		directoryErr      error
+		expectedLocal     bool
+		expectedErr       bool
+		expectedDirectory int
+	}{
+		{ModeFirst, "alice", "bcrypt-pw", nil, true, false, 0},
+		{ModeFirst, "alice", "ldap-pw", nil, false, false, 1},
+		{ModeFirst, "dave", "ldap-pw", nil, false, false, 1},
+		{ModeLast, "alice", "bcrypt-pw", nil, false, false, 1},
+		{ModeLast, "alice", "bcrypt-pw", errors.New("unreachable"), true, false, 1},
+		{ModeLast, "dave", "ldap-pw", errors.New("unreachable"), false, true, 1},
+		{ModeOnly, "alice", "bcrypt-pw", nil, true, false, 0},
+		{ModeOnly, "alice", "ldap-pw", nil, false, true, 0},
+		{ModeOnly, "dave", "ldap-pw", nil, false, false, 1},
+	}
+
+	for i, c := range cases {
+		directory := &fakeDirectory{err: c.directoryErr}
+		chain := &Chain{Users: users, Directory: directory, Mode: c.mode}
+
+		entry, err := chain.Authenticate(c.username, c.password)
+		if c.expectedErr != (err != nil) {
+			t.Errorf("Case %d: unexpected error %v", i, err)
+		}
+		if err == nil && c.expectedLocal != (entry.DN == "uid="+c.username+",ou=local") {
+			t.Errorf("Case %d: expected local %t, got entry %s", i, c.expectedLocal, entry.DN)
+		}
+		if directory.calls != c.expectedDirectory {
+			t.Errorf("Case %d: expected %d directory calls, got %d", i, c.expectedDirectory, directory.calls)
+		}
+	}
+}
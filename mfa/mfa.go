@@ -0,0 +1,330 @@
+// Package mfa implements TOTP (RFC 6238) based second factor authentication
+// with backup codes.
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupCodeCount = 10
+
+// DefaultEnrollmentCodeTTL is the validity of enrollment codes if the
+// Authenticator sets none.
+const DefaultEnrollmentCodeTTL = 72 * time.Hour
+
+// backupCodeAlphabet leaves out characters that are easily confused.
+const backupCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var (
+	// ErrInvalidCode is returned when neither a TOTP nor a backup code matched.
+	ErrInvalidCode = errors.New("invalid MFA code")
+	// ErrAlreadyEnrolled is returned when enrolling a user with a confirmed enrollment.
+	ErrAlreadyEnrolled = errors.New("user is already enrolled for MFA")
+	// ErrInvalidEnrollmentCode is returned when enrolling without a valid
+	// enrollment code issued by an admin.
+	ErrInvalidEnrollmentCode = errors.New("invalid or expired MFA enrollment code")
+	// ErrEnrollmentPending is returned when enrolling a user whose
+	// enrollment awaits confirmation. An admin has to issue a new
+	// enrollment code to replace it.
+	ErrEnrollmentPending = errors.New("MFA enrollment is pending confirmation")
+)
+
+// Authenticator verifies second factor codes for users and decides which
+// users must provide one.
+type Authenticator struct {
+	// Store holds the enrollments. It may be nil when secrets are only
+	// read from the directory.
+	Store Store
+	// Issuer is the name shown by authenticator apps.
+	Issuer string
+	// RequiredGroups lists the groups whose members must use MFA. The
+	// special group "*" requires MFA for every user.
+	RequiredGroups []string
+	// EnrollmentCodeTTL is the validity of enrollment codes. Defaults to
+	// DefaultEnrollmentCodeTTL.
+	EnrollmentCodeTTL time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	// mu serializes read-modify-write cycles on the store, and guards
+	// lastSteps.
+	mu sync.Mutex
+	// lastSteps holds the last accepted time step of secrets not managed
+	// by the store, by username. Steps outside of the skew window are
+	// dropped, as no valid code can replay them.
+	lastSteps map[string]int64
+}
+
+// NewEnrollment is returned to the user after enrolling.
+type NewEnrollment struct {
+	Secret      string   `json:"secret"`
+	KeyURI      string   `json:"keyURI"`
+	BackupCodes []string `json:"backupCodes"`
+}
+
+// Required returns true if a user with the given groups must provide a second factor.
+func (a *Authenticator) Required(groups []string) bool {
+	for _, required := range a.RequiredGroups {
+		if required == "*" {
+			return true
+		}
+		for _, group := range groups {
+			if strings.EqualFold(required, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Enrolled returns true if the user has a confirmed enrollment.
+func (a *Authenticator) Enrolled(username string) (bool, error) {
+	if a.Store == nil {
+		return false, nil
+	}
+	e, err := a.Store.Get(username)
+	if err == ErrNotEnrolled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.Confirmed, nil
+}
+
+// IssueEnrollmentCode returns a one-time code which lets the user enroll,
+// so that a leaked password alone doesn't suffice to bind a secret to the
+// account. It replaces a pending enrollment of the user.
+func (a *Authenticator) IssueEnrollmentCode(username string) (string, error) {
+	if a.Store == nil {
+		return "", errors.New("no MFA store configured")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	existing, err := a.Store.Get(username)
+	if err != nil && err != ErrNotEnrolled {
+		return "", err
+	}
+	if existing != nil && existing.Confirmed {
+		return "", ErrAlreadyEnrolled
+	}
+
+	code, err := generateBackupCode()
+	if err != nil {
+		return "", err
+	}
+	ttl := a.EnrollmentCodeTTL
+	if ttl == 0 {
+		ttl = DefaultEnrollmentCodeTTL
+	}
+
+	err = a.Store.Put(username, &Enrollment{
+		EnrollmentCode:       hashBackupCode(code),
+		EnrollmentCodeExpiry: a.now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Enroll creates a new secret and backup codes for the user, consuming the
+// enrollment code issued by an admin. The enrollment has to be confirmed
+// with a valid code before it is enforced. A pending enrollment is only
+// replaced via a new enrollment code.
+func (a *Authenticator) Enroll(username, enrollmentCode string) (*NewEnrollment, error) {
+	if a.Store == nil {
+		return nil, errors.New("no MFA store configured")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	existing, err := a.Store.Get(username)
+	if err == ErrNotEnrolled {
+		return nil, ErrInvalidEnrollmentCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case existing.Confirmed:
+		return nil, ErrAlreadyEnrolled
+	case existing.Secret != "":
+		return nil, ErrEnrollmentPending
+	case existing.EnrollmentCode == "" || a.now().Unix() > existing.EnrollmentCodeExpiry:
+		return nil, ErrInvalidEnrollmentCode
+	case subtle.ConstantTimeCompare([]byte(existing.EnrollmentCode), []byte(hashBackupCode(enrollmentCode))) != 1:
+		return nil, ErrInvalidEnrollmentCode
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+	for i := range codes {
+		if codes[i], err = generateBackupCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashBackupCode(codes[i])
+	}
+
+	err = a.Store.Put(username, &Enrollment{
+		Secret:      secret,
+		BackupCodes: hashes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &NewEnrollment{
+		Secret:      secret,
+		KeyURI:      KeyURI(a.Issuer, username, secret),
+		BackupCodes: codes,
+	}, nil
+}
+
+// Confirm activates a pending enrollment once the user supplied a valid TOTP code.
+func (a *Authenticator) Confirm(username, code string) error {
+	if a.Store == nil {
+		return errors.New("no MFA store configured")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, err := a.Store.Get(username)
+	if err != nil {
+		return err
+	}
+	if e.Secret == "" {
+		return ErrNotEnrolled
+	}
+
+	step, ok := ValidateCode(e.Secret, code, a.now())
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	e.Confirmed = true
+	e.LastStep = step
+	return a.Store.Put(username, e)
+}
+
+// Verify checks a TOTP or backup code against the user's confirmed
+// enrollment. TOTP codes can only be used once and backup codes are
+// consumed on use.
+func (a *Authenticator) Verify(username, code string) error {
+	if a.Store == nil {
+		return ErrNotEnrolled
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, err := a.Store.Get(username)
+	if err != nil {
+		return err
+	}
+	if !e.Confirmed {
+		return ErrNotEnrolled
+	}
+
+	if step, ok := ValidateCode(e.Secret, code, a.now()); ok {
+		if step <= e.LastStep {
+			return ErrInvalidCode
+		}
+		e.LastStep = step
+		return a.Store.Put(username, e)
+	}
+
+	hash := hashBackupCode(code)
+	for i, stored := range e.BackupCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			e.BackupCodes = append(e.BackupCodes[:i], e.BackupCodes[i+1:]...)
+			return a.Store.Put(username, e)
+		}
+	}
+
+	return ErrInvalidCode
+}
+
+// VerifySecret checks a TOTP code of the user against a secret which is
+// not managed by the store, e.g. one read from a directory attribute.
+// Like with Verify codes can only be used once, though only within this
+// process, as the last accepted step isn't persisted.
+func (a *Authenticator) VerifySecret(username, secret, code string) error {
+	now := a.now()
+	step, ok := ValidateCode(secret, code, now)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	oldest := timeStep(now) - skew
+	for user, last := range a.lastSteps {
+		if last < oldest {
+			delete(a.lastSteps, user)
+		}
+	}
+	if step <= a.lastSteps[username] {
+		return ErrInvalidCode
+	}
+	if a.lastSteps == nil {
+		a.lastSteps = map[string]int64{}
+	}
+	a.lastSteps[username] = step
+	return nil
+}
+
+func (a *Authenticator) now() time.Time {
+	if a.Now != nil {
+		return a.Now()
+	}
+	return time.Now()
+}
+
+func generateBackupCode() (string, error) {
+	return readBackupCode(rand.Reader)
+}
+
+// readBackupCode returns a backup code of random bytes of r. Bytes beyond
+// the largest multiple of the alphabet size are skipped, as the modulo
+// would make the first characters of the alphabet more likely.
+func readBackupCode(r io.Reader) (string, error) {
+	limit := 256 - 256%len(backupCodeAlphabet)
+	code := make([]byte, 0, 10)
+	buf := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(code) < cap(code) {
+				code = append(code, backupCodeAlphabet[int(b)%len(backupCodeAlphabet)])
+			}
+		}
+	}
+	return string(code[:5]) + "-" + string(code[5:]), nil
+}
+
+func hashBackupCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,245 @@
+package mfa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequired(t *testing.T) {
+	cases := []struct {
+		required []string
+		groups   []string
+		expected bool
+	}{
+		{required: nil, groups: []string{"admins"}, expected: false},
+		{required: []string{"admins"}, groups: []string{"users", "Admins"}, expected: true},
+		{required: []string{"admins"}, groups: []string{"users"}, expected: false},
+		{required: []string{"*"}, groups: nil, expected: true},
+	}
+
+	for i, c := range cases {
+		a := &Authenticator{RequiredGroups: c.required}
+		if got := a.Required(c.groups); got != c.expected {
+			t.Errorf("Case %d: expected %v, got %v", i, c.expected, got)
+		}
+	}
+}
+
+func TestEnrollAndVerify(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	a := &Authenticator{
+		Store:  NewMemoryStore(),
+		Issuer: "test",
+		Now:    func() time.Time { return now },
+	}
+
+	enrollmentCode, err := a.IssueEnrollmentCode("alice")
+	if err != nil {
+		t.Fatalf("Unexpected error issuing enrollment code: %v", err)
+	}
+	enrollment, err := a.Enroll("alice", enrollmentCode)
+	if err != nil {
+		t.Fatalf("Unexpected error enrolling: %v", err)
+	}
+	if len(enrollment.BackupCodes) != backupCodeCount {
+		t.Errorf("Expected %d backup codes, got %d", backupCodeCount, len(enrollment.BackupCodes))
+	}
+
+	if enrolled, _ := a.Enrolled("alice"); enrolled {
+		t.Errorf("Enrollment must not be active before confirmation")
+	}
+	if err := a.Confirm("alice", "000000"); err != ErrInvalidCode {
+		t.Errorf("Expected ErrInvalidCode confirming with a wrong code, got %v", err)
+	}
+
+	code, _ := GenerateCode(enrollment.Secret, now)
+	if err := a.Confirm("alice", code); err != nil {
+		t.Fatalf("Unexpected error confirming: %v", err)
+	}
+	if enrolled, _ := a.Enrolled("alice"); !enrolled {
+		t.Errorf("Enrollment must be active after confirmation")
+	}
+	if _, err := a.Enroll("alice", enrollmentCode); err != ErrAlreadyEnrolled {
+		t.Errorf("Expected ErrAlreadyEnrolled, got %v", err)
+	}
+	if _, err := a.IssueEnrollmentCode("alice"); err != ErrAlreadyEnrolled {
+		t.Errorf("Expected ErrAlreadyEnrolled issuing a code, got %v", err)
+	}
+
+	// the code used for confirmation can't be replayed
+	if err := a.Verify("alice", code); err != ErrInvalidCode {
+		t.Errorf("Expected replayed code to be rejected, got %v", err)
+	}
+
+	now = now.Add(period)
+	code, _ = GenerateCode(enrollment.Secret, now)
+	if err := a.Verify("alice", code); err != nil {
+		t.Errorf("Unexpected error verifying: %v", err)
+	}
+
+	backup := enrollment.BackupCodes[0]
+	if err := a.Verify("alice", backup); err != nil {
+		t.Errorf("Unexpected error verifying backup code: %v", err)
+	}
+	if err := a.Verify("alice", backup); err != ErrInvalidCode {
+		t.Errorf("Expected used backup code to be rejected, got %v", err)
+	}
+
+	if err := a.Verify("bob", code); err != ErrNotEnrolled {
+		t.Errorf("Expected ErrNotEnrolled for unknown user, got %v", err)
+	}
+}
+
+func TestEnrollmentCode(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	a := &Authenticator{
+		Store:             NewMemoryStore(),
+		EnrollmentCodeTTL: time.Hour,
+		Now:               func() time.Time { return now },
+	}
+
+	if _, err := a.Enroll("alice", ""); err != ErrInvalidEnrollmentCode {
+		t.Errorf("Expected ErrInvalidEnrollmentCode without a code, got %v", err)
+	}
+
+	code, err := a.IssueEnrollmentCode("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Enroll("alice", "wrong-code"); err != ErrInvalidEnrollmentCode {
+		t.Errorf("Expected ErrInvalidEnrollmentCode for a wrong code, got %v", err)
+	}
+	if _, err := a.Enroll("bob", code); err != ErrInvalidEnrollmentCode {
+		t.Errorf("Expected the code of another user to be rejected, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := a.Enroll("alice", code); err != ErrInvalidEnrollmentCode {
+		t.Errorf("Expected an expired code to be rejected, got %v", err)
+	}
+
+	code, _ = a.IssueEnrollmentCode("alice")
+	first, err := a.Enroll("alice", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the code is consumed, and the pending enrollment kept
+	if _, err := a.Enroll("alice", code); err != ErrEnrollmentPending {
+		t.Errorf("Expected ErrEnrollmentPending, got %v", err)
+	}
+	if e, _ := a.Store.Get("alice"); e.Secret != first.Secret {
+		t.Error("Expected the pending enrollment to be kept")
+	}
+
+	// a new code from an admin replaces the pending enrollment
+	code, _ = a.IssueEnrollmentCode("alice")
+	if second, err := a.Enroll("alice", code); err != nil || second.Secret == first.Secret {
+		t.Errorf("Expected a new enrollment, got %v", err)
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := "JBSWY3DPEHPK3PXP"
+	a := &Authenticator{Now: func() time.Time { return now }}
+
+	code, _ := GenerateCode(secret, now)
+	if err := a.VerifySecret("alice", secret, code); err != nil {
+		t.Fatalf("Unexpected error verifying: %v", err)
+	}
+	if err := a.VerifySecret("alice", secret, code); err != ErrInvalidCode {
+		t.Errorf("Expected replayed code to be rejected, got %v", err)
+	}
+	if err := a.VerifySecret("bob", secret, code); err != nil {
+		t.Errorf("Expected the code of another user to be accepted, got %v", err)
+	}
+	if err := a.VerifySecret("alice", secret, "000000"); err != ErrInvalidCode {
+		t.Errorf("Expected ErrInvalidCode, got %v", err)
+	}
+
+	now = now.Add(period)
+	code, _ = GenerateCode(secret, now)
+	if err := a.VerifySecret("alice", secret, code); err != nil {
+		t.Errorf("Unexpected error verifying the next code: %v", err)
+	}
+
+	// steps outside of the skew window are forgotten
+	now = now.Add(3 * period)
+	code, _ = GenerateCode(secret, now)
+	if err := a.VerifySecret("carol", secret, code); err != nil {
+		t.Errorf("Unexpected error verifying: %v", err)
+	}
+	if _, ok := a.lastSteps["bob"]; ok || len(a.lastSteps) != 1 {
+		t.Errorf("Expected only the step of carol to be kept, got %v", a.lastSteps)
+	}
+}
+
+func TestReadBackupCode(t *testing.T) {
+	// 248 to 255 would favor the first 8 characters
+	random := bytes.Repeat([]byte{255, 248, 0, 30, 247}, 10)
+	code, err := readBackupCode(bytes.NewReader(random))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code != "a99a9-9a99a" {
+		t.Errorf("Expected the bytes of the bias to be skipped, got %q", code)
+	}
+
+	if _, err := readBackupCode(bytes.NewReader([]byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255})); err == nil {
+		t.Errorf("Expected an error when the random bytes run out")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)
+	storeFile := filepath.Join(dir, "store")
+
+	store, err := NewFileStore(storeFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	if _, err := store.Get("alice"); err != ErrNotEnrolled {
+		t.Errorf("Expected ErrNotEnrolled, got %v", err)
+	}
+	if err := store.Put("alice", &Enrollment{Secret: "JBSWY3DPEHPK3PXP", Confirmed: true}); err != nil {
+		t.Fatalf("Unexpected error storing enrollment: %v", err)
+	}
+
+	// a new store must read what the first one wrote
+	store, err = NewFileStore(storeFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %v", err)
+	}
+	e, err := store.Get("alice")
+	if err != nil || e.Secret != "JBSWY3DPEHPK3PXP" || !e.Confirmed {
+		t.Errorf("Unexpected enrollment %+v, error %v", e, err)
+	}
+
+	data, _ := ioutil.ReadFile(storeFile)
+	for _, secret := range []string{"JBSWY3DPEHPK3PXP", "alice"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Store file contains %q in plain text", secret)
+		}
+	}
+
+	rand.Read(key)
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)
+	if _, err := NewFileStore(storeFile, keyFile); err == nil {
+		t.Errorf("Expected an error opening the store with the wrong key")
+	}
+}
@@ -0,0 +1,193 @@
+package mfa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrNotEnrolled is returned by a Store when the user has no enrollment.
+var ErrNotEnrolled = errors.New("user is not enrolled for MFA")
+
+// Enrollment is the MFA state of a single user.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	// BackupCodes holds the hashes of the unused backup codes.
+	BackupCodes []string `json:"backupCodes,omitempty"`
+	// Confirmed is set once the user proved possession of the secret.
+	Confirmed bool `json:"confirmed"`
+	// LastStep is the last accepted TOTP time step, used to reject replays.
+	LastStep int64 `json:"lastStep,omitempty"`
+	// EnrollmentCode is the hash of the one-time code an admin issued to
+	// let the user enroll, and EnrollmentCodeExpiry its expiry in seconds
+	// since the epoch.
+	EnrollmentCode       string `json:"enrollmentCode,omitempty"`
+	EnrollmentCodeExpiry int64  `json:"enrollmentCodeExpiry,omitempty"`
+}
+
+// Store persists user enrollments.
+type Store interface {
+	Get(username string) (*Enrollment, error)
+	Put(username string, enrollment *Enrollment) error
+}
+
+// memoryStore keeps enrollments in memory only.
+type memoryStore struct {
+	mu          sync.Mutex
+	enrollments map[string]Enrollment
+}
+
+// NewMemoryStore returns a Store that does not persist enrollments.
+func NewMemoryStore() Store {
+	return &memoryStore{enrollments: map[string]Enrollment{}}
+}
+
+func (m *memoryStore) Get(username string) (*Enrollment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.enrollments[username]
+	if !ok {
+		return nil, ErrNotEnrolled
+	}
+	return &e, nil
+}
+
+func (m *memoryStore) Put(username string, enrollment *Enrollment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enrollments[username] = *enrollment
+	return nil
+}
+
+// fileStore keeps enrollments in a single AES-GCM encrypted JSON file.
+type fileStore struct {
+	mu       sync.Mutex
+	filename string
+	aead     cipher.AEAD
+}
+
+// NewFileStore returns a Store backed by filename, encrypted with the
+// base64 encoded 256 bit key read from keyFile.
+func NewFileStore(filename, keyFile string) (Store, error) {
+	encoded, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding MFA key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("expected a 32 byte MFA key, got %d bytes", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &fileStore{filename: filename, aead: aead}
+	// fail early on a corrupt file or a wrong key
+	if _, err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileStore) Get(username string) (*Enrollment, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	enrollments, err := fs.load()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := enrollments[username]
+	if !ok {
+		return nil, ErrNotEnrolled
+	}
+	return &e, nil
+}
+
+func (fs *fileStore) Put(username string, enrollment *Enrollment) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	enrollments, err := fs.load()
+	if err != nil {
+		return err
+	}
+	enrollments[username] = *enrollment
+	return fs.save(enrollments)
+}
+
+func (fs *fileStore) load() (map[string]Enrollment, error) {
+	enrollments := map[string]Enrollment{}
+
+	data, err := ioutil.ReadFile(fs.filename)
+	if os.IsNotExist(err) {
+		return enrollments, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := fs.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("MFA store %s is corrupt", fs.filename)
+	}
+	plain, err := fs.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting MFA store %s: %v", fs.filename, err)
+	}
+
+	if err := json.Unmarshal(plain, &enrollments); err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+func (fs *fileStore) save(enrollments map[string]Enrollment) error {
+	plain, err := json.Marshal(enrollments)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, fs.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data := fs.aead.Seal(nonce, nonce, plain, nil)
+
+	// write to a temporary file first so a crash never leaves a truncated store
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.filename), ".mfa-store")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.filename)
+}
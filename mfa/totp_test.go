@@ -0,0 +1,68 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors, truncated to 6 digits.
+func TestGenerateCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, c := range cases {
+		code, err := GenerateCode(secret, time.Unix(c.unix, 0))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if code != c.code {
+			t.Errorf("At %d expected code %s, got %s", c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now := time.Unix(1600000000, 0)
+
+	cases := []struct {
+		name  string
+		at    time.Time
+		valid bool
+	}{
+		{name: "current step", at: now, valid: true},
+		{name: "previous step", at: now.Add(-period), valid: true},
+		{name: "next step", at: now.Add(period), valid: true},
+		{name: "too old", at: now.Add(-2 * period), valid: false},
+		{name: "too new", at: now.Add(2 * period), valid: false},
+	}
+
+	for _, c := range cases {
+		code, _ := GenerateCode(secret, c.at)
+		if _, ok := ValidateCode(secret, code, now); ok != c.valid {
+			t.Errorf("%s: expected valid=%v, got %v", c.name, c.valid, ok)
+		}
+	}
+
+	if _, ok := ValidateCode(secret, "12345", now); ok {
+		t.Errorf("short code must not validate")
+	}
+	if _, ok := ValidateCode("not base32!", "123456", now); ok {
+		t.Errorf("invalid secret must not validate")
+	}
+}
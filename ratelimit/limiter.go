@@ -0,0 +1,187 @@
+// Package ratelimit throttles login attempts per key (e.g. username or
+// source IP) with a token bucket, exponential backoff after failures and a
+// temporary lockout.
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle entries are dropped.
+const sweepInterval = time.Minute
+
+// DefaultBackoffMax bounds the backoff if BackoffMax is unset, long before
+// the doubling overflows time.Duration after about 40 failures.
+const DefaultBackoffMax = time.Hour
+
+var (
+	// ErrRateLimited is returned when a key exceeded its request rate.
+	ErrRateLimited = errors.New("too many requests")
+	// ErrBackoff is returned when a key retries too soon after a failure.
+	ErrBackoff = errors.New("retrying too soon after a failed attempt")
+	// ErrLockedOut is returned while a key is locked out.
+	ErrLockedOut = errors.New("temporarily locked out after too many failed attempts")
+)
+
+// Limiter tracks attempts per key. The zero value allows everything.
+type Limiter struct {
+	// PerMinute is the number of attempts allowed per minute, with bursts
+	// of the same size. 0 disables rate limiting.
+	PerMinute int
+	// BackoffBase is the delay enforced after the first failure, doubled
+	// after each further failure up to BackoffMax, or DefaultBackoffMax
+	// if 0. A BackoffBase of 0 disables backoff.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// LockoutThreshold is the number of consecutive failures after which
+	// the key is locked for LockoutDuration. Failures older than
+	// LockoutDuration are forgotten. 0 disables lockouts.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+type entry struct {
+	tokens      float64
+	updated     time.Time
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Allow records an attempt for key. It returns nil if the attempt may
+// proceed, otherwise the reason and how long to wait before retrying.
+func (l *Limiter) Allow(key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	e := l.get(key, now)
+
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now), ErrLockedOut
+	}
+
+	if e.failures > 0 && l.BackoffBase > 0 {
+		if next := e.lastFailure.Add(l.backoff(e.failures)); now.Before(next) {
+			return next.Sub(now), ErrBackoff
+		}
+	}
+
+	if l.PerMinute > 0 {
+		if e.tokens < 1 {
+			wait := time.Duration((1 - e.tokens) / l.ratePerSecond() * float64(time.Second))
+			return wait, ErrRateLimited
+		}
+		e.tokens--
+	}
+
+	return 0, nil
+}
+
+// Failure records a failed attempt for key and returns true if the key
+// got locked out because of it.
+func (l *Limiter) Failure(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	e := l.get(key, now)
+	e.failures++
+	e.lastFailure = now
+
+	if l.LockoutThreshold > 0 && e.failures >= l.LockoutThreshold {
+		e.failures = 0
+		e.lockedUntil = now.Add(l.LockoutDuration)
+		return true
+	}
+	return false
+}
+
+// Success forgets the failures recorded for key.
+func (l *Limiter) Success(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok {
+		e.failures = 0
+	}
+}
+
+// get returns the entry of key with its bucket refilled and stale failures
+// forgotten. Must be called with l.mu held.
+func (l *Limiter) get(key string, now time.Time) *entry {
+	if l.entries == nil {
+		l.entries = map[string]*entry{}
+	}
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{tokens: float64(l.PerMinute), updated: now}
+		l.entries[key] = e
+	}
+
+	if l.PerMinute > 0 {
+		e.tokens = math.Min(float64(l.PerMinute), e.tokens+now.Sub(e.updated).Seconds()*l.ratePerSecond())
+	}
+	e.updated = now
+
+	if e.failures > 0 && l.LockoutDuration > 0 && now.Sub(e.lastFailure) > l.LockoutDuration {
+		e.failures = 0
+	}
+	return e
+}
+
+// sweep drops entries which carry no state anymore.
+func (l *Limiter) sweep(now time.Time) {
+	for key, e := range l.entries {
+		refilled := l.PerMinute == 0 || now.Sub(e.updated) >= time.Minute
+		forgotten := e.failures == 0 || (l.LockoutDuration > 0 && now.Sub(e.lastFailure) > l.LockoutDuration)
+		if refilled && forgotten && !now.Before(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *Limiter) backoff(failures int) time.Duration {
+	max := l.BackoffMax
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+
+	d := l.BackoffBase
+	for i := 1; i < failures; i++ {
+		// checked before doubling, which could overflow
+		if d >= max/2 {
+			return max
+		}
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func (l *Limiter) ratePerSecond() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimit(t *testing.T) {
+	c := &clock{now: time.Unix(1600000000, 0)}
+	l := &Limiter{PerMinute: 3, Now: c.Now}
+
+	for i := 0; i < 3; i++ {
+		if _, err := l.Allow("alice"); err != nil {
+			t.Fatalf("Attempt %d: unexpected error %v", i, err)
+		}
+	}
+
+	retryAfter, err := l.Allow("alice")
+	if err != ErrRateLimited {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("Expected to retry after 20s, got %s", retryAfter)
+	}
+
+	if _, err := l.Allow("bob"); err != nil {
+		t.Errorf("Other keys must not be limited, got %v", err)
+	}
+
+	c.Advance(20 * time.Second)
+	if _, err := l.Allow("alice"); err != nil {
+		t.Errorf("Expected attempt to be allowed after refill, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &clock{now: time.Unix(1600000000, 0)}
+	l := &Limiter{BackoffBase: time.Second, BackoffMax: 4 * time.Second, Now: c.Now}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, wait := range expected {
+		l.Failure("alice")
+
+		retryAfter, err := l.Allow("alice")
+		if err != ErrBackoff || retryAfter != wait {
+			t.Errorf("Failure %d: expected %s backoff, got %s (%v)", i+1, wait, retryAfter, err)
+		}
+
+		c.Advance(wait)
+		if _, err := l.Allow("alice"); err != nil {
+			t.Errorf("Failure %d: expected attempt to be allowed after backoff, got %v", i+1, err)
+		}
+	}
+
+	l.Success("alice")
+	if _, err := l.Allow("alice"); err != nil {
+		t.Errorf("Expected success to reset the backoff, got %v", err)
+	}
+}
+
+func TestBackoffBounded(t *testing.T) {
+	cases := []struct {
+		limiter  *Limiter
+		expected time.Duration
+	}{
+		// without a maximum the doubling overflowed after ~40 failures
+		{&Limiter{BackoffBase: time.Second}, DefaultBackoffMax},
+		{&Limiter{BackoffBase: time.Second, BackoffMax: time.Duration(1<<63 - 1)}, time.Duration(1<<63 - 1)},
+		{&Limiter{BackoffBase: time.Hour, BackoffMax: time.Minute}, time.Minute},
+	}
+	for _, c := range cases {
+		for _, failures := range []int{1, 40, 64, 1000} {
+			d := c.limiter.backoff(failures)
+			if d <= 0 || d > c.expected {
+				t.Errorf("%+v: %d failures: expected a backoff up to %s, got %s", c.limiter, failures, c.expected, d)
+			}
+		}
+		if d := c.limiter.backoff(1000); d != c.expected {
+			t.Errorf("%+v: expected a backoff of %s, got %s", c.limiter, c.expected, d)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	c := &clock{now: time.Unix(1600000000, 0)}
+	l := &Limiter{LockoutThreshold: 3, LockoutDuration: time.Minute, Now: c.Now}
+
+	if l.Failure("alice") || l.Failure("alice") {
+		t.Fatalf("Locked out before reaching the threshold")
+	}
+	if !l.Failure("alice") {
+		t.Fatalf("Expected lockout on reaching the threshold")
+	}
+
+	retryAfter, err := l.Allow("alice")
+	if err != ErrLockedOut || retryAfter != time.Minute {
+		t.Errorf("Expected lockout for 1m, got %s (%v)", retryAfter, err)
+	}
+
+	c.Advance(time.Minute)
+	if _, err := l.Allow("alice"); err != nil {
+		t.Errorf("Expected lockout to expire, got %v", err)
+	}
+
+	// failures older than the lockout duration are forgotten
+	l.Failure("alice")
+	l.Failure("alice")
+	c.Advance(2 * time.Minute)
+	if l.Failure("alice") {
+		t.Errorf("Stale failures must not count towards a lockout")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	c := &clock{now: time.Unix(1600000000, 0)}
+	l := &Limiter{PerMinute: 10, LockoutThreshold: 3, LockoutDuration: time.Minute, Now: c.Now}
+
+	l.Allow("alice")
+	l.Failure("bob")
+	c.Advance(30 * time.Second)
+	l.Allow("carol")
+	c.Advance(2 * time.Minute)
+	l.Allow("dave")
+
+	if _, ok := l.entries["alice"]; ok {
+		t.Errorf("Expected idle entry to be swept")
+	}
+	if _, ok := l.entries["dave"]; !ok {
+		t.Errorf("Expected active entry to be kept")
+	}
+}
@@ -0,0 +1,143 @@
+// Package reload watches files such as certificates and keys and reloads
+// them when they change on disk, e.g. after a renewal by cert-manager.
+package reload
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// debounce is how long to wait for further changes before reloading, as
+// updates of Kubernetes secrets and renewals touch several files.
+const debounce = time.Second
+
+var (
+	reloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kubernetes_ldap_reloads_total",
+			Help: "Total number of reloads of watched files by target and result.",
+		},
+		[]string{"target", "result"},
+	)
+	lastReloadSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kubernetes_ldap_last_reload_success_timestamp_seconds",
+			Help: "Time of the last successful reload by target.",
+		},
+		[]string{"target"},
+	)
+)
+
+// RegisterReloadMetrics registers the metrics for reloads
+func RegisterReloadMetrics() {
+	prometheus.MustRegister(reloads)
+	prometheus.MustRegister(lastReloadSuccess)
+}
+
+// Watcher calls reload functions when their files change.
+type Watcher struct {
+	watcher *fsnotify.Watcher
+
+	mu      sync.Mutex
+	targets []*target
+}
+
+type target struct {
+	name   string
+	reload func() error
+	dirs   map[string]bool
+	timer  *time.Timer
+}
+
+// NewWatcher returns a Watcher. Run must be called to process changes.
+func NewWatcher() (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{watcher: w}, nil
+}
+
+// Add calls reload whenever one of the files changes. The directories of
+// the files are watched rather than the files themselves, so that files
+// replaced by a rename or a symlink swap are picked up.
+func (w *Watcher) Add(name string, reload func() error, files ...string) error {
+	t := &target{name: name, reload: reload, dirs: map[string]bool{}}
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if !t.dirs[dir] {
+			if err := w.watcher.Add(dir); err != nil {
+				return err
+			}
+			t.dirs[dir] = true
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.targets = append(w.targets, t)
+	return nil
+}
+
+// Run processes file changes until stop is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	defer w.watcher.Close()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			w.schedule(filepath.Dir(event.Name))
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("Error watching files: %v", err)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// schedule reloads the targets watching dir once no changes happened for
+// the debounce interval.
+func (w *Watcher) schedule(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, t := range w.targets {
+		if !t.dirs[dir] {
+			continue
+		}
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		t := t
+		t.timer = time.AfterFunc(debounce, func() { Run(t.name, t.reload) })
+	}
+}
+
+// Run calls reload, logging and counting the result for target.
+func Run(target string, reload func() error) error {
+	err := reload()
+	if err != nil {
+		reloads.WithLabelValues(target, "error").Inc()
+		glog.Errorf("Error reloading %s, keeping the previous version: %v", target, err)
+		return err
+	}
+
+	reloads.WithLabelValues(target, "success").Inc()
+	lastReloadSuccess.WithLabelValues(target).SetToCurrentTime()
+	glog.Infof("Reloaded %s", target)
+	return nil
+}
@@ -0,0 +1,141 @@
+package reload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCertificate(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func commonName(t *testing.T, c *Certificate) string {
+	cert, _ := c.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	c, err := NewCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error loading certificate: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan struct{}, 1)
+	err = w.Add("test", func() error {
+		err := c.Reload()
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+		return err
+	}, c.Files()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(stop)
+
+	writeCertificate(t, certFile, keyFile, "second")
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Certificate was not reloaded")
+	}
+	if cn := commonName(t, c); cn != "second" {
+		t.Errorf("Expected the renewed certificate, got %q", cn)
+	}
+
+	// a broken certificate keeps the previous one
+	ioutil.WriteFile(certFile, []byte("garbage"), 0644)
+	if err := Run("test", c.Reload); err == nil {
+		t.Errorf("Expected an error reloading a broken certificate")
+	}
+	if cn := commonName(t, c); cn != "second" {
+		t.Errorf("Expected the previous certificate to be kept, got %q", cn)
+	}
+}
+
+func TestSecretReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "password")
+	ioutil.WriteFile(filename, []byte("first\n"), 0600)
+
+	s, err := NewSecret(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error reading secret: %v", err)
+	}
+	if s.Value() != "first" {
+		t.Errorf("Expected first, got %q", s.Value())
+	}
+
+	ioutil.WriteFile(filename, []byte("second"), 0600)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading secret: %v", err)
+	}
+	if s.Value() != "second" {
+		t.Errorf("Expected second, got %q", s.Value())
+	}
+
+	// an empty file keeps the previous secret
+	ioutil.WriteFile(filename, []byte("\n"), 0600)
+	if err := s.Reload(); err == nil {
+		t.Errorf("Expected an error reloading an empty secret")
+	}
+	if s.Value() != "second" {
+		t.Errorf("Expected the previous secret to be kept, got %q", s.Value())
+	}
+}
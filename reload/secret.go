@@ -0,0 +1,56 @@
+package reload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Secret holds a password read from a file, e.g. a mounted Kubernetes
+// secret, which can be reloaded when it is rotated.
+type Secret struct {
+	filename string
+
+	mu    sync.RWMutex
+	value string
+}
+
+// NewSecret reads the secret from filename.
+func NewSecret(filename string) (*Secret, error) {
+	s := &Secret{filename: filename}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again. Trailing newlines are removed. On error or
+// if the file is empty the previous secret is kept.
+func (s *Secret) Reload() error {
+	data, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return fmt.Errorf("%s is empty", s.filename)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = value
+	return nil
+}
+
+// Files returns the secret file.
+func (s *Secret) Files() []string {
+	return []string{s.filename}
+}
+
+// Value returns the current secret.
+func (s *Secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
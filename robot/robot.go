@@ -0,0 +1,90 @@
+// Package robot describes the tokens of automation like CI pipelines,
+// which admins issue so that it doesn't share the LDAP accounts of humans.
+// Robot tokens are signed like the tokens of users, and recorded in a
+// Store which lists and revokes them one by one.
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/proofpoint/kubernetes-ldap/token"
+)
+
+const (
+	// Assertion marks the tokens of robots, with the value "true".
+	Assertion = "robot"
+	// UsernamePrefix prefixes the names of robots in Kubernetes, so that
+	// they can't be mistaken for users.
+	UsernamePrefix = "robot:"
+)
+
+var (
+	// ErrUnknown is returned for tokens the Store has no record of.
+	ErrUnknown = errors.New("unknown robot token")
+	// ErrRevoked is returned for revoked tokens.
+	ErrRevoked = errors.New("robot token was revoked")
+)
+
+// namePattern restricts names to lowercase DNS labels, like ci-deployer.
+var namePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Robot is the record of an issued robot token. The serialized token is
+// only returned once, on creation.
+type Robot struct {
+	// TokenID is the ID of the token, which revokes it.
+	TokenID string   `json:"tokenID"`
+	Name    string   `json:"name"`
+	Groups  []string `json:"groups"`
+	// CreatedBy names the admin who created the robot.
+	CreatedBy  string    `json:"createdBy,omitempty"`
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expiration"`
+	// Revoked is the time the token was revoked, nil while it is valid.
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// New returns a robot with a new token ID, whose token expires after ttl.
+func New(name string, groups []string, ttl time.Duration, createdBy string) (*Robot, error) {
+	if !namePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid robot name %q, expected a lowercase DNS label", name)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid TTL %s", ttl)
+	}
+	id, err := token.NewID()
+	if err != nil {
+		return nil, err
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	return &Robot{
+		TokenID:    id,
+		Name:       name,
+		Groups:     groups,
+		CreatedBy:  createdBy,
+		Created:    now,
+		Expiration: now.Add(ttl),
+	}, nil
+}
+
+// Token returns the token of the robot, to be signed.
+func (r *Robot) Token() *token.AuthToken {
+	return &token.AuthToken{
+		ID:         r.TokenID,
+		Username:   r.Name,
+		Groups:     r.Groups,
+		Assertions: map[string]string{Assertion: "true"},
+		Expiration: r.Expiration.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// IsRobot returns true if tok is the token of a robot.
+func IsRobot(tok *token.AuthToken) bool {
+	return tok.Assertions[Assertion] == "true"
+}
@@ -0,0 +1,182 @@
+package robot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store persists robots in a JSON file. It is read on changes only, so
+// replicas sharing the file see each other's revocations once it is
+// reloaded, e.g. by a file watcher.
+type Store struct {
+	filename string
+
+	// writes serializes the changes of the file
+	writes sync.Mutex
+
+	mu     sync.RWMutex
+	robots map[string]Robot
+}
+
+// NewStore reads the robots of filename, which doesn't need to exist yet.
+func NewStore(filename string) (*Store, error) {
+	s := &Store{filename: filename}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again. On error the previous robots are kept.
+func (s *Store) Reload() error {
+	robots, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.robots = robots
+	return nil
+}
+
+// Files returns the file of the store.
+func (s *Store) Files() []string {
+	return []string{s.filename}
+}
+
+// Add records a new robot.
+func (s *Store) Add(r *Robot) error {
+	return s.update(func(robots map[string]Robot) error {
+		if _, ok := robots[r.TokenID]; ok {
+			return fmt.Errorf("robot token %s exists", r.TokenID)
+		}
+		robots[r.TokenID] = *r
+		return nil
+	})
+}
+
+// Revoke revokes the token of a robot at the given time and returns the
+// robot. Revoking a revoked token keeps the time of the first revocation.
+func (s *Store) Revoke(tokenID string, at time.Time) (*Robot, error) {
+	var revoked Robot
+	err := s.update(func(robots map[string]Robot) error {
+		r, ok := robots[tokenID]
+		if !ok {
+			return ErrUnknown
+		}
+		if r.Revoked == nil {
+			at = at.UTC()
+			r.Revoked = &at
+			robots[tokenID] = r
+		}
+		revoked = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &revoked, nil
+}
+
+// List returns all robots, oldest first.
+func (s *Store) List() []Robot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	robots := make([]Robot, 0, len(s.robots))
+	for _, r := range s.robots {
+		robots = append(robots, r)
+	}
+	sort.Slice(robots, func(i, j int) bool {
+		if robots[i].Created.Equal(robots[j].Created) {
+			return robots[i].TokenID < robots[j].TokenID
+		}
+		return robots[i].Created.Before(robots[j].Created)
+	})
+	return robots
+}
+
+// Check returns ErrUnknown or ErrRevoked unless the token is valid.
+// Expiration is checked by the verifier of the token.
+func (s *Store) Check(tokenID string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.robots[tokenID]
+	switch {
+	case !ok:
+		return ErrUnknown
+	case r.Revoked != nil:
+		return ErrRevoked
+	}
+	return nil
+}
+
+// update applies change to the robots of the file, so that the changes of
+// other replicas are kept, and saves them.
+func (s *Store) update(change func(map[string]Robot) error) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	robots, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := change(robots); err != nil {
+		return err
+	}
+	if err := s.save(robots); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.robots = robots
+	return nil
+}
+
+func (s *Store) load() (map[string]Robot, error) {
+	robots := map[string]Robot{}
+
+	data, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return robots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &robots); err != nil {
+		return nil, fmt.Errorf("parsing robot store %s: %v", s.filename, err)
+	}
+	return robots, nil
+}
+
+func (s *Store) save(robots map[string]Robot) error {
+	data, err := json.MarshalIndent(robots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated store
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), ".robot-store")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
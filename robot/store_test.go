@@ -0,0 +1,112 @@
+package robot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	r, err := New("ci-deployer", []string{"deployers"}, 720*time.Hour, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TokenID == "" || r.Expiration.Sub(r.Created) != 720*time.Hour {
+		t.Errorf("Unexpected robot %+v", r)
+	}
+
+	tok := r.Token()
+	if !IsRobot(tok) || tok.Username != "ci-deployer" || tok.ID != r.TokenID || tok.Expiration != r.Expiration.Unix()*1000 {
+		t.Errorf("Unexpected token %+v", tok)
+	}
+
+	for _, name := range []string{"", "CI", "robot:ci", "-ci", "ci_deployer"} {
+		if _, err := New(name, nil, time.Hour, ""); err == nil {
+			t.Errorf("Expected name %q to be rejected", name)
+		}
+	}
+	if _, err := New("ci", nil, 0, ""); err == nil {
+		t.Error("Expected a TTL of 0 to be rejected")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "robots.json")
+
+	s, err := NewStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check("unknown"); err != ErrUnknown {
+		t.Errorf("Expected ErrUnknown, got %v", err)
+	}
+
+	first, _ := New("first", nil, time.Hour, "")
+	second, _ := New("second", nil, time.Hour, "")
+	second.Created = second.Created.Add(time.Second)
+	for _, r := range []*Robot{second, first} {
+		if err := s.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Add(first); err == nil {
+		t.Error("Expected a duplicate token ID to be rejected")
+	}
+	if list := s.List(); len(list) != 2 || list[0].Name != "first" || list[1].Name != "second" {
+		t.Errorf("Expected both robots oldest first, got %+v", list)
+	}
+
+	// a replica sharing the file
+	replica, err := NewStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Check(first.TokenID); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+
+	at := time.Now()
+	revoked, err := s.Revoke(first.TokenID, at)
+	if err != nil || revoked.Revoked == nil || !revoked.Revoked.Equal(at) {
+		t.Fatalf("Unexpected revocation %+v: %v", revoked, err)
+	}
+	if revoked, err := s.Revoke(first.TokenID, at.Add(time.Hour)); err != nil || !revoked.Revoked.Equal(at) {
+		t.Errorf("Expected the first revocation to be kept, got %+v: %v", revoked, err)
+	}
+	if _, err := s.Revoke("unknown", at); err != ErrUnknown {
+		t.Errorf("Expected ErrUnknown, got %v", err)
+	}
+	if err := s.Check(first.TokenID); err != ErrRevoked {
+		t.Errorf("Expected ErrRevoked, got %v", err)
+	}
+	if err := s.Check(second.TokenID); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+
+	if err := replica.Check(first.TokenID); err != nil {
+		t.Errorf("Expected the replica to see the revocation only after reloading, got %v", err)
+	}
+	if err := replica.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Check(first.TokenID); err != ErrRevoked {
+		t.Errorf("Expected ErrRevoked after reloading, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Reload(); err == nil {
+		t.Error("Expected a corrupt store to be rejected")
+	}
+	if err := replica.Check(second.TokenID); err != nil {
+		t.Errorf("Expected the previous robots to be kept, got %v", err)
+	}
+}
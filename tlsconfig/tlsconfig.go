@@ -0,0 +1,129 @@
+// Package tlsconfig turns the TLS flags of the server and of the LDAP
+// client (versions, cipher suites and curves given by name) into a
+// crypto/tls configuration.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultMinVersion is the minimum TLS version used unless configured otherwise.
+const DefaultMinVersion = "VersionTLS12"
+
+var versions = map[string]uint16{
+	"VersionTLS10": tls.VersionTLS10,
+	"VersionTLS11": tls.VersionTLS11,
+	"VersionTLS12": tls.VersionTLS12,
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Options are the configurable TLS parameters. Empty fields keep the
+// defaults of crypto/tls.
+type Options struct {
+	// MinVersion and MaxVersion are named like VersionTLS12.
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are IANA names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// They only apply up to TLS 1.2, the TLS 1.3 suites are not configurable.
+	CipherSuites []string
+	// CurvePreferences are X25519, P256, P384 or P521, in order of preference.
+	CurvePreferences []string
+}
+
+// Apply sets the options on config.
+func (o Options) Apply(config *tls.Config) error {
+	var err error
+	if o.MinVersion != "" {
+		if config.MinVersion, err = ParseVersion(o.MinVersion); err != nil {
+			return err
+		}
+	}
+	if o.MaxVersion != "" {
+		if config.MaxVersion, err = ParseVersion(o.MaxVersion); err != nil {
+			return err
+		}
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return fmt.Errorf("maximum TLS version %s is lower than minimum version %s", o.MaxVersion, o.MinVersion)
+	}
+
+	if len(o.CipherSuites) > 0 {
+		if config.CipherSuites, err = ParseCipherSuites(o.CipherSuites); err != nil {
+			return err
+		}
+	}
+	if len(o.CurvePreferences) > 0 {
+		if config.CurvePreferences, err = ParseCurves(o.CurvePreferences); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseVersion returns the TLS version with the given name.
+func ParseVersion(name string) (uint16, error) {
+	if version, ok := versions[name]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, supported versions are %s", name, strings.Join(sortedKeys(versions), ", "))
+}
+
+// ParseCipherSuites returns the IDs of the named cipher suites. Suites
+// which crypto/tls considers insecure are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	supported := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := supported[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q, supported suites are %s", name, strings.Join(sortedKeys(supported), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves returns the IDs of the named elliptic curves.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	ids := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		id, ok := curves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, supported curves are %s", name, strings.Join(sortedCurves(), ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func sortedKeys(m map[string]uint16) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCurves() []string {
+	keys := make([]string, 0, len(curves))
+	for key := range curves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,58 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	config := &tls.Config{}
+	err := Options{
+		MinVersion:       "VersionTLS12",
+		MaxVersion:       "VersionTLS13",
+		CipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		CurvePreferences: []string{"X25519", "P256"},
+	}.Apply(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("Unexpected versions %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	expectedSuites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if !reflect.DeepEqual(config.CipherSuites, expectedSuites) {
+		t.Errorf("Expected cipher suites %v, got %v", expectedSuites, config.CipherSuites)
+	}
+	expectedCurves := []tls.CurveID{tls.X25519, tls.CurveP256}
+	if !reflect.DeepEqual(config.CurvePreferences, expectedCurves) {
+		t.Errorf("Expected curves %v, got %v", expectedCurves, config.CurvePreferences)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	config := &tls.Config{}
+	if err := (Options{}).Apply(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(config, &tls.Config{}) {
+		t.Errorf("Expected empty options to keep the config unchanged, got %+v", config)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []Options{
+		{MinVersion: "TLS1.2"},
+		{MinVersion: "VersionTLS13", MaxVersion: "VersionTLS12"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_NOPE"}},
+		{CurvePreferences: []string{"P192"}},
+	}
+
+	for _, options := range tests {
+		if err := options.Apply(&tls.Config{}); err == nil {
+			t.Errorf("Expected an error for %+v", options)
+		}
+	}
+}
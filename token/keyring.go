@@ -0,0 +1,134 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"sync"
+)
+
+// Keyring is a Signer and Verifier whose keypair can be reloaded from disk
+// while serving. After a reload, tokens signed with the previous key are
+// still accepted so that tokens issued before a rotation, or by replicas
+// which did not reload yet, keep working until they expire.
+type Keyring struct {
+	dirname string
+
+	mu       sync.RWMutex
+	signer   Signer
+	verifier Verifier
+	previous Verifier
+}
+
+// NewKeyring returns a keyring for the keypair in dirname. If the keypair
+// can't be loaded the error is returned along with an empty keyring, which
+// fails to sign and verify until a Reload succeeds.
+func NewKeyring(dirname string) (*Keyring, error) {
+	k := &Keyring{dirname: dirname}
+	return k, k.Reload()
+}
+
+// Reload reads the keypair again. On error the keys loaded before are kept,
+// including while a rotation replaced only one of the key files.
+func (k *Keyring) Reload() error {
+	signer, err := NewSigner(k.dirname)
+	if err != nil {
+		return err
+	}
+	verifier, err := NewVerifier(k.dirname)
+	if err != nil {
+		return err
+	}
+	if !samePublicKey(signer, verifier) {
+		return errors.New("the private and public key files don't belong to the same keypair")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.verifier != nil && !samePublicKey(k.verifier, verifier) {
+		k.previous = k.verifier
+	}
+	k.signer = signer
+	k.verifier = verifier
+	return nil
+}
+
+// Files returns the key files of the keyring.
+func (k *Keyring) Files() []string {
+	return []string{getPrivateKeyFilename(k.dirname), getPublicKeyFilename(k.dirname)}
+}
+
+// Sign signs the token with the current key.
+func (k *Keyring) Sign(token *AuthToken) (string, error) {
+	k.mu.RLock()
+	signer := k.signer
+	k.mu.RUnlock()
+
+	if signer == nil {
+		return "", errors.New("no signing key loaded")
+	}
+	return signer.Sign(token)
+}
+
+// SignContext is Sign returning a SignedToken.
+func (k *Keyring) SignContext(ctx context.Context, token *AuthToken) (*SignedToken, error) {
+	serialized, err := k.Sign(token)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedToken{Serialized: serialized, Token: token}, nil
+}
+
+// Verify verifies the token with the current key, falling back to the
+// previous one.
+func (k *Keyring) Verify(s string) (*AuthToken, error) {
+	token, err := k.VerifyContext(context.Background(), s)
+	if err != nil {
+		return nil, err
+	}
+	return token.AuthToken, nil
+}
+
+// VerifyContext is Verify also reporting whether the previous key was
+// used.
+func (k *Keyring) VerifyContext(ctx context.Context, s string) (*VerifiedToken, error) {
+	k.mu.RLock()
+	verifier, previous := k.verifier, k.previous
+	k.mu.RUnlock()
+
+	if verifier == nil {
+		return nil, errors.New("no verification key loaded")
+	}
+
+	token, err := verifier.Verify(s)
+	if err != nil && previous != nil {
+		if token, prevErr := previous.Verify(s); prevErr == nil {
+			return &VerifiedToken{AuthToken: token, PreviousKey: true}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &VerifiedToken{AuthToken: token}, nil
+}
+
+func samePublicKey(a, b interface{}) bool {
+	ka, kb := publicKey(a), publicKey(b)
+	if ka == nil || kb == nil {
+		return false
+	}
+	return ka.X.Cmp(kb.X) == 0 && ka.Y.Cmp(kb.Y) == 0
+}
+
+// publicKey returns the key of an ECDSA signer or verifier, and nil for
+// others.
+func publicKey(v interface{}) *ecdsa.PublicKey {
+	switch v := v.(type) {
+	case *ecdsaVerifier:
+		return v.publicKey
+	case *ecdsaSigner:
+		return v.publicKey
+	}
+	return nil
+}
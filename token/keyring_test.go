@@ -0,0 +1,149 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k, err := NewKeyring(dir)
+	if err == nil {
+		t.Fatalf("Expected an error loading a missing keypair")
+	}
+	if _, err := k.Sign(&AuthToken{}); err == nil {
+		t.Errorf("Expected an empty keyring to fail signing")
+	}
+
+	if err := GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading keyring: %v", err)
+	}
+
+	expiration := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	oldToken, err := k.Sign(&AuthToken{Username: "old", Expiration: expiration})
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %v", err)
+	}
+
+	// rotate the keypair
+	if err := GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading keyring: %v", err)
+	}
+
+	newToken, err := k.Sign(&AuthToken{Username: "new", Expiration: expiration})
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %v", err)
+	}
+
+	for _, s := range []string{oldToken, newToken} {
+		if _, err := k.Verify(s); err != nil {
+			t.Errorf("Unexpected error verifying token: %v", err)
+		}
+	}
+	for s, previous := range map[string]bool{oldToken: true, newToken: false} {
+		verified, err := k.VerifyContext(context.Background(), s)
+		if err != nil {
+			t.Fatalf("Unexpected error verifying token: %v", err)
+		}
+		if verified.PreviousKey != previous {
+			t.Errorf("Token of %s: expected PreviousKey %v", verified.Username, previous)
+		}
+	}
+
+	// a keypair which can't be loaded keeps the current keys
+	ioutil.WriteFile(getPrivateKeyFilename(dir), []byte("garbage"), 0600)
+	if err := k.Reload(); err == nil {
+		t.Errorf("Expected an error reloading a corrupt keypair")
+	}
+	if _, err := k.Verify(newToken); err != nil {
+		t.Errorf("Expected the current key to be kept, got %v", err)
+	}
+
+	// a rotation which replaced only the private key so far keeps the
+	// current keys, as new tokens would fail verification
+	current, _ := ioutil.ReadFile(getPublicKeyFilename(dir))
+	if err := GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(getPublicKeyFilename(dir), current, 0644)
+	if err := k.Reload(); err == nil {
+		t.Errorf("Expected an error reloading a mismatched keypair")
+	}
+	signed, err := k.Sign(&AuthToken{Username: "mismatch", Expiration: expiration})
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %v", err)
+	}
+	if _, err := k.Verify(signed); err != nil {
+		t.Errorf("Expected the current keypair to be kept, got %v", err)
+	}
+
+	// after another rotation the oldest key is no longer accepted
+	if err := GenerateKeypair(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reload(); err != nil {
+		t.Fatalf("Unexpected error reloading keyring: %v", err)
+	}
+	if _, err := k.Verify(oldToken); err == nil {
+		t.Errorf("Expected token of a retired key to be rejected")
+	}
+}
+
+type staticSigner struct{}
+
+func (staticSigner) Sign(token *AuthToken) (string, error) {
+	if token.Username == "" {
+		return "", errors.New("no username")
+	}
+	return "signed-" + token.Username, nil
+}
+
+type staticVerifier struct{}
+
+func (staticVerifier) Verify(s string) (*AuthToken, error) {
+	if s != "signed-alice" {
+		return nil, errors.New("invalid token")
+	}
+	return &AuthToken{Username: "alice"}, nil
+}
+
+func TestUpgrade(t *testing.T) {
+	signer := UpgradeSigner(staticSigner{})
+	signed, err := signer.SignContext(context.Background(), &AuthToken{Username: "alice"})
+	if err != nil || signed.Serialized != "signed-alice" || signed.Token.Username != "alice" {
+		t.Errorf("Unexpected signed token %+v: %v", signed, err)
+	}
+	if _, err := signer.SignContext(context.Background(), &AuthToken{}); err == nil {
+		t.Errorf("Expected the error of the signer")
+	}
+
+	verifier := UpgradeVerifier(staticVerifier{})
+	verified, err := verifier.VerifyContext(context.Background(), "signed-alice")
+	if err != nil || verified.Username != "alice" || verified.PreviousKey {
+		t.Errorf("Unexpected verified token %+v: %v", verified, err)
+	}
+	if _, err := verifier.VerifyContext(context.Background(), "garbage"); err == nil {
+		t.Errorf("Expected the error of the verifier")
+	}
+
+	// implementations of the v2 interfaces are used as they are
+	k := &Keyring{}
+	if UpgradeSigner(k) != SignerV2(k) || UpgradeVerifier(k) != VerifierV2(k) {
+		t.Errorf("Expected the keyring not to be adapted")
+	}
+}
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,41 @@ type Signer interface {
 	Sign(token *AuthToken) (string, error)
 }
 
+// SignedToken is a token signed by a SignerV2.
+type SignedToken struct {
+	// Serialized is the cryptographic token handed to the client.
+	Serialized string
+	// Token is the token which was signed.
+	Token *AuthToken
+}
+
+// SignerV2 is Signer with the context of the request, for signers which
+// do I/O like remote signing services.
+type SignerV2 interface {
+	SignContext(ctx context.Context, token *AuthToken) (*SignedToken, error)
+}
+
+// UpgradeSigner returns s as SignerV2, adapting signers which don't
+// implement it.
+func UpgradeSigner(s Signer) SignerV2 {
+	if v2, ok := s.(SignerV2); ok {
+		return v2
+	}
+	return signerAdapter{s}
+}
+
+type signerAdapter struct {
+	Signer
+}
+
+func (s signerAdapter) SignContext(ctx context.Context, token *AuthToken) (*SignedToken, error) {
+	serialized, err := s.Sign(token)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedToken{Serialized: serialized, Token: token}, nil
+}
+
 // ecdsaSigner represents a signer of tokens under a particular public key.
 type ecdsaSigner struct {
 	ecdsaVerifier
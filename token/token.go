@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -22,6 +23,7 @@ var curveEll = elliptic.P256()
 
 // AuthToken contains information about the authenticated user
 type AuthToken struct {
+	ID         string `json:",omitempty"`
 	Username   string
 	Groups     []string
 	Assertions map[string]string
@@ -30,6 +32,15 @@ type AuthToken struct {
 
 const fileprefix = "signing"
 
+// NewID returns a random identifier for a token.
+func NewID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 func getPrivateKeyFilename(dirname string) string {
 	return filepath.Join(dirname, fmt.Sprintf("%s.%s", fileprefix, "priv"))
 }
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
@@ -16,6 +17,41 @@ type Verifier interface {
 	Verify(s string) (token *AuthToken, err error)
 }
 
+// VerifiedToken is a token verified by a VerifierV2.
+type VerifiedToken struct {
+	*AuthToken
+	// PreviousKey is set if the token was signed with the key replaced by
+	// the last rotation.
+	PreviousKey bool
+}
+
+// VerifierV2 is Verifier with the context of the request, for verifiers
+// which do I/O like revocation lists.
+type VerifierV2 interface {
+	VerifyContext(ctx context.Context, s string) (*VerifiedToken, error)
+}
+
+// UpgradeVerifier returns v as VerifierV2, adapting verifiers which don't
+// implement it.
+func UpgradeVerifier(v Verifier) VerifierV2 {
+	if v2, ok := v.(VerifierV2); ok {
+		return v2
+	}
+	return verifierAdapter{v}
+}
+
+type verifierAdapter struct {
+	Verifier
+}
+
+func (v verifierAdapter) VerifyContext(ctx context.Context, s string) (*VerifiedToken, error) {
+	token, err := v.Verify(s)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifiedToken{AuthToken: token}, nil
+}
+
 // EcdsaVerifier represents an object that can verify tokens.
 type ecdsaVerifier struct {
 	publicKey *ecdsa.PublicKey
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type recordingExporter struct {
+	spans []*Span
+}
+
+func (r *recordingExporter) Export(span *Span) {
+	r.spans = append(r.spans, span)
+}
+
+func TestSampling(t *testing.T) {
+	for _, ratio := range []float64{0, 1} {
+		exporter := &recordingExporter{}
+		tracer := NewTracer(exporter, ratio)
+
+		for i := 0; i < 100; i++ {
+			_, span := tracer.Start(context.Background(), "root", KindServer)
+			span.Finish()
+		}
+
+		if expected := int(ratio * 100); len(exporter.spans) != expected {
+			t.Errorf("Ratio %v: expected %d exported spans, got %d", ratio, expected, len(exporter.spans))
+		}
+	}
+}
+
+func TestNestedSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, 1)
+
+	ctx, root := tracer.Start(context.Background(), "root", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.RecordError(errors.New("failed"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, got %d", len(exporter.spans))
+	}
+	if child.Context.TraceID != root.Context.TraceID || child.Parent != root.Context.SpanID {
+		t.Errorf("Expected child to be part of the root's trace")
+	}
+
+	// a nil span is a no-op
+	var span *Span
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("failed"))
+	span.Finish()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan *exportRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected request %s with headers %v", r.URL.Path, r.Header)
+		}
+		req := &exportRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("Error decoding export request: %v", err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, "test-service", map[string]string{"Authorization": "Bearer secret"})
+	tracer := NewTracer(exporter, 1)
+
+	_, span := tracer.Start(context.Background(), "operation", KindServer)
+	span.SetAttribute("result", "success")
+	span.SetAttribute("attempts", 2)
+	span.Finish()
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting down exporter: %v", err)
+	}
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected export request %+v", req)
+	}
+	if name := *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != "test-service" {
+		t.Errorf("Expected service name test-service, got %s", name)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	got := spans[0]
+	if got.Name != "operation" || got.Kind != KindServer || got.TraceID != span.Context.TraceID.String() || got.Status.Code != statusOK {
+		t.Errorf("Unexpected span %+v", got)
+	}
+	if len(got.Attributes) != 2 {
+		t.Errorf("Expected 2 attributes, got %+v", got.Attributes)
+	}
+}
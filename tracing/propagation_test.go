@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true, sampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", valid: true, sampled: false},
+		// future versions may append fields
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", valid: true, sampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", valid: false},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: false},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", valid: false},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", valid: false},
+		{value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", valid: false},
+		{value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", valid: false},
+		{value: "", valid: false},
+	}
+
+	for _, c := range cases {
+		sc, ok := ParseTraceparent(c.value)
+		if ok != c.valid {
+			t.Errorf("%q: expected valid=%v, got %v", c.value, c.valid, ok)
+			continue
+		}
+		if ok && sc.Sampled != c.sampled {
+			t.Errorf("%q: expected sampled=%v, got %v", c.value, c.sampled, sc.Sampled)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	header := http.Header{}
+	header.Set(TraceparentHeader, value)
+
+	tracer := NewTracer(nil, 1)
+	ctx, span := tracer.Start(Extract(context.Background(), header), "child", KindServer)
+
+	if span.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected span to continue the remote trace, got trace %s", span.Context.TraceID)
+	}
+	if span.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected remote span as parent, got %s", span.Parent)
+	}
+	if !span.Context.Sampled {
+		t.Errorf("Expected span to follow the remote sampling decision")
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.Context.SpanID.String() + "-01"
+	if out.Get(TraceparentHeader) != expected {
+		t.Errorf("Expected traceparent %s, got %s", expected, out.Get(TraceparentHeader))
+	}
+}
+
+func TestRemoteSamplingIsCapped(t *testing.T) {
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, 0)
+	for i := 0; i < 100; i++ {
+		_, span := tracer.Start(Extract(context.Background(), header), "child", KindServer)
+		span.Finish()
+	}
+	if len(exporter.spans) != 0 {
+		t.Errorf("Expected the local ratio to cap sampled remote parents, got %d exported spans", len(exporter.spans))
+	}
+
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tracer = NewTracer(exporter, 1)
+	if _, span := tracer.Start(Extract(context.Background(), header), "child", KindServer); span.Context.Sampled {
+		t.Error("Expected unsampled remote parents not to be sampled")
+	}
+}
@@ -0,0 +1,240 @@
+// Package tracing records OpenTelemetry compatible spans of the login path,
+// propagates W3C trace context and exports spans via OTLP/HTTP.
+//
+// It deliberately implements only what this service needs instead of
+// pulling in the OpenTelemetry SDK.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid returns false for the all-zero trace ID.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid returns false for the all-zero span ID.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanKind as defined by OpenTelemetry.
+type SpanKind int
+
+// Span kinds, numbered as in the OTLP protocol.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanContext is the part of a span which is propagated.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if the span context carries trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Span is a timed operation. A nil *Span is valid and records nothing.
+type Span struct {
+	tracer *Tracer
+
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttribute sets a string, bool, integer or float attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.Context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil || !s.Context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and hands it to the exporter. Only the first call
+// has an effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Exporter receives finished, sampled spans.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Tracer creates spans.
+type Tracer struct {
+	exporter Exporter
+	// sampleBound is the ratio of sampled root spans scaled to 2^63.
+	sampleBound uint64
+}
+
+// NewTracer returns a tracer sampling sampleRatio of the traces started
+// here. Traces continued from a remote parent are only sampled if the
+// parent was, and then again at sampleRatio, so that unauthenticated
+// callers can't force sampling beyond it.
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	switch {
+	case sampleRatio > 1:
+		sampleRatio = 1
+	case sampleRatio < 0:
+		sampleRatio = 0
+	}
+	return &Tracer{
+		exporter:    exporter,
+		sampleBound: uint64(sampleRatio * (1 << 63)),
+	}
+}
+
+var (
+	globalMu     sync.RWMutex
+	globalTracer *Tracer
+)
+
+// SetTracer installs the tracer used by Start. A nil tracer disables tracing.
+func SetTracer(t *Tracer) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	globalTracer = t
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span as a child of the span or remote span context in ctx
+// using the global tracer. It returns a nil span if tracing is disabled.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	globalMu.RLock()
+	t := globalTracer
+	globalMu.RUnlock()
+
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name, kind)
+}
+
+// Start begins a span as a child of the span or remote span context in ctx.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.Context.TraceID = parent.Context.TraceID
+		span.Context.Sampled = parent.Context.Sampled
+		span.Parent = parent.Context.SpanID
+	} else if remote, _ := ctx.Value(remoteKey{}).(SpanContext); remote.IsValid() {
+		span.Context.TraceID = remote.TraceID
+		// the caller chose the trace ID, so it can't make the decision
+		var random [8]byte
+		mustRead(random[:])
+		span.Context.Sampled = remote.Sampled && t.sample(random[:])
+		span.Parent = remote.SpanID
+	} else {
+		span.Context.TraceID = newTraceID()
+		// the trace ID is random, so its low bits make a uniform sampling decision
+		span.Context.Sampled = t.sample(span.Context.TraceID[8:])
+	}
+	span.Context.SpanID = newSpanID()
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample decides uniformly at the ratio of the tracer, given 8 random bytes.
+func (t *Tracer) sample(random []byte) bool {
+	return binary.BigEndian.Uint64(random)>>1 < t.sampleBound
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the context of the current span, or of
+// the remote parent if no span was started locally.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// ContextWithRemoteSpanContext returns a context continuing the remote trace.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func newTraceID() (id TraceID) {
+	mustRead(id[:])
+	return
+}
+
+func newSpanID() (id SpanID) {
+	mustRead(id[:])
+	return
+}
+
+func mustRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+}